@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// newAdminCommand 创建 admin 子命令, 它的子命令调用驱动的管理接口(--admin-address), 不需要手写 curl
+func newAdminCommand() *cobra.Command {
+	var address string
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Call the admin API of a running driver",
+	}
+	cmd.PersistentFlags().StringVar(&address, "address", "127.0.0.1:9810", "address of the driver's admin API, as passed to --admin-address")
+
+	var pool string
+	migrate := &cobra.Command{
+		Use:   "migrate VOLUME_ID",
+		Short: "Migrate a volume to another storage pool",
+		Long:  "Migrate a volume to another storage pool. The volume must not be published on any node; an empty --pool moves it back to the data directory.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target := fmt.Sprintf("http://%s/volumes/%s/migrate?pool=%s", address, url.PathEscape(args[0]), url.QueryEscape(pool))
+			return callAdminAPI(http.MethodPost, target, nil)
+		},
+	}
+	migrate.Flags().StringVar(&pool, "pool", "", "storage pool to move the volume to")
+	cmd.AddCommand(migrate)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "export-state",
+		Short: "Write the driver's state (volume and snapshot records) to stdout as JSON",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return callAdminAPI(http.MethodGet, fmt.Sprintf("http://%s/state", address), nil)
+		},
+	})
+	var clearState bool
+	importState := &cobra.Command{
+		Use:   "import-state FILE",
+		Short: "Replace the driver's state with a backup written by export-state",
+		Long:  "Replace the driver's state with a backup written by export-state. The driver must run with --admin-state-import; the data of the volumes and snapshots is not checked. A backup without any records is refused unless --clear is set.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return callAdminAPI(http.MethodPost, fmt.Sprintf("http://%s/state?clear=%t", address, clearState), f)
+		},
+	}
+	importState.Flags().BoolVar(&clearState, "clear", false, "allow importing a backup without any records, which removes all volume and snapshot records")
+	cmd.AddCommand(importState)
+	return cmd
+}
+
+// callAdminAPI 发送请求并把响应输出到标准输出, 失败的响应作为错误返回
+func callAdminAPI(method, target string, body io.Reader) error {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ZhangSIming-blyq/hostpathcsi/pkg/hostpathcsi"
+	"k8s.io/klog"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
+)
+
+var (
+	configFile = flag.String("config", "", "YAML config file whose values apply to the flags not set on the command line, re-read on SIGHUP")
+	mode       = flag.String("mode", "all", "CSI services to serve besides Identity: controller (a Deployment/StatefulSet with the sidecars), node (the DaemonSet) or all")
+	driverName = flag.String("driver-name", hostpathcsi.DefaultDriverName, "driver name reported by GetPluginInfo, must match the CSIDriver object and the provisioner of StorageClasses")
+	endpoint   = flag.String("endpoint", hostpathcsi.DefaultEndpoint, "gRPC endpoint the CSI services are served on, unix:///path/to/csi.sock or tcp://host:port")
+	sockMode   = flag.String("socket-mode", "", "octal permissions of the unix socket (e.g. 0660), left as created by the umask when empty")
+	sockOwner  = flag.String("socket-owner", "", "user[:group] owning the unix socket, names or numeric ids (e.g. 0:992 to let the kubelet group connect), unchanged when empty")
+	regPath    = flag.String("kubelet-registration-path", "", "host path of the CSI socket that kubelet connects to, registers the node plugin with kubelet instead of the node-driver-registrar sidecar when set")
+	regDir     = flag.String("plugin-registration-dir", hostpathcsi.DefaultRegistrationDir, "kubelet's plugin registration directory the registration socket is created in")
+	nodeIDFlag = flag.String("node-id", "", "node id reported by NodeGetInfo, takes precedence over --node-id-file, $KUBE_NODE_NAME and the hostname")
+	nodeIDFile = flag.String("node-id-file", "", "file containing the node id, used when --node-id is not set")
+	topology   = flag.String("topology", "", "extra static topology segments reported by NodeGetInfo, as comma separated key=value pairs")
+	topoLabels = flag.String("topology-labels", "", "comma separated node label keys (e.g. topology.kubernetes.io/zone) read from the API server and reported as topology segments")
+	maxVolumes = flag.Int64("max-volumes-per-node", 0, "maximum number of volumes that can be published on this node, reported to the scheduler (0 means unlimited)")
+	attach     = flag.Bool("attach-required", false, "implement ControllerPublishVolume/ControllerUnpublishVolume and track attachments, the CSIDriver object must set attachRequired: true")
+	maxConns   = flag.Int("max-connections", 0, "maximum number of concurrent connections on the CSI socket, further connections wait until one is closed (0 means unlimited)")
+	enforce    = flag.Bool("enforce-capacity", false, "require project quotas (xfs or ext4 with prjquota) to enforce the capacity of directory volumes, Probe fails while they are unavailable")
+	zfsParent  = flag.String("zfs-dataset", "", "parent zfs dataset (e.g. tank/csi) for volumes on the zfs backend, the zfs backend is only available when it is set")
+	lvmVG      = flag.String("lvm-volume-group", "", "LVM volume group for volumes on the lvm backend, the lvm backend is only available when it is set")
+	lvmPool    = flag.String("lvm-thin-pool", "", "thin pool in --lvm-volume-group that lvm volumes are provisioned from")
+	dataDir    = flag.String("data-dir", "", "directory volumes are stored in, must be the same for the controller and the node plugin (default $HOSTPATH_DATA_DIR or "+hostpathcsi.DefaultDataDir+")")
+	stateDir   = flag.String("state-dir", "", "directory the state file, publish records, adoption records and checksum manifests are kept in, must be the same for the controller and the node plugin (default "+hostpathcsi.DefaultStateDir+")")
+	snapDir    = flag.String("snapshot-dir", "", "directory snapshots and snapshot archives are stored in (default "+hostpathcsi.DefaultSnapshotDir+")")
+	importDir  = flag.String("import-dir", "", "directory containing tar archives that volumes can be imported from with the importFrom StorageClass parameter, local imports are disabled when empty")
+	tmplDir    = flag.String("template-dir", "", "directory containing the template directories that overlayfs volumes can be seeded from with the template StorageClass parameter, template volumes are disabled when empty")
+	staticRoot = flag.String("static-volume-roots", "", "comma separated directories that the path of statically provisioned volumes must be under, static volumes are rejected when empty")
+	pools      = flag.String("pools", "", "comma separated name=/path storage pools, selected with the pool StorageClass parameter (e.g. ssd=/mnt/ssd,hdd=/mnt/hdd)")
+	poolPolicy = flag.String("pool-policy", "", "policy (most-free, round-robin or weighted) that places volumes whose StorageClass does not set the pool parameter in one of --pools, they go to --data-dir when empty")
+	poolWeight = flag.String("pool-weights", "", "comma separated name=weight pool weights for --pool-policy=weighted, unlisted pools have weight 1")
+	usageEvery = flag.Duration("usage-interval", time.Minute, "how often the node plugin accounts the usage of published volumes in the background, NodeGetVolumeStats computes it on every call when 0")
+	usageAlert = flag.Float64("usage-alert-ratio", 0.9, "log a warning when a volume's used bytes exceed this fraction of its total (0 disables the alert)")
+	ephGrace   = flag.Duration("ephemeral-grace-period", 0, "how long the node plugin keeps the directory of an inline ephemeral volume after its last unpublish, a pod re-created within it reuses the directory (0 removes it right away)")
+	gcEvery    = flag.Duration("gc-interval", 0, "how often the controller looks for data left behind by volume creations that crashed or failed before the volume was recorded, and for snapshot data without a record (0 disables it); volume directories the driver did not create, e.g. from before the state file existed, are never touched")
+	gcDryRun   = flag.Bool("gc-dry-run", true, "only log the orphaned data found by --gc-interval instead of removing it, set to false to remove it")
+	scrubEvery = flag.Duration("scrub-interval", 0, "how often the controller verifies the file checksums of volumes with integrity=true and reports corrupted files through ControllerGetVolume (0 disables it)")
+	chainDepth = flag.Int("max-snapshot-chain-depth", 0, "maximum number of incremental snapshots chained on a full snapshot, the next snapshot of the volume is a full snapshot that starts a new chain (0 means unlimited)")
+	maxSnaps   = flag.Int("max-snapshots-per-volume", 0, "maximum number of snapshots of a volume, CreateSnapshot fails with ResourceExhausted once a volume has that many (0 means unlimited)")
+	onMissing  = flag.String("on-missing-backing", "error", "what ControllerGetVolume and NodePublishVolume do when the directory of a recorded volume was removed outside the driver: error (NotFound), recreate (an empty volume) or prune (remove the record, NotFound; the node plugin treats it as error)")
+	capTruth   = flag.String("capacity-truth", "store", "what ControllerGetVolume and NodeGetVolumeStats trust when the recorded capacity of a volume differs from the quota or backing file size on disk: disk (update the record, only the controller writes it) or store (report the volume as abnormal)")
+	wipe       = flag.Bool("wipe-on-delete", false, "overwrite the data of every deleted volume with zeros before removing it, as if its StorageClass set wipeOnDelete=true")
+	adminAddr  = flag.String("admin-address", "", "address of the unauthenticated admin HTTP API (e.g. 127.0.0.1:9810) used to migrate volumes between pools, disabled when empty")
+	impState   = flag.Bool("admin-state-import", false, "allow POST /state on the admin API to replace the whole state with a backup taken from GET /state")
+	healthPort = flag.Int("health-port", 0, "port of the HTTP /healthz and /readyz endpoints for liveness and readiness probes, backed by the same checks as Probe (0 disables them)")
+	rpcLogLvl  = flag.Int("rpc-log-level", 0, "klog verbosity (--v) at which every CSI call is logged with its sanitized request, duration and status code, responses are logged one level higher; failed calls are always logged")
+	otlpAddr   = flag.String("otlp-endpoint", "", "host:port of the OTLP/gRPC collector (e.g. otel-collector:4317) that spans of CSI calls and their backend and mount operations are exported to, tracing is disabled when empty")
+	otlpPlain  = flag.Bool("otlp-insecure", false, "connect to --otlp-endpoint without TLS")
+	sampleRate = flag.Float64("trace-sample-ratio", 1, "fraction of CSI calls that are traced, calls whose caller already sampled the trace are always traced")
+	metricAddr = flag.String("metrics-address", "", "address of the Prometheus /metrics endpoint (e.g. :9809) with per-method call, error and latency metrics and volume gauges, disabled when empty")
+	hardened   = flag.Bool("hardened-mounts", false, "publish volumes with nosuid and nodev unless their mountOptions contain suid or dev")
+	noexec     = flag.Bool("noexec", false, "with --hardened-mounts, also publish volumes with noexec unless their mountOptions contain exec")
+	drainWait  = flag.Duration("shutdown-timeout", 25*time.Second, "how long to wait for in-flight requests to finish after SIGTERM before exiting anyway, keep it below the pod's terminationGracePeriodSeconds")
+	leaderElec = flag.Bool("leader-election", false, "elect a leader among controller replicas with a Lease, only the leader serves Controller requests and runs the background tasks while the others stand by")
+	leaseNS    = flag.String("leader-election-namespace", "", "namespace of the leader election Lease (default the namespace of the pod)")
+	leaseDur   = flag.Duration("leader-election-lease-duration", 15*time.Second, "how long standby replicas wait after the last renewal before taking over the leadership")
+	renewDL    = flag.Duration("leader-election-renew-deadline", 10*time.Second, "how long the leader keeps retrying to renew the Lease before giving up the leadership and exiting")
+	retryEvery = flag.Duration("leader-election-retry-period", 2*time.Second, "how often replicas try to acquire or renew the Lease")
+	backend    = flag.String("backend", "directory", "storage backend (directory, image, btrfs, zfs or lvm) used for volumes whose StorageClass does not set the backend parameter")
+)
+
+// limitListener 限制同时存在的连接数, 超过上限的连接会在 Accept 中排队, 直到已有连接关闭
+// 监听队列(backlog)本身由内核的 net.core.somaxconn 决定, Go 不支持在 Listen 时单独设置
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{Listener: l, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitConn 在关闭时归还 limitListener 的连接名额
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// envPrefix 是设置 flag 的环境变量的前缀, 例如 CSI_NODE_ID 对应 --node-id
+const envPrefix = "CSI_"
+
+// envNames 是不按 flag 名转换的环境变量名
+var envNames = map[string]string{
+	"v": envPrefix + "LOG_LEVEL",
+}
+
+// envName 返回设置 flag 的环境变量名: 前缀加上大写的 flag 名, - 换成 _
+func envName(flagName string) string {
+	if name, ok := envNames[flagName]; ok {
+		return name
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv 用 CSI_* 环境变量设置命令行上没有指定的 flag, 这样 DaemonSet 可以只通过 env 和 downward API 配置驱动;
+// 设置过的 flag 记录到 explicit 里, 配置文件不再覆盖它们
+func applyEnv(explicit map[string]bool) error {
+	var setErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		if setErr != nil || explicit[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := flag.Set(f.Name, value); err != nil {
+			setErr = fmt.Errorf("invalid value %q for %s: %v", value, name, err)
+			return
+		}
+		explicit[f.Name] = true
+	})
+	return setErr
+}
+
+// reloadableFlags 是 SIGHUP 重新加载配置文件时立即生效的 flag, 其他 flag 的修改要重启才生效
+var reloadableFlags = map[string]bool{
+	"pools":                true,
+	"pool-policy":          true,
+	"pool-weights":         true,
+	"max-volumes-per-node": true,
+	"wipe-on-delete":       true,
+	"hardened-mounts":      true,
+	"noexec":               true,
+}
+
+// flagValues 返回所有 flag 当前的值
+func flagValues() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// restoreFlags 把 flag 恢复成 flagValues 返回的值
+func restoreFlags(values map[string]string) {
+	for name, value := range values {
+		flag.Set(name, value)
+	}
+}
+
+// applyConfigFile 把配置文件里的值设置到命令行没有指定的 flag 上, 文件里没有写的恢复为默认值; 失败时 flag 恢复原来的值
+func applyConfigFile(path string, cmdline map[string]bool) error {
+	fileConfig, err := hostpathcsi.LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	values := fileConfig.FlagValues()
+	before := flagValues()
+	var setErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		if setErr != nil || cmdline[f.Name] || f.Name == "config" {
+			return
+		}
+		value, ok := values[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+		if err := flag.Set(f.Name, value); err != nil {
+			setErr = fmt.Errorf("invalid value %q for %s in %s: %v", value, f.Name, path, err)
+		}
+	})
+	if setErr != nil {
+		restoreFlags(before)
+		return setErr
+	}
+	return nil
+}
+
+// reloadConfig 重新读取配置文件, 让存储池、存储池策略、卷数量上限、wipeOnDelete 和加固挂载的修改立即生效;
+// 任何一项不合法时都不修改, 继续使用原来的配置
+func reloadConfig(path string, cmdline map[string]bool, config *hostpathcsi.Config, controllerServer *hostpathcsi.ControllerServer, nodeServer *hostpathcsi.NodeServer) error {
+	before := flagValues()
+	if err := applyConfigFile(path, cmdline); err != nil {
+		return err
+	}
+	after := flagValues()
+
+	if *noexec && !*hardened {
+		restoreFlags(before)
+		return fmt.Errorf("noexec requires hardenedMounts")
+	}
+	var policy hostpathcsi.PoolPolicy
+	if *poolPolicy != "" {
+		var err error
+		if policy, err = hostpathcsi.NewPoolPolicy(*poolPolicy, *poolWeight); err != nil {
+			restoreFlags(before)
+			return fmt.Errorf("invalid pool policy or pool weights: %v", err)
+		}
+	}
+	added, err := config.UpdatePools(*pools)
+	if err != nil {
+		restoreFlags(before)
+		return fmt.Errorf("invalid pools: %v", err)
+	}
+	for _, name := range added {
+		log.Printf("Added storage pool %s at %s", name, config.PoolDirs()[name])
+	}
+
+	// 策略没有变化时保留原来的策略, 不打断轮流选择的顺序
+	if controllerServer != nil && (before["pool-policy"] != after["pool-policy"] || before["pool-weights"] != after["pool-weights"]) {
+		controllerServer.SetPoolPolicy(policy)
+	}
+	if controllerServer != nil {
+		controllerServer.SetWipeOnDelete(*wipe)
+	}
+	if nodeServer != nil {
+		nodeServer.SetHardenedMounts(*hardened, *noexec)
+		nodeServer.SetMaxVolumes(*maxVolumes)
+	}
+	for name, value := range after {
+		if value != before[name] && !reloadableFlags[name] {
+			log.Printf("WARNING: %s changed from %q to %q in %s, restart the driver for it to take effect", name, before[name], value, path)
+		}
+	}
+	return nil
+}
+
+func init() {
+	// 只暴露 klog 的日志级别, 日志文件之类的 flag 在容器里用不到
+	klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
+	klog.InitFlags(klogFlags)
+	flag.Var(klogFlags.Lookup("v").Value, "v", "log level verbosity of the driver, higher levels log more details")
+}
+
+// newServeCommand 创建 serve 子命令, 它的 flag 就是上面定义的 flag
+func newServeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the CSI Identity, Controller and Node services",
+		Long: "Serve the CSI services on --endpoint. Every flag can also be set with a CSI_* environment variable " +
+			"(e.g. CSI_NODE_ID for --node-id) or in the --config file; the command line wins over the environment, " +
+			"which wins over the config file.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			serve(cmd.Flags())
+		},
+	}
+	cmd.Flags().AddGoFlagSet(flag.CommandLine)
+	return cmd
+}
+
+// serve 运行驱动直到收到 SIGTERM, flags 是解析过命令行的 flag, 用来区分哪些 flag 是在命令行上指定的
+func serve(flags *pflag.FlagSet) {
+	// 命令行和 CSI_* 环境变量指定的 flag 优先于配置文件
+	cmdline := make(map[string]bool)
+	flags.Visit(func(f *pflag.Flag) {
+		cmdline[f.Name] = true
+	})
+	if err := applyEnv(cmdline); err != nil {
+		log.Fatalf("invalid environment variable: %v", err)
+	}
+	if *configFile != "" {
+		if err := applyConfigFile(*configFile, cmdline); err != nil {
+			log.Fatalf("failed to load config file: %v", err)
+		}
+		log.Printf("Loaded config file %s", *configFile)
+	}
+	var serveController, serveNode bool
+	switch *mode {
+	case "all":
+		serveController, serveNode = true, true
+	case "controller":
+		serveController = true
+	case "node":
+		serveNode = true
+	default:
+		log.Fatalf("invalid --mode %q, must be controller, node or all", *mode)
+	}
+
+	log.Printf("hostpath CSI driver %s (commit %s, built %s)", hostpathcsi.Version, hostpathcsi.Commit, hostpathcsi.BuildDate)
+
+	// 节点 ID 解析失败时直接退出, 避免上报一个错误的节点 ID
+	nodeID, err := hostpathcsi.ResolveNodeID(*nodeIDFlag, *nodeIDFile)
+	if err != nil {
+		log.Fatalf("failed to resolve node id: %v", err)
+	}
+
+	// 存放卷的目录不可用时直接退出, 不要等到 CreateVolume 才失败
+	config, err := hostpathcsi.NewConfig(*dataDir, *snapDir, *stateDir, *importDir, *tmplDir, *staticRoot, *pools)
+	if err != nil {
+		log.Fatalf("invalid --data-dir, --snapshot-dir, --state-dir, --import-dir, --template-dir, --static-volume-roots or --pools: %v", err)
+	}
+	log.Printf("Storing volumes in %s", config.DataDir)
+	for name, dir := range config.PoolDirs() {
+		log.Printf("Storage pool %s is at %s", name, dir)
+	}
+
+	if *zfsParent != "" {
+		hostpathcsi.RegisterBackend(hostpathcsi.NewZFSBackend(*zfsParent))
+	}
+	if *lvmVG != "" {
+		if *lvmPool == "" {
+			log.Fatalf("--lvm-thin-pool is required when --lvm-volume-group is set")
+		}
+		hostpathcsi.RegisterBackend(hostpathcsi.NewLVMBackend(*lvmVG, *lvmPool))
+	}
+	if err := hostpathcsi.SetDefaultBackend(*backend); err != nil {
+		log.Fatalf("invalid --backend: %v", err)
+	}
+
+	// 监听 Unix socket 时先删除已存在的 socket 文件，这是因为 kubelet 会在 /var/lib/kubelet/plugins/hostpath.csi.k8s.io/ 目录下创建一个 socket 文件
+	// 先删除 socket 文件是为了确保新的进程可以绑定到同样的 socket 地址，避免因为旧的 socket 文件存在导致绑定失败或进程崩溃。
+	// Unix Socket 适用于本地进程间通信，效率更高，安全性好，适用于 CSI 驱动和 Kubelet 的通信场景。
+	// IP 地址（TCP/IP Socket） 适用于跨主机的进程通信，主要用于需要远程通信的场景。
+	socketOpts, err := hostpathcsi.ParseSocketOptions(*sockMode, *sockOwner)
+	if err != nil {
+		log.Fatalf("invalid --socket-mode or --socket-owner: %v", err)
+	}
+	// 由 systemd socket 激活时使用 systemd 创建的 socket, 忽略 --endpoint
+	listener, err := hostpathcsi.SystemdListener()
+	if err != nil {
+		log.Fatalf("failed to use the socket passed by systemd: %v", err)
+	}
+	activated := listener != nil
+	if activated {
+		log.Printf("Listening on %s passed by systemd", listener.Addr())
+	} else {
+		if listener, err = hostpathcsi.Listen(*endpoint, socketOpts); err != nil {
+			log.Fatalf("failed to listen on %s: %v", *endpoint, err)
+		}
+		log.Printf("Listening on %s", *endpoint)
+	}
+	if *maxConns > 0 {
+		listener = newLimitListener(listener, *maxConns)
+	}
+
+	// 加载卷的元数据, 必须在开始服务之前完成, 这样重启后的请求能看到之前创建的卷
+	state, err := hostpathcsi.NewState(config.StatePath())
+	if err != nil {
+		log.Fatalf("failed to load state: %v", err)
+	}
+
+	// 拓扑在启动时确定, 节点 labels 读取失败时退出, 避免上报不完整的拓扑
+	static, err := hostpathcsi.ParseTopologySegments(*topology)
+	if err != nil {
+		log.Fatalf("invalid --topology: %v", err)
+	}
+	var labelKeys []string
+	for _, key := range strings.Split(*topoLabels, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			labelKeys = append(labelKeys, key)
+		}
+	}
+	segments, err := hostpathcsi.ResolveTopologySegments(context.Background(), nodeID, static, labelKeys)
+	if err != nil {
+		log.Fatalf("failed to resolve topology: %v", err)
+	}
+
+	// 启动时检查目录卷的容量能否通过 project quota 限制; 要求限制却不支持时不退出, 而是让 Probe 失败, 原因在 Probe 的错误里
+	quotaErr := hostpathcsi.CheckProjectQuota(config.DataDir)
+	switch {
+	case quotaErr == nil:
+		log.Println("Capacity of directory volumes is enforced with project quotas")
+	case *enforce:
+		log.Printf("WARNING: --enforce-capacity is set but project quotas are unavailable, Probe will fail: %v", quotaErr)
+	default:
+		log.Printf("Capacity of directory volumes is not enforced: %v", quotaErr)
+	}
+
+	// 链路追踪的 span 由 stats handler 在拦截器之前创建, 拦截器和处理过程的 span 都是它的子 span
+	var serverOpts []grpc.ServerOption
+	var shutdownTracing func(context.Context) error
+	if *otlpAddr != "" {
+		shutdownTracing, err = hostpathcsi.SetupTracing(context.Background(), hostpathcsi.TracingConfig{
+			Endpoint:    *otlpAddr,
+			Insecure:    *otlpPlain,
+			SampleRatio: *sampleRate,
+			ServiceName: *driverName,
+		})
+		if err != nil {
+			log.Fatalf("failed to set up tracing: %v", err)
+		}
+		serverOpts = append(serverOpts, hostpathcsi.TracingServerOption())
+		log.Printf("Exporting traces to %s", *otlpAddr)
+	}
+
+	// 多副本的 Controller 开启 leader 选举, 只有 leader 处理 Controller 的请求, 其他副本返回 Unavailable
+	var elector *hostpathcsi.LeaderElector
+	// 请求 ID 放在最外层, 之后的拦截器和处理过程的日志都能带上它
+	interceptors := []grpc.UnaryServerInterceptor{hostpathcsi.NewRequestIDInterceptor()}
+	// metrics 的拦截器放在其次, 被其他拦截器拒绝的调用也要统计
+	var metrics *hostpathcsi.Metrics
+	if *metricAddr != "" {
+		metrics = hostpathcsi.NewMetrics()
+		metrics.SetState(state)
+		interceptors = append(interceptors, metrics.UnaryServerInterceptor())
+	}
+	interceptors = append(interceptors, hostpathcsi.NewLoggingInterceptor(klog.Level(*rpcLogLvl)))
+	if *leaderElec {
+		if !serveController {
+			log.Fatalf("--leader-election only applies to the controller, it can not be used with --mode=node")
+		}
+		elector, err = hostpathcsi.NewLeaderElector(hostpathcsi.LeaderElectionConfig{
+			Namespace:     *leaseNS,
+			Name:          hostpathcsi.LeaseNameFor(*driverName),
+			LeaseDuration: *leaseDur,
+			RenewDeadline: *renewDL,
+			RetryPeriod:   *retryEvery,
+			State:         state,
+		})
+		if err != nil {
+			log.Fatalf("invalid leader election config: %v", err)
+		}
+		interceptors = append(interceptors, elector.UnaryServerInterceptor())
+	}
+	// panic 恢复放在最内层, 转换出的 Internal 错误也会被记录和统计
+	interceptors = append(interceptors, hostpathcsi.NewRecoveryInterceptor(metrics))
+
+	server := grpc.NewServer(append(serverOpts, grpc.ChainUnaryInterceptor(interceptors...))...)
+	// Identity 服务总是注册, Controller 和 Node 服务按 --mode 注册
+	identityServer := hostpathcsi.NewIdentityServer(state, config.DataDir)
+	if err := identityServer.SetDriverName(*driverName); err != nil {
+		log.Fatalf("invalid --driver-name: %v", err)
+	}
+	identityServer.SetControllerService(serveController)
+	if *enforce {
+		identityServer.AddHealthCheck("project quota", func() error {
+			return hostpathcsi.CheckProjectQuota(config.DataDir)
+		})
+	}
+	csi.RegisterIdentityServer(server, identityServer)
+
+	missingPolicy, err := hostpathcsi.ParseMissingBackingPolicy(*onMissing)
+	if err != nil {
+		log.Fatalf("invalid --on-missing-backing: %v", err)
+	}
+	capacityTruth, err := hostpathcsi.ParseCapacityTruth(*capTruth)
+	if err != nil {
+		log.Fatalf("invalid --capacity-truth: %v", err)
+	}
+
+	var nodeServer *hostpathcsi.NodeServer
+	if serveNode {
+		if nodeServer, err = hostpathcsi.NewNodeServer(config, nodeID, segments, *maxVolumes); err != nil {
+			log.Fatalf("failed to create node server: %v", err)
+		}
+		if *noexec && !*hardened {
+			log.Fatalf("--noexec requires --hardened-mounts")
+		}
+		nodeServer.SetHardenedMounts(*hardened, *noexec)
+		nodeServer.SetOnMissingBacking(missingPolicy)
+		nodeServer.SetCapacityTruth(capacityTruth)
+		if *ephGrace < 0 {
+			log.Fatalf("--ephemeral-grace-period must not be negative")
+		}
+		nodeServer.SetEphemeralGracePeriod(*ephGrace)
+		if *usageAlert < 0 || *usageAlert > 1 {
+			log.Fatalf("--usage-alert-ratio must be between 0 and 1")
+		}
+		if *usageEvery > 0 {
+			nodeServer.StartUsageAccounting(*usageEvery, *usageAlert)
+			identityServer.AddHealthCheck("usage accounting", nodeServer.CheckUsageAccounting)
+		}
+		if metrics != nil {
+			metrics.SetNodeServer(nodeServer)
+		}
+		csi.RegisterNodeServer(server, nodeServer)
+	}
+	// 开始服务之前注册, kubelet 收到注册后马上会调用 NodeGetInfo, 请求在 Serve 开始之前排队
+	var registration *hostpathcsi.PluginRegistration
+	if *regPath != "" {
+		if !serveNode {
+			log.Fatalf("--kubelet-registration-path only applies to the node plugin, it can not be used with --mode=controller")
+		}
+		if registration, err = hostpathcsi.NewPluginRegistration(*driverName, *regPath, *regDir); err != nil {
+			log.Fatalf("invalid --kubelet-registration-path: %v", err)
+		}
+		if err := registration.Start(); err != nil {
+			log.Fatalf("failed to register with kubelet: %v", err)
+		}
+	}
+
+	var controllerServer *hostpathcsi.ControllerServer
+	var adminServer *http.Server
+	electCtx, stopElection := context.WithCancel(context.Background())
+	defer stopElection()
+	if serveController {
+		controllerServer = hostpathcsi.NewControllerServer(config, state, nodeID, *attach)
+		controllerServer.SetWipeOnDelete(*wipe)
+		controllerServer.SetOnMissingBacking(missingPolicy)
+		controllerServer.SetCapacityTruth(capacityTruth)
+		if *chainDepth < 0 {
+			log.Fatalf("--max-snapshot-chain-depth must not be negative")
+		}
+		controllerServer.SetMaxSnapshotChainDepth(*chainDepth)
+		if *maxSnaps < 0 {
+			log.Fatalf("--max-snapshots-per-volume must not be negative")
+		}
+		controllerServer.SetMaxSnapshotsPerVolume(*maxSnaps)
+		if *poolPolicy != "" {
+			policy, err := hostpathcsi.NewPoolPolicy(*poolPolicy, *poolWeight)
+			if err != nil {
+				log.Fatalf("invalid --pool-policy or --pool-weights: %v", err)
+			}
+			controllerServer.SetPoolPolicy(policy)
+		}
+		if metrics != nil {
+			metrics.SetControllerServer(controllerServer)
+		}
+		if *adminAddr != "" {
+			adminServer = &http.Server{Addr: *adminAddr, Handler: hostpathcsi.NewAdminHandler(controllerServer, *impState)}
+		}
+		csi.RegisterControllerServer(server, controllerServer)
+		csi.RegisterGroupControllerServer(server, hostpathcsi.NewGroupControllerServer(controllerServer))
+
+		// 后台任务和管理接口会修改卷, 开启 leader 选举时只在 leader 上运行
+		startTasks := func() {
+			if *gcEvery > 0 {
+				controllerServer.StartGarbageCollection(*gcEvery, *gcDryRun)
+			}
+			if *scrubEvery > 0 {
+				controllerServer.StartScrubbing(*scrubEvery)
+			}
+			if adminServer != nil {
+				go func() {
+					if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+						log.Fatalf("failed to serve admin API: %v", err)
+					}
+				}()
+			}
+		}
+		if elector == nil {
+			startTasks()
+		} else {
+			// 失去 leader 身份或者接替时重新加载状态失败时退出, 由 Kubernetes 重启后重新作为备用副本参与选举, 不会有两个副本同时修改卷
+			go elector.Run(electCtx, startTasks, func() {
+				log.Fatalf("no longer the leader, exiting")
+			})
+		}
+	}
+
+	// 健康检查接口在开始服务之前启动, 这期间 /readyz 返回失败
+	var healthServer *http.Server
+	if *healthPort > 0 {
+		healthServer = &http.Server{Addr: fmt.Sprintf(":%d", *healthPort), Handler: hostpathcsi.NewHealthHandler(identityServer)}
+		go func() {
+			if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("failed to serve health checks: %v", err)
+			}
+		}()
+	}
+
+	var metricsServer *http.Server
+	if metrics != nil {
+		metricsServer = &http.Server{Addr: *metricAddr, Handler: metrics.Handler()}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	// 收到 SIGHUP 时重新加载配置文件, 例如 ConfigMap 更新之后 kubectl exec <pod> -- kill -HUP 1
+	if *configFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Printf("Reloading config file %s", *configFile)
+				if err := reloadConfig(*configFile, cmdline, config, controllerServer, nodeServer); err != nil {
+					log.Printf("failed to reload config file, keeping the previous configuration: %v", err)
+				}
+			}
+		}()
+	}
+
+	// 收到 SIGTERM(kubelet 删除 pod)或 SIGINT 时不再接受新的请求, 等正在处理的请求完成再退出, 避免留下创建了一半的卷;
+	// 超过 --shutdown-timeout 还没有完成的请求直接中断
+	stopped := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-stop
+		log.Printf("Received %s, waiting up to %s for in-flight requests to finish", sig, *drainWait)
+		identityServer.SetReady(false)
+		// 先注销, kubelet 不再向正在退出的驱动发送新的请求
+		if registration != nil {
+			registration.Stop()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *drainWait)
+		defer cancel()
+		drained := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			if adminServer != nil {
+				adminServer.Shutdown(ctx)
+			}
+			if healthServer != nil {
+				healthServer.Shutdown(ctx)
+			}
+			if metricsServer != nil {
+				metricsServer.Shutdown(ctx)
+			}
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			log.Printf("WARNING: in-flight requests did not finish within %s, stopping anyway", *drainWait)
+			server.Stop()
+		}
+		close(stopped)
+	}()
+
+	log.Printf("Starting CSI driver in %s mode...", *mode)
+	identityServer.SetReady(true)
+	// 启动 gRPC 服务器, 开始停止之后 Serve 就返回, 要等正在处理的请求完成
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+	<-stopped
+
+	// 状态在每次修改时已经写入文件, 退出前再刷到磁盘; 必须在释放 Lease 之前完成, 释放之后接替的副本随时会修改状态文件。
+	// 不是 leader 的副本没有修改过状态, 内存里的状态可能比文件旧, 不能写回
+	if elector == nil || elector.IsLeader() {
+		if err := state.Flush(); err != nil {
+			log.Printf("failed to flush state: %v", err)
+		}
+	}
+	// 主动释放 Lease, 备用副本不用等 Lease 过期就能接替
+	if elector != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), *renewDL)
+		if err := elector.Release(ctx); err != nil {
+			log.Printf("%v", err)
+		}
+		cancel()
+	}
+	// 导出还在缓冲区里的 span
+	if shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := shutdownTracing(ctx); err != nil {
+			log.Printf("failed to flush traces: %v", err)
+		}
+		cancel()
+	}
+	// systemd 激活的 socket 由 systemd 管理, 下次连接时还要用它再次启动驱动
+	if !activated {
+		if err := hostpathcsi.RemoveSocket(*endpoint); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	log.Println("CSI driver stopped")
+}
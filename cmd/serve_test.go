@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		dials int
+		// wantAccepted 是已有连接都不关闭时能 Accept 的连接数, 其余的连接排队
+		wantAccepted int
+	}{
+		{name: "below the limit", limit: 3, dials: 2, wantAccepted: 2},
+		{name: "at the limit", limit: 2, dials: 2, wantAccepted: 2},
+		{name: "beyond the limit", limit: 2, dials: 4, wantAccepted: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := newLimitListener(inner, tt.limit)
+			defer listener.Close()
+
+			for i := 0; i < tt.dials; i++ {
+				conn, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+			}
+
+			accepted := make(chan net.Conn, tt.dials)
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					accepted <- conn
+				}
+			}()
+			var conns []net.Conn
+			for len(conns) < tt.wantAccepted {
+				select {
+				case conn := <-accepted:
+					conns = append(conns, conn)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("accepted %d connections, want %d", len(conns), tt.wantAccepted)
+				}
+			}
+			// 超过上限的连接一直排队
+			select {
+			case <-accepted:
+				t.Fatalf("accepted more than %d connections", tt.wantAccepted)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			// 关闭一个连接之后排队的连接才能被 Accept
+			if tt.dials > tt.wantAccepted {
+				conns[0].Close()
+				select {
+				case conn := <-accepted:
+					conns = append(conns, conn)
+				case <-time.After(5 * time.Second):
+					t.Fatal("queued connection was not accepted after a connection was closed")
+				}
+			}
+			for _, conn := range conns {
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestLimitListenerClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newLimitListener(inner, 1)
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	first, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// 名额用完时 Accept 阻塞, 关闭 listener 要让它返回
+	done := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	listener.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept() after Close error = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return after Close")
+	}
+}
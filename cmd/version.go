@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ZhangSIming-blyq/hostpathcsi/pkg/hostpathcsi"
+	"github.com/spf13/cobra"
+)
+
+// newVersionCommand 创建 version 子命令, 输出和 GetPluginInfo 的 Manifest 相同的构建信息
+func newVersionCommand() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version and build information",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info := hostpathcsi.BuildInfo()
+			if asJSON {
+				return json.NewEncoder(os.Stdout).Encode(info)
+			}
+			fmt.Printf("hostpath CSI driver %s (commit %s, built %s, %s)\n", info["version"], info["commit"], info["buildDate"], info["goVersion"])
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the build information as JSON")
+	return cmd
+}
@@ -0,0 +1,81 @@
+// Package hostpathcsi Description: 这个文件实现给运维使用的管理接口(HTTP), 提供 CSI 里没有的操作: 卷在存储池之间的迁移,
+// 以及备份和恢复元数据(状态文件):
+//
+//	curl -X POST 'http://127.0.0.1:9810/volumes/<卷 ID>/migrate?pool=ssd'
+//	custom-csi admin migrate <卷 ID> --pool=ssd
+//	curl http://127.0.0.1:9810/state > state.json
+//	curl -X POST --data-binary @state.json http://127.0.0.1:9810/state
+//
+// 接口没有认证, 只应该监听在本机地址上; 恢复会替换所有卷和快照的记录, 默认关闭。恢复一个没有记录的状态会清空所有记录,
+// 需要加上 ?clear=true 确认。
+package hostpathcsi
+
+import (
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	"net/http"
+)
+
+// migrateResponse 是迁移成功后返回的卷的新位置
+type migrateResponse struct {
+	VolumeID string `json:"volumeId"`
+	Path     string `json:"path"`
+	Pool     string `json:"pool"`
+}
+
+// httpStatusCodes 把 gRPC 错误码转换成 HTTP 状态码, 没有列出的都是 500
+var httpStatusCodes = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.NotFound:           http.StatusNotFound,
+	codes.FailedPrecondition: http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusInsufficientStorage,
+}
+
+// NewAdminHandler 返回管理接口的 HTTP handler, allowImport 为 false 时拒绝恢复状态
+func NewAdminHandler(controller *ControllerServer, allowImport bool) http.Handler {
+	mux := http.NewServeMux()
+	// pool 为空表示迁移回 DataDir
+	mux.HandleFunc("POST /volumes/{id}/migrate", func(w http.ResponseWriter, r *http.Request) {
+		volumeID, pool := r.PathValue("id"), r.URL.Query().Get("pool")
+		klog.Infof("Received admin request to migrate volume %s to pool %q", volumeID, pool)
+		volume, err := controller.MigrateVolume(volumeID, pool)
+		if err != nil {
+			code, ok := httpStatusCodes[status.Code(err)]
+			if !ok {
+				code = http.StatusInternalServerError
+			}
+			http.Error(w, status.Convert(err).Message(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(migrateResponse{VolumeID: volume.ID, Path: volume.Path, Pool: volume.Pool})
+	})
+	mux.HandleFunc("GET /state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := controller.state.Export(w); err != nil {
+			klog.Warningf("Failed to export state: %v", err)
+		}
+	})
+	// 恢复只替换记录, 不检查卷和快照的数据是否还在, 应该在没有其他请求的时候使用
+	mux.HandleFunc("POST /state", func(w http.ResponseWriter, r *http.Request) {
+		if !allowImport {
+			http.Error(w, "importing the state is disabled, start the driver with --admin-state-import to enable it", http.StatusForbidden)
+			return
+		}
+		klog.Infof("Received admin request to import the state")
+		if err := controller.state.Import(r.Body, r.URL.Query().Get("clear") == "true"); err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, errInvalidState) {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		klog.Infof("Imported the state, %d volumes and %d snapshots", len(controller.state.ListVolumes()), len(controller.state.ListSnapshots()))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
@@ -0,0 +1,113 @@
+package hostpathcsi
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStateExportRoundTrip(t *testing.T) {
+	s := newTestControllerServer(t)
+	if err := s.state.UpdateVolume(Volume{ID: "pvc-1", Path: "/data/pvc-1", CapacityBytes: 1 << 20, Parameters: map[string]string{poolParameter: "ssd"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.state.AddGroupSnapshot(GroupSnapshot{ID: "group-1", SnapshotIDs: []string{"snap-1"}}, []Snapshot{{ID: "snap-1", SourceVolumeID: "pvc-1", CreationTime: time.Unix(1700000000, 0).UTC()}}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewAdminHandler(s, false)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/state", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /state = %d: %s", rec.Code, rec.Body)
+	}
+
+	restored, err := NewState(newTestConfig(t).StatePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Import(bytes.NewReader(rec.Body.Bytes()), false); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	var want, got bytes.Buffer
+	if err := s.state.Export(&want); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Export(&got); err != nil {
+		t.Fatal(err)
+	}
+	if want.String() != got.String() {
+		t.Errorf("exported state after the round trip = %s, want %s", got.String(), want.String())
+	}
+	if _, ok := restored.GetGroupSnapshot("group-1"); !ok {
+		t.Error("group snapshot was not restored")
+	}
+}
+
+func TestStateImport(t *testing.T) {
+	backup := newTestControllerServer(t)
+	if err := backup.state.UpdateVolume(Volume{ID: "pvc-backup", Path: "/data/pvc-backup"}); err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	if err := backup.state.Export(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		allowImport bool
+		// query 是请求的参数
+		query    string
+		body     []byte
+		wantCode int
+		// wantVolume 是导入之后应该存在的卷, 为空表示导入之后没有卷
+		wantVolume string
+	}{
+		{name: "disabled", body: raw.Bytes(), wantCode: http.StatusForbidden, wantVolume: "pvc-current"},
+		{name: "enabled", allowImport: true, body: raw.Bytes(), wantCode: http.StatusNoContent, wantVolume: "pvc-backup"},
+		{name: "invalid state", allowImport: true, body: []byte("{"), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "null volume", allowImport: true, body: []byte(`{"volumes": {"pvc-backup": null}}`), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "null snapshot", allowImport: true, body: []byte(`{"volumes": {"pvc-backup": {"id": "pvc-backup"}}, "snapshots": {"snap-1": null}}`), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "null group snapshot", allowImport: true, body: []byte(`{"volumes": {"pvc-backup": {"id": "pvc-backup"}}, "groupSnapshots": {"group-1": null}}`), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "key does not match the id", allowImport: true, body: []byte(`{"volumes": {"pvc-backup": {"id": "pvc-other"}}}`), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "snapshot key does not match the id", allowImport: true, body: []byte(`{"volumes": {"pvc-backup": {"id": "pvc-backup"}}, "snapshots": {"snap-1": {"id": "snap-2"}}}`), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "empty object", allowImport: true, body: []byte("{}"), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "null", allowImport: true, body: []byte("null"), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "empty tables", allowImport: true, body: []byte(`{"volumes": {}, "snapshots": {}}`), wantCode: http.StatusBadRequest, wantVolume: "pvc-current"},
+		{name: "clear", allowImport: true, query: "?clear=true", body: []byte("{}"), wantCode: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestControllerServer(t)
+			if err := s.state.UpdateVolume(Volume{ID: "pvc-current", Path: "/data/pvc-current"}); err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			NewAdminHandler(s, tt.allowImport).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/state"+tt.query, bytes.NewReader(tt.body)))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("POST /state = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			// 导入的状态也要写到状态文件里, 重启之后仍然有效
+			reloaded, err := NewState(s.config.StatePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, state := range map[string]*State{"state": s.state, "state file": reloaded} {
+				var ids []string
+				for _, v := range state.ListVolumes() {
+					ids = append(ids, v.ID)
+				}
+				var want []string
+				if tt.wantVolume != "" {
+					want = []string{tt.wantVolume}
+				}
+				if !equalStrings(ids, want) {
+					t.Errorf("volumes in the %s after POST /state = %v, want %v", name, ids, want)
+				}
+			}
+		})
+	}
+}
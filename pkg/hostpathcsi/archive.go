@@ -0,0 +1,364 @@
+// Package hostpathcsi Description: 这个文件实现快照的归档格式: VolumeSnapshotClass 设置 format 参数时, 快照写成压缩的 tar 包,
+// 卷的内容放在包内的 data/ 目录下, 最后附带每个文件的 sha256 清单, 归档旁边再写一份整个包的校验和, 拷贝到其他节点也能校验和恢复。
+package hostpathcsi
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/fs"
+	"k8s.io/klog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// snapshotFormatParameter 是 VolumeSnapshotClass 中选择快照格式的参数, 不设置时由后端保存快照
+	snapshotFormatParameter = "format"
+	// snapshotFormatTarGzip 和 snapshotFormatTarZstd 把快照写成 gzip 或 zstd 压缩的 tar 包
+	snapshotFormatTarGzip = "tar.gz"
+	snapshotFormatTarZstd = "tar.zst"
+
+	// archiveDataDir 是归档中存放卷内容的目录
+	archiveDataDir = "data"
+	// archiveManifest 是归档中的校验和清单, 格式和 sha256sum 的输出相同, 解包后可以用 sha256sum -c 校验
+	archiveManifest = "MANIFEST.sha256"
+	// archiveChecksumSuffix 是归档旁边记录整个包 sha256 的文件后缀
+	archiveChecksumSuffix = ".sha256"
+)
+
+// checkSnapshotFormat 检查快照格式参数
+func checkSnapshotFormat(format string) error {
+	switch format {
+	case "", snapshotFormatTarGzip, snapshotFormatTarZstd:
+		return nil
+	default:
+		return fmt.Errorf("invalid %s parameter %q, must be %s or %s", snapshotFormatParameter, format, snapshotFormatTarGzip, snapshotFormatTarZstd)
+	}
+}
+
+// isArchiveFormat 判断快照是否以归档格式保存
+func isArchiveFormat(format string) bool {
+	return format == snapshotFormatTarGzip || format == snapshotFormatTarZstd
+}
+
+// exportArchive 把目录 src 写成 archivePath 处的压缩 tar 包, 返回卷内容的大小(所有普通文件的大小之和);
+// 先写临时文件, 完成后再 rename, 避免留下不完整的归档
+func exportArchive(src, archivePath, format string) (int64, error) {
+	tmpPath := archivePath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create archive %s: %w", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	archiveHash := sha256.New()
+	compressor, err := newCompressor(io.MultiWriter(f, archiveHash), format)
+	if err != nil {
+		return 0, err
+	}
+	tw := tar.NewWriter(compressor)
+
+	var size int64
+	var manifest strings.Builder
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// 设备文件、管道等特殊文件不归档
+		if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(archiveDataDir, filepath.ToSlash(rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		fileHash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, fileHash), in); err != nil {
+			return err
+		}
+		size += info.Size()
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(fileHash.Sum(nil)), header.Name)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: archiveManifest, Mode: 0644, Size: int64(manifest.Len()), Typeflag: tar.TypeReg}); err != nil {
+		return 0, fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+	if _, err := io.WriteString(tw, manifest.String()); err != nil {
+		return 0, fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return 0, fmt.Errorf("failed to finish archive %s: %w", tmpPath, err)
+	}
+	if err := compressor.Close(); err != nil {
+		return 0, fmt.Errorf("failed to finish archive %s: %w", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("failed to finish archive %s: %w", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, archivePath); err != nil {
+		return 0, fmt.Errorf("failed to finalize archive %s: %v", archivePath, err)
+	}
+	checksum := fmt.Sprintf("%s  %s\n", hex.EncodeToString(archiveHash.Sum(nil)), filepath.Base(archivePath))
+	if err := writeFileAtomic(archivePath+archiveChecksumSuffix, []byte(checksum)); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// extractArchive 把 r 中的 tar 包(可以是 gzip、zstd 压缩的, 也可以不压缩)解包到目录 dst。
+// 第一个条目是 data/ 时按快照归档的布局解包: 只解包 data/ 下的内容, 并按清单校验每个文件; 否则把整个包解包到卷的根目录。
+// requireManifest 为 true 时只接受带清单的快照归档
+func extractArchive(r io.Reader, dst string, requireManifest bool) error {
+	decompressor, err := newDecompressor(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+
+	tr := tar.NewReader(decompressor)
+	checksums := make(map[string]string)
+	var manifest map[string]string
+	first, snapshotLayout := true, false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if first {
+			snapshotLayout = name == archiveDataDir && header.Typeflag == tar.TypeDir
+			first = false
+			if requireManifest && !snapshotLayout {
+				return fmt.Errorf("archive is not a snapshot archive, its first entry is %q", header.Name)
+			}
+		}
+		if snapshotLayout && name == archiveManifest {
+			if manifest, err = parseManifest(tr); err != nil {
+				return fmt.Errorf("invalid %s: %v", archiveManifest, err)
+			}
+			continue
+		}
+
+		rel := name
+		if snapshotLayout {
+			var ok bool
+			if rel, ok = strings.CutPrefix(name, archiveDataDir); !ok || (rel != "" && !strings.HasPrefix(rel, "/")) {
+				return fmt.Errorf("archive contains unexpected entry %q", header.Name)
+			}
+		}
+		// 清理后仍然指向上级目录或者是绝对路径的条目会写到卷外面
+		if rel == ".." || strings.HasPrefix(rel, "../") || (!snapshotLayout && path.IsAbs(rel)) {
+			return fmt.Errorf("archive entry %q is outside the volume", header.Name)
+		}
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+		if err := checkNoSymlinkParents(dst, target); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, os.FileMode(header.Mode).Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			fileHash := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(out, fileHash), tr); err != nil {
+				out.Close()
+				return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+			checksums[name] = hex.EncodeToString(fileHash.Sum(nil))
+			os.Chtimes(target, header.ModTime, header.ModTime)
+		default:
+			// 硬链接、设备文件等其他类型的条目不解包
+			klog.Warningf("Skipping archive entry %s of type %c", header.Name, header.Typeflag)
+			continue
+		}
+		// 以 root 运行时恢复属主, 失败(例如没有权限)不影响数据
+		os.Lchown(target, header.Uid, header.Gid)
+	}
+
+	if !snapshotLayout {
+		return nil
+	}
+	if manifest == nil {
+		return fmt.Errorf("snapshot archive has no %s", archiveManifest)
+	}
+	for name, sum := range manifest {
+		if checksums[name] != sum {
+			return fmt.Errorf("checksum of %s does not match %s", name, archiveManifest)
+		}
+	}
+	for name := range checksums {
+		if _, ok := manifest[name]; !ok {
+			return fmt.Errorf("%s is not listed in %s", name, archiveManifest)
+		}
+	}
+	return nil
+}
+
+// populateFromArchive 在后端上创建一个空卷, 再把 open 打开的归档解包进去; 失败时删除创建的卷
+func populateFromArchive(ctx context.Context, backend Backend, volume *Volume, open func() (io.ReadCloser, error), requireManifest bool) error {
+	if err := backend.CreateVolume(ctx, volume); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(volume.Path); err != nil || !fi.IsDir() {
+		backend.DeleteVolume(ctx, *volume)
+		return status.Errorf(codes.InvalidArgument, "backend %s does not store volumes as directories, archives can not be extracted into it", backend.Name())
+	}
+	r, err := open()
+	if err == nil {
+		err = extractArchive(r, volume.Path, requireManifest)
+		r.Close()
+	}
+	if err != nil {
+		backend.DeleteVolume(ctx, *volume)
+		return storageError(err, "failed to populate volume %s from archive", volume.ID)
+	}
+	return nil
+}
+
+// removeArchive 删除归档和它的校验和文件, 不存在时返回成功
+func removeArchive(archivePath string) error {
+	for _, p := range []string{archivePath, archivePath + archiveChecksumSuffix, archivePath + ".tmp"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseManifest 解析 sha256sum 格式的清单, 返回 条目名 -> sha256
+func parseManifest(r io.Reader) (map[string]string, error) {
+	manifest := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		manifest[path.Clean(name)] = sum
+	}
+	return manifest, scanner.Err()
+}
+
+// checkNoSymlinkParents 检查 target 在 dst 下的上级目录都不是软链接, 避免归档中的软链接把后面的文件写到卷外面
+func checkNoSymlinkParents(dst, target string) error {
+	rel, err := filepath.Rel(dst, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+	dir := dst
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %s is below symlink %s", target, dir)
+		}
+	}
+	return nil
+}
+
+// newCompressor 按快照格式返回压缩 w 的 writer
+func newCompressor(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case snapshotFormatTarGzip:
+		return gzip.NewWriter(w), nil
+	case snapshotFormatTarZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+}
+
+// newDecompressor 根据开头的 magic number 识别 gzip 和 zstd 压缩, 返回解压后的 reader; 都不是时认为是没有压缩的 tar 包
+func newDecompressor(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
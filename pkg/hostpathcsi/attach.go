@@ -0,0 +1,84 @@
+// Package hostpathcsi Description: 这个文件实现可选的 Attach 阶段: 开启后 ControllerPublishVolume 在状态里记录卷挂到了哪个节点,
+// 这样可以使用 external-attacher, 并通过 VolumeAttachment 发现残留的挂载。
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"slices"
+)
+
+// ControllerPublishVolume 记录卷挂到了 req.NodeId 节点, 卷只能挂到它所在的节点上
+func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	// 在 HostPath 场景中，通常不需要 Controller 发布卷，因为它是本地存储
+	if !s.attachRequired {
+		return nil, status.Error(codes.Unimplemented, "ControllerPublishVolume is not supported")
+	}
+
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+
+	volume, ok := s.state.GetVolume(req.VolumeId)
+	if !ok {
+		// 兼容引入状态记录之前创建的卷: 目录存在就补一条记录
+		volume = Volume{ID: req.VolumeId, Path: s.volumePath(req.VolumeId)}
+		if _, err := os.Stat(volume.Path); err != nil {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", req.VolumeId)
+		}
+	}
+
+	// 卷的数据在它所在节点的本地目录里, 挂到其他节点上也访问不到
+	volumeNode := volume.NodeID
+	if volumeNode == "" {
+		volumeNode = s.nodeID
+	}
+	if req.NodeId != volumeNode {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is only accessible from node %s, not %s", req.VolumeId, volumeNode, req.NodeId)
+	}
+
+	publishContext := map[string]string{volumeContextPathKey: volume.Path}
+	if slices.Contains(volume.AttachedNodes, req.NodeId) {
+		return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+	}
+	volume.AttachedNodes = append(volume.AttachedNodes, req.NodeId)
+	slices.Sort(volume.AttachedNodes)
+	if err := s.state.UpdateVolume(volume); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record attachment of volume %s: %v", req.VolumeId, err)
+	}
+
+	logFor(ctx).Infof("Volume %s attached to node %s", req.VolumeId, req.NodeId)
+	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+}
+
+// ControllerUnpublishVolume 删除卷挂到 req.NodeId 节点的记录, NodeId 为空时删除所有节点的记录; 卷不存在时也返回成功
+func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if !s.attachRequired {
+		return nil, status.Error(codes.Unimplemented, "ControllerUnpublishVolume is not supported")
+	}
+
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+
+	volume, ok := s.state.GetVolume(req.VolumeId)
+	if !ok || len(volume.AttachedNodes) == 0 {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if req.NodeId == "" {
+		volume.AttachedNodes = nil
+	} else if i := slices.Index(volume.AttachedNodes, req.NodeId); i >= 0 {
+		volume.AttachedNodes = slices.Delete(volume.AttachedNodes, i, i+1)
+	} else {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err := s.state.UpdateVolume(volume); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record detachment of volume %s: %v", req.VolumeId, err)
+	}
+
+	logFor(ctx).Infof("Volume %s detached from node %s", req.VolumeId, req.NodeId)
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
@@ -0,0 +1,132 @@
+// Package hostpathcsi Description: 这个文件定义卷数据的存储后端, gRPC 服务只负责校验请求和记录元数据,
+// 卷的创建、删除、扩容、快照和容量统计都交给 Backend, 新的存储方式(loop 设备、btrfs、LVM 等)只需要实现这个接口。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// backendParameter 是 StorageClass 中选择后端的参数, 没有指定时使用默认后端
+const backendParameter = "backend"
+
+// Backend 是卷数据的存储方式; 返回的错误应该是 gRPC 状态, 由 gRPC 服务直接返回;
+// ctx 是触发操作的 CSI 请求的 context, 日志通过它带上请求 ID
+type Backend interface {
+	// Name 返回后端的名字, 记录在卷的元数据里
+	Name() string
+	// CreateVolume 在 volume.Path 创建一个空卷, 需要时可以修改 volume 的路径
+	CreateVolume(ctx context.Context, volume *Volume) error
+	// CloneVolume 创建一个内容和 source 相同的卷
+	CloneVolume(ctx context.Context, source Volume, volume *Volume) error
+	// DeleteVolume 删除卷的数据, 卷不存在时返回成功
+	DeleteVolume(ctx context.Context, volume Volume) error
+	// ExpandVolume 把卷扩大到 capacity
+	ExpandVolume(ctx context.Context, volume Volume, capacity int64) error
+	// NodeExpansionRequired 返回扩容后是否还需要在节点上调用 NodeExpandVolume
+	NodeExpansionRequired(volume Volume) bool
+	// CreateSnapshot 在 snapshot.Path 为 volume 创建快照, 需要时可以修改快照的路径, 并填写快照的大小
+	CreateSnapshot(ctx context.Context, volume Volume, snapshot *Snapshot) error
+	// RestoreSnapshot 用快照的内容创建卷
+	RestoreSnapshot(ctx context.Context, snapshot Snapshot, volume *Volume) error
+	// DeleteSnapshot 删除快照的数据, 快照不存在时返回成功
+	DeleteSnapshot(ctx context.Context, snapshot Snapshot) error
+	// Stats 返回发布在 path 上的卷的使用情况
+	Stats(ctx context.Context, volumeID, path string) (VolumeStats, error)
+}
+
+// incrementalBackend 是可以基于同一个卷的上一个快照增量创建快照的后端, 没有变化的数据和父快照共享
+type incrementalBackend interface {
+	// CreateIncrementalSnapshot 基于 parent 为 volume 创建快照, 并在 snapshot 中记录 parent
+	CreateIncrementalSnapshot(ctx context.Context, volume Volume, parent Snapshot, snapshot *Snapshot) error
+}
+
+// groupSnapshotBackend 是可以在同一时刻为多个卷创建快照的后端, 多个卷的组快照只在这样的后端上创建,
+// 否则各个卷的快照不是同一时刻的数据, 恢复出来的应用数据可能不一致
+type groupSnapshotBackend interface {
+	// CreateGroupSnapshot 原子地为 volumes 创建快照, snapshots 和 volumes 一一对应, 要求同 CreateSnapshot
+	CreateGroupSnapshot(ctx context.Context, volumes []Volume, snapshots []*Snapshot) error
+}
+
+// VolumeStats 是卷的容量和 inode 使用情况
+type VolumeStats struct {
+	TotalBytes     int64
+	UsedBytes      int64
+	AvailableBytes int64
+	TotalInodes    int64
+	UsedInodes     int64
+	FreeInodes     int64
+}
+
+var (
+	// backendsMu 保护 backends 和 defaultBackend
+	backendsMu sync.RWMutex
+	// backends 是所有可用的后端, 按名字索引
+	backends = map[string]Backend{directoryBackendName: directoryBackend{}}
+	// defaultBackend 是 StorageClass 没有指定后端时使用的后端
+	defaultBackend = directoryBackendName
+)
+
+// RegisterBackend 登记一个后端, 同名的后端会被替换
+func RegisterBackend(backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[backend.Name()] = backend
+}
+
+// SetDefaultBackend 设置默认后端, 后端必须已经登记
+func SetDefaultBackend(name string) error {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, ok := backends[name]; !ok {
+		return fmt.Errorf("unknown backend %q, available backends are %v", name, backendNamesLocked())
+	}
+	defaultBackend = name
+	return nil
+}
+
+// lookupBackend 返回名字对应的后端, 名字为空时返回默认后端
+func lookupBackend(name string) (Backend, error) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	if name == "" {
+		name = defaultBackend
+	}
+	backend, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, available backends are %v", name, backendNamesLocked())
+	}
+	return traceBackend(backend), nil
+}
+
+// backendOf 返回卷或快照记录的后端; 引入后端之前创建的卷和快照没有记录后端, 它们都在目录后端上
+func backendOf(name string) (Backend, error) {
+	if name == "" {
+		name = directoryBackendName
+	}
+	return lookupBackend(name)
+}
+
+// groupSnapshotsSupported 判断是否登记了可以创建多个卷的组快照的后端, 没有时不上报 GroupController 服务
+func groupSnapshotsSupported() bool {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	for _, backend := range backends {
+		if _, ok := backend.(groupSnapshotBackend); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// backendNamesLocked 返回排序后的后端名字, 调用方需要持有 backendsMu
+func backendNamesLocked() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
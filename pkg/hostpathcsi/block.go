@@ -0,0 +1,247 @@
+// Package hostpathcsi Description: 这个文件实现 raw block 卷, 卷的数据保存在一个稀疏文件里,
+// NodeStageVolume 把它挂到 loop 设备上, NodePublishVolume 再把 loop 设备 bind mount 到目标路径。
+package hostpathcsi
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	mount "k8s.io/mount-utils"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// accessTypeMount 表示文件系统(目录)卷
+	accessTypeMount = "mount"
+	// accessTypeBlock 表示 raw block 卷
+	accessTypeBlock = "block"
+)
+
+// stagingBackingLink 是 NodeStageVolume 在 staging 目录下创建的软链接, 指向卷的后端文件,
+// NodeUnstageVolume 只拿得到 staging 路径, 靠它找到需要释放的 loop 设备
+const stagingBackingLink = "backing"
+
+// preallocateParameter 是 StorageClass 中要求预先分配空间的参数, 为 true 时镜像文件用 fallocate 分配全部空间,
+// 默认创建稀疏文件, 只在写入时才占用磁盘
+const preallocateParameter = "preallocate"
+
+// volumeContextAllocatedKey 是 ListVolumes/ControllerGetVolume 返回的 VolumeContext 中记录后端文件实际占用磁盘字节数的 key,
+// 卷的逻辑大小是 capacity_bytes
+const volumeContextAllocatedKey = "allocatedBytes"
+
+// shouldPreallocate 判断卷是否要求预先分配空间
+func shouldPreallocate(parameters map[string]string) bool {
+	return parameters[preallocateParameter] == "true"
+}
+
+// allocatedBytes 返回文件实际占用的磁盘字节数, 稀疏文件没有写过的部分不占用磁盘
+func allocatedBytes(path string) (int64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	// st_blocks 总是以 512 字节为单位, 和文件系统的块大小无关
+	return st.Blocks * 512, nil
+}
+
+// createBlockFile 创建(或扩大)后端文件; 默认是稀疏文件, 只分配逻辑大小不占用实际磁盘, preallocate 时用 fallocate 分配全部空间
+func createBlockFile(path string, size int64, preallocate bool) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create block file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat block file %s: %v", path, err)
+	}
+	if preallocate {
+		// fallocate 会同时扩大文件, 已经分配的部分不受影响; 空间不足时返回 ENOSPC
+		if err := unix.Fallocate(int(f.Fd()), 0, 0, size); err != nil {
+			return fmt.Errorf("failed to preallocate block file %s to %d: %w", path, size, err)
+		}
+		return nil
+	}
+	// 只扩大不缩小, 避免截断数据
+	if fi.Size() < size {
+		if err := f.Truncate(size); err != nil {
+			return fmt.Errorf("failed to resize block file %s to %d: %w", path, size, err)
+		}
+	}
+	return nil
+}
+
+// findLoopDevice 返回已经关联到 file 的 loop 设备, 没有时返回空字符串
+func findLoopDevice(file string) (string, error) {
+	out, err := exec.Command("losetup", "-j", file).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to find loop device for %s: %v, output: %s", file, err, strings.TrimSpace(string(out)))
+	}
+	// 输出格式: /dev/loop0: [2049]:1234 (/tmp/csi/hostpath/pvc-xxx)
+	line := strings.TrimSpace(string(out))
+	if line == "" {
+		return "", nil
+	}
+	if i := strings.Index(line, ":"); i > 0 {
+		return line[:i], nil
+	}
+	return "", fmt.Errorf("unexpected losetup output for %s: %s", file, line)
+}
+
+// attachLoopDevice 把 file 挂到一个空闲的 loop 设备上, 已经挂载过时直接返回已有的设备
+func attachLoopDevice(file string) (string, error) {
+	if device, err := findLoopDevice(file); err != nil || device != "" {
+		return device, err
+	}
+	out, err := exec.Command("losetup", "-f", "--show", file).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to attach loop device for %s: %v, output: %s", file, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// detachLoopDevice 释放关联到 file 的 loop 设备, 没有关联时什么都不做
+func detachLoopDevice(file string) error {
+	device, err := findLoopDevice(file)
+	if err != nil || device == "" {
+		return err
+	}
+	if out, err := exec.Command("losetup", "-d", device).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to detach loop device %s: %v, output: %s", device, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// deviceFor 返回卷的块设备: 后端本身就是块设备(例如 LVM 逻辑卷)时直接使用, 是文件时挂到 loop 设备上
+func deviceFor(backingFile string) (string, error) {
+	if isBlockDevice(backingFile) {
+		return backingFile, nil
+	}
+	return attachLoopDevice(backingFile)
+}
+
+// isBlockDevice 判断 path 是否是块设备
+func isBlockDevice(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// refreshLoopDevice 在后端文件扩大后让 loop 设备重新读取文件大小; 后端是块设备时大小已经生效, 什么都不做
+func refreshLoopDevice(file string) error {
+	if isBlockDevice(file) {
+		return nil
+	}
+	device, err := findLoopDevice(file)
+	if err != nil {
+		return err
+	}
+	if device == "" {
+		return fmt.Errorf("no loop device attached to %s", file)
+	}
+	return reloadLoopDevice(device)
+}
+
+// reloadLoopDevice 让 loop 设备重新读取后端文件的大小
+func reloadLoopDevice(device string) error {
+	if out, err := exec.Command("losetup", "-c", device).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to refresh loop device %s: %v, output: %s", device, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// stageBlockVolume 把后端文件挂到 loop 设备上(后端是块设备时直接使用), 并在 staging 目录下记录后端文件的位置
+func stageBlockVolume(backingFile, stagingPath string) (string, error) {
+	if _, err := os.Stat(backingFile); err != nil {
+		return "", fmt.Errorf("block file %s is not accessible: %v", backingFile, err)
+	}
+	device, err := deviceFor(backingFile)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return "", fmt.Errorf("failed to create staging path %s: %v", stagingPath, err)
+	}
+	link := filepath.Join(stagingPath, stagingBackingLink)
+	if existing, err := os.Readlink(link); err != nil || existing != backingFile {
+		os.Remove(link)
+		if err := os.Symlink(backingFile, link); err != nil {
+			return "", fmt.Errorf("failed to record backing file in %s: %v", stagingPath, err)
+		}
+	}
+	return device, nil
+}
+
+// unstageBlockVolume 释放 loop 设备并清理 staging 目录下的记录
+func unstageBlockVolume(stagingPath string) error {
+	link := filepath.Join(stagingPath, stagingBackingLink)
+	backingFile, err := os.Readlink(link)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read backing file record in %s: %v", stagingPath, err)
+	}
+	if err := detachLoopDevice(backingFile); err != nil {
+		return err
+	}
+	return os.Remove(link)
+}
+
+// stagedBackingFile 返回 staging 目录记录的后端文件, 不是 block 卷时返回空字符串
+func stagedBackingFile(stagingPath string) string {
+	if stagingPath == "" {
+		return ""
+	}
+	backingFile, err := os.Readlink(filepath.Join(stagingPath, stagingBackingLink))
+	if err != nil {
+		return ""
+	}
+	return backingFile
+}
+
+// publishBlockVolume 把卷的块设备 bind mount 到 targetPath(一个普通文件)上
+func publishBlockVolume(mounter mount.Interface, backingFile, targetPath string, readOnly bool) error {
+	device, err := deviceFor(backingFile)
+	if err != nil {
+		return err
+	}
+
+	mounted, err := isMountPoint(mounter, targetPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0750); err != nil {
+		return fmt.Errorf("failed to create parent directory of %s: %v", targetPath, err)
+	}
+	// bind mount 设备需要目标是一个已存在的文件
+	f, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDONLY, 0660)
+	if err != nil {
+		return fmt.Errorf("failed to create target file %s: %v", targetPath, err)
+	}
+	f.Close()
+
+	var flags uintptr
+	if readOnly {
+		flags = unix.MS_RDONLY
+	}
+	return bindMount(mounter, device, targetPath, flags)
+}
+
+// blockDeviceSize 返回块设备(或文件)的大小
+func blockDeviceSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
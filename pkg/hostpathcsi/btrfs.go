@@ -0,0 +1,251 @@
+// Package hostpathcsi Description: 这个文件实现 btrfs 后端: 每个卷是一个 btrfs 子卷, 快照和克隆都是子卷快照,
+// 不需要复制数据, 耗时和卷的大小无关; 卷的容量由子卷的 qgroup 限制。卷目录和快照目录需要在同一个 btrfs 文件系统上。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// btrfsBackendName 是 btrfs 后端的名字
+const btrfsBackendName = "btrfs"
+
+func init() {
+	RegisterBackend(btrfsBackend{})
+}
+
+// btrfsBackend 把卷保存为 btrfs 子卷
+type btrfsBackend struct{}
+
+func (btrfsBackend) Name() string {
+	return btrfsBackendName
+}
+
+// CreateVolume 创建一个子卷, 并用 qgroup 限制它的容量
+func (b btrfsBackend) CreateVolume(ctx context.Context, volume *Volume) error {
+	if err := b.checkAccessType(*volume); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(volume.Path), 0755); err != nil {
+		return storageError(err, "failed to create volume directory")
+	}
+	if _, err := runBtrfs("subvolume", "create", volume.Path); err != nil {
+		return status.Errorf(codes.Internal, "failed to create subvolume for volume %s: %v", volume.ID, err)
+	}
+	if err := b.compress(ctx, volume); err != nil {
+		return err
+	}
+	return b.limit(*volume, volume.CapacityBytes)
+}
+
+// CloneVolume 对源卷做一个可写的子卷快照
+func (b btrfsBackend) CloneVolume(ctx context.Context, source Volume, volume *Volume) error {
+	if err := b.checkAccessType(*volume); err != nil {
+		return err
+	}
+	if err := b.snapshot(source.Path, volume.Path, false); err != nil {
+		return status.Errorf(codes.Internal, "failed to clone volume %s: %v", source.ID, err)
+	}
+	logFor(ctx).Infof("Cloned volume %s into %s", source.ID, volume.Path)
+	if err := b.compress(ctx, volume); err != nil {
+		return err
+	}
+	return b.limit(*volume, volume.CapacityBytes)
+}
+
+// DeleteVolume 删除卷的子卷
+func (b btrfsBackend) DeleteVolume(ctx context.Context, volume Volume) error {
+	if err := b.deleteSubvolume(volume.Path); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete subvolume of volume %s: %v", volume.ID, err)
+	}
+	return nil
+}
+
+// ExpandVolume 调大子卷的 qgroup 限制
+func (b btrfsBackend) ExpandVolume(ctx context.Context, volume Volume, capacity int64) error {
+	return b.limit(volume, capacity)
+}
+
+// NodeExpansionRequired 子卷没有需要在节点上扩展的文件系统
+func (btrfsBackend) NodeExpansionRequired(volume Volume) bool {
+	return false
+}
+
+// CreateSnapshot 在 snapshot.Path 对卷做一个只读的子卷快照
+func (b btrfsBackend) CreateSnapshot(ctx context.Context, volume Volume, snapshot *Snapshot) error {
+	if err := b.snapshot(volume.Path, snapshot.Path, true); err != nil {
+		return status.Errorf(codes.Internal, "failed to snapshot volume %s: %v", volume.ID, err)
+	}
+	snapshot.SizeBytes = btrfsUsage(snapshot.Path).used
+	return nil
+}
+
+// RestoreSnapshot 对只读快照再做一个可写的子卷快照作为新卷
+func (b btrfsBackend) RestoreSnapshot(ctx context.Context, snapshot Snapshot, volume *Volume) error {
+	if err := b.checkAccessType(*volume); err != nil {
+		return err
+	}
+	if err := b.snapshot(snapshot.Path, volume.Path, false); err != nil {
+		return status.Errorf(codes.Internal, "failed to restore snapshot %s: %v", snapshot.ID, err)
+	}
+	logFor(ctx).Infof("Restored snapshot %s into %s", snapshot.ID, volume.Path)
+	if err := b.compress(ctx, volume); err != nil {
+		return err
+	}
+	return b.limit(*volume, volume.CapacityBytes)
+}
+
+// DeleteSnapshot 删除快照的子卷
+func (b btrfsBackend) DeleteSnapshot(ctx context.Context, snapshot Snapshot) error {
+	if err := b.deleteSubvolume(snapshot.Path); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete snapshot %s: %v", snapshot.ID, err)
+	}
+	return nil
+}
+
+// Stats 已用量取子卷 qgroup 的引用量, 总量取 qgroup 的限制; 没有开启 quota 时退回文件系统的统计
+func (btrfsBackend) Stats(ctx context.Context, volumeID, path string) (VolumeStats, error) {
+	stats, err := statFS(path)
+	if err != nil {
+		return VolumeStats{}, status.Errorf(codes.Internal, "failed to get stats of volume %s: %v", volumeID, err)
+	}
+	result := VolumeStats{
+		TotalBytes:     stats.TotalBytes,
+		UsedBytes:      stats.UsedBytes,
+		AvailableBytes: stats.AvailableBytes,
+		TotalInodes:    stats.TotalInodes,
+		UsedInodes:     stats.UsedInodes,
+		FreeInodes:     stats.FreeInodes,
+	}
+	usage := btrfsUsage(path)
+	if usage.limit > 0 {
+		result.TotalBytes = usage.limit
+		result.UsedBytes = usage.used
+		if remaining := usage.limit - usage.used; remaining < result.AvailableBytes {
+			result.AvailableBytes = max(remaining, 0)
+		}
+	}
+	return result, nil
+}
+
+// checkAccessType 子卷只能作为文件系统卷使用
+func (btrfsBackend) checkAccessType(volume Volume) error {
+	if volume.AccessType == accessTypeBlock {
+		return status.Error(codes.InvalidArgument, "the btrfs backend does not support block volumes")
+	}
+	return nil
+}
+
+// snapshot 对子卷 source 做快照到 target, target 已经是子卷时认为是重试, 直接返回
+func (btrfsBackend) snapshot(source, target string, readOnly bool) error {
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	args := []string{"subvolume", "snapshot"}
+	if readOnly {
+		args = append(args, "-r")
+	}
+	_, err := runBtrfs(append(args, source, target)...)
+	return err
+}
+
+// deleteSubvolume 删除子卷, 子卷已经不存在时什么都不做
+func (btrfsBackend) deleteSubvolume(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	_, err := runBtrfs("subvolume", "delete", path)
+	return err
+}
+
+// limit 把子卷的 qgroup 限制为 capacity, capacity 为 0 时不限制; 文件系统还没有开启 quota 时先开启
+func (btrfsBackend) limit(volume Volume, capacity int64) error {
+	if capacity <= 0 {
+		return nil
+	}
+	if _, err := runBtrfs("qgroup", "limit", strconv.FormatInt(capacity, 10), volume.Path); err != nil {
+		if _, enableErr := runBtrfs("quota", "enable", volume.Path); enableErr != nil {
+			return status.Errorf(codes.Internal, "failed to enable quota for volume %s: %v", volume.ID, enableErr)
+		}
+		if _, err := runBtrfs("qgroup", "limit", strconv.FormatInt(capacity, 10), volume.Path); err != nil {
+			return status.Errorf(codes.Internal, "failed to limit capacity of volume %s: %v", volume.ID, err)
+		}
+	}
+	return nil
+}
+
+// compress 按 compression 参数设置子卷的压缩属性(只影响之后写入的数据), 并把实际生效的设置记录到卷上;
+// 没有设置参数时克隆和恢复出来的子卷沿用源子卷的属性
+func (btrfsBackend) compress(ctx context.Context, volume *Volume) error {
+	if compression := volume.Parameters[compressionParameter]; compression != "" {
+		value := compression
+		if compression == compressionOff {
+			value = "none"
+		}
+		if _, err := runBtrfs("property", "set", volume.Path, "compression", value); err != nil {
+			return status.Errorf(codes.Internal, "failed to set compression of volume %s: %v", volume.ID, err)
+		}
+	}
+	// 输出例如 compression=zstd, 没有设置压缩属性时没有输出
+	out, err := runBtrfs("property", "get", volume.Path, "compression")
+	if err != nil {
+		logFor(ctx).Warningf("Failed to get compression of volume %s: %v", volume.ID, err)
+		return nil
+	}
+	_, value, _ := strings.Cut(strings.TrimSpace(out), "=")
+	switch value {
+	case "none", "no":
+		volume.Compression = compressionOff
+	default:
+		volume.Compression = value
+	}
+	return nil
+}
+
+// btrfsQgroupUsage 是子卷 qgroup 的引用量和限制, limit 为 0 表示没有限制或者没有开启 quota
+type btrfsQgroupUsage struct {
+	used  int64
+	limit int64
+}
+
+// btrfsUsage 读取子卷 qgroup 的用量; 读取失败(例如没有开启 quota)时退回统计目录大小, 没有限制
+func btrfsUsage(path string) btrfsQgroupUsage {
+	// -f 只显示 path 所在子卷的 qgroup, 输出例如:
+	// qgroupid         rfer         excl     max_rfer     max_excl
+	// --------         ----         ----     --------     --------
+	// 0/257           16384        16384   1073741824         none
+	out, err := runBtrfs("qgroup", "show", "-r", "-e", "-f", "--raw", path)
+	if err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || !strings.HasPrefix(fields[0], "0/") {
+				continue
+			}
+			var usage btrfsQgroupUsage
+			usage.used, _ = strconv.ParseInt(fields[1], 10, 64)
+			usage.limit, _ = strconv.ParseInt(fields[3], 10, 64)
+			return usage
+		}
+	}
+	size, _ := dirSize(path)
+	return btrfsQgroupUsage{used: size}
+}
+
+// runBtrfs 执行一条 btrfs 命令, 返回它的输出
+func runBtrfs(args ...string) (string, error) {
+	out, err := exec.Command("btrfs", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("btrfs %s failed: %v, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
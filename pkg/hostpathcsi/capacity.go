@@ -0,0 +1,163 @@
+// Package hostpathcsi Description: 这个文件实现状态里记录的卷容量和磁盘上实际限制的容量不一致时的处理(--capacity-truth),
+// 例如手工扩大了镜像文件或者修改了 project quota。ControllerGetVolume 读取卷时比较两者: disk 用磁盘上的容量更新状态,
+// store 保留记录并报告卷异常; NodeGetVolumeStats 在 store 下同样报告卷异常, Node 从不修改状态, 由 Controller 更新。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"sync"
+)
+
+// CapacityTruth 决定容量不一致时以哪一边为准
+type CapacityTruth string
+
+const (
+	// CapacityTruthDisk 以磁盘上实际限制的容量为准, 更新状态里的记录
+	CapacityTruthDisk CapacityTruth = "disk"
+	// CapacityTruthStore 以状态里记录的容量为准, 报告卷异常
+	CapacityTruthStore CapacityTruth = "store"
+)
+
+// capacityTolerance 是不算作不一致的容量差别: project quota 按文件系统块取整, LVM 按 extent(默认 4MiB)取整
+const capacityTolerance = 4 << 20
+
+// ParseCapacityTruth 解析 --capacity-truth 的值, 为空时是 store
+func ParseCapacityTruth(value string) (CapacityTruth, error) {
+	switch truth := CapacityTruth(value); truth {
+	case "":
+		return CapacityTruthStore, nil
+	case CapacityTruthDisk, CapacityTruthStore:
+		return truth, nil
+	}
+	return "", fmt.Errorf("unknown capacity truth %q, must be %s or %s", value, CapacityTruthDisk, CapacityTruthStore)
+}
+
+// SetCapacityTruth 设置 ControllerGetVolume 发现容量不一致时以哪一边为准
+func (s *ControllerServer) SetCapacityTruth(truth CapacityTruth) {
+	s.capacityTruth = truth
+}
+
+// SetCapacityTruth 设置 NodeGetVolumeStats 发现容量不一致时是否报告卷异常
+func (s *NodeServer) SetCapacityTruth(truth CapacityTruth) {
+	s.capacityTruth = truth
+}
+
+// enforcedCapacity 返回磁盘上实际限制的卷容量: block 卷和镜像卷是后端文件的大小, LVM 卷是逻辑卷的大小,
+// 有 project quota 的目录卷是配额; 其他卷(没有配额的目录卷、内存卷、模板卷、btrfs 和 zfs 卷)没有可以比较的值, 返回 false
+func enforcedCapacity(volume Volume) (int64, bool) {
+	if isMemoryVolume(volume.Parameters) || isTemplateVolume(volume.Parameters) {
+		return 0, false
+	}
+	fi, err := os.Stat(volume.Path)
+	if err != nil {
+		return 0, false
+	}
+	switch {
+	case fi.Mode().IsRegular():
+		return fi.Size(), true
+	case fi.Mode()&os.ModeDevice != 0:
+		size, err := blockDeviceSize(volume.Path)
+		return size, err == nil
+	case fi.IsDir() && (volume.Backend == "" || volume.Backend == directoryBackendName) && hasProjectQuota(volume.Path):
+		stats, err := statFS(volume.Path)
+		return stats.TotalBytes, err == nil
+	}
+	return 0, false
+}
+
+// capacityMismatch 比较卷记录的容量和磁盘上实际限制的容量, 返回磁盘上的容量以及两者是否不一致; 没有记录容量的卷不比较
+func capacityMismatch(volume Volume) (int64, bool) {
+	if volume.CapacityBytes <= 0 {
+		return 0, false
+	}
+	disk, ok := enforcedCapacity(volume)
+	if !ok {
+		return 0, false
+	}
+	diff := disk - volume.CapacityBytes
+	if diff < 0 {
+		diff = -diff
+	}
+	return disk, diff >= capacityTolerance
+}
+
+// capacityCondition 返回容量不一致时的卷状态
+func capacityCondition(volume Volume, disk int64) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf("capacity of volume %s is recorded as %d bytes but %d bytes are enforced on disk", volume.ID, volume.CapacityBytes, disk),
+	}
+}
+
+// reconcileCapacity 在 ControllerGetVolume 读取卷时比较容量: disk 用磁盘上的容量更新状态并返回更新后的卷,
+// store 返回卷异常的状态; 容量一致时状态为空
+func (s *ControllerServer) reconcileCapacity(ctx context.Context, volume Volume) (Volume, *csi.VolumeCondition, error) {
+	disk, mismatch := capacityMismatch(volume)
+	if !mismatch {
+		return volume, nil, nil
+	}
+	if s.capacityTruth != CapacityTruthDisk {
+		return volume, capacityCondition(volume, disk), nil
+	}
+	logFor(ctx).Warningf("Capacity of volume %s is recorded as %d bytes but %d bytes are enforced on disk, updating the record", volume.ID, volume.CapacityBytes, disk)
+	volume.CapacityBytes = disk
+	if err := s.state.UpdateVolume(volume); err != nil {
+		return Volume{}, nil, status.Errorf(codes.Internal, "failed to record capacity of volume %s: %v", volume.ID, err)
+	}
+	return volume, nil, nil
+}
+
+// stateSnapshot 缓存 Node 读到的状态文件, 文件没有变化时不重新解析; kubelet 定期为每个卷调用 NodeGetVolumeStats,
+// 每次都解析整个状态文件在卷多的时候开销很大。状态文件总是通过重命名替换, 内容变化时文件(inode)和修改时间都会变
+type stateSnapshot struct {
+	mu   sync.Mutex
+	path string
+	// info 是解析时状态文件的信息, 为空表示还没有解析过
+	info  os.FileInfo
+	state *State
+}
+
+// get 返回状态文件当前内容的只读视图, 文件和上次解析时相同时直接返回缓存; 读不到文件时返回错误
+func (c *stateSnapshot) get() (*State, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.info != nil && os.SameFile(c.info, info) && c.info.ModTime().Equal(info.ModTime()) && c.info.Size() == info.Size() {
+		return c.state, nil
+	}
+	state, err := NewState(c.path)
+	if err != nil {
+		return nil, err
+	}
+	c.info, c.state = info, state
+	return state, nil
+}
+
+// statsCondition 返回 NodeGetVolumeStats 上报的卷状态: store 下读取状态文件里卷的记录, 容量不一致时报告卷异常;
+// 读不到状态文件(例如 Controller 在其他节点上)或者没有卷的记录时不比较
+func (s *NodeServer) statsCondition(volumeID string) *csi.VolumeCondition {
+	healthy := &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+	if s.capacityTruth == CapacityTruthDisk {
+		return healthy
+	}
+	state, err := s.stateSnapshot.get()
+	if err != nil {
+		return healthy
+	}
+	volume, ok := state.GetVolume(volumeID)
+	if !ok {
+		return healthy
+	}
+	if disk, mismatch := capacityMismatch(volume); mismatch {
+		return capacityCondition(volume, disk)
+	}
+	return healthy
+}
@@ -0,0 +1,140 @@
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createBackingFile 创建 size 字节的稀疏文件, 模拟 block 卷或镜像卷的后端文件
+func createBackingFile(t *testing.T, path string, size int64) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControllerGetVolumeCapacityTruth(t *testing.T) {
+	const recorded = 64 << 20
+	tests := []struct {
+		name         string
+		truth        CapacityTruth
+		diskBytes    int64
+		wantCapacity int64
+		wantAbnormal bool
+	}{
+		{name: "consistent", truth: CapacityTruthStore, diskBytes: recorded, wantCapacity: recorded},
+		{name: "within the tolerance", truth: CapacityTruthStore, diskBytes: recorded + 1<<20, wantCapacity: recorded},
+		{name: "disk", truth: CapacityTruthDisk, diskBytes: 128 << 20, wantCapacity: 128 << 20},
+		{name: "store", truth: CapacityTruthStore, diskBytes: 128 << 20, wantCapacity: recorded, wantAbnormal: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestControllerServer(t)
+			s.SetCapacityTruth(tt.truth)
+			path := s.config.VolumePath("pvc-1")
+			// block 卷的后端文件在驱动之外被扩大
+			createBackingFile(t, path, tt.diskBytes)
+			volume := Volume{ID: "pvc-1", Path: path, CapacityBytes: recorded, AccessType: accessTypeBlock, Backend: directoryBackendName}
+			if err := s.state.UpdateVolume(volume); err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := s.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pvc-1"})
+			if err != nil {
+				t.Fatalf("ControllerGetVolume: %v", err)
+			}
+			if got := resp.Volume.CapacityBytes; got != tt.wantCapacity {
+				t.Errorf("reported capacity = %d, want %d", got, tt.wantCapacity)
+			}
+			if got, _ := s.state.GetVolume("pvc-1"); got.CapacityBytes != tt.wantCapacity {
+				t.Errorf("recorded capacity = %d, want %d", got.CapacityBytes, tt.wantCapacity)
+			}
+			if got := resp.Status.VolumeCondition.Abnormal; got != tt.wantAbnormal {
+				t.Errorf("abnormal = %v, want %v: %s", got, tt.wantAbnormal, resp.Status.VolumeCondition.Message)
+			}
+		})
+	}
+}
+
+func TestNodeGetVolumeStatsCapacityTruth(t *testing.T) {
+	tests := []struct {
+		truth        CapacityTruth
+		wantAbnormal bool
+	}{
+		{truth: CapacityTruthDisk},
+		{truth: CapacityTruthStore, wantAbnormal: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.truth), func(t *testing.T) {
+			s := newTestNodeServer(t)
+			s.SetCapacityTruth(tt.truth)
+			path := s.config.VolumePath("pvc-1")
+			createBackingFile(t, path, 128<<20)
+			state, err := NewState(s.config.StatePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := state.UpdateVolume(Volume{ID: "pvc-1", Path: path, CapacityBytes: 64 << 20, AccessType: accessTypeBlock}); err != nil {
+				t.Fatal(err)
+			}
+
+			// block 卷的目标路径是设备文件, 这里直接用后端文件代替
+			resp, err := s.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc-1", VolumePath: path})
+			if err != nil {
+				t.Fatalf("NodeGetVolumeStats: %v", err)
+			}
+			if got := resp.Usage[0].Total; got != 128<<20 {
+				t.Errorf("total = %d, want the size on disk %d", got, 128<<20)
+			}
+			if got := resp.VolumeCondition.Abnormal; got != tt.wantAbnormal {
+				t.Errorf("abnormal = %v, want %v: %s", got, tt.wantAbnormal, resp.VolumeCondition.Message)
+			}
+		})
+	}
+}
+
+func TestStateSnapshot(t *testing.T) {
+	path := newTestConfig(t).StatePath()
+	c := &stateSnapshot{path: path}
+	if _, err := c.get(); err == nil {
+		t.Fatal("get() without a state file succeeded")
+	}
+
+	state, err := NewState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.UpdateVolume(Volume{ID: "pvc-1", CapacityBytes: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := c.get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if second, err := c.get(); err != nil || second != first {
+		t.Errorf("get() of an unchanged state file = %p, %v, want the cached %p", second, err, first)
+	}
+
+	// Controller 修改状态之后重新解析
+	if err := state.UpdateVolume(Volume{ID: "pvc-1", CapacityBytes: 2 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := c.get()
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if volume, _ := updated.GetVolume("pvc-1"); volume.CapacityBytes != 2<<20 {
+		t.Errorf("capacity after the update = %d, want %d", volume.CapacityBytes, 2<<20)
+	}
+}
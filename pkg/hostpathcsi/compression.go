@@ -0,0 +1,35 @@
+// Package hostpathcsi Description: 这个文件实现 btrfs 和 zfs 后端的按卷压缩: StorageClass 的 compression 参数在创建卷时设置到
+// 子卷或 dataset 的压缩属性上, 后端读回实际生效的设置记录到卷上, 通过 VolumeContext 的同名 key 返回。
+package hostpathcsi
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// compressionParameter 是 StorageClass 中选择压缩算法的参数, 也是 VolumeContext 中实际生效的压缩设置的 key
+	compressionParameter = "compression"
+	compressionZstd      = "zstd"
+	compressionLZ4       = "lz4"
+	compressionOff       = "off"
+)
+
+// checkCompression 检查 compression 参数: 只有 btrfs 和 zfs 后端支持按卷压缩, btrfs 没有 lz4
+func checkCompression(backend Backend, compression string) error {
+	switch compression {
+	case compressionZstd, compressionLZ4, compressionOff:
+	default:
+		return status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, must be %s, %s or %s", compressionParameter, compression, compressionZstd, compressionLZ4, compressionOff)
+	}
+	switch backend.Name() {
+	case zfsBackendName:
+	case btrfsBackendName:
+		if compression == compressionLZ4 {
+			return status.Errorf(codes.InvalidArgument, "the btrfs backend does not support %s compression", compressionLZ4)
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "the %s backend does not support the %s parameter", backend.Name(), compressionParameter)
+	}
+	return nil
+}
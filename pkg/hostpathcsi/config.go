@@ -0,0 +1,272 @@
+package hostpathcsi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultDataDir 是没有通过 --data-dir 或环境变量指定时存放卷的目录
+const DefaultDataDir = "/tmp/csi/hostpath/"
+
+// DefaultSnapshotDir 是没有通过 --snapshot-dir 指定时存放快照的目录
+const DefaultSnapshotDir = "/tmp/csi/snapshots/"
+
+// DefaultStateDir 是没有通过 --state-dir 指定时存放驱动元数据(状态文件、发布记录、领养记录、校验和清单)的目录
+const DefaultStateDir = "/tmp/csi/"
+
+// dataDirEnv 是指定存放卷目录的环境变量, 优先级低于 --data-dir
+const dataDirEnv = "HOSTPATH_DATA_DIR"
+
+// poolParameter 是 StorageClass 中选择存储池的参数, 不设置时卷放在 DataDir 下
+const poolParameter = "pool"
+
+// Config 是 ControllerServer 和 NodeServer 共用的配置, 在启动时确定并校验; 之后只有存储池可以在重新加载配置文件时增加
+type Config struct {
+	// DataDir 是存放卷的目录, 每个卷是其中以卷 ID 命名的目录或文件
+	DataDir string
+	// SnapshotDir 是存放快照(快照目录、子卷和导出的归档)的目录
+	SnapshotDir string
+	// StateDir 存放驱动自己的元数据: 状态文件、各节点的发布记录、领养记录、校验和清单和创建中的卷的标记;
+	// 它们都很小, 不占用卷的空间, Controller 和 Node 必须使用同一个目录
+	StateDir string
+	// ImportDir 是可以通过 importFrom 参数导入的本地归档所在的目录, 为空表示只能从 http/https 地址导入
+	ImportDir string
+	// TemplateDir 是可以通过 template 参数作为 overlayfs 模板的目录所在的目录, 为空表示不能创建模板卷
+	TemplateDir string
+	// StaticRoots 是静态卷的目录可以所在的目录(已经解析软链接), 为空表示不能使用静态卷
+	StaticRoots []string
+	// Pools 是命名的存储池(池名 -> 目录), 例如 ssd=/mnt/ssd, StorageClass 通过 pool 参数把卷放到对应的目录下;
+	// 重新加载时整个替换而不是原地修改, 启动之后要通过 PoolDirs 读取
+	Pools map[string]string
+
+	// mu 保护 Pools 的替换
+	mu sync.RWMutex
+}
+
+// NewConfig 按 flag > 环境变量 > 默认值 的优先级确定存放卷的目录, 解析 "name=/path,..." 格式的存储池, 并检查这些目录和快照目录都可以使用;
+// Controller 和 Node 必须使用同一个目录, 否则 Node 找不到 Controller 创建的卷
+func NewConfig(dataDirFlag, snapshotDirFlag, stateDirFlag, importDirFlag, templateDirFlag, staticRootsFlag, poolsFlag string) (*Config, error) {
+	dataDir := strings.TrimSpace(dataDirFlag)
+	if dataDir == "" {
+		dataDir = strings.TrimSpace(os.Getenv(dataDirEnv))
+	}
+	if dataDir == "" {
+		dataDir = DefaultDataDir
+	}
+	dataDir, err := checkDataDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotDir := strings.TrimSpace(snapshotDirFlag)
+	if snapshotDir == "" {
+		snapshotDir = DefaultSnapshotDir
+	}
+	if snapshotDir, err = checkDataDir(snapshotDir); err != nil {
+		return nil, fmt.Errorf("invalid snapshot directory: %v", err)
+	}
+
+	stateDir := strings.TrimSpace(stateDirFlag)
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+	if stateDir, err = checkDataDir(stateDir); err != nil {
+		return nil, fmt.Errorf("invalid state directory: %v", err)
+	}
+
+	config := &Config{DataDir: dataDir, SnapshotDir: snapshotDir, StateDir: stateDir}
+	if config.ImportDir, err = resolveSourceDir(importDirFlag, "import"); err != nil {
+		return nil, err
+	}
+	if config.TemplateDir, err = resolveSourceDir(templateDirFlag, "template"); err != nil {
+		return nil, err
+	}
+	for _, root := range strings.Split(staticRootsFlag, ",") {
+		root, err := resolveSourceDir(root, "static volume root")
+		if err != nil {
+			return nil, err
+		}
+		if root != "" {
+			config.StaticRoots = append(config.StaticRoots, root)
+		}
+	}
+	if config.Pools, err = config.parsePools(poolsFlag); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// parsePools 解析 "name=/path,..." 格式的存储池, 并检查池目录可以使用
+func (c *Config) parsePools(poolsFlag string) (map[string]string, error) {
+	pools := make(map[string]string)
+	// 同一个目录只能属于一个池, 否则两个池会重复计算同一份可用空间
+	owners := map[string]string{c.DataDir: "the data directory", c.SnapshotDir: "the snapshot directory", c.StateDir: "the state directory"}
+	for _, pair := range strings.Split(poolsFlag, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, dir, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || dir == "" {
+			return nil, fmt.Errorf("invalid pool %q, expected name=/path", pair)
+		}
+		if _, ok := pools[name]; ok {
+			return nil, fmt.Errorf("pool %s is defined more than once", name)
+		}
+		dir, err := checkDataDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool %s: %v", name, err)
+		}
+		if owner, ok := owners[dir]; ok {
+			return nil, fmt.Errorf("pool %s uses directory %s, which is already used by %s", name, dir, owner)
+		}
+		owners[dir] = "pool " + name
+		pools[name] = dir
+	}
+	return pools, nil
+}
+
+// UpdatePools 把存储池替换成 poolsFlag 里的池, 返回新增的池名; 已有的池不能删除或者换目录, 否则其中的卷就找不到了
+func (c *Config) UpdatePools(poolsFlag string) ([]string, error) {
+	pools, err := c.parsePools(poolsFlag)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, dir := range c.Pools {
+		switch newDir, ok := pools[name]; {
+		case !ok:
+			return nil, fmt.Errorf("pool %s can not be removed", name)
+		case newDir != dir:
+			return nil, fmt.Errorf("pool %s can not be moved from %s to %s", name, dir, newDir)
+		}
+	}
+	var added []string
+	for name := range pools {
+		if _, ok := c.Pools[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	c.Pools = pools
+	return added, nil
+}
+
+// PoolDirs 返回当前的存储池(池名 -> 目录), 调用方不能修改返回的 map
+func (c *Config) PoolDirs() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Pools
+}
+
+// checkDataDir 检查存放卷或快照的目录是一个可写的绝对路径, 不存在时创建, 返回清理后的路径
+func checkDataDir(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("directory %q must be an absolute path", dir)
+	}
+	dir = filepath.Clean(dir)
+	if dir == "/" {
+		return "", fmt.Errorf("directory must not be the root directory")
+	}
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := checkWritable(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// resolveSourceDir 检查只读取不写入的目录(导入目录、模板目录), 为空时返回空字符串;
+// 来源路径会解析软链接后再和它比较, 所以目录本身也要解析
+func resolveSourceDir(dir, kind string) (string, error) {
+	dir = strings.TrimSpace(dir)
+	if dir == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("%s directory %q must be an absolute path", kind, dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("%s directory %s is not accessible: %v", kind, dir, err)
+	}
+	return resolved, nil
+}
+
+// VolumePath 返回卷在 DataDir 下的默认路径
+func (c *Config) VolumePath(volumeID string) string {
+	return filepath.Join(c.DataDir, volumeID)
+}
+
+// SnapshotPath 返回快照在 SnapshotDir 下的默认路径
+func (c *Config) SnapshotPath(snapshotID string) string {
+	return filepath.Join(c.SnapshotDir, snapshotID)
+}
+
+// StatePath 返回状态文件的路径
+func (c *Config) StatePath() string {
+	return filepath.Join(c.StateDir, "state.json")
+}
+
+// publishedDir 返回存放每个节点的发布记录的目录, 文件名是节点 ID; 每个节点只写自己的文件, Controller 汇总读取
+func (c *Config) publishedDir() string {
+	return filepath.Join(c.StateDir, "published")
+}
+
+// ephemeralRecordDir 返回存放每个节点的 inline ephemeral 卷记录的目录, 文件名是节点 ID; 只有记录里的卷在最后一次卸载时删除临时目录
+func (c *Config) ephemeralRecordDir() string {
+	return filepath.Join(c.StateDir, "ephemeral")
+}
+
+// adoptedDir 返回存放 Node 写下的领养记录的目录, 每个卷一个文件, 文件名是卷 ID; Controller 查找卷时读取
+func (c *Config) adoptedDir() string {
+	return filepath.Join(c.StateDir, "adopted")
+}
+
+// scrubDir 返回存放每个卷的校验和清单的目录, 放在卷外面, pod 不能修改
+func (c *Config) scrubDir() string {
+	return filepath.Join(c.StateDir, "scrub")
+}
+
+// ioLimitsPath 返回节点写入 pod cgroup 的 IO 上限记录, 卸载卷时据此恢复 io.max
+func (c *Config) ioLimitsPath(nodeID string) string {
+	return filepath.Join(c.StateDir, "iolimits", nodeID+".json")
+}
+
+// pendingDir 返回存放创建中的卷的标记的目录, 每个卷一个空文件, 文件名是卷 ID; 回收只删除有标记而没有记录的卷的数据
+func (c *Config) pendingDir() string {
+	return filepath.Join(c.StateDir, "pending")
+}
+
+// ephemeralPath 返回临时卷的目录, 放在 DataDir 下的隐藏目录里, 和其他卷使用同一块磁盘
+func (c *Config) ephemeralPath(volumeID string) string {
+	return filepath.Join(c.DataDir, ephemeralDirName, volumeID)
+}
+
+// PoolDir 返回存储池的目录, 池名为空时是 DataDir
+func (c *Config) PoolDir(pool string) (string, error) {
+	if pool == "" {
+		return c.DataDir, nil
+	}
+	dir, ok := c.PoolDirs()[pool]
+	if !ok {
+		return "", fmt.Errorf("unknown pool %q", pool)
+	}
+	return dir, nil
+}
+
+// isPoolDir 判断 path 是否是某个存储池的目录, 池目录放在 DataDir 下时不能把它当成卷
+func (c *Config) isPoolDir(path string) bool {
+	for _, dir := range c.PoolDirs() {
+		if dir == path {
+			return true
+		}
+	}
+	return false
+}
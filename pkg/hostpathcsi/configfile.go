@@ -0,0 +1,111 @@
+// Package hostpathcsi Description: 这个文件实现 --config 指定的 YAML 配置文件: 文件里可以写存放卷的目录、存储池、上限和功能开关,
+// 命令行和 CSI_* 环境变量指定的 flag 优先于文件。驱动收到 SIGHUP 时重新读取文件, 存储池(只能增加)、存储池策略、每个节点的卷数量上限、
+// wipeOnDelete 和加固挂载立即生效, 其他配置需要重启才生效。
+package hostpathcsi
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileConfig 是配置文件的内容, 每个字段对应一个 flag, 没有写的字段使用 flag 的默认值
+type FileConfig struct {
+	DataDir     string `yaml:"dataDir"`
+	SnapshotDir string `yaml:"snapshotDir"`
+	StateDir    string `yaml:"stateDir"`
+	ImportDir   string `yaml:"importDir"`
+	TemplateDir string `yaml:"templateDir"`
+	// StaticVolumeRoots 对应 --static-volume-roots
+	StaticVolumeRoots []string `yaml:"staticVolumeRoots"`
+	// Pools 是存储池, 池名 -> 目录
+	Pools map[string]string `yaml:"pools"`
+	// PoolPolicy 和 PoolWeights 对应 --pool-policy 和 --pool-weights
+	PoolPolicy  string           `yaml:"poolPolicy"`
+	PoolWeights map[string]int64 `yaml:"poolWeights"`
+
+	// 下面的上限和开关用指针区分没有写和写了零值
+	MaxVolumesPerNode *int64   `yaml:"maxVolumesPerNode"`
+	MaxConnections    *int     `yaml:"maxConnections"`
+	UsageAlertRatio   *float64 `yaml:"usageAlertRatio"`
+	EnforceCapacity   *bool    `yaml:"enforceCapacity"`
+	AttachRequired    *bool    `yaml:"attachRequired"`
+	WipeOnDelete      *bool    `yaml:"wipeOnDelete"`
+	HardenedMounts    *bool    `yaml:"hardenedMounts"`
+	Noexec            *bool    `yaml:"noexec"`
+}
+
+// LoadConfigFile 读取并解析配置文件, 不认识的字段报错, 避免写错的字段名被悄悄忽略
+func LoadConfigFile(path string) (*FileConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	var config FileConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	// 空文件等同于没有写任何字段
+	if err := decoder.Decode(&config); err != nil && len(bytes.TrimSpace(raw)) > 0 {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return &config, nil
+}
+
+// FlagValues 把配置文件里写了的字段转换成对应 flag 的值(flag 名 -> 值), 由 main 用 flag.Set 设置到命令行没有指定的 flag 上
+func (c *FileConfig) FlagValues() map[string]string {
+	values := make(map[string]string)
+	for name, value := range map[string]string{
+		"data-dir":            c.DataDir,
+		"snapshot-dir":        c.SnapshotDir,
+		"state-dir":           c.StateDir,
+		"import-dir":          c.ImportDir,
+		"template-dir":        c.TemplateDir,
+		"static-volume-roots": strings.Join(c.StaticVolumeRoots, ","),
+		"pools":               joinPairs(c.Pools),
+		"pool-policy":         c.PoolPolicy,
+		"pool-weights":        joinPairs(c.PoolWeights),
+	} {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	if c.MaxVolumesPerNode != nil {
+		values["max-volumes-per-node"] = strconv.FormatInt(*c.MaxVolumesPerNode, 10)
+	}
+	if c.MaxConnections != nil {
+		values["max-connections"] = strconv.Itoa(*c.MaxConnections)
+	}
+	if c.UsageAlertRatio != nil {
+		values["usage-alert-ratio"] = strconv.FormatFloat(*c.UsageAlertRatio, 'g', -1, 64)
+	}
+	for name, value := range map[string]*bool{
+		"enforce-capacity": c.EnforceCapacity,
+		"attach-required":  c.AttachRequired,
+		"wipe-on-delete":   c.WipeOnDelete,
+		"hardened-mounts":  c.HardenedMounts,
+		"noexec":           c.Noexec,
+	} {
+		if value != nil {
+			values[name] = strconv.FormatBool(*value)
+		}
+	}
+	return values
+}
+
+// joinPairs 把 map 按 key 排序后拼成 "key=value,..." 格式, 和 --pools、--pool-weights 的格式一致
+func joinPairs[V any](m map[string]V) string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", key, m[key]))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -3,63 +3,1033 @@ package hostpathcsi
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	"k8s.io/klog"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// volumeContextPathKey 是 VolumeContext/PublishContext 中记录卷实际路径的 key,
+// Node 端优先使用这个路径, 而不是按约定重新拼接
+const volumeContextPathKey = "path"
+
+// supportedAccessModes 是节点本地卷支持的访问模式
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+}
+
+const (
+	// onDeleteParameter 是 StorageClass 中指定删除策略的参数
+	onDeleteParameter = "onDelete"
+	// onDeleteDelete 删除卷目录, 是默认的策略
+	onDeleteDelete = "delete"
+	// onDeleteArchive 把卷目录移动到卷所在目录下的 archiveDirName 里, 误删 PVC 后还能找回数据
+	onDeleteArchive = "archive"
+	// archiveDirName 是存放归档的卷的隐藏目录, 在卷所在的 DataDir 或存储池目录下, 重命名不会跨文件系统; 归档的目录名是 卷 ID-删除时间
+	archiveDirName = ".archive"
+)
+
+// mutableParameters 是可以通过 VolumeAttributesClass 修改的参数, 由使用这些参数的功能登记
+var mutableParameters = map[string]bool{}
+
 // ControllerServer 用于实现 ControllerService
 type ControllerServer struct {
-	// 继承默认的 ControllerServer
-	csi.ControllerServer
+	// 没有实现的 RPC 由它返回 codes.Unimplemented
+	csi.UnimplementedControllerServer
+
+	// config 是和 NodeServer 共用的配置, 决定卷存放在哪个目录
+	config *Config
+	// state 记录已创建卷的元数据(容量、参数等)
+	state *State
+	// nodeID 是 Controller 所在的节点, hostpath 卷只能在这个节点上访问
+	nodeID string
+	// mu 保证容量检查和卷的记录是原子的, 避免并发的 CreateVolume 一起超额分配
+	mu sync.Mutex
+	// attachRequired 为 true 时实现 ControllerPublishVolume/ControllerUnpublishVolume, 记录卷挂到了哪个节点
+	attachRequired bool
+	// wipeOnDelete 为 true 时 DeleteVolume 擦除所有可以擦除的卷, 不论 StorageClass 是否要求; 重新加载配置时可以修改
+	wipeOnDelete atomic.Bool
+	// poolPolicy 为没有指定 pool 参数的卷选择存储池, 为空时这些卷放在 DataDir 下; 由 mu 保护
+	poolPolicy PoolPolicy
+	// scrub 保存后台校验的结果, 没有启动后台校验时一直为空
+	scrub *scrubResults
+	// maxChainDepth 是增量快照链的最大深度, 超过时创建完整的快照, 0 表示不限制
+	maxChainDepth int
+	// maxSnapshots 是每个卷的快照数量上限, 0 表示不限制
+	maxSnapshots int
+	// snapshotMu 在限制了快照数量时保证数量检查和快照的记录是原子的, 避免并发的 CreateSnapshot 和 CreateVolumeGroupSnapshot 一起超过上限
+	snapshotMu sync.Mutex
+	// onMissing 是卷的数据不见时 ControllerGetVolume 的处理策略, 为空等同于 error
+	onMissing MissingBackingPolicy
+	// capacityTruth 决定 ControllerGetVolume 发现容量不一致时以哪一边为准, 为空等同于 store
+	capacityTruth CapacityTruth
+}
+
+// NewControllerServer 创建一个 ControllerServer
+func NewControllerServer(config *Config, state *State, nodeID string, attachRequired bool) *ControllerServer {
+	return &ControllerServer{config: config, state: state, nodeID: nodeID, attachRequired: attachRequired, scrub: newScrubResults()}
 }
 
 // CreateVolume 用于创建卷, 具体的创建"远程"真的数据卷出来
 func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	klog.Infof("Received CreateVolume request for %s", req.Name)
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	if err := validateMutableParameters(req.MutableParameters); err != nil {
+		return nil, err
+	}
 
-	// 模拟 HostPath 卷的创建
-	volumePath := "/tmp/csi/hostpath/" + req.Name
-	if err := os.MkdirAll(volumePath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create volume directory: %v", err)
+	accessType, err := accessTypeOf(req.VolumeCapabilities)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+	if accessType == accessTypeBlock && capacity <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "required bytes must be set for block volumes")
+	}
+	// 密钥只在本次请求中使用, 不随卷一起记录
+	if err := checkSecrets(provisionerSecrets, req.Parameters, req.Secrets); err != nil {
+		return nil, err
+	}
+	if len(req.Secrets) > 0 {
+		logFor(ctx).Infof("CreateVolume request for %s carries secrets %v", req.Name, Secrets(req.Secrets))
+	}
+	switch req.Parameters[preallocateParameter] {
+	case "", "true", "false":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, must be true or false", preallocateParameter, req.Parameters[preallocateParameter])
+	}
+	if o, err := parseOwnership(req.Parameters); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	} else if !o.isZero() && accessType == accessTypeBlock {
+		return nil, status.Errorf(codes.InvalidArgument, "the %s, %s and %s parameters only apply to filesystem volumes", ownerUIDParameter, ownerGIDParameter, dirModeParameter)
+	}
+	switch req.Parameters[onDeleteParameter] {
+	case "", onDeleteDelete, onDeleteArchive:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, must be %s or %s", onDeleteParameter, req.Parameters[onDeleteParameter], onDeleteDelete, onDeleteArchive)
+	}
+	backend, err := lookupBackend(req.Parameters[backendParameter])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.checkParameterCombinations(req, accessType, backend.Name()); err != nil {
+		return nil, err
+	}
+	if isMemoryVolume(req.Parameters) {
+		if err := checkMemoryVolume(req, backend); err != nil {
+			return nil, err
+		}
+	}
+	switch req.Parameters[discardParameter] {
+	case "", "false":
+	case "true":
+		if !filesystemBackends[backend.Name()] || accessType == accessTypeBlock {
+			return nil, status.Errorf(codes.InvalidArgument, "the %s parameter only applies to filesystem volumes on the image and lvm backends", discardParameter)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, must be true or false", discardParameter, req.Parameters[discardParameter])
+	}
+	switch req.Parameters[encryptedParameter] {
+	case "", "false":
+	case "true":
+		if err := checkEncryptedVolume(accessType, backend); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, must be true or false", encryptedParameter, req.Parameters[encryptedParameter])
+	}
+	// 镜像卷和 LVM 卷第一次 stage 时按 fsType(StorageClass 的 csi.storage.k8s.io/fstype)格式化, 不支持的类型在创建时就拒绝
+	if filesystemBackends[backend.Name()] {
+		if err := checkFsTypes(req.VolumeCapabilities); err != nil {
+			return nil, err
+		}
+	}
+	if compression := req.Parameters[compressionParameter]; compression != "" {
+		if err := checkCompression(backend, compression); err != nil {
+			return nil, err
+		}
+	}
+	if idMap := req.Parameters[idMapParameter]; idMap != "" {
+		if accessType == accessTypeBlock {
+			return nil, status.Errorf(codes.InvalidArgument, "the %s parameter does not apply to block volumes", idMapParameter)
+		}
+		if err := checkIDMap(idMap); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	switch req.Parameters[integrityParameter] {
+	case "", "false":
+	case "true":
+		if err := checkIntegrityVolume(req.Parameters, accessType, backend); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, must be true or false", integrityParameter, req.Parameters[integrityParameter])
+	}
+	switch req.Parameters[wipeOnDeleteParameter] {
+	case "", "false":
+	case "true":
+		if err := canWipe(Volume{Backend: backend.Name(), Parameters: req.Parameters}); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "the %s parameter can not be used: %v", wipeOnDeleteParameter, err)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, must be true or false", wipeOnDeleteParameter, req.Parameters[wipeOnDeleteParameter])
+	}
+	switch req.Parameters[immutableParameter] {
+	case "", "false":
+	case "true":
+		if err := checkImmutableVolume(req); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q, must be true or false", immutableParameter, req.Parameters[immutableParameter])
+	}
+	if mode := req.Parameters[podSubdirParameter]; mode != "" {
+		if err := checkPodSubdir(mode, accessType); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if isTemplateVolume(req.Parameters) {
+		if err := s.checkTemplateVolume(req, accessType, backend); err != nil {
+			return nil, err
+		}
+	}
+	if source := req.Parameters[importParameter]; source != "" {
+		if err := s.checkImport(req, accessType, source); err != nil {
+			return nil, err
+		}
+	}
+	pool := req.Parameters[poolParameter]
+	poolDir, err := s.config.PoolDir(pool)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	nodeID, err := chooseNode(req.AccessibilityRequirements, s.nodeID)
+	if err != nil {
+		return nil, err
 	}
 
-	return &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			VolumeId:      req.Name,
-			CapacityBytes: req.CapacityRange.RequiredBytes,
-			VolumeContext: req.Parameters,
-		},
-	}, nil
+	// VolumeAttributesClass 里的可变参数和 StorageClass 参数一样记录下来
+	parameters := make(map[string]string, len(req.Parameters)+len(req.MutableParameters))
+	for k, v := range req.Parameters {
+		parameters[k] = v
+	}
+	for k, v := range req.MutableParameters {
+		parameters[k] = v
+	}
+	if hasIOLimitParameters(parameters) {
+		if err := checkIOLimits(parameters, accessType, backend); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	volume := Volume{
+		ID:               req.Name,
+		Path:             filepath.Join(poolDir, req.Name),
+		CapacityBytes:    capacity,
+		Parameters:       parameters,
+		AccessType:       accessType,
+		SourceVolumeID:   req.GetVolumeContentSource().GetVolume().GetVolumeId(),
+		SourceSnapshotID: req.GetVolumeContentSource().GetSnapshot().GetSnapshotId(),
+		NodeID:           nodeID,
+		Backend:          backend.Name(),
+		Pool:             pool,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 幂等: 同名卷已经存在时, 请求兼容则直接返回已有的卷, 否则返回 ALREADY_EXISTS
+	if existing, ok := s.state.GetVolume(req.Name); ok {
+		if err := checkVolumeCompatible(existing, volume, req.CapacityRange); err != nil {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with different attributes: %v", req.Name, err)
+		}
+		logFor(ctx).Infof("Volume %s already exists, returning it", req.Name)
+		return &csi.CreateVolumeResponse{Volume: csiVolume(existing)}, nil
+	}
+
+	// 策略要比较各个池扣除已有卷之后的容量, 所以在锁里选择
+	if s.usesPoolPolicy(req.Parameters, backend) {
+		if pool, err = s.choosePool(capacity); err != nil {
+			return nil, err
+		}
+		poolDir = s.config.PoolDirs()[pool]
+		volume.Pool, volume.Path = pool, filepath.Join(poolDir, req.Name)
+		logFor(ctx).Infof("Pool policy %s placed volume %s in pool %s", s.poolPolicy.Name(), req.Name, pool)
+	}
+
+	// 容量不足时拒绝创建, 而不是悄悄地超额分配; 内存卷不占用磁盘
+	if capacity > 0 && !isMemoryVolume(parameters) {
+		available, err := s.availableCapacity(pool)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get capacity: %v", err)
+		}
+		if capacity > available {
+			return nil, status.Errorf(codes.ResourceExhausted, "requested %d bytes but only %d bytes are available", capacity, available)
+		}
+	}
+
+	// 数据记录到状态之前崩溃或失败时, 回收根据这个标记删除留下的数据
+	if err := s.markPending(req.Name); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mark volume %s as being created: %v", req.Name, err)
+	}
+	if err := s.populateVolume(ctx, backend, &volume, req.VolumeContentSource); err != nil {
+		return nil, err
+	}
+	if root := ownershipRoot(volume); root != "" {
+		if err := applyVolumeOwnership(root, volume.Parameters); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to apply ownership to volume %s: %v", req.Name, err)
+		}
+	}
+
+	if err := s.state.UpdateVolume(volume); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record volume %s: %v", req.Name, err)
+	}
+	if err := s.clearPending(req.Name); err != nil {
+		logFor(ctx).Warningf("Failed to remove creation marker of volume %s: %v", req.Name, err)
+	}
+
+	return &csi.CreateVolumeResponse{Volume: csiVolume(volume)}, nil
+}
+
+// checkMemoryVolume 检查内存卷的请求: 内存卷只能是有容量的文件系统卷, 没有数据源, 并且使用目录后端(卷目录只是一个占位)
+func checkMemoryVolume(req *csi.CreateVolumeRequest, backend Backend) error {
+	switch {
+	case req.GetCapacityRange().GetRequiredBytes() <= 0:
+		return status.Error(codes.InvalidArgument, "required bytes must be set for memory volumes")
+	case req.VolumeContentSource != nil:
+		return status.Error(codes.InvalidArgument, "memory volumes can not be created from a volume or snapshot")
+	case backend.Name() != directoryBackendName:
+		return status.Errorf(codes.InvalidArgument, "memory volumes can not use the %s backend", backend.Name())
+	}
+	for _, capability := range req.VolumeCapabilities {
+		if capability.GetBlock() != nil {
+			return status.Error(codes.InvalidArgument, "memory volumes can not be block volumes")
+		}
+	}
+	return nil
+}
+
+// checkEncryptedVolume 检查加密卷的请求: 加密卷只能是 image 或 lvm 后端上的文件系统卷, LUKS 头在第一次 NodeStageVolume 时才写入
+func checkEncryptedVolume(accessType string, backend Backend) error {
+	switch {
+	case !filesystemBackends[backend.Name()]:
+		return status.Errorf(codes.InvalidArgument, "encrypted volumes can not use the %s backend", backend.Name())
+	case accessType == accessTypeBlock:
+		return status.Error(codes.InvalidArgument, "encrypted volumes can not be block volumes")
+	}
+	return nil
+}
+
+// checkFsTypes 检查请求的文件系统类型都可以格式化, 没有指定时使用 defaultFsType
+func checkFsTypes(capabilities []*csi.VolumeCapability) error {
+	for _, capability := range capabilities {
+		fsType := capability.GetMount().GetFsType()
+		if fsType == "" {
+			continue
+		}
+		if !supportedFsTypes[fsType] {
+			supported := make([]string, 0, len(supportedFsTypes))
+			for t := range supportedFsTypes {
+				supported = append(supported, t)
+			}
+			sort.Strings(supported)
+			return status.Errorf(codes.InvalidArgument, "fsType %s is not supported, supported types are %v", fsType, supported)
+		}
+	}
+	return nil
+}
+
+// checkImport 检查导入归档的请求: 只能导入到没有其他数据源的文件系统卷, 本地文件必须在 --import-dir 下
+func (s *ControllerServer) checkImport(req *csi.CreateVolumeRequest, accessType, source string) error {
+	switch {
+	case req.VolumeContentSource != nil:
+		return status.Error(codes.InvalidArgument, "volumes imported from an archive can not also be created from a volume or snapshot")
+	case accessType == accessTypeBlock:
+		return status.Error(codes.InvalidArgument, "archives can only be imported into filesystem volumes")
+	case isMemoryVolume(req.Parameters):
+		return status.Error(codes.InvalidArgument, "archives can not be imported into memory volumes")
+	}
+	if _, err := s.config.checkImportSource(source); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// checkVolumeCompatible 检查同名卷的重试请求是否和已有的卷一致: 容量满足请求的范围, 参数、访问类型和数据源相同
+func checkVolumeCompatible(existing, requested Volume, capacityRange *csi.CapacityRange) error {
+	if required := capacityRange.GetRequiredBytes(); required > existing.CapacityBytes {
+		return fmt.Errorf("existing capacity %d is smaller than required bytes %d", existing.CapacityBytes, required)
+	}
+	if limit := capacityRange.GetLimitBytes(); limit > 0 && existing.CapacityBytes > limit {
+		return fmt.Errorf("existing capacity %d exceeds limit bytes %d", existing.CapacityBytes, limit)
+	}
+	if !maps.Equal(existing.Parameters, requested.Parameters) {
+		return fmt.Errorf("parameters differ")
+	}
+	existingType := existing.AccessType
+	if existingType == "" {
+		existingType = accessTypeMount
+	}
+	if existingType != requested.AccessType {
+		return fmt.Errorf("existing access type is %s", existingType)
+	}
+	if existing.SourceVolumeID != requested.SourceVolumeID || existing.SourceSnapshotID != requested.SourceSnapshotID {
+		return fmt.Errorf("content source differs")
+	}
+	if existing.NodeID != "" && existing.NodeID != requested.NodeID {
+		return fmt.Errorf("existing volume is on node %s", existing.NodeID)
+	}
+	return nil
+}
+
+// csiVolume 把卷的元数据转换成 CSI 的 Volume
+// 卷路径放到 VolumeContext 里, 这样 Node 端不用关心 Controller 的目录布局
+func csiVolume(v Volume) *csi.Volume {
+	volumeContext := make(map[string]string, len(v.Parameters)+1)
+	for k, val := range v.Parameters {
+		volumeContext[k] = val
+	}
+	volumeContext[volumeContextPathKey] = v.Path
+	// Node 端按后端统计卷的使用情况
+	if v.Backend != "" {
+		volumeContext[backendParameter] = v.Backend
+	}
+	if v.Pool != "" {
+		volumeContext[poolParameter] = v.Pool
+	}
+	// 返回实际生效的压缩设置, 而不是 StorageClass 里请求的值(例如 zfs 从父 dataset 继承的设置)
+	if v.Compression != "" {
+		volumeContext[compressionParameter] = v.Compression
+	}
+	// 内存卷在 Node 端按容量挂载 tmpfs
+	if isMemoryVolume(v.Parameters) {
+		volumeContext[volumeContextSizeKey] = strconv.FormatInt(v.CapacityBytes, 10)
+	}
+
+	var contentSource *csi.VolumeContentSource
+	switch {
+	case v.SourceVolumeID != "":
+		contentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: v.SourceVolumeID},
+			},
+		}
+	case v.SourceSnapshotID != "":
+		contentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: v.SourceSnapshotID},
+			},
+		}
+	}
+
+	// PV 的 nodeAffinity 由 AccessibleTopology 生成, 保证使用卷的 pod 调度到卷所在的节点
+	var accessibleTopology []*csi.Topology
+	if v.NodeID != "" {
+		accessibleTopology = []*csi.Topology{nodeTopology(v.NodeID, nil)}
+	}
+
+	return &csi.Volume{
+		VolumeId:           v.ID,
+		CapacityBytes:      v.CapacityBytes,
+		VolumeContext:      volumeContext,
+		ContentSource:      contentSource,
+		AccessibleTopology: accessibleTopology,
+	}
+}
+
+// reportedVolume 是 ListVolumes/ControllerGetVolume 返回的卷: 后端是文件(block 卷和镜像卷)时,
+// VolumeContext 里再加上文件实际占用的磁盘字节数, 和逻辑大小 capacity_bytes 对比可以看出稀疏文件真正用了多少磁盘;
+// CreateVolume 返回的 VolumeContext 会固化到 PV 里, 所以不带这个随时变化的值
+func reportedVolume(v Volume) *csi.Volume {
+	volume := csiVolume(v)
+	if fi, err := os.Stat(v.Path); err == nil && fi.Mode().IsRegular() {
+		if allocated, err := allocatedBytes(v.Path); err == nil {
+			volume.VolumeContext[volumeContextAllocatedKey] = strconv.FormatInt(allocated, 10)
+		}
+	}
+	return volume
+}
+
+// populateVolume 由后端创建卷, 有 VolumeContentSource 时从源卷克隆或者从快照恢复
+func (s *ControllerServer) populateVolume(ctx context.Context, backend Backend, volume *Volume, source *csi.VolumeContentSource) error {
+	if source == nil {
+		if from := volume.Parameters[importParameter]; from != "" {
+			open := func() (io.ReadCloser, error) { return s.config.openImportSource(from) }
+			if err := traceOperation(ctx, "volume.import", func(ctx context.Context) error {
+				return populateFromArchive(ctx, backend, volume, open, false)
+			}, attribute.String("csi.volume_id", volume.ID)); err != nil {
+				return err
+			}
+			logFor(ctx).Infof("Imported %s into volume %s", from, volume.ID)
+			return nil
+		}
+		if err := backend.CreateVolume(ctx, volume); err != nil {
+			return err
+		}
+		// 模板卷的数据来自模板目录, 卷目录只保存 overlayfs 的改动
+		if isTemplateVolume(volume.Parameters) {
+			if err := createOverlayDirs(volume.Path); err != nil {
+				backend.DeleteVolume(ctx, *volume)
+				return storageError(err, "failed to create overlay directories of volume %s", volume.ID)
+			}
+		}
+		return nil
+	}
+
+	if src := source.GetVolume(); src != nil {
+		sourceVolume, ok := s.lookupVolume(src.VolumeId)
+		if !ok {
+			return status.Errorf(codes.NotFound, "source volume %s not found", src.VolumeId)
+		}
+		if err := checkSameBackend(backend, sourceVolume.Backend); err != nil {
+			return status.Errorf(codes.InvalidArgument, "can not clone volume %s: %v", src.VolumeId, err)
+		}
+		return backend.CloneVolume(ctx, sourceVolume, volume)
+	}
+
+	if src := source.GetSnapshot(); src != nil {
+		snap, ok := s.state.GetSnapshot(src.SnapshotId)
+		if !ok {
+			return status.Errorf(codes.NotFound, "source snapshot %s not found", src.SnapshotId)
+		}
+		// 请求的容量不能小于快照大小
+		if volume.CapacityBytes > 0 && snap.SizeBytes > volume.CapacityBytes {
+			return status.Errorf(codes.OutOfRange, "snapshot %s size %d exceeds requested capacity %d", src.SnapshotId, snap.SizeBytes, volume.CapacityBytes)
+		}
+		// 归档不依赖后端, 可以恢复到其他后端上
+		if isArchiveFormat(snap.Format) {
+			return restoreArchive(ctx, backend, snap, volume)
+		}
+		if err := checkSameBackend(backend, snap.Backend); err != nil {
+			return status.Errorf(codes.InvalidArgument, "can not restore snapshot %s: %v", src.SnapshotId, err)
+		}
+		return backend.RestoreSnapshot(ctx, snap, volume)
+	}
+
+	return status.Errorf(codes.InvalidArgument, "unsupported volume content source %v", source)
+}
+
+// checkSameBackend 检查数据源和新卷在同一个后端上, 后端之间不能直接复制数据
+func checkSameBackend(backend Backend, sourceBackend string) error {
+	if sourceBackend == "" {
+		sourceBackend = directoryBackendName
+	}
+	if sourceBackend != backend.Name() {
+		return fmt.Errorf("source is on backend %s but the new volume is on backend %s", sourceBackend, backend.Name())
+	}
+	return nil
+}
+
+// volumePath 返回卷的目录: 优先使用状态记录里的路径, 没有记录时按默认布局拼接
+func (s *ControllerServer) volumePath(volumeID string) string {
+	if volume, ok := s.state.GetVolume(volumeID); ok {
+		return volume.Path
+	}
+	return s.config.VolumePath(volumeID)
+}
+
+// lookupVolume 返回卷的元数据; 没有记录时先查找 Node 写下的领养记录并登记, 引入状态记录之前创建的卷没有记录, 只要目录还在就认为存在;
+// DataDir 下的隐藏目录(归档、临时卷)不是卷
+func (s *ControllerServer) lookupVolume(volumeID string) (Volume, bool) {
+	if volume, ok := s.state.GetVolume(volumeID); ok {
+		return volume, true
+	}
+	if volume, ok := s.registerAdoptedVolume(volumeID); ok {
+		return volume, true
+	}
+	if strings.HasPrefix(volumeID, ".") {
+		return Volume{}, false
+	}
+	volume := Volume{ID: volumeID, Path: s.config.VolumePath(volumeID)}
+	if _, err := os.Stat(volume.Path); os.IsNotExist(err) {
+		return Volume{}, false
+	}
+	return volume, true
 }
 
 // DeleteVolume 用于删除卷, 具体的删除"远程"真的数据卷
 func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	klog.Infof("Received DeleteVolume request for %s", req.VolumeId)
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
 
-	volumePath := "/tmp/csi/hostpath/" + req.VolumeId
-	if err := os.RemoveAll(volumePath); err != nil {
-		return nil, fmt.Errorf("failed to delete volume directory: %v", err)
+	volume, exists := s.lookupVolume(req.VolumeId)
+	if err := checkSecrets(provisionerSecrets, volume.Parameters, req.Secrets); err != nil {
+		return nil, err
+	}
+	// 还挂在节点上的卷不能删除, 否则节点上会留下指向已删除数据的挂载
+	if len(volume.AttachedNodes) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still attached to nodes %v", req.VolumeId, volume.AttachedNodes)
+	}
+	switch {
+	case volume.Static:
+		// 领养的目录不归驱动所有, 和 Retain 一样保留数据
+		logFor(ctx).Infof("Volume %s is a static volume, keeping its data at %s", req.VolumeId, volume.Path)
+		if err := s.removeAdoption(req.VolumeId); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to forget adoption of volume %s: %v", req.VolumeId, err)
+		}
+	case exists:
+		if s.wipeOnDelete.Load() || shouldWipe(volume.Parameters) {
+			if err := canWipe(volume); err != nil {
+				logFor(ctx).Warningf("Not wiping volume %s: %v", req.VolumeId, err)
+			} else if err := traceOperation(ctx, "volume.wipe", func(context.Context) error {
+				return wipeVolume(volume)
+			}, attribute.String("csi.volume_id", volume.ID)); errors.Is(err, errSharedData) {
+				return nil, status.Errorf(codes.FailedPrecondition, "can not wipe volume %s: %v", req.VolumeId, err)
+			} else if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to wipe volume %s: %v", req.VolumeId, err)
+			} else {
+				logFor(ctx).Infof("Wiped the data of volume %s", req.VolumeId)
+			}
+		}
+		if err := deleteVolumeData(ctx, volume); err != nil {
+			return nil, err
+		}
+		removePreviousPaths(volume)
+	}
+	if err := s.state.DeleteVolume(req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to forget volume %s: %v", req.VolumeId, err)
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-// ControllerPublishVolume 用于发布卷, 这个是Attach阶段的功能
-func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	// 在 HostPath 场景中，通常不需要 Controller 发布卷，因为它是本地存储
-	return nil, fmt.Errorf("ControllerPublishVolume is not supported")
+// deleteVolumeData 按卷的删除策略归档或者由后端删除卷的数据
+func deleteVolumeData(ctx context.Context, volume Volume) error {
+	if volume.Parameters[onDeleteParameter] == onDeleteArchive {
+		return traceOperation(ctx, "volume.archive", func(ctx context.Context) error {
+			return archiveVolume(ctx, volume.ID, volume.Path)
+		}, attribute.String("csi.volume_id", volume.ID))
+	}
+	backend, err := backendOf(volume.Backend)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to delete volume %s: %v", volume.ID, err)
+	}
+	return backend.DeleteVolume(ctx, volume)
+}
+
+// archiveVolume 把卷目录(或 block 卷的后端文件)重命名到归档目录, 卷已经不存在时什么都不做
+func archiveVolume(ctx context.Context, volumeID, volumePath string) error {
+	if _, err := os.Lstat(volumePath); os.IsNotExist(err) {
+		return nil
+	}
+	archiveDir := filepath.Join(filepath.Dir(volumePath), archiveDirName)
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		return status.Errorf(codes.Internal, "failed to create archive directory: %v", err)
+	}
+	archivePath := filepath.Join(archiveDir, volumeID+"-"+time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.Rename(volumePath, archivePath); err != nil {
+		return status.Errorf(codes.Internal, "failed to archive volume %s: %v", volumeID, err)
+	}
+	logFor(ctx).Infof("Volume %s archived to %s", volumeID, archivePath)
+	return nil
+}
+
+// ControllerExpandVolume 用于扩容卷, 更新记录的容量; 目录卷在节点上不需要额外操作, block 卷需要节点刷新 loop 设备
+func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	newCapacity := req.CapacityRange.RequiredBytes
+	if newCapacity == 0 {
+		newCapacity = req.CapacityRange.LimitBytes
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 引入状态记录之前创建的卷在扩容后会补上一条记录
+	volume, ok := s.lookupVolume(req.VolumeId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", req.VolumeId)
+	}
+	// 领养的目录没有驱动设置的容量限制, 不能在上面设置 project quota
+	if volume.Static {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is a static volume and can not be expanded", req.VolumeId)
+	}
+	backend, err := backendOf(volume.Backend)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to expand volume %s: %v", req.VolumeId, err)
+	}
+
+	// 缩容不支持, 请求的容量不大于当前容量时直接返回当前容量(幂等)
+	if newCapacity > volume.CapacityBytes {
+		available, err := s.availableCapacity(volume.Pool)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get capacity: %v", err)
+		}
+		if newCapacity-volume.CapacityBytes > available && !isMemoryVolume(volume.Parameters) {
+			return nil, status.Errorf(codes.ResourceExhausted, "expanding volume %s by %d bytes exceeds the available %d bytes", req.VolumeId, newCapacity-volume.CapacityBytes, available)
+		}
+		if err := backend.ExpandVolume(ctx, volume, newCapacity); err != nil {
+			return nil, err
+		}
+		volume.CapacityBytes = newCapacity
+		if err := s.state.UpdateVolume(volume); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record capacity of volume %s: %v", req.VolumeId, err)
+		}
+	}
+
+	// block 卷和镜像卷扩大文件后还需要节点刷新 loop 设备的大小
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         volume.CapacityBytes,
+		NodeExpansionRequired: backend.NodeExpansionRequired(volume),
+	}, nil
+}
+
+// ValidateVolumeCapabilities 检查卷是否支持请求的访问模式和访问类型
+func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(s.volumePath(req.VolumeId)); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", req.VolumeId)
+	}
+
+	// 不支持时不返回 Confirmed, 只返回原因
+	if err := validateVolumeCapabilities(req.VolumeCapabilities); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	recorded := accessTypeMount
+	if volume, ok := s.state.GetVolume(req.VolumeId); ok && volume.AccessType != "" {
+		recorded = volume.AccessType
+	}
+	if accessType, err := accessTypeOf(req.VolumeCapabilities); err != nil || accessType != recorded {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: fmt.Sprintf("volume %s only supports %s access type", req.VolumeId, recorded)}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		},
+	}, nil
 }
 
-// ControllerUnpublishVolume 用于取消发布卷, 这个是Detach阶段的功能
-func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, fmt.Errorf("ControllerUnpublishVolume is not supported")
+// validateVolumeCapabilities 检查每个 VolumeCapability 的访问类型和访问模式是否被支持
+func validateVolumeCapabilities(capabilities []*csi.VolumeCapability) error {
+	for _, capability := range capabilities {
+		if capability == nil {
+			return fmt.Errorf("volume capability must not be empty")
+		}
+		if capability.GetMount() == nil && capability.GetBlock() == nil {
+			return fmt.Errorf("access type must be mount or block")
+		}
+		if capability.GetAccessMode() == nil {
+			return fmt.Errorf("access mode is required")
+		}
+		if mode := capability.GetAccessMode().GetMode(); !supportedAccessModes[mode] {
+			return fmt.Errorf("access mode %s is not supported", mode)
+		}
+	}
+	return nil
+}
+
+// accessTypeOf 根据 VolumeCapabilities 判断要创建 mount 卷还是 block 卷, 两种都请求时返回错误
+func accessTypeOf(capabilities []*csi.VolumeCapability) (string, error) {
+	accessType := ""
+	for _, capability := range capabilities {
+		t := accessTypeMount
+		if capability.GetBlock() != nil {
+			t = accessTypeBlock
+		}
+		if accessType != "" && accessType != t {
+			return "", fmt.Errorf("volume capabilities request both mount and block access types")
+		}
+		accessType = t
+	}
+	if accessType == "" {
+		accessType = accessTypeMount
+	}
+	return accessType, nil
+}
+
+// ListVolumes 列出所有卷, 包括状态记录里的卷和引入状态记录之前创建的卷目录, 支持分页
+func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	volumes := s.state.ListVolumes()
+	known := make(map[string]bool, len(volumes))
+	for _, v := range volumes {
+		known[v.ID] = true
+	}
+	entries, err := os.ReadDir(s.config.DataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "failed to read volume directory: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !known[entry.Name()] && !strings.HasPrefix(entry.Name(), ".") && !s.config.isPoolDir(s.config.VolumePath(entry.Name())) {
+			volumes = append(volumes, Volume{ID: entry.Name(), Path: s.config.VolumePath(entry.Name())})
+		}
+	}
+	// 保证分页时顺序稳定
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+
+	start, end, nextToken, err := paginate(len(volumes), req.StartingToken, req.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	// 各节点的发布记录, 用于填充 VolumeStatus.PublishedNodeIds
+	publishedNodes, err := listPublishedNodes(s.config.publishedDir())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load publish records: %v", err)
+	}
+
+	result := make([]*csi.ListVolumesResponse_Entry, 0, end-start)
+	for _, v := range volumes[start:end] {
+		result = append(result, &csi.ListVolumesResponse_Entry{
+			Volume: reportedVolume(v),
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodes[v.ID],
+			},
+		})
+	}
+
+	return &csi.ListVolumesResponse{Entries: result, NextToken: nextToken}, nil
+}
+
+// GetCapacity 通过 statfs 返回卷目录所在文件系统的可用容量; 请求的拓扑不包含本节点时返回 0
+func (s *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if topology := req.GetAccessibleTopology(); topology != nil && !topologyMatches(topology, s.nodeID) {
+		return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+	}
+
+	// 由策略选择存储池时, 新卷最大可以是可用空间最多的池的容量
+	backend, err := lookupBackend(req.Parameters[backendParameter])
+	s.mu.Lock()
+	usesPolicy := err == nil && s.usesPoolPolicy(req.Parameters, backend)
+	s.mu.Unlock()
+	if usesPolicy {
+		candidates, err := s.poolCandidates()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get capacity: %v", err)
+		}
+		var available int64
+		for _, c := range candidates {
+			if c.AvailableBytes > available {
+				available = c.AvailableBytes
+			}
+		}
+		return &csi.GetCapacityResponse{
+			AvailableCapacity: available,
+			MaximumVolumeSize: wrapperspb.Int64(available),
+		}, nil
+	}
+
+	// 每个存储池单独统计, StorageClass 没有设置 pool 时统计 DataDir
+	pool := req.Parameters[poolParameter]
+	if _, err := s.config.PoolDir(pool); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	available, err := s.availableCapacity(pool)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get capacity: %v", err)
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: wrapperspb.Int64(available),
+	}, nil
+}
+
+// availableCapacity 返回存储池还能分配给新卷的容量: 池目录所在文件系统的可用空间, 并且不超过总容量减去已经分配给池中卷的容量;
+// 卷目录和稀疏文件是按需占用空间的, 只看 statfs 会把已经承诺给其他卷的空间重复分配出去
+func (s *ControllerServer) availableCapacity(pool string) (int64, error) {
+	path, err := s.config.PoolDir(pool)
+	if err != nil {
+		return 0, err
+	}
+	// 卷目录还没创建时统计它的父目录, 两者在同一个文件系统上
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path = filepath.Dir(path)
+	}
+	stats, err := statFS(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var provisioned int64
+	for _, v := range s.state.ListVolumes() {
+		if v.Pool == pool && !isMemoryVolume(v.Parameters) {
+			provisioned += v.CapacityBytes
+		}
+	}
+	available := stats.AvailableBytes
+	if remaining := stats.TotalBytes - provisioned; remaining < available {
+		available = remaining
+	}
+	if available < 0 {
+		available = 0
+	}
+	return available, nil
+}
+
+// ControllerGetVolume 返回卷的状态, 卷目录丢失或不可读时返回异常的 VolumeCondition, 供 external-health-monitor 使用
+func (s *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+
+	volume, ok := s.lookupVolume(req.VolumeId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", req.VolumeId)
+	}
+	volume, err := s.checkBacking(ctx, volume)
+	if err != nil {
+		return nil, err
+	}
+	volume, mismatch, err := s.reconcileCapacity(ctx, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	publishedNodes, err := listPublishedNodes(s.config.publishedDir())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load publish records: %v", err)
+	}
+
+	// 卷目录正常时再看后台校验有没有发现损坏的文件
+	condition := volumeCondition(volume.Path)
+	if scrubbed := s.scrubCondition(volume.ID); scrubbed != nil && !condition.Abnormal {
+		condition = scrubbed
+	}
+	if mismatch != nil && !condition.Abnormal {
+		condition = mismatch
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: reportedVolume(volume),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodes[volume.ID],
+			VolumeCondition:  condition,
+		},
+	}, nil
+}
+
+// volumeCondition 检查卷目录(或 block 卷的后端文件)是否存在并且可读
+func volumeCondition(path string) *csi.VolumeCondition {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume directory %s does not exist", path)}
+	}
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("failed to stat volume directory %s: %v", path, err)}
+	}
+	if fi.Mode().IsRegular() || fi.Mode()&os.ModeDevice != 0 {
+		// block 卷和镜像卷的后端是一个文件(LVM 卷是一个块设备), 能打开就认为正常
+		f, err := os.Open(path)
+		if err != nil {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("block file %s is not readable: %v", path, err)}
+		}
+		f.Close()
+		return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+	}
+	if !fi.IsDir() {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume path %s is not a directory", path)}
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume directory %s is not readable: %v", path, err)}
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume directory %s is not readable: %v", path, err)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+// paginate 根据 starting_token(上一页结束的下标) 和 max_entries 计算本页的范围 [start, end) 以及下一页的 token
+func paginate(total int, startingToken string, maxEntries int32) (start, end int, nextToken string, err error) {
+	if maxEntries < 0 {
+		return 0, 0, "", status.Errorf(codes.InvalidArgument, "max entries %d must not be negative", maxEntries)
+	}
+	if startingToken != "" {
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+	}
+	end = total
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+	if end < total {
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+// ControllerModifyVolume 修改已有卷的可变参数(VolumeAttributesClass), 修改后的参数写回卷的记录
+func (s *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	if err := validateMutableParameters(req.MutableParameters); err != nil {
+		return nil, err
+	}
+
+	volume, ok := s.state.GetVolume(req.VolumeId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", req.VolumeId)
+	}
+
+	parameters := make(map[string]string, len(volume.Parameters)+len(req.MutableParameters))
+	for k, v := range volume.Parameters {
+		parameters[k] = v
+	}
+	for k, v := range req.MutableParameters {
+		parameters[k] = v
+	}
+	if hasIOLimitParameters(req.MutableParameters) {
+		backend, err := backendOf(volume.Backend)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := checkIOLimits(parameters, volume.AccessType, backend); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	volume.Parameters = parameters
+	if err := s.state.UpdateVolume(volume); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record parameters of volume %s: %v", req.VolumeId, err)
+	}
+	if hasIOLimitParameters(req.MutableParameters) {
+		reapplyIOLimits(ctx, s.config, s.nodeID, volume)
+	}
+
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+// validateMutableParameters 拒绝不支持修改的参数
+func validateMutableParameters(params map[string]string) error {
+	for k := range params {
+		if !mutableParameters[k] {
+			return status.Errorf(codes.InvalidArgument, "parameter %s can not be modified", k)
+		}
+	}
+	return nil
 }
 
 // ControllerGetCapabilities 返回 Controller 的功能
 func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	klog.Infof("Received ControllerGetCapabilities request")
 	capabilities := []*csi.ControllerServiceCapability{
 		{
 			Type: &csi.ControllerServiceCapability_Rpc{
@@ -68,6 +1038,94 @@ func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *c
 				},
 			},
 		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					// 支持 SINGLE_NODE_SINGLE_WRITER 和 SINGLE_NODE_MULTI_WRITER 访问模式
+					Type: csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+				},
+			},
+		},
+	}
+	if s.attachRequired {
+		capabilities = append(capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					// 开启 attach 时由 external-attacher 调用 ControllerPublishVolume
+					Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+				},
+			},
+		})
 	}
 	return &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
 }
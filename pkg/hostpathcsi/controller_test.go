@@ -0,0 +1,193 @@
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	mount := &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+	tests := []struct {
+		name       string
+		capability *csi.VolumeCapability
+		wantErr    bool
+	}{
+		{name: "single node writer", capability: &csi.VolumeCapability{AccessType: mount, AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}},
+		{name: "single node reader only", capability: &csi.VolumeCapability{AccessType: mount, AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY}}},
+		{name: "single node single writer", capability: &csi.VolumeCapability{AccessType: mount, AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER}}},
+		{name: "single node multi writer", capability: &csi.VolumeCapability{AccessType: mount, AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER}}},
+		{name: "multi node multi writer", capability: &csi.VolumeCapability{AccessType: mount, AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}, wantErr: true},
+		{name: "missing access mode", capability: &csi.VolumeCapability{AccessType: mount}, wantErr: true},
+		{name: "missing access type", capability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVolumeCapabilities([]*csi.VolumeCapability{tt.capability})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateVolumeCapabilities() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeIdempotency(t *testing.T) {
+	const mib = 1 << 20
+	mount := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	block := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	first := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * mib},
+		Parameters:         map[string]string{onDeleteParameter: onDeleteDelete},
+		VolumeCapabilities: mount,
+	}
+
+	tests := []struct {
+		name     string
+		retry    *csi.CreateVolumeRequest
+		wantCode codes.Code
+	}{
+		{name: "identical retry", retry: first},
+		{
+			name:  "smaller required bytes",
+			retry: &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: mib}, Parameters: first.Parameters, VolumeCapabilities: mount},
+		},
+		{
+			name:     "larger required bytes",
+			retry:    &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 4 * mib}, Parameters: first.Parameters, VolumeCapabilities: mount},
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name:     "limit below the existing capacity",
+			retry:    &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{LimitBytes: mib}, Parameters: first.Parameters, VolumeCapabilities: mount},
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name:     "different parameters",
+			retry:    &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: first.CapacityRange, Parameters: map[string]string{onDeleteParameter: onDeleteArchive}, VolumeCapabilities: mount},
+			wantCode: codes.AlreadyExists,
+		},
+		{
+			name:     "different access type",
+			retry:    &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: first.CapacityRange, Parameters: first.Parameters, VolumeCapabilities: block},
+			wantCode: codes.AlreadyExists,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestControllerServer(t)
+			created, err := s.CreateVolume(context.Background(), first)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			retried, err := s.CreateVolume(context.Background(), tt.retry)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("retried CreateVolume error = %v, want code %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if retried.Volume.VolumeId != created.Volume.VolumeId || retried.Volume.CapacityBytes != created.Volume.CapacityBytes {
+				t.Errorf("retried CreateVolume = %v, want %v", retried.Volume, created.Volume)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeIdempotencyAfterRestart(t *testing.T) {
+	const mib = 1 << 20
+	mount := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	first := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * mib},
+		Parameters:         map[string]string{onDeleteParameter: onDeleteDelete},
+		VolumeCapabilities: mount,
+	}
+	s := newTestControllerServer(t)
+	created, err := s.CreateVolume(context.Background(), first)
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	state, err := NewState(s.config.StatePath())
+	if err != nil {
+		t.Fatalf("NewState: %v", err)
+	}
+	restarted := NewControllerServer(s.config, state, "node-1", false)
+	retried, err := restarted.CreateVolume(context.Background(), first)
+	if err != nil {
+		t.Fatalf("retried CreateVolume after the restart: %v", err)
+	}
+	if retried.Volume.VolumeId != created.Volume.VolumeId || retried.Volume.CapacityBytes != created.Volume.CapacityBytes {
+		t.Errorf("retried CreateVolume after the restart = %v, want %v", retried.Volume, created.Volume)
+	}
+	if volumes := state.ListVolumes(); len(volumes) != 1 {
+		t.Errorf("volumes after the retry = %v, want only %s", volumes, created.Volume.VolumeId)
+	}
+
+	conflict := &csi.CreateVolumeRequest{Name: "pvc-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 4 * mib}, Parameters: first.Parameters, VolumeCapabilities: mount}
+	if _, err := restarted.CreateVolume(context.Background(), conflict); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("conflicting CreateVolume after the restart error = %v, want code %v", err, codes.AlreadyExists)
+	}
+}
+
+func TestControllerExpandVolumeNodeExpansionRequired(t *testing.T) {
+	const mib = 1 << 20
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		capability *csi.VolumeCapability
+		want       bool
+	}{
+		{name: "directory volume", capability: mount, want: false},
+		{name: "directory block volume", capability: block, want: true},
+		{name: "image volume", parameters: map[string]string{backendParameter: imageBackendName}, capability: mount, want: true},
+		{name: "image block volume", parameters: map[string]string{backendParameter: imageBackendName}, capability: block, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestControllerServer(t)
+			created, err := s.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * mib},
+				Parameters:         tt.parameters,
+				VolumeCapabilities: []*csi.VolumeCapability{tt.capability},
+			})
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			// 扩容和容量没有变化的重试都要返回节点是否需要扩展
+			for _, attempt := range []string{"expand", "retry"} {
+				resp, err := s.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+					VolumeId:      created.Volume.VolumeId,
+					CapacityRange: &csi.CapacityRange{RequiredBytes: 4 * mib},
+				})
+				if err != nil {
+					t.Fatalf("%s: ControllerExpandVolume: %v", attempt, err)
+				}
+				if resp.CapacityBytes != 4*mib || resp.NodeExpansionRequired != tt.want {
+					t.Errorf("%s: ControllerExpandVolume() = capacity %d, node expansion required %v, want %d, %v", attempt, resp.CapacityBytes, resp.NodeExpansionRequired, 4*mib, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Package hostpathcsi Description: 这个文件实现默认的目录后端: 文件系统卷是一个目录, block 卷是一个稀疏文件,
+// 快照和克隆都是完整的拷贝。
+package hostpathcsi
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+)
+
+// directoryBackendName 是目录后端的名字
+const directoryBackendName = "directory"
+
+// directoryBackend 把卷保存为宿主机上的目录(block 卷是稀疏文件)
+type directoryBackend struct{}
+
+func (directoryBackend) Name() string {
+	return directoryBackendName
+}
+
+// CreateVolume 创建卷目录, block 卷创建稀疏文件
+func (b directoryBackend) CreateVolume(ctx context.Context, volume *Volume) error {
+	if err := b.prepare(volume); err != nil {
+		return err
+	}
+	return b.resizeBlock(*volume)
+}
+
+// CloneVolume 把源卷的内容复制到新卷
+func (b directoryBackend) CloneVolume(ctx context.Context, source Volume, volume *Volume) error {
+	if !sameAccessType(source.Path, volume.AccessType) {
+		return status.Errorf(codes.InvalidArgument, "source volume %s has a different access type than the new volume", source.ID)
+	}
+	if err := b.prepare(volume); err != nil {
+		return err
+	}
+	if err := copyDir(source.Path, volume.Path); err != nil {
+		return storageError(err, "failed to clone volume %s", source.ID)
+	}
+	logFor(ctx).Infof("Cloned volume %s into %s", source.ID, volume.Path)
+	return b.resizeBlock(*volume)
+}
+
+// DeleteVolume 删除卷目录或者 block 卷的文件, 并释放卷目录的 project quota; block 卷的文件先打洞, 和镜像卷一样立即释放空间
+func (directoryBackend) DeleteVolume(ctx context.Context, volume Volume) error {
+	if fi, err := os.Stat(volume.Path); err == nil && fi.IsDir() {
+		if err := clearQuota(volume.Path); err != nil {
+			logFor(ctx).Warningf("Failed to clear project quota of volume %s: %v", volume.ID, err)
+		}
+	} else if err := punchFile(volume.Path); err != nil {
+		logFor(ctx).Warningf("Failed to discard block file of volume %s: %v", volume.ID, err)
+	}
+	if err := os.RemoveAll(volume.Path); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete volume directory: %v", err)
+	}
+	return nil
+}
+
+// ExpandVolume 目录卷调大 project quota 的限制(文件系统支持时), block 卷扩大后端文件
+func (b directoryBackend) ExpandVolume(ctx context.Context, volume Volume, capacity int64) error {
+	volume.CapacityBytes = capacity
+	if isMemoryVolume(volume.Parameters) {
+		return nil
+	}
+	if volume.AccessType != accessTypeBlock {
+		if err := applyQuota(volume.ID, volume.Path, capacity); err != nil {
+			return status.Errorf(codes.Internal, "failed to expand quota of volume %s: %v", volume.ID, err)
+		}
+		return nil
+	}
+	return b.resizeBlock(volume)
+}
+
+// NodeExpansionRequired 目录卷没有文件系统需要扩展, block 卷需要节点刷新 loop 设备的大小, 内存卷需要节点调整 tmpfs 的大小
+func (directoryBackend) NodeExpansionRequired(volume Volume) bool {
+	return volume.AccessType == accessTypeBlock || isMemoryVolume(volume.Parameters)
+}
+
+// CreateSnapshot 把卷完整地复制到快照目录
+func (b directoryBackend) CreateSnapshot(ctx context.Context, volume Volume, snapshot *Snapshot) error {
+	return b.snapshot(volume, "", snapshot)
+}
+
+// CreateIncrementalSnapshot 把卷复制到快照目录, 和父快照相比没有变化的文件硬链接到父快照, 不占用额外的空间;
+// 父快照的目录已经不存在时退回完整的快照
+func (b directoryBackend) CreateIncrementalSnapshot(ctx context.Context, volume Volume, parent Snapshot, snapshot *Snapshot) error {
+	if _, err := os.Lstat(parent.Path); err != nil {
+		logFor(ctx).Warningf("Parent snapshot %s of volume %s is not accessible, taking a full snapshot: %v", parent.ID, volume.ID, err)
+		return b.snapshot(volume, "", snapshot)
+	}
+	if err := b.snapshot(volume, parent.Path, snapshot); err != nil {
+		return err
+	}
+	snapshot.ParentSnapshotID = parent.ID
+	return nil
+}
+
+// snapshot 把卷复制到快照目录 snapshot.Path, parentPath 不为空时没有变化的文件硬链接到父快照;
+// 先复制到临时目录, 完成后再 rename, 避免留下不完整的快照
+func (directoryBackend) snapshot(volume Volume, parentPath string, snapshot *Snapshot) error {
+	snapshotPath := snapshot.Path
+	tmpPath := snapshotPath + ".tmp"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to clean up temporary snapshot directory: %v", err)
+	}
+	if err := linkDir(volume.Path, parentPath, tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return storageError(err, "failed to copy volume %s", volume.ID)
+	}
+	if err := os.RemoveAll(snapshotPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to clean up snapshot directory: %v", err)
+	}
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to finalize snapshot %s: %v", snapshot.ID, err)
+	}
+
+	size, err := dirSize(snapshotPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to compute size of snapshot %s: %v", snapshot.ID, err)
+	}
+	snapshot.SizeBytes = size
+	return nil
+}
+
+// RestoreSnapshot 把快照的内容复制到新卷
+func (b directoryBackend) RestoreSnapshot(ctx context.Context, snapshot Snapshot, volume *Volume) error {
+	if !sameAccessType(snapshot.Path, volume.AccessType) {
+		return status.Errorf(codes.InvalidArgument, "snapshot %s has a different access type than the new volume", snapshot.ID)
+	}
+	if err := b.prepare(volume); err != nil {
+		return err
+	}
+	if err := copyDir(snapshot.Path, volume.Path); err != nil {
+		return storageError(err, "failed to restore snapshot %s", snapshot.ID)
+	}
+	logFor(ctx).Infof("Restored snapshot %s into %s", snapshot.ID, volume.Path)
+	return b.resizeBlock(*volume)
+}
+
+// DeleteSnapshot 删除快照目录
+func (directoryBackend) DeleteSnapshot(ctx context.Context, snapshot Snapshot) error {
+	if err := os.RemoveAll(snapshot.Path); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete snapshot directory: %v", err)
+	}
+	return nil
+}
+
+// Stats 目录卷和其他卷共享同一个文件系统: 总量和可用量取文件系统的值, 已用量取卷目录自身的大小;
+// 卷目录设置了 project quota 时, statfs 返回的就是 quota 的限制和用量, 直接使用 quota 的计数而不遍历目录
+func (directoryBackend) Stats(ctx context.Context, volumeID, path string) (VolumeStats, error) {
+	stats, err := statFS(path)
+	if err != nil {
+		return VolumeStats{}, status.Errorf(codes.Internal, "failed to get stats of volume %s: %v", volumeID, err)
+	}
+	used := stats.UsedBytes
+	if !hasProjectQuota(path) {
+		if used, err = dirSize(path); err != nil {
+			return VolumeStats{}, status.Errorf(codes.Internal, "failed to get usage of volume %s: %v", volumeID, err)
+		}
+	}
+	return VolumeStats{
+		TotalBytes:     stats.TotalBytes,
+		UsedBytes:      used,
+		AvailableBytes: stats.AvailableBytes,
+		TotalInodes:    stats.TotalInodes,
+		UsedInodes:     stats.UsedInodes,
+		FreeInodes:     stats.FreeInodes,
+	}, nil
+}
+
+// prepare 创建卷目录, 在写入数据之前设置 project quota, 克隆和恢复的数据也计入卷的用量;
+// block 卷只创建父目录, 文件由 resizeBlock 创建
+func (directoryBackend) prepare(volume *Volume) error {
+	if volume.AccessType == accessTypeBlock {
+		if err := os.MkdirAll(filepath.Dir(volume.Path), 0755); err != nil {
+			return storageError(err, "failed to create volume directory")
+		}
+		return nil
+	}
+	if err := os.MkdirAll(volume.Path, 0755); err != nil {
+		return storageError(err, "failed to create volume directory")
+	}
+	if volume.CapacityBytes > 0 && !isMemoryVolume(volume.Parameters) {
+		if err := applyQuota(volume.ID, volume.Path, volume.CapacityBytes); err != nil {
+			return status.Errorf(codes.Internal, "failed to limit capacity of volume %s: %v", volume.ID, err)
+		}
+	}
+	return nil
+}
+
+// resizeBlock 把 block 卷的稀疏文件扩大到卷的容量, 不是 block 卷时什么都不做
+func (directoryBackend) resizeBlock(volume Volume) error {
+	if volume.AccessType != accessTypeBlock {
+		return nil
+	}
+	if err := createBlockFile(volume.Path, volume.CapacityBytes, shouldPreallocate(volume.Parameters)); err != nil {
+		return storageError(err, "failed to resize block volume %s", volume.ID)
+	}
+	return nil
+}
+
+// sameAccessType 判断数据源(目录或者 block 卷的文件)和新卷的访问类型是否一致, 数据源无法访问时交给复制过程报错
+func sameAccessType(sourcePath, accessType string) bool {
+	fi, err := os.Stat(sourcePath)
+	if err != nil {
+		return true
+	}
+	return fi.IsDir() != (accessType == accessTypeBlock)
+}
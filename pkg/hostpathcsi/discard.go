@@ -0,0 +1,48 @@
+// Package hostpathcsi Description: 这个文件处理镜像文件和 block 卷的 discard/TRIM: 删除卷时先在后端文件上打洞, 即使还有没释放的
+// loop 设备打开着文件, 空间也能立即还给宿主机的文件系统; StorageClass 设置 discard=true 时, 卷的文件系统以 discard 挂载,
+// 卷里删除文件时 loop 设备把 discard 转成对后端文件的打洞, 稀疏文件随之缩小。
+package hostpathcsi
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+const (
+	// discardParameter 是 StorageClass 中要求以 discard 挂载文件系统的参数, 只对 image 和 lvm 后端的文件系统卷有效
+	discardParameter = "discard"
+	// discardMountOption 是挂载文件系统时开启在线 discard 的选项, ext4 和 xfs 都支持
+	discardMountOption = "discard"
+)
+
+// shouldDiscard 判断卷是否要求以 discard 挂载
+func shouldDiscard(parameters map[string]string) bool {
+	return parameters[discardParameter] == "true"
+}
+
+// discardMountData 返回挂载卷的文件系统时的 data 选项
+func discardMountData(discard bool) string {
+	if discard {
+		return discardMountOption
+	}
+	return ""
+}
+
+// punchFile 在整个后端文件上打洞, 释放它占用的磁盘; 文件不存在、不是普通文件或者还有其他硬链接(例如快照)时什么都不做,
+// 文件系统不支持打洞时返回错误, 由调用方决定是否忽略
+func punchFile(path string) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFREG || st.Size == 0 || st.Nlink > 1 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, st.Size); err != nil {
+		return fmt.Errorf("failed to punch hole in %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Package hostpathcsi Description: 这个文件实现 LUKS 加密卷: StorageClass 设置 encrypted=true 时, 卷的 loop 设备(或 LVM 逻辑卷)
+// 在 NodeStageVolume 时用 cryptsetup 打开, 文件系统建在解密后的 /dev/mapper 设备上, NodeUnstageVolume 时关闭。
+// 口令来自 NodeStageVolume 请求的 secrets, 驱动不保存口令, 节点上也不落盘。
+package hostpathcsi
+
+import (
+	"fmt"
+	"k8s.io/klog"
+	mount "k8s.io/mount-utils"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// encryptedParameter 是 StorageClass 中开启加密的参数, 只能用于 image 和 lvm 后端的文件系统卷
+	encryptedParameter = "encrypted"
+	// encryptionPassphraseKey 是 secrets 中加密口令的 key, 由 csi.storage.k8s.io/node-stage-secret-name 指定的 Secret 提供
+	encryptionPassphraseKey = "encryptionPassphrase"
+	// encryptedMapperPrefix 是打开的加密卷在 /dev/mapper 下的名字前缀, 后面跟卷 ID
+	encryptedMapperPrefix = "csi-"
+)
+
+func init() {
+	// 打开加密卷的口令由 NodeStageVolume 的 secrets 提供
+	requiredSecrets[encryptedParameter] = secretRequirement{enabled: isEncryptedVolume, kind: nodeStageSecrets, keys: []string{encryptionPassphraseKey}}
+}
+
+// isEncryptedVolume 判断卷参数(或 VolumeContext)是否开启了加密
+func isEncryptedVolume(parameters map[string]string) bool {
+	return parameters[encryptedParameter] == "true"
+}
+
+// encryptedMapperName 返回卷打开后的 device mapper 名字
+func encryptedMapperName(volumeID string) string {
+	return encryptedMapperPrefix + volumeID
+}
+
+// encryptedDevicePath 返回卷打开后解密设备的路径
+func encryptedDevicePath(volumeID string) string {
+	return filepath.Join("/dev/mapper", encryptedMapperName(volumeID))
+}
+
+// cryptsetup 执行 cryptsetup, passphrase 不为空时通过标准输入传入, 不出现在命令行里
+func cryptsetup(passphrase string, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	if passphrase != "" {
+		cmd.Stdin = strings.NewReader(passphrase)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %v, output: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// isLuks 判断设备上是否已经有 LUKS 头
+func isLuks(device string) bool {
+	return exec.Command("cryptsetup", "isLuks", device).Run() == nil
+}
+
+// openEncryptedDevice 用口令打开设备上的 LUKS 卷, 返回解密设备的路径; 已经打开时直接返回。
+// 设备上还没有 LUKS 头时先格式化, 但设备上已有其他数据(文件系统等)时拒绝格式化, 和 formatAndMount 一样绝不覆盖已有的数据
+func openEncryptedDevice(mounter *mount.SafeFormatAndMount, device, volumeID, passphrase string, discard bool) (string, error) {
+	mapperPath := encryptedDevicePath(volumeID)
+	if _, err := os.Stat(mapperPath); err == nil {
+		return mapperPath, nil
+	}
+
+	if !isLuks(device) {
+		existing, err := mounter.GetDiskFormat(device)
+		if err != nil {
+			return "", fmt.Errorf("failed to probe filesystem on %s: %v", device, err)
+		}
+		if existing != "" {
+			return "", &formatConflictError{device: device, existing: existing, requested: "LUKS"}
+		}
+		klog.Infof("Formatting %s as LUKS for volume %s", device, volumeID)
+		if err := cryptsetup(passphrase, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", device); err != nil {
+			return "", err
+		}
+	}
+	args := []string{"open", "--type", "luks", "--key-file", "-"}
+	if discard {
+		// dm-crypt 默认不把 discard 传给下面的设备, 因为这会暴露哪些块没有使用
+		args = append(args, "--allow-discards")
+	}
+	if err := cryptsetup(passphrase, append(args, device, encryptedMapperName(volumeID))...); err != nil {
+		return "", err
+	}
+	return mapperPath, nil
+}
+
+// closeEncryptedDevice 关闭卷的解密设备, 没有打开时什么都不做
+func closeEncryptedDevice(volumeID string) error {
+	if _, err := os.Stat(encryptedDevicePath(volumeID)); os.IsNotExist(err) {
+		return nil
+	}
+	return cryptsetup("", "close", encryptedMapperName(volumeID))
+}
+
+// expandEncryptedDevice 在后端扩大后刷新解密设备下面的 loop 设备, 再让解密设备使用全部空间;
+// LUKS2 把卷密钥放在内核 keyring 里时 cryptsetup resize 需要口令, 所以有口令时一并传入
+func expandEncryptedDevice(volumeID, passphrase string) error {
+	device, err := encryptedBackingDevice(volumeID)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(device, "/dev/loop") {
+		if err := reloadLoopDevice(device); err != nil {
+			return err
+		}
+	}
+	args := []string{"resize"}
+	if passphrase != "" {
+		args = append(args, "--key-file", "-")
+	}
+	return cryptsetup(passphrase, append(args, encryptedMapperName(volumeID))...)
+}
+
+// encryptedBackingDevice 返回打开的解密设备下面的设备(loop 设备或逻辑卷), 用于扩容时先刷新它的大小
+func encryptedBackingDevice(volumeID string) (string, error) {
+	out, err := exec.Command("cryptsetup", "status", encryptedMapperName(volumeID)).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("cryptsetup status failed: %v, output: %s", err, strings.TrimSpace(string(out)))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && key == "device" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", fmt.Errorf("no backing device in cryptsetup status of %s", encryptedMapperName(volumeID))
+}
+
+// stageEncryptedVolume 和 stageFilesystemVolume 一样把卷挂到 loop 设备上, 但先用口令打开设备上的 LUKS 卷,
+// 文件系统格式化和挂载都在解密设备上进行
+func stageEncryptedVolume(mounter *mount.SafeFormatAndMount, backingFile, stagingPath, fsType string, flags uintptr, data string, discard bool, volumeID, passphrase string) error {
+	device, err := stageBlockVolume(backingFile, stagingPath)
+	if err != nil {
+		return err
+	}
+	device, err = openEncryptedDevice(mounter, device, volumeID, passphrase, discard)
+	if err != nil {
+		return err
+	}
+	if err := formatAndMount(mounter, device, stagingPath, fsType, flags, data); err != nil {
+		return err
+	}
+	return resizeFilesystem(device, stagingPath, fsType)
+}
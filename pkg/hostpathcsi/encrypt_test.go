@@ -0,0 +1,162 @@
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// requireCryptsetup 在没有 cryptsetup 或者不是 root 时跳过测试, 打开 LUKS 卷需要 loop 设备和 device mapper
+func requireCryptsetup(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("cryptsetup"); err != nil {
+		t.Skip("cryptsetup is not in PATH")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("encrypted volumes can only be staged as root")
+	}
+}
+
+// newEncryptedVolume 创建加密的镜像卷的后端文件, 返回 stage 它的请求; LUKS2 的头部就要 16 MiB
+func newEncryptedVolume(t *testing.T, s *NodeServer, volumeID string) *csi.NodeStageVolumeRequest {
+	t.Helper()
+	createBackingFile(t, s.config.VolumePath(volumeID), 64<<20)
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{backendParameter: imageBackendName, encryptedParameter: "true"},
+	}
+	// 测试失败时也要卸载并关闭解密设备, 释放 loop 设备
+	t.Cleanup(func() {
+		s.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: req.StagingTargetPath})
+	})
+	return req
+}
+
+// stageWithPassphrase 用 passphrase 作为 secrets 里的口令 stage 卷
+func stageWithPassphrase(s *NodeServer, req *csi.NodeStageVolumeRequest, passphrase string) error {
+	req.Secrets = map[string]string{encryptionPassphraseKey: passphrase}
+	_, err := s.NodeStageVolume(context.Background(), req)
+	return err
+}
+
+func TestEncryptedVolumeStageAndUnstage(t *testing.T) {
+	requireCryptsetup(t)
+	s := newTestNodeServer(t)
+	req := newEncryptedVolume(t, s, "pvc-encrypted")
+	unstage := &csi.NodeUnstageVolumeRequest{VolumeId: req.VolumeId, StagingTargetPath: req.StagingTargetPath}
+
+	if err := stageWithPassphrase(s, req, "secret"); err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	if !isLuks(s.config.VolumePath(req.VolumeId)) {
+		t.Error("the image of the volume has no LUKS header after the first stage")
+	}
+	if _, err := os.Stat(encryptedDevicePath(req.VolumeId)); err != nil {
+		t.Errorf("decrypted device is not open: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(req.StagingTargetPath, "data"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.NodeUnstageVolume(context.Background(), unstage); err != nil {
+		t.Fatalf("NodeUnstageVolume: %v", err)
+	}
+	if _, err := os.Stat(encryptedDevicePath(req.VolumeId)); !os.IsNotExist(err) {
+		t.Errorf("decrypted device is still open after NodeUnstageVolume: %v", err)
+	}
+	if mounted, err := isMountPoint(s.mounter, req.StagingTargetPath); err != nil || mounted {
+		t.Errorf("staging path mounted = %v, %v after NodeUnstageVolume, want false", mounted, err)
+	}
+
+	// 再次 stage 打开已有的 LUKS 卷, 不能重新格式化
+	if err := stageWithPassphrase(s, req, "secret"); err != nil {
+		t.Fatalf("NodeStageVolume after NodeUnstageVolume: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(req.StagingTargetPath, "data")); err != nil || string(data) != "hello" {
+		t.Errorf("data after staging the volume again = %q, %v, want %q", data, err, "hello")
+	}
+	if _, err := s.NodeUnstageVolume(context.Background(), unstage); err != nil {
+		t.Fatalf("NodeUnstageVolume: %v", err)
+	}
+}
+
+func TestEncryptedVolumeWrongPassphrase(t *testing.T) {
+	requireCryptsetup(t)
+	s := newTestNodeServer(t)
+	req := newEncryptedVolume(t, s, "pvc-encrypted")
+	if err := stageWithPassphrase(s, req, "secret"); err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	if _, err := s.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: req.VolumeId, StagingTargetPath: req.StagingTargetPath}); err != nil {
+		t.Fatalf("NodeUnstageVolume: %v", err)
+	}
+
+	if err := stageWithPassphrase(s, req, "wrong"); err == nil {
+		t.Fatal("NodeStageVolume with a wrong passphrase succeeded")
+	}
+	if _, err := os.Stat(encryptedDevicePath(req.VolumeId)); !os.IsNotExist(err) {
+		t.Errorf("decrypted device is open after a wrong passphrase: %v", err)
+	}
+	if mounted, err := isMountPoint(s.mounter, req.StagingTargetPath); err != nil || mounted {
+		t.Errorf("staging path mounted = %v, %v after a wrong passphrase, want false", mounted, err)
+	}
+	// 口令错误不能把已有的 LUKS 卷当成空设备重新格式化
+	if !isLuks(s.config.VolumePath(req.VolumeId)) {
+		t.Error("the LUKS header is gone after a wrong passphrase")
+	}
+}
+
+func TestEncryptedVolumeMissingPassphrase(t *testing.T) {
+	s := newTestNodeServer(t)
+	req := newEncryptedVolume(t, s, "pvc-encrypted")
+	for name, secrets := range map[string]map[string]string{
+		"no secrets":       nil,
+		"empty passphrase": {encryptionPassphraseKey: ""},
+	} {
+		req.Secrets = secrets
+		_, err := s.NodeStageVolume(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: NodeStageVolume error = %v, want code %v", name, err, codes.InvalidArgument)
+		}
+	}
+	// 缺少口令时在打开 loop 设备之前就拒绝, staging 目录没有记录后端文件
+	if backing := stagedBackingFile(req.StagingTargetPath); backing != "" {
+		t.Errorf("staging path records backing file %s after a missing passphrase", backing)
+	}
+}
+
+func TestCheckSecretsEncryption(t *testing.T) {
+	encrypted := map[string]string{encryptedParameter: "true"}
+	passphrase := Secrets{encryptionPassphraseKey: "secret"}
+	tests := []struct {
+		name       string
+		kind       secretKind
+		parameters map[string]string
+		secrets    Secrets
+		wantCode   codes.Code
+	}{
+		{name: "stage with the passphrase", kind: nodeStageSecrets, parameters: encrypted, secrets: passphrase},
+		{name: "stage without the passphrase", kind: nodeStageSecrets, parameters: encrypted, wantCode: codes.InvalidArgument},
+		{name: "stage of an unencrypted volume", kind: nodeStageSecrets, parameters: map[string]string{encryptedParameter: "false"}},
+		// 口令只在 stage 时需要, 创建卷和发布卷时不带 node-stage 的 Secret
+		{name: "create without the passphrase", kind: provisionerSecrets, parameters: encrypted},
+		{name: "publish without the passphrase", kind: nodePublishSecrets, parameters: encrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkSecrets(tt.kind, tt.parameters, tt.secrets); status.Code(err) != tt.wantCode {
+				t.Errorf("checkSecrets() error = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
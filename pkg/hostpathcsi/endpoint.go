@@ -0,0 +1,81 @@
+// Package hostpathcsi Description: 这个文件实现 gRPC 监听地址(--endpoint)的解析: unix:///path 监听 Unix socket, 用于和 kubelet、sidecar 通信;
+// tcp://host:port 监听 TCP 端口, 用于测试(csi-sanity)和远程调试。
+package hostpathcsi
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultEndpoint 是没有通过 --endpoint 指定时监听的 socket, kubelet 和 sidecar 通过插件目录下的这个文件访问驱动
+const DefaultEndpoint = "unix:///var/lib/kubelet/plugins/hostpath.csi.k8s.io/csi.sock"
+
+// ParseEndpoint 把 scheme://address 格式的地址解析成 net.Listen 的 network 和 address, 只支持 unix 和 tcp
+func ParseEndpoint(endpoint string) (string, string, error) {
+	scheme, address, ok := strings.Cut(endpoint, "://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid endpoint %q, expected unix:///path or tcp://host:port", endpoint)
+	}
+	switch strings.ToLower(scheme) {
+	case "unix":
+		// unix://csi.sock 这样的相对路径也接受, 和 sidecar 的 --csi-address 的写法一致
+		if address == "" {
+			return "", "", fmt.Errorf("invalid endpoint %q, the socket path is empty", endpoint)
+		}
+		return "unix", address, nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+		}
+		return "tcp", address, nil
+	}
+	return "", "", fmt.Errorf("unsupported endpoint scheme %q in %q, must be unix or tcp", scheme, endpoint)
+}
+
+// Listen 监听 endpoint; Unix socket 先删除上次运行留下的 socket 文件, 否则 bind 会因为文件已经存在而失败,
+// 插件目录不存在时创建, 并按 opts 设置 socket 文件的权限和属主; TCP 地址不能设置 opts
+func Listen(endpoint string, opts SocketOptions) (net.Listener, error) {
+	network, address, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if network != "unix" {
+		if !opts.isZero() {
+			return nil, fmt.Errorf("socket mode and owner only apply to unix endpoints")
+		}
+		return net.Listen(network, address)
+	}
+
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove existing socket %s: %v", address, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(address), 0755); err != nil {
+		return nil, err
+	}
+	restore := opts.listenUmask()
+	listener, err := net.Listen(network, address)
+	restore()
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.apply(address); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// RemoveSocket 删除 endpoint 的 Unix socket 文件, 驱动退出时调用, 避免 kubelet 和 sidecar 连接一个没有进程监听的 socket; TCP 地址什么都不做
+func RemoveSocket(endpoint string) error {
+	network, address, err := ParseEndpoint(endpoint)
+	if err != nil || network != "unix" {
+		return err
+	}
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove socket %s: %v", address, err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Package hostpathcsi Description: 这个文件实现 inline ephemeral 卷临时目录的延迟回收: 最后一个目标路径卸载之后等一个宽限期再删除临时目录,
+// 宽限期内 pod 重建又发布了同一个卷时取消删除, 直接复用原来的目录, 避免频繁重启的 pod 反复删除和创建临时目录。
+package hostpathcsi
+
+import (
+	"context"
+	"k8s.io/klog"
+	"os"
+	"time"
+)
+
+// ephemeralCleanup 是等待宽限期结束的一次临时目录删除
+type ephemeralCleanup struct {
+	timer *time.Timer
+}
+
+// SetEphemeralGracePeriod 设置删除 inline ephemeral 卷临时目录之前的宽限期, 0 表示卸载之后立即删除;
+// 在开始服务之前调用, 同时为上次退出时还在宽限期内、已经没有任何发布的卷重新安排删除
+func (s *NodeServer) SetEphemeralGracePeriod(grace time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ephemeralGrace = grace
+	for volumeID := range s.ephemeral {
+		if len(s.published[volumeID]) == 0 {
+			s.scheduleEphemeralCleanupLocked(volumeID)
+		}
+	}
+}
+
+// removeEphemeral 删除卷在最后一个目标路径卸载之后的临时目录: 没有宽限期时立即删除, 否则等宽限期结束再删除
+func (s *NodeServer) removeEphemeral(ctx context.Context, volumeID string) error {
+	s.mu.Lock()
+	grace := s.ephemeralGrace
+	if grace > 0 {
+		s.scheduleEphemeralCleanupLocked(volumeID)
+	}
+	s.mu.Unlock()
+	ephemeralPath := s.config.ephemeralPath(volumeID)
+	if grace > 0 {
+		logFor(ctx).Infof("Ephemeral volume directory %s will be removed in %s unless the volume is published again", ephemeralPath, grace)
+		return nil
+	}
+
+	if err := os.RemoveAll(ephemeralPath); err != nil {
+		return err
+	}
+	if err := s.forgetEphemeral(volumeID); err != nil {
+		return err
+	}
+	logFor(ctx).Infof("Removed ephemeral volume directory %s", ephemeralPath)
+	return nil
+}
+
+// scheduleEphemeralCleanupLocked 在宽限期结束时删除卷的临时目录, 替换卷之前安排的删除; 调用方需要持有 s.mu
+func (s *NodeServer) scheduleEphemeralCleanupLocked(volumeID string) {
+	if cleanup, ok := s.ephemeralCleanups[volumeID]; ok {
+		cleanup.timer.Stop()
+	}
+	cleanup := &ephemeralCleanup{}
+	cleanup.timer = time.AfterFunc(s.ephemeralGrace, func() {
+		s.reclaimEphemeral(volumeID, cleanup)
+	})
+	s.ephemeralCleanups[volumeID] = cleanup
+}
+
+// cancelEphemeralCleanup 取消卷还在宽限期内的删除, 返回是否取消了
+func (s *NodeServer) cancelEphemeralCleanup(volumeID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cleanup, ok := s.ephemeralCleanups[volumeID]
+	if !ok {
+		return false
+	}
+	cleanup.timer.Stop()
+	delete(s.ephemeralCleanups, volumeID)
+	return true
+}
+
+// reclaimEphemeral 在宽限期结束时删除临时目录; 删除已经被取消或者被新的删除替换时什么都不做。
+// 持有 s.mu 删除, 同时发布这个卷的请求等删除完成之后再重新创建临时目录
+func (s *NodeServer) reclaimEphemeral(volumeID string, cleanup *ephemeralCleanup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ephemeralCleanups[volumeID] != cleanup {
+		return
+	}
+	delete(s.ephemeralCleanups, volumeID)
+	if len(s.published[volumeID]) > 0 {
+		return
+	}
+
+	ephemeralPath := s.config.ephemeralPath(volumeID)
+	if err := os.RemoveAll(ephemeralPath); err != nil {
+		klog.Warningf("Failed to remove ephemeral volume directory %s: %v", ephemeralPath, err)
+		return
+	}
+	delete(s.ephemeral, volumeID)
+	if err := saveEphemeral(s.ephemeralRecordPath, s.ephemeral); err != nil {
+		klog.Warningf("Failed to record removal of ephemeral volume %s: %v", volumeID, err)
+	}
+	klog.Infof("Removed ephemeral volume directory %s after the grace period", ephemeralPath)
+}
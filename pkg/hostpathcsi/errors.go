@@ -0,0 +1,41 @@
+package hostpathcsi
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storageError 把读写卷数据时的错误转换成 gRPC 状态码: 磁盘或配额用完时返回 ResourceExhausted, 让 sidecar 按容量不足处理,
+// 其他错误返回 Internal
+func storageError(err error, format string, args ...interface{}) error {
+	code := codes.Internal
+	if errors.Is(err, unix.ENOSPC) || errors.Is(err, unix.EDQUOT) {
+		code = codes.ResourceExhausted
+	}
+	return status.Errorf(code, "%s: %v", fmt.Sprintf(format, args...), err)
+}
+
+// formatConflictError 表示设备上已经有和请求不一致的数据(其他类型的文件系统等), 驱动拒绝格式化它
+type formatConflictError struct {
+	device    string
+	existing  string
+	requested string
+}
+
+func (e *formatConflictError) Error() string {
+	return fmt.Sprintf("device %s already contains %s data, refusing to format it as %s", e.device, e.existing, e.requested)
+}
+
+// stageError 把 stage 卷时的错误转换成 gRPC 状态码: 设备上已有不一致的数据时返回 FailedPrecondition, 重试也不会成功,
+// 需要修改 fsType 或者清理设备, 其他错误返回 Internal
+func stageError(err error, format string, args ...interface{}) error {
+	code := codes.Internal
+	var conflict *formatConflictError
+	if errors.As(err, &conflict) {
+		code = codes.FailedPrecondition
+	}
+	return status.Errorf(code, "%s: %v", fmt.Sprintf(format, args...), err)
+}
@@ -0,0 +1,213 @@
+package hostpathcsi
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// fsStats 是文件系统的容量和 inode 使用情况
+type fsStats struct {
+	TotalBytes     int64
+	AvailableBytes int64
+	UsedBytes      int64
+	TotalInodes    int64
+	FreeInodes     int64
+	UsedInodes     int64
+}
+
+// statFS 通过 statfs 获取 path 所在文件系统的使用情况
+func statFS(path string) (fsStats, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return fsStats{}, fmt.Errorf("failed to statfs %s: %v", path, err)
+	}
+	bsize := int64(st.Bsize)
+	return fsStats{
+		TotalBytes:     int64(st.Blocks) * bsize,
+		AvailableBytes: int64(st.Bavail) * bsize,
+		UsedBytes:      int64(st.Blocks-st.Bfree) * bsize,
+		TotalInodes:    int64(st.Files),
+		FreeInodes:     int64(st.Ffree),
+		UsedInodes:     int64(st.Files - st.Ffree),
+	}, nil
+}
+
+// copyDir 递归地把 src 目录复制到 dst, 保留文件权限和软链接
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			// 设备文件、管道等特殊文件不复制
+			return nil
+		}
+	})
+}
+
+// linkDir 像 rsync --link-dest 一样把 src 复制到 dst: parent 中同一路径的文件大小、修改时间和权限都没有变化时,
+// 硬链接 parent 中的文件而不复制数据, 否则复制; 复制的文件保留修改时间, 下一次才能据此判断文件是否变化。
+// parent 为空时复制所有文件; 硬链接共享 inode, 所以 dst 和 parent 之后都不能再修改
+func linkDir(src, parent, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			if parent != "" {
+				previous := filepath.Join(parent, rel)
+				if pi, err := os.Lstat(previous); err == nil && pi.Mode() == info.Mode() && pi.Size() == info.Size() && pi.ModTime().Equal(info.ModTime()) {
+					// 跨文件系统或者链接数达到上限时链接失败, 退回复制
+					if err := os.Link(previous, target); err == nil {
+						return nil
+					}
+				}
+			}
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		default:
+			// 设备文件、管道等特殊文件不复制
+			return nil
+		}
+	})
+}
+
+// copyFile 复制单个普通文件; 文件系统支持 reflink(开启了 reflink 的 xfs、btrfs)时用 FICLONE 共享数据块,
+// 大文件也几乎是瞬间完成, 之后写入时才复制被修改的块; 不支持时退回普通的复制
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	// 跨文件系统(EXDEV)或者文件系统不支持(EOPNOTSUPP、EINVAL)时 FICLONE 失败, 目标文件仍然是空的
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return out.Close()
+	}
+	// 两端都是 *os.File 时 io.Copy 会先尝试在内核中用 copy_file_range 复制, 不支持时再退回读写
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	return out.Close()
+}
+
+// applyVolumeMountGroup 把卷内容的属组改成 gid, 并给属组读写权限; 目录设置 setgid, 让新建的文件继承属组
+func applyVolumeMountGroup(path, group string) error {
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return fmt.Errorf("invalid volume mount group %q", group)
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(p, -1, gid); err != nil {
+			return err
+		}
+		if d.Type()&os.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		if d.IsDir() {
+			mode |= 0070 | os.ModeSetgid
+		} else {
+			mode |= 0060
+		}
+		if mode == info.Mode() {
+			return nil
+		}
+		return os.Chmod(p, mode)
+	})
+}
+
+// writeFileAtomic 先写临时文件再 rename, 避免写到一半崩溃导致文件损坏
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", path, err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	return nil
+}
+
+// dirSize 统计目录下所有普通文件的大小之和
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,209 @@
+// Package hostpathcsi Description: 这个文件实现孤儿数据的回收: CreateVolume 在创建卷的数据之前写下"创建中"的标记, 记录到状态之后删除;
+// 定期检查时, 有标记却没有记录的卷(例如 CreateVolume 中途崩溃或失败)留下的目录和镜像文件, 以及快照目录下没有记录的条目被删除, dry-run 时只打印出来。
+// 没有标记的卷目录(包括引入状态记录之前创建的卷)可能还在使用, 从不删除。
+package hostpathcsi
+
+import (
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gcMinAge 是孤儿条目的最短存在时间, 更新的条目可能属于正在进行的 CreateSnapshot(它不持有 ControllerServer 的锁), 留到下一轮再检查
+const gcMinAge = time.Hour
+
+// StartGarbageCollection 启动后台回收, 每隔 interval 检查一次; dryRun 时只打印找到的孤儿, 不删除
+func (s *ControllerServer) StartGarbageCollection(interval time.Duration, dryRun bool) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.collectGarbage(dryRun)
+			<-ticker.C
+		}
+	}()
+}
+
+// markPending 在创建卷的数据之前写下创建中的标记
+func (s *ControllerServer) markPending(volumeID string) error {
+	return writeFileAtomic(filepath.Join(s.config.pendingDir(), volumeID), nil)
+}
+
+// clearPending 在卷记录到状态之后删除创建中的标记, 不存在时返回成功
+func (s *ControllerServer) clearPending(volumeID string) error {
+	if err := os.Remove(filepath.Join(s.config.pendingDir(), volumeID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// collectGarbage 执行一轮回收; 持有锁, 避免把正在创建、还没有写入状态的卷当作孤儿
+func (s *ControllerServer) collectGarbage(dryRun bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orphans, stale, err := s.findOrphans()
+	if err != nil {
+		klog.Warningf("Failed to look for orphaned volume data: %v", err)
+		return
+	}
+	for _, path := range orphans {
+		if dryRun {
+			klog.Infof("Found orphaned %s (dry run, not removing it)", path)
+			continue
+		}
+		if fi, err := os.Lstat(path); err == nil && fi.IsDir() {
+			if err := clearQuota(path); err != nil {
+				klog.Warningf("Failed to clear project quota of orphaned %s: %v", path, err)
+			}
+		}
+		if err := os.RemoveAll(path); err != nil {
+			klog.Warningf("Failed to remove orphaned %s: %v", path, err)
+			continue
+		}
+		klog.Infof("Removed orphaned %s", path)
+	}
+	// 数据已经删完或者卷已经记录的标记不再需要
+	for _, volumeID := range stale {
+		if err := s.clearPending(volumeID); err != nil {
+			klog.Warningf("Failed to remove creation marker of volume %s: %v", volumeID, err)
+		}
+	}
+}
+
+// findOrphans 返回可以删除的孤儿条目, 以及不再需要的创建中标记(卷 ID):
+// 卷目录和存储池目录下只有属于有标记、没有记录的卷的条目是孤儿, 快照目录下没有对应记录的条目都是孤儿
+func (s *ControllerServer) findOrphans() ([]string, []string, error) {
+	recorded := make(map[string]bool)
+	for _, volume := range s.state.ListVolumes() {
+		recorded[volume.ID] = true
+	}
+	pending, err := s.pendingVolumes()
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshotIDs := make(map[string]bool)
+	for _, snap := range s.state.ListSnapshots() {
+		snapshotIDs[snap.ID] = true
+	}
+	// 还发布在节点上的卷一定还在使用, 即使没有记录也不能删除
+	published, err := listPublishedNodes(s.config.publishedDir())
+	if err != nil {
+		return nil, nil, err
+	}
+	dirs := []string{s.config.DataDir}
+	for _, dir := range s.config.PoolDirs() {
+		dirs = append(dirs, dir)
+	}
+
+	var orphans []string
+	// hasData 记录还有数据的标记, 包括因为太新这一轮没有删除的数据
+	hasData := make(map[string]bool)
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			volumeID, ok := pendingEntry(entry.Name(), pending)
+			if !ok || recorded[volumeID] {
+				continue
+			}
+			hasData[volumeID] = true
+			if len(published[volumeID]) > 0 || !isGCEntry(entry) {
+				continue
+			}
+			orphans = append(orphans, filepath.Join(dir, entry.Name()))
+		}
+	}
+	var stale []string
+	for volumeID, markedAt := range pending {
+		// 刚写下的标记可能属于还没有创建数据的卷, 等到下一轮
+		if recorded[volumeID] || (!hasData[volumeID] && time.Since(markedAt) >= gcMinAge) {
+			stale = append(stale, volumeID)
+		}
+	}
+
+	entries, err := readGCEntries(s.config.SnapshotDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if isSnapshotEntry(entry.Name(), snapshotIDs) {
+			continue
+		}
+		orphans = append(orphans, filepath.Join(s.config.SnapshotDir, entry.Name()))
+	}
+	return orphans, stale, nil
+}
+
+// pendingVolumes 返回有创建中标记的卷 ID 和写下标记的时间
+func (s *ControllerServer) pendingVolumes() (map[string]time.Time, error) {
+	entries, err := os.ReadDir(s.config.pendingDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	pending := make(map[string]time.Time)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			pending[entry.Name()] = info.ModTime()
+		}
+	}
+	return pending, nil
+}
+
+// pendingEntry 判断卷目录下的条目是否属于有创建中标记的卷: 条目名是卷 ID(目录卷和 block 卷的文件), 或者是卷 ID 加上后缀
+func pendingEntry(name string, pending map[string]time.Time) (string, bool) {
+	if _, ok := pending[name]; ok {
+		return name, true
+	}
+	for id := range pending {
+		if strings.HasPrefix(name, id+".") {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// isSnapshotEntry 判断快照目录下的条目是否属于某个已记录的快照: 条目名是快照 ID, 或者是快照 ID 加上后缀
+// (归档快照的格式、旁边的校验和文件以及写入中的临时文件)
+func isSnapshotEntry(name string, snapshotIDs map[string]bool) bool {
+	for id := range snapshotIDs {
+		if name == id || strings.HasPrefix(name, id+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// readGCEntries 返回目录下可以回收的条目, 目录不存在时返回空
+func readGCEntries(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []os.DirEntry
+	for _, entry := range entries {
+		if isGCEntry(entry) {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+// isGCEntry 判断条目是否可以回收: 跳过隐藏文件、lost+found 以及最近修改过的条目
+func isGCEntry(entry os.DirEntry) bool {
+	if strings.HasPrefix(entry.Name(), ".") || entry.Name() == "lost+found" {
+		return false
+	}
+	info, err := entry.Info()
+	return err == nil && time.Since(info.ModTime()) >= gcMinAge
+}
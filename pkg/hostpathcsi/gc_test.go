@@ -0,0 +1,200 @@
+package hostpathcsi
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestConfig 创建使用临时目录的配置
+func newTestConfig(t *testing.T) *Config {
+	t.Helper()
+	root := t.TempDir()
+	config, err := NewConfig(filepath.Join(root, "data"), filepath.Join(root, "snapshots"), filepath.Join(root, "state"), "", "", "", "")
+	if err != nil {
+		t.Fatalf("NewConfig: %v", err)
+	}
+	return config
+}
+
+// newTestControllerServer 创建使用临时目录的 ControllerServer
+func newTestControllerServer(t *testing.T) *ControllerServer {
+	t.Helper()
+	config := newTestConfig(t)
+	state, err := NewState(config.StatePath())
+	if err != nil {
+		t.Fatalf("NewState: %v", err)
+	}
+	return NewControllerServer(config, state, "node-1", false)
+}
+
+// touch 创建文件或目录并把修改时间设为 age 之前
+func touch(t *testing.T, path string, dir bool, age time.Duration) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if dir {
+		err = os.Mkdir(path, 0755)
+	} else {
+		err = os.WriteFile(path, nil, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	old := 2 * gcMinAge
+	tests := []struct {
+		name string
+		// dataDirs 和 dataFiles 是 DataDir 下的条目, 值是存在的时间
+		dataDirs  map[string]time.Duration
+		dataFiles map[string]time.Duration
+		// pending 是有创建中标记的卷, 值是标记存在的时间
+		pending   map[string]time.Duration
+		recorded  []string
+		snapshots map[string]time.Duration
+		// snapshotRecords 是状态里记录的快照
+		snapshotRecords []string
+		wantOrphans     []string
+		wantStale       []string
+	}{
+		{
+			name:     "legacy directory without a marker is kept",
+			dataDirs: map[string]time.Duration{"pvc-legacy": old},
+		},
+		{
+			name:        "crashed creation is collected",
+			dataDirs:    map[string]time.Duration{"pvc-crashed": old},
+			pending:     map[string]time.Duration{"pvc-crashed": old},
+			wantOrphans: []string{"data/pvc-crashed"},
+		},
+		{
+			name:        "files with a suffix of a crashed creation are collected",
+			dataFiles:   map[string]time.Duration{"pvc-crashed.img": old, "pvc-crashed-2": old},
+			pending:     map[string]time.Duration{"pvc-crashed": old},
+			wantOrphans: []string{"data/pvc-crashed.img"},
+		},
+		{
+			name:      "recorded volume is kept and its marker is stale",
+			dataDirs:  map[string]time.Duration{"pvc-ok": old},
+			pending:   map[string]time.Duration{"pvc-ok": old},
+			recorded:  []string{"pvc-ok"},
+			wantStale: []string{"pvc-ok"},
+		},
+		{
+			name:     "recent data of a crashed creation waits for the next round",
+			dataDirs: map[string]time.Duration{"pvc-new": time.Minute},
+			pending:  map[string]time.Duration{"pvc-new": old},
+		},
+		{
+			name:      "old marker without data is stale",
+			pending:   map[string]time.Duration{"pvc-gone": old},
+			wantStale: []string{"pvc-gone"},
+		},
+		{
+			name:    "recent marker without data is kept",
+			pending: map[string]time.Duration{"pvc-starting": time.Minute},
+		},
+		{
+			name:            "snapshot data without a record is collected",
+			snapshots:       map[string]time.Duration{"snap-1": old, "snap-1.tar.gz": old, "snap-2": old, ".hidden": old},
+			snapshotRecords: []string{"snap-1"},
+			wantOrphans:     []string{"snapshots/snap-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestControllerServer(t)
+			root := filepath.Dir(s.config.DataDir)
+			for name, age := range tt.dataDirs {
+				touch(t, filepath.Join(s.config.DataDir, name), true, age)
+			}
+			for name, age := range tt.dataFiles {
+				touch(t, filepath.Join(s.config.DataDir, name), false, age)
+			}
+			for name, age := range tt.pending {
+				touch(t, filepath.Join(s.config.pendingDir(), name), false, age)
+			}
+			for _, id := range tt.recorded {
+				if err := s.state.UpdateVolume(Volume{ID: id, Path: s.config.VolumePath(id)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, age := range tt.snapshots {
+				touch(t, filepath.Join(s.config.SnapshotDir, name), false, age)
+			}
+			for _, id := range tt.snapshotRecords {
+				if err := s.state.UpdateSnapshot(Snapshot{ID: id, Path: s.config.SnapshotPath(id)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			orphans, stale, err := s.findOrphans()
+			if err != nil {
+				t.Fatalf("findOrphans: %v", err)
+			}
+			var gotOrphans []string
+			for _, path := range orphans {
+				rel, _ := filepath.Rel(root, path)
+				gotOrphans = append(gotOrphans, rel)
+			}
+			sort.Strings(gotOrphans)
+			sort.Strings(stale)
+			if !equalStrings(gotOrphans, tt.wantOrphans) {
+				t.Errorf("orphans = %v, want %v", gotOrphans, tt.wantOrphans)
+			}
+			if !equalStrings(stale, tt.wantStale) {
+				t.Errorf("stale markers = %v, want %v", stale, tt.wantStale)
+			}
+		})
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	s := newTestControllerServer(t)
+	crashed := filepath.Join(s.config.DataDir, "pvc-crashed")
+	legacy := filepath.Join(s.config.DataDir, "pvc-legacy")
+	touch(t, crashed, true, 2*gcMinAge)
+	touch(t, legacy, true, 2*gcMinAge)
+	touch(t, filepath.Join(s.config.pendingDir(), "pvc-crashed"), false, 2*gcMinAge)
+
+	s.collectGarbage(true)
+	if _, err := os.Stat(crashed); err != nil {
+		t.Fatalf("dry run removed %s: %v", crashed, err)
+	}
+
+	s.collectGarbage(false)
+	if _, err := os.Stat(crashed); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed: %v", crashed, err)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Errorf("legacy volume %s was removed: %v", legacy, err)
+	}
+	// 数据删完之后的下一轮删除标记
+	s.collectGarbage(false)
+	if _, err := os.Stat(filepath.Join(s.config.pendingDir(), "pvc-crashed")); !os.IsNotExist(err) {
+		t.Errorf("creation marker was not removed: %v", err)
+	}
+}
+
+// equalStrings 比较两个字符串切片, nil 和空切片相等
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
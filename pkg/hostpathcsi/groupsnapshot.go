@@ -0,0 +1,240 @@
+// Package hostpathcsi Description: 这个文件实现 GroupControllerService, 一次为多个卷创建快照(组快照),
+// 成员快照全部创建完成后才一起记录, 任何一个失败都会清理已经创建的数据。组快照要求各个卷的快照是同一时刻的数据(崩溃一致),
+// 逐个复制的目录、镜像快照和逐个创建的 btrfs、lvm 快照做不到, 所以多个卷的组快照只在 zfs 这样能原子地创建多个快照的后端上支持,
+// 没有这样的后端时不上报 GroupController 服务。
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"slices"
+	"time"
+)
+
+// GroupControllerServer 用于实现 GroupControllerService
+type GroupControllerServer struct {
+	// 没有实现的 RPC 由它返回 codes.Unimplemented
+	csi.UnimplementedGroupControllerServer
+
+	// controller 提供卷的查找和创建快照的逻辑
+	controller *ControllerServer
+}
+
+// NewGroupControllerServer 创建一个 GroupControllerServer
+func NewGroupControllerServer(controller *ControllerServer) *GroupControllerServer {
+	return &GroupControllerServer{controller: controller}
+}
+
+// GroupControllerGetCapabilities 返回 GroupController 的功能
+func (s *GroupControllerServer) GroupControllerGetCapabilities(ctx context.Context, req *csi.GroupControllerGetCapabilitiesRequest) (*csi.GroupControllerGetCapabilitiesResponse, error) {
+	if !groupSnapshotsSupported() {
+		return &csi.GroupControllerGetCapabilitiesResponse{}, nil
+	}
+	return &csi.GroupControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.GroupControllerServiceCapability{
+			{
+				Type: &csi.GroupControllerServiceCapability_Rpc{
+					Rpc: &csi.GroupControllerServiceCapability_RPC{
+						Type: csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// CreateVolumeGroupSnapshot 为一组卷创建快照, 同名组快照已经存在时源卷相同则直接返回, 否则冲突
+func (s *GroupControllerServer) CreateVolumeGroupSnapshot(ctx context.Context, req *csi.CreateVolumeGroupSnapshotRequest) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	if err := checkSnapshotFormat(req.Parameters[snapshotFormatParameter]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	state := s.controller.state
+	if group, ok := state.GetGroupSnapshot(req.Name); ok {
+		sources := s.sourceVolumes(group)
+		requested := slices.Clone(req.SourceVolumeIds)
+		slices.Sort(requested)
+		if !slices.Equal(sources, requested) {
+			return nil, status.Errorf(codes.AlreadyExists, "group snapshot %s already exists for volumes %v", req.Name, sources)
+		}
+		return &csi.CreateVolumeGroupSnapshotResponse{GroupSnapshot: s.csiGroupSnapshot(group)}, nil
+	}
+
+	// 组快照里的快照也计入每个卷的快照数量
+	unlock, err := s.controller.lockSnapshotLimit(req.SourceVolumeIds...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// 先为所有卷创建快照, 全部成功后再一起记录
+	snapshots, err := s.takeSnapshots(ctx, req.Name, req.SourceVolumeIds, req.Parameters[snapshotFormatParameter])
+	if err != nil {
+		return nil, err
+	}
+
+	group := GroupSnapshot{ID: req.Name, CreationTime: time.Now()}
+	for _, snap := range snapshots {
+		group.SnapshotIDs = append(group.SnapshotIDs, snap.ID)
+	}
+	if err := state.AddGroupSnapshot(group, snapshots); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record group snapshot %s: %v", req.Name, err)
+	}
+
+	logFor(ctx).Infof("Group snapshot %s of volumes %v created", req.Name, req.SourceVolumeIds)
+	return &csi.CreateVolumeGroupSnapshotResponse{GroupSnapshot: s.csiGroupSnapshot(group)}, nil
+}
+
+// takeSnapshots 在同一时刻为所有卷创建快照: 只有一个卷时和 CreateSnapshot 相同,
+// 多个卷时它们必须在同一个支持组快照的后端上, 由后端原子地创建; 失败时删除已经创建的快照
+func (s *GroupControllerServer) takeSnapshots(ctx context.Context, groupID string, volumeIDs []string, format string) ([]Snapshot, error) {
+	if len(volumeIDs) == 1 {
+		snap, err := s.controller.takeSnapshot(ctx, groupID+"-"+volumeIDs[0], volumeIDs[0], format)
+		if err != nil {
+			return nil, err
+		}
+		snap.GroupSnapshotID = groupID
+		return []Snapshot{snap}, nil
+	}
+	// 归档是逐个卷打包的, 不是同一时刻的数据
+	if isArchiveFormat(format) {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot format %s can not be used for a group snapshot of more than one volume", format)
+	}
+
+	volumes := make([]Volume, 0, len(volumeIDs))
+	var backendName string
+	for _, volumeID := range volumeIDs {
+		volume, ok := s.controller.lookupVolume(volumeID)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "source volume %s not found", volumeID)
+		}
+		name := volume.Backend
+		if name == "" {
+			name = directoryBackendName
+		}
+		if backendName != "" && name != backendName {
+			return nil, status.Errorf(codes.FailedPrecondition, "volumes of group snapshot %s are on different backends %s and %s, they can not be snapshotted at the same instant", groupID, backendName, name)
+		}
+		backendName = name
+		volumes = append(volumes, volume)
+	}
+	backend, err := backendOf(backendName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to snapshot volumes %v: %v", volumeIDs, err)
+	}
+	group, ok := backend.(groupSnapshotBackend)
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "the %s backend can not snapshot several volumes at the same instant, group snapshot %s would not be consistent", backendName, groupID)
+	}
+
+	now := time.Now()
+	snapshots := make([]*Snapshot, len(volumes))
+	for i, volume := range volumes {
+		id := groupID + "-" + volume.ID
+		snapshots[i] = &Snapshot{
+			ID:              id,
+			SourceVolumeID:  volume.ID,
+			Path:            s.controller.config.SnapshotPath(id),
+			CreationTime:    now,
+			Backend:         backendName,
+			GroupSnapshotID: groupID,
+		}
+	}
+	if err := group.CreateGroupSnapshot(ctx, volumes, snapshots); err != nil {
+		for _, snap := range snapshots {
+			deleteSnapshotData(ctx, *snap)
+		}
+		return nil, err
+	}
+	created := make([]Snapshot, len(snapshots))
+	for i, snap := range snapshots {
+		created[i] = *snap
+	}
+	return created, nil
+}
+
+// DeleteVolumeGroupSnapshot 删除组快照和它的所有成员快照, 组快照不存在时也返回成功
+func (s *GroupControllerServer) DeleteVolumeGroupSnapshot(ctx context.Context, req *csi.DeleteVolumeGroupSnapshotRequest) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+
+	state := s.controller.state
+	group, ok := state.GetGroupSnapshot(req.GroupSnapshotId)
+	if !ok {
+		return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+	}
+	for _, snapshotID := range req.SnapshotIds {
+		if !slices.Contains(group.SnapshotIDs, snapshotID) {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshot %s does not belong to group snapshot %s", snapshotID, req.GroupSnapshotId)
+		}
+	}
+
+	for _, snapshotID := range group.SnapshotIDs {
+		snap, ok := state.GetSnapshot(snapshotID)
+		if !ok {
+			snap = Snapshot{ID: snapshotID, Path: s.controller.config.SnapshotPath(snapshotID)}
+		}
+		if err := deleteSnapshotData(ctx, snap); err != nil {
+			return nil, err
+		}
+	}
+	if err := state.DeleteGroupSnapshot(req.GroupSnapshotId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to forget group snapshot %s: %v", req.GroupSnapshotId, err)
+	}
+
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+// GetVolumeGroupSnapshot 返回组快照和它的成员快照
+func (s *GroupControllerServer) GetVolumeGroupSnapshot(ctx context.Context, req *csi.GetVolumeGroupSnapshotRequest) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+
+	group, ok := s.controller.state.GetGroupSnapshot(req.GroupSnapshotId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "group snapshot %s not found", req.GroupSnapshotId)
+	}
+	for _, snapshotID := range req.SnapshotIds {
+		if !slices.Contains(group.SnapshotIDs, snapshotID) {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshot %s does not belong to group snapshot %s", snapshotID, req.GroupSnapshotId)
+		}
+	}
+
+	return &csi.GetVolumeGroupSnapshotResponse{GroupSnapshot: s.csiGroupSnapshot(group)}, nil
+}
+
+// sourceVolumes 返回组快照的源卷, 按 ID 排序
+func (s *GroupControllerServer) sourceVolumes(group GroupSnapshot) []string {
+	var sources []string
+	for _, snapshotID := range group.SnapshotIDs {
+		if snap, ok := s.controller.state.GetSnapshot(snapshotID); ok {
+			sources = append(sources, snap.SourceVolumeID)
+		}
+	}
+	slices.Sort(sources)
+	return sources
+}
+
+// csiGroupSnapshot 把组快照元数据转换成 CSI 的 VolumeGroupSnapshot
+func (s *GroupControllerServer) csiGroupSnapshot(group GroupSnapshot) *csi.VolumeGroupSnapshot {
+	snapshots := make([]*csi.Snapshot, 0, len(group.SnapshotIDs))
+	for _, snapshotID := range group.SnapshotIDs {
+		if snap, ok := s.controller.state.GetSnapshot(snapshotID); ok {
+			snapshots = append(snapshots, csiSnapshot(snap))
+		}
+	}
+	return &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: group.ID,
+		Snapshots:       snapshots,
+		CreationTime:    timestamppb.New(group.CreationTime),
+		ReadyToUse:      true,
+	}
+}
@@ -0,0 +1,134 @@
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"testing"
+)
+
+// atomicGroupBackend 是测试用的支持组快照的后端, 记录每次 CreateGroupSnapshot 的卷
+type atomicGroupBackend struct {
+	directoryBackend
+	calls *[][]string
+}
+
+func (atomicGroupBackend) Name() string {
+	return "atomic-group"
+}
+
+func (b atomicGroupBackend) CreateGroupSnapshot(ctx context.Context, volumes []Volume, snapshots []*Snapshot) error {
+	var ids []string
+	for i, volume := range volumes {
+		ids = append(ids, volume.ID)
+		snapshots[i].SizeBytes = 1
+	}
+	*b.calls = append(*b.calls, ids)
+	return nil
+}
+
+func TestCreateVolumeGroupSnapshot(t *testing.T) {
+	var calls [][]string
+	RegisterBackend(atomicGroupBackend{calls: &calls})
+	t.Cleanup(func() {
+		backendsMu.Lock()
+		defer backendsMu.Unlock()
+		delete(backends, "atomic-group")
+	})
+
+	tests := []struct {
+		name      string
+		volumes   map[string]string
+		format    string
+		wantCode  codes.Code
+		wantCalls int
+		wantGroup bool
+	}{
+		{
+			name:      "single directory volume",
+			volumes:   map[string]string{"pvc-a": directoryBackendName},
+			wantGroup: true,
+		},
+		{
+			name:     "several directory volumes are not consistent",
+			volumes:  map[string]string{"pvc-a": directoryBackendName, "pvc-b": directoryBackendName},
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "volumes on different backends",
+			volumes:  map[string]string{"pvc-a": directoryBackendName, "pvc-b": "atomic-group"},
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:      "several volumes on a backend with group snapshots",
+			volumes:   map[string]string{"pvc-a": "atomic-group", "pvc-b": "atomic-group"},
+			wantCalls: 1,
+			wantGroup: true,
+		},
+		{
+			name:     "archives of several volumes",
+			volumes:  map[string]string{"pvc-a": "atomic-group", "pvc-b": "atomic-group"},
+			format:   snapshotFormatTarGzip,
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			controller := newTestControllerServer(t)
+			var ids []string
+			for id, backend := range tt.volumes {
+				path := controller.config.VolumePath(id)
+				if err := os.MkdirAll(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := controller.state.UpdateVolume(Volume{ID: id, Path: path, Backend: backend}); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+			}
+			s := NewGroupControllerServer(controller)
+			req := &csi.CreateVolumeGroupSnapshotRequest{Name: "group-1", SourceVolumeIds: ids}
+			if tt.format != "" {
+				req.Parameters = map[string]string{snapshotFormatParameter: tt.format}
+			}
+			_, err := s.CreateVolumeGroupSnapshot(context.Background(), req)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateVolumeGroupSnapshot() error = %v, want code %v", err, tt.wantCode)
+			}
+			if len(calls) != tt.wantCalls {
+				t.Errorf("CreateGroupSnapshot called %d times, want %d", len(calls), tt.wantCalls)
+			}
+			if _, ok := controller.state.GetGroupSnapshot("group-1"); ok != tt.wantGroup {
+				t.Errorf("group snapshot recorded = %v, want %v", ok, tt.wantGroup)
+			}
+		})
+	}
+}
+
+func TestGroupControllerCapabilities(t *testing.T) {
+	s := NewGroupControllerServer(newTestControllerServer(t))
+	resp, err := s.GroupControllerGetCapabilities(context.Background(), &csi.GroupControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Capabilities) != 0 {
+		t.Errorf("capabilities = %v without a backend that supports group snapshots, want none", resp.Capabilities)
+	}
+
+	RegisterBackend(atomicGroupBackend{calls: new([][]string)})
+	t.Cleanup(func() {
+		backendsMu.Lock()
+		defer backendsMu.Unlock()
+		delete(backends, "atomic-group")
+	})
+	resp, err = s.GroupControllerGetCapabilities(context.Background(), &csi.GroupControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Capabilities) != 1 {
+		t.Errorf("capabilities = %v, want CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT", resp.Capabilities)
+	}
+}
@@ -0,0 +1,44 @@
+// Package hostpathcsi Description: 这个文件实现 HTTP 的健康检查接口, 代替 livenessprobe sidecar: /healthz 和 /readyz 执行和 Probe 相同的检查,
+// Kubernetes 的 livenessProbe 和 readinessProbe 可以直接配置 httpGet; /readyz 还要求 gRPC 服务已经开始服务并且没有在退出。
+package hostpathcsi
+
+import (
+	"fmt"
+	"k8s.io/klog"
+	"net/http"
+)
+
+// SetReady 设置 gRPC 服务是否在正常服务, 开始 Serve 之前和收到退出信号之后 /readyz 返回失败
+func (s *IdentityServer) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// NewHealthHandler 返回 /healthz 和 /readyz 的 HTTP handler, 检查通过时返回 200, 否则返回 503 和失败的原因
+func NewHealthHandler(identity *IdentityServer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, "healthz", identity.checkHealth())
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if !identity.ready.Load() {
+			err = fmt.Errorf("the CSI services are not serving")
+		} else {
+			err = identity.checkHealth()
+		}
+		writeHealth(w, "readyz", err)
+	})
+	return mux
+}
+
+// writeHealth 写出检查的结果
+func writeHealth(w http.ResponseWriter, name string, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		klog.Warningf("%s check failed: %v", name, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%s check failed: %v\n", name, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
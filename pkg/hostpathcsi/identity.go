@@ -2,46 +2,163 @@ package hostpathcsi
 
 import (
 	"context"
+	"fmt"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	"k8s.io/klog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
 )
 
+// DefaultDriverName 是没有通过 --driver-name 指定时的驱动名, CSIDriver 对象、StorageClass 的 provisioner 都要使用这个名字
+const DefaultDriverName = "hostpath.csi.k8s.io"
+
+// driverNamePattern 是 CSI 规范对驱动名的要求: 不超过 63 个字符, 以字母或数字开头和结尾, 中间可以有 -、_ 和 .
+var driverNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([-_.a-zA-Z0-9]{0,61}[a-zA-Z0-9])?$`)
+
 // IdentityServer 注意因为要作为csi.ControllerServer的实现，所以需要实现csi.ControllerServer的所有方法
 type IdentityServer struct {
 	csi.UnimplementedIdentityServer
+
+	// driverName 是 GetPluginInfo 返回的驱动名
+	driverName string
+	// controllerService 为 false 时(只运行 Node 服务)不上报 Controller 和 GroupController 服务
+	controllerService bool
+	// state 是卷的元数据存储, Probe 检查它还能正常加载
+	state *State
+	// basePath 是存放卷的目录, Probe 检查它存在并且可写
+	basePath string
+	// ready 表示 gRPC 服务是否在正常服务, 决定 /readyz 的结果
+	ready atomic.Bool
+
+	// mu 保护 checks
+	mu sync.Mutex
+	// checks 是后台任务等组件登记的健康检查, 任何一个失败 Probe 就失败
+	checks map[string]func() error
+}
+
+// NewIdentityServer 创建一个 IdentityServer
+func NewIdentityServer(state *State, basePath string) *IdentityServer {
+	return &IdentityServer{driverName: DefaultDriverName, controllerService: true, state: state, basePath: basePath, checks: make(map[string]func() error)}
+}
+
+// SetControllerService 设置同一个进程里是否运行了 Controller 服务, 决定 GetPluginCapabilities 是否上报它
+func (s *IdentityServer) SetControllerService(enabled bool) {
+	s.controllerService = enabled
+}
+
+// SetDriverName 修改 GetPluginInfo 返回的驱动名, 同一个集群里部署多份驱动时用不同的名字区分
+func (s *IdentityServer) SetDriverName(name string) error {
+	if !driverNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid driver name %q, it must be at most 63 characters, begin and end with an alphanumeric character and contain only alphanumerics, '-', '_' and '.'", name)
+	}
+	s.driverName = name
+	return nil
+}
+
+// AddHealthCheck 登记一个健康检查, 例如后台循环是否还在运行; 同名的检查会被替换
+func (s *IdentityServer) AddHealthCheck(name string, check func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks[name] = check
 }
 
 // GetPluginInfo 的作用是返回插件的信息，包括插件的名称和版本号
 func (s *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	klog.Infof("Received GetPluginInfo request")
-
 	return &csi.GetPluginInfoResponse{
-		// csi要求插件的名称必顫是域名的逆序，这里使用了hostpath.csi.k8s.io
-		Name:          "hostpath.csi.k8s.io",
-		VendorVersion: "v1.0.0",
+		// csi要求插件的名称必顫是域名的逆序，默认使用了hostpath.csi.k8s.io
+		Name:          s.driverName,
+		VendorVersion: Version,
+		// Manifest 带上 commit 和构建时间, 方便确认每个节点上运行的是哪个构建
+		Manifest: BuildInfo(),
 	}, nil
 }
 
 // GetPluginCapabilities 的作用是返回插件的能力，这里只返回了 ControllerService 的能力; 也就是说，这个插件只实现了 ControllerService
 func (s *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	// 什么是ControllerService能力呢？ControllerService是CSI规范中的一个服务，它负责管理卷的生命周期，包括创建、删除、扩容等操作
-	klog.Infof("Received GetPluginCapabilities request")
 
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
+	capabilities := []*csi.PluginCapability{
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					// 卷只能在创建它的节点上访问, 需要 external-provisioner 传递拓扑信息
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		},
+	}
+	if s.controllerService {
+		capabilities = append(capabilities,
+			&csi.PluginCapability{
 				Type: &csi.PluginCapability_Service_{
 					Service: &csi.PluginCapability_Service{
 						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 					},
 				},
 			},
-		},
-	}, nil
+		)
+	}
+	// 只有能在同一时刻为多个卷创建快照的后端可用时才支持组快照
+	if s.controllerService && groupSnapshotsSupported() {
+		capabilities = append(capabilities,
+			&csi.PluginCapability{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE,
+					},
+				},
+			},
+		)
+	}
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: capabilities}, nil
 }
 
+// Probe 检查驱动是否健康: 卷目录可写、状态文件可以加载、登记的后台任务正常; 失败时返回 FailedPrecondition,
+// livenessprobe sidecar 会据此重启驱动
 func (s *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	klog.Infof("Received Probe request")
+	if err := s.checkHealth(); err != nil {
+		logFor(ctx).Errorf("Probe failed: %v", err)
+		return nil, status.Errorf(codes.FailedPrecondition, "driver is not healthy: %v", err)
+	}
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
+
+// checkHealth 依次执行所有健康检查, 返回第一个失败的原因
+func (s *IdentityServer) checkHealth() error {
+	if s.basePath != "" {
+		if err := checkWritable(s.basePath); err != nil {
+			return err
+		}
+	}
+	if s.state != nil {
+		if err := s.state.Check(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, check := range s.checks {
+		if err := check(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
 
-	return &csi.ProbeResponse{}, nil
+// checkWritable 检查目录存在并且可以创建文件
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("volume directory %s is not accessible: %v", dir, err)
+	}
+	f, err := os.CreateTemp(dir, ".probe-")
+	if err != nil {
+		return fmt.Errorf("volume directory %s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
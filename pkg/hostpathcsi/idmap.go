@@ -0,0 +1,199 @@
+// Package hostpathcsi Description: 这个文件实现 idmapped bind mount: StorageClass 设置 idMap 参数时, NodePublishVolume 用
+// open_tree/mount_setattr/move_mount 把卷以 ID 映射的方式挂到目标路径, 开启 user namespace 的 pod 里看到的属主是容器内的 ID,
+// 磁盘上的数据保持宿主机的 ID, 不需要 chown。需要 5.12 以上的内核以及支持 idmapped mount 的文件系统。
+package hostpathcsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// idMapParameter 是 StorageClass 中开启 idmapped mount 的参数: pod 表示使用 kubelet 为 pod 分配的 user namespace 映射,
+	// 也可以直接写映射, 格式是逗号分隔的 容器内ID:宿主机ID:长度, 例如 0:100000:65536, uid 和 gid 使用相同的映射
+	idMapParameter = "idMap"
+	// idMapPod 表示使用 pod 的 user namespace 映射
+	idMapPod = "pod"
+	// kubeletUserNamespaceFile 是 kubelet 在 pod 目录下记录 user namespace 映射的文件
+	kubeletUserNamespaceFile = "userns"
+	// kubeletCSIVolumesDir 是 CSI 卷在 kubelet pod 目录下的位置, 用来从目标路径找到 pod 目录
+	kubeletCSIVolumesDir = "/volumes/kubernetes.io~csi/"
+)
+
+// idMapping 是一段连续的 ID 映射, 字段名和 kubelet 记录的格式一致
+type idMapping struct {
+	ContainerID uint32 `json:"containerId"`
+	HostID      uint32 `json:"hostId"`
+	Length      uint32 `json:"length"`
+}
+
+// podUserNamespace 是 kubelet 记录的 pod 的 user namespace 映射
+type podUserNamespace struct {
+	UIDMappings []idMapping `json:"uidMappings"`
+	GIDMappings []idMapping `json:"gidMappings"`
+}
+
+// checkIDMap 检查 idMap 参数
+func checkIDMap(value string) error {
+	if value == idMapPod {
+		return nil
+	}
+	_, err := parseIDMappings(value)
+	return err
+}
+
+// parseIDMappings 解析 容器内ID:宿主机ID:长度 格式的映射
+func parseIDMappings(value string) ([]idMapping, error) {
+	var mappings []idMapping
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid %s parameter %q, expected %s or containerID:hostID:length[,...]", idMapParameter, value, idMapPod)
+		}
+		var ids [3]uint32
+		for i, f := range fields {
+			id, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s parameter %q: %q is not a valid id", idMapParameter, value, f)
+			}
+			ids[i] = uint32(id)
+		}
+		if ids[2] == 0 {
+			return nil, fmt.Errorf("invalid %s parameter %q: length must be positive", idMapParameter, value)
+		}
+		mappings = append(mappings, idMapping{ContainerID: ids[0], HostID: ids[1], Length: ids[2]})
+	}
+	return mappings, nil
+}
+
+// volumeIDMappings 返回发布卷时使用的 uid 和 gid 映射; 没有设置 idMap 参数, 或者使用 pod 的映射但 pod 没有开启 user namespace 时 ok 为 false
+func volumeIDMappings(volumeContext map[string]string, targetPath string) (uidMap, gidMap []idMapping, ok bool, err error) {
+	value := volumeContext[idMapParameter]
+	switch value {
+	case "":
+		return nil, nil, false, nil
+	case idMapPod:
+		return readPodUserNamespace(targetPath)
+	}
+	mappings, err := parseIDMappings(value)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return mappings, mappings, true, nil
+}
+
+// readPodUserNamespace 从目标路径找到 kubelet 的 pod 目录, 读取其中记录的 user namespace 映射, pod 没有 user namespace 时 ok 为 false
+func readPodUserNamespace(targetPath string) (uidMap, gidMap []idMapping, ok bool, err error) {
+	i := strings.Index(targetPath, kubeletCSIVolumesDir)
+	if i < 0 {
+		return nil, nil, false, fmt.Errorf("target path %s is not in a kubelet pod directory", targetPath)
+	}
+	path := filepath.Join(targetPath[:i], kubeletUserNamespaceFile)
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to read user namespace of pod: %v", err)
+	}
+	var userns podUserNamespace
+	if err := json.Unmarshal(raw, &userns); err != nil {
+		return nil, nil, false, fmt.Errorf("failed to parse user namespace of pod %s: %v", path, err)
+	}
+	if len(userns.UIDMappings) == 0 || len(userns.GIDMappings) == 0 {
+		return nil, nil, false, nil
+	}
+	return userns.UIDMappings, userns.GIDMappings, true, nil
+}
+
+// mountAttrFlags 是 bind mount 的 mount(2) 标志对应的 mount_setattr 属性
+var mountAttrFlags = []struct {
+	flag uintptr
+	attr uint64
+}{
+	{unix.MS_RDONLY, unix.MOUNT_ATTR_RDONLY},
+	{unix.MS_NOSUID, unix.MOUNT_ATTR_NOSUID},
+	{unix.MS_NODEV, unix.MOUNT_ATTR_NODEV},
+	{unix.MS_NOEXEC, unix.MOUNT_ATTR_NOEXEC},
+	{unix.MS_NODIRATIME, unix.MOUNT_ATTR_NODIRATIME},
+	{unix.MS_NOATIME, unix.MOUNT_ATTR_NOATIME},
+	{unix.MS_STRICTATIME, unix.MOUNT_ATTR_STRICTATIME},
+}
+
+// idmappedBindMount 把 source 以 uidMap/gidMap 映射的方式 bind mount 到 target, flags 和 bindMount 的含义相同
+func idmappedBindMount(source, target string, uidMap, gidMap []idMapping, flags uintptr) error {
+	userns, err := newUserNamespace(uidMap, gidMap)
+	if err != nil {
+		return err
+	}
+	defer userns.Close()
+
+	tree, err := unix.OpenTree(unix.AT_FDCWD, source, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to clone mount of %s: %v", source, err)
+	}
+	defer unix.Close(tree)
+
+	attr := unix.MountAttr{Attr_set: unix.MOUNT_ATTR_IDMAP, Userns_fd: uint64(userns.Fd())}
+	for _, f := range mountAttrFlags {
+		if flags&f.flag != 0 {
+			attr.Attr_set |= f.attr
+		}
+	}
+	if flags&(unix.MS_NOATIME|unix.MS_STRICTATIME|unix.MS_RELATIME) != 0 {
+		attr.Attr_clr |= unix.MOUNT_ATTR__ATIME
+	}
+	if err := unix.MountSetattr(tree, "", unix.AT_EMPTY_PATH, &attr); err != nil {
+		return fmt.Errorf("failed to set id mapping on mount of %s: %v", source, err)
+	}
+	if err := unix.MoveMount(tree, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("failed to attach idmapped mount of %s to %s: %v", source, target, err)
+	}
+	return nil
+}
+
+// newUserNamespace 创建一个带有给定映射的 user namespace, 返回它的文件描述符;
+// 映射只能由 namespace 里的进程之外写入, 所以先启动一个在新 namespace 里阻塞的进程, 打开它的 namespace 后再结束它
+func newUserNamespace(uidMap, gidMap []idMapping) (*os.File, error) {
+	cmd := exec.Command("cat")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		UidMappings: sysProcIDMaps(uidMap),
+		GidMappings: sysProcIDMaps(gidMap),
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to create user namespace: %v", err)
+	}
+	defer func() {
+		stdin.Close()
+		if err := cmd.Wait(); err != nil {
+			klog.Warningf("User namespace helper exited with error: %v", err)
+		}
+	}()
+	f, err := os.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user namespace: %v", err)
+	}
+	return f, nil
+}
+
+// sysProcIDMaps 把映射转换成 exec 使用的格式
+func sysProcIDMaps(mappings []idMapping) []syscall.SysProcIDMap {
+	result := make([]syscall.SysProcIDMap, 0, len(mappings))
+	for _, m := range mappings {
+		result = append(result, syscall.SysProcIDMap{ContainerID: int(m.ContainerID), HostID: int(m.HostID), Size: int(m.Length)})
+	}
+	return result
+}
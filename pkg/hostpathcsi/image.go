@@ -0,0 +1,206 @@
+// Package hostpathcsi Description: 这个文件实现 image 后端: 每个卷是一个稀疏的镜像文件, NodeStageVolume 把它挂到 loop 设备上,
+// 第一次 stage 时格式化成 fsType 指定的文件系统再挂载。和目录卷不同, 卷的容量由文件系统真正限制住。
+package hostpathcsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// imageBackendName 是 image 后端的名字
+	imageBackendName = "image"
+	// defaultFsType 是 VolumeCapability 没有指定 fsType 时使用的文件系统
+	defaultFsType = "ext4"
+)
+
+// supportedFsTypes 是支持的文件系统; 格式化的参数由 SafeFormatAndMount 决定, ext 系列用 -F -m0, xfs 用 -f
+var supportedFsTypes = map[string]bool{
+	"ext3": true,
+	"ext4": true,
+	"xfs":  true,
+}
+
+// filesystemBackends 是卷的后端是块设备(或镜像文件)、在 stage 时格式化并挂载文件系统的后端
+var filesystemBackends = map[string]bool{imageBackendName: true}
+
+func init() {
+	RegisterBackend(imageBackend{})
+}
+
+// imageBackend 把卷保存为镜像文件, 文件里是一个真正的文件系统(block 卷直接使用镜像文件)
+type imageBackend struct{}
+
+func (imageBackend) Name() string {
+	return imageBackendName
+}
+
+// CreateVolume 创建卷容量大小的稀疏镜像文件, 文件系统在第一次 stage 时才创建
+func (b imageBackend) CreateVolume(ctx context.Context, volume *Volume) error {
+	if volume.CapacityBytes <= 0 {
+		return status.Error(codes.InvalidArgument, "required bytes must be set for image volumes")
+	}
+	if err := os.MkdirAll(filepath.Dir(volume.Path), 0755); err != nil {
+		return storageError(err, "failed to create volume directory")
+	}
+	return b.ExpandVolume(ctx, *volume, volume.CapacityBytes)
+}
+
+// CloneVolume 复制源卷的镜像文件, 再扩大到新卷的容量; 文件系统在 stage 时扩展到整个镜像
+func (b imageBackend) CloneVolume(ctx context.Context, source Volume, volume *Volume) error {
+	if err := b.copyImage(source.Path, volume); err != nil {
+		return storageError(err, "failed to clone volume %s", source.ID)
+	}
+	logFor(ctx).Infof("Cloned volume %s into %s", source.ID, volume.Path)
+	return nil
+}
+
+// DeleteVolume 先在镜像文件上打洞再删除它, 这样即使还有 loop 设备打开着文件, 空间也会立即释放
+func (imageBackend) DeleteVolume(ctx context.Context, volume Volume) error {
+	if err := punchFile(volume.Path); err != nil {
+		logFor(ctx).Warningf("Failed to discard image of volume %s: %v", volume.ID, err)
+	}
+	if err := os.RemoveAll(volume.Path); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete volume image: %v", err)
+	}
+	return nil
+}
+
+// ExpandVolume 扩大镜像文件, 文件系统由 NodeExpandVolume 扩展
+func (imageBackend) ExpandVolume(ctx context.Context, volume Volume, capacity int64) error {
+	if err := createBlockFile(volume.Path, capacity, shouldPreallocate(volume.Parameters)); err != nil {
+		return storageError(err, "failed to resize image of volume %s", volume.ID)
+	}
+	return nil
+}
+
+// NodeExpansionRequired 镜像文件扩大后, 节点还需要刷新 loop 设备并扩展文件系统
+func (imageBackend) NodeExpansionRequired(volume Volume) bool {
+	return true
+}
+
+// CreateSnapshot 复制镜像文件, 和目录后端的快照方式相同
+func (imageBackend) CreateSnapshot(ctx context.Context, volume Volume, snapshot *Snapshot) error {
+	return directoryBackend{}.CreateSnapshot(ctx, volume, snapshot)
+}
+
+// RestoreSnapshot 复制快照的镜像文件, 再扩大到新卷的容量
+func (b imageBackend) RestoreSnapshot(ctx context.Context, snapshot Snapshot, volume *Volume) error {
+	if err := b.copyImage(snapshot.Path, volume); err != nil {
+		return storageError(err, "failed to restore snapshot %s", snapshot.ID)
+	}
+	logFor(ctx).Infof("Restored snapshot %s into %s", snapshot.ID, volume.Path)
+	return nil
+}
+
+// DeleteSnapshot 删除快照的镜像文件
+func (imageBackend) DeleteSnapshot(ctx context.Context, snapshot Snapshot) error {
+	return directoryBackend{}.DeleteSnapshot(ctx, snapshot)
+}
+
+// Stats 卷独占一个文件系统, 直接上报文件系统的使用情况
+func (imageBackend) Stats(ctx context.Context, volumeID, path string) (VolumeStats, error) {
+	return filesystemStats(volumeID, path)
+}
+
+// filesystemStats 返回独占一个文件系统的卷的使用情况
+func filesystemStats(volumeID, path string) (VolumeStats, error) {
+	stats, err := statFS(path)
+	if err != nil {
+		return VolumeStats{}, status.Errorf(codes.Internal, "failed to get stats of volume %s: %v", volumeID, err)
+	}
+	return VolumeStats{
+		TotalBytes:     stats.TotalBytes,
+		UsedBytes:      stats.UsedBytes,
+		AvailableBytes: stats.AvailableBytes,
+		TotalInodes:    stats.TotalInodes,
+		UsedInodes:     stats.UsedInodes,
+		FreeInodes:     stats.FreeInodes,
+	}, nil
+}
+
+// copyImage 把镜像文件 source 复制到新卷, 再扩大到新卷的容量
+func (imageBackend) copyImage(source string, volume *Volume) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return status.Errorf(codes.InvalidArgument, "source %s is a directory, not a volume image", source)
+	}
+	if err := os.MkdirAll(filepath.Dir(volume.Path), 0755); err != nil {
+		return err
+	}
+	if err := copyFile(source, volume.Path, 0600); err != nil {
+		os.Remove(volume.Path)
+		return err
+	}
+	return createBlockFile(volume.Path, volume.CapacityBytes, shouldPreallocate(volume.Parameters))
+}
+
+// stageFilesystemVolume 把镜像文件挂到 loop 设备上(后端是块设备时直接使用), 再把设备上的文件系统挂载到 stagingPath;
+// 后端文件的记录写在挂载之前, 挂载后被文件系统盖住, 卸载后 NodeUnstageVolume 又能读到它
+func stageFilesystemVolume(mounter *mount.SafeFormatAndMount, backingFile, stagingPath, fsType string, flags uintptr, data string) error {
+	device, err := stageBlockVolume(backingFile, stagingPath)
+	if err != nil {
+		return err
+	}
+	if err := formatAndMount(mounter, device, stagingPath, fsType, flags, data); err != nil {
+		return err
+	}
+	// 从更大的快照或者克隆恢复的卷, 文件系统还是源卷的大小, 挂载后扩展到整个设备
+	return resizeFilesystem(device, stagingPath, fsType)
+}
+
+// stagedFilesystemDevice 返回挂载在 stagingPath 上的卷的块设备和文件系统类型, 卷没有自己的文件系统时 ok 为 false;
+// 目录卷的 staging 是 bind mount, 挂载的是子目录而不是整个文件系统, 以此区分
+func stagedFilesystemDevice(stagingPath string) (device, fsType string, ok bool, err error) {
+	if stagingPath == "" {
+		return "", "", false, nil
+	}
+	entry, found, err := findMount(stagingPath)
+	if err != nil || !found {
+		return "", "", false, err
+	}
+	if entry.Root != "/" || !strings.HasPrefix(entry.Source, "/dev/") {
+		return "", "", false, nil
+	}
+	return entry.Source, entry.FsType, true, nil
+}
+
+// formatAndMount 用 mount-utils 的 SafeFormatAndMount 把设备上的文件系统挂载到 target: 设备上没有文件系统时才格式化,
+// 已有文件系统时先检查修复再挂载; 已有的文件系统和请求的类型不同时挂载失败, 返回 formatConflictError, 绝不覆盖已有的数据
+func formatAndMount(mounter *mount.SafeFormatAndMount, device, target, fsType string, flags uintptr, data string) error {
+	err := mounter.FormatAndMount(device, target, fsType, mountOptions(flags, data))
+	var mountErr mount.MountError
+	if errors.As(err, &mountErr) && mountErr.Type == mount.FilesystemMismatch {
+		existing, _ := mounter.GetDiskFormat(device)
+		return &formatConflictError{device: device, existing: existing, requested: fsType}
+	}
+	return err
+}
+
+// resizeFilesystem 把文件系统扩展到整个设备; ext 系列在线扩展作用于设备, xfs 作用于挂载点
+func resizeFilesystem(device, mountPoint, fsType string) error {
+	var cmd *exec.Cmd
+	switch fsType {
+	case "ext3", "ext4":
+		cmd = exec.Command("resize2fs", device)
+	case "xfs":
+		cmd = exec.Command("xfs_growfs", mountPoint)
+	default:
+		return fmt.Errorf("resizing %s filesystems is not supported", fsType)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to resize filesystem on %s: %v, output: %s", device, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
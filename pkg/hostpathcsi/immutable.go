@@ -0,0 +1,40 @@
+// Package hostpathcsi Description: 这个文件实现不可变卷: StorageClass 设置 immutable=true 时, 卷只在创建时从数据源(克隆、快照、
+// 导入的归档或者模板)写入数据, 之后每次发布都以只读方式挂载, 要求读写发布的请求被拒绝, 适合多个 pod 共享的参考数据。
+package hostpathcsi
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// immutableParameter 是 StorageClass 中开启不可变卷的参数
+const immutableParameter = "immutable"
+
+// isImmutableVolume 判断卷参数(或 VolumeContext)是否是不可变卷
+func isImmutableVolume(parameters map[string]string) bool {
+	return parameters[immutableParameter] == "true"
+}
+
+// checkImmutableVolume 检查不可变卷的请求: 卷创建之后不能再写入, 所以必须有数据源, 内存卷没有可以保留的数据
+func checkImmutableVolume(req *csi.CreateVolumeRequest) error {
+	switch {
+	case isMemoryVolume(req.Parameters):
+		return status.Error(codes.InvalidArgument, "memory volumes can not be immutable")
+	case req.VolumeContentSource == nil && req.Parameters[importParameter] == "" && !isTemplateVolume(req.Parameters):
+		return status.Errorf(codes.InvalidArgument, "immutable volumes need a data source, a volume, a snapshot, %s or %s", importParameter, templateParameter)
+	}
+	return nil
+}
+
+// checkImmutablePublish 检查不可变卷的发布请求是只读的: pod 里设置了 readOnly, 或者访问模式本身是只读的
+func checkImmutablePublish(req *csi.NodePublishVolumeRequest) error {
+	switch req.VolumeCapability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return nil
+	}
+	if req.Readonly {
+		return nil
+	}
+	return status.Errorf(codes.FailedPrecondition, "volume %s is immutable and can only be published read-only", req.VolumeId)
+}
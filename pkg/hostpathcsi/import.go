@@ -0,0 +1,70 @@
+// Package hostpathcsi Description: 这个文件实现从 tar 包导入卷: StorageClass 设置 importFrom 参数时, CreateVolume 创建空卷后
+// 把指定的归档(--import-dir 下的文件, 或者 http/https 地址)解包进去, 用于把已有的数据迁移到驱动管理的卷里。
+package hostpathcsi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// importParameter 是 StorageClass 中指定导入来源的参数, 值是 --import-dir 下的文件路径或者 http/https 地址
+const importParameter = "importFrom"
+
+// importHTTPClient 下载导入的归档, 只限制等待响应头的时间, 大的归档可以下载很久
+var importHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// isRemoteImport 判断导入来源是否是 http/https 地址
+func isRemoteImport(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// checkImportSource 检查导入来源: 本地文件必须在 --import-dir 下, 避免通过 StorageClass 读取节点上的任意文件
+func (c *Config) checkImportSource(source string) (string, error) {
+	if isRemoteImport(source) {
+		return source, nil
+	}
+	if c.ImportDir == "" {
+		return "", fmt.Errorf("importing from local files is disabled, start the driver with --import-dir")
+	}
+	if !filepath.IsAbs(source) {
+		return "", fmt.Errorf("import source %q must be an absolute path or an http(s) URL", source)
+	}
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", fmt.Errorf("import source %s is not accessible: %v", source, err)
+	}
+	if rel, err := filepath.Rel(c.ImportDir, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("import source %s is not under the import directory %s", source, c.ImportDir)
+	}
+	return resolved, nil
+}
+
+// openImportSource 打开导入来源, 返回归档的内容
+func (c *Config) openImportSource(source string) (io.ReadCloser, error) {
+	source, err := c.checkImportSource(source)
+	if err != nil {
+		return nil, err
+	}
+	if !isRemoteImport(source) {
+		return os.Open(source)
+	}
+	resp, err := importHTTPClient.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", source, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", source, resp.Status)
+	}
+	return resp.Body, nil
+}
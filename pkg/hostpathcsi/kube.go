@@ -0,0 +1,123 @@
+package hostpathcsi
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir 是 pod 内 ServiceAccount 凭证的挂载目录
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// kubeClient 用 pod 的 ServiceAccount 直接调用 API Server 的 REST 接口; 只用来读取节点的标签, 一个请求不需要 client-go 的 informer 和缓存
+type kubeClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// kubeAPIError 是 API Server 返回的非 2xx 响应
+type kubeAPIError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *kubeAPIError) Error() string {
+	return e.Status + ": " + e.Body
+}
+
+// isKubeStatus 判断 err 是否是状态码为 code 的 API Server 响应
+func isKubeStatus(err error, code int) bool {
+	apiErr, ok := err.(*kubeAPIError)
+	return ok && apiErr.StatusCode == code
+}
+
+// newKubeClient 用 pod 内的 ServiceAccount 凭证创建客户端, 不在集群里运行时返回错误
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is not set")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in service account CA")
+	}
+	return &kubeClient{
+		baseURL: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// do 发送请求, body 不为 nil 时编码成 JSON, 2xx 的响应解码到 out(不为 nil 时); 其他响应返回 *kubeAPIError
+func (c *kubeClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	// token 会被 kubelet 定期轮换, 每次请求重新读取
+	token, err := os.ReadFile(serviceAccountDir + "token")
+	if err != nil {
+		return fmt.Errorf("failed to read service account token: %v", err)
+	}
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &kubeAPIError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(raw)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// getNodeLabels 用 pod 的 ServiceAccount 访问 API Server, 返回节点的 labels
+func getNodeLabels(ctx context.Context, nodeName string) (map[string]string, error) {
+	client, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	var node struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := client.do(ctx, http.MethodGet, "/api/v1/nodes/"+url.PathEscape(nodeName), nil, &node); err != nil {
+		return nil, fmt.Errorf("failed to get node %s: %v", nodeName, err)
+	}
+	return node.Metadata.Labels, nil
+}
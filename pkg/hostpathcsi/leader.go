@@ -0,0 +1,214 @@
+// Package hostpathcsi Description: 这个文件实现 Controller 的 leader 选举: Controller 以多副本运行并开启 --leader-election 时,
+// 副本之间通过 client-go 的 leaderelection 和 coordination.k8s.io/v1 的 Lease 选出一个 leader, 只有 leader 处理 Controller 和
+// GroupController 的请求、运行垃圾回收等后台任务, 其他副本对这些请求返回 Unavailable, 等待接替。
+// 所有副本共用 --state-dir 下的状态文件, 成为 leader 时先从文件重新加载状态, 之后才开始服务, 不会用启动时的旧状态覆盖上一个 leader 的记录。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LeaderElectionConfig 是 leader 选举的配置
+type LeaderElectionConfig struct {
+	// Namespace 和 Name 是 Lease 对象, Namespace 为空时使用 pod 所在的 namespace
+	Namespace string
+	Name      string
+	// Identity 是这个副本的标识, 为空时使用主机名(即 pod 名)
+	Identity string
+	// LeaseDuration 是其他副本等待 leader 续约的时间, 超过后抢占
+	LeaseDuration time.Duration
+	// RenewDeadline 是 leader 续约失败之后放弃 leader 身份之前重试的时间
+	RenewDeadline time.Duration
+	// RetryPeriod 是每次尝试获取或续约的间隔
+	RetryPeriod time.Duration
+	// State 是副本之间共用的状态, 成为 leader 时从文件重新加载; 为空时不加载
+	State *State
+}
+
+// LeaderElector 参与 leader 选举, 并且可以作为 gRPC 拦截器让非 leader 拒绝 Controller 的请求
+type LeaderElector struct {
+	config  LeaderElectionConfig
+	elector *leaderelection.LeaderElector
+	// leading 表示当前是否是 leader, 在重新加载状态、启动后台任务之后才设置
+	leading atomic.Bool
+
+	// onStarted 和 onStopped 是 Run 传入的回调
+	onStarted, onStopped func()
+
+	// mu 保护 ctx、cancel 和 leading 的设置: ctx 是 Run 的 ctx, cancel 结束选举并释放 Lease; Run 返回时关闭 done
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// LeaseNameFor 返回驱动的 Controller 使用的 Lease 名字, 驱动名中的 . 和 _ 不能出现在对象名里
+func LeaseNameFor(driverName string) string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(strings.ToLower(driverName)) + "-controller"
+}
+
+// NewLeaderElector 检查配置并创建 LeaderElector, 不在集群里运行时返回错误
+func NewLeaderElector(config LeaderElectionConfig) (*LeaderElector, error) {
+	if config.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountDir + "namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the namespace of the pod, set it explicitly: %v", err)
+		}
+		config.Namespace = strings.TrimSpace(string(namespace))
+	}
+	if config.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the identity of this replica: %v", err)
+		}
+		config.Identity = hostname
+	}
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newLeaderElector(config, client)
+}
+
+// newLeaderElector 用 client 访问 Lease 创建 LeaderElector; 测试时传入假的 client
+func newLeaderElector(config LeaderElectionConfig, client kubernetes.Interface) (*LeaderElector, error) {
+	e := &LeaderElector{config: config, done: make(chan struct{})}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: config.Namespace, Name: config.Name},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: config.Identity},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		Name:          config.Name,
+		LeaseDuration: config.LeaseDuration,
+		RenewDeadline: config.RenewDeadline,
+		RetryPeriod:   config.RetryPeriod,
+		// 退出时主动释放 Lease, 备用副本不用等 Lease 过期就能接替
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.startedLeading,
+			OnStoppedLeading: e.stoppedLeading,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.elector = elector
+	return e, nil
+}
+
+// IsLeader 返回当前是否是 leader
+func (e *LeaderElector) IsLeader() bool {
+	return e.leading.Load()
+}
+
+// Run 参与选举直到 ctx 取消或者调用 Release: 成为 leader 时先重新加载状态再调用 onStarted;
+// 续约失败失去 leader 身份(或者重新加载状态失败)时调用 onStopped, 之后不再参与选举
+func (e *LeaderElector) Run(ctx context.Context, onStarted, onStopped func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	e.mu.Lock()
+	e.ctx, e.cancel = ctx, cancel
+	e.onStarted, e.onStopped = onStarted, onStopped
+	e.mu.Unlock()
+	defer close(e.done)
+
+	klog.Infof("Waiting to become the leader of lease %s/%s as %s", e.config.Namespace, e.config.Name, e.config.Identity)
+	e.elector.Run(ctx)
+}
+
+// startedLeading 在获得 Lease 之后调用, ctx 在失去 Lease 时取消: 其他副本可能在这个副本启动之后修改过状态文件,
+// 先重新加载, 再启动后台任务, 最后才作为 leader 开始处理请求
+func (e *LeaderElector) startedLeading(ctx context.Context) {
+	if e.config.State != nil {
+		if err := e.config.State.Reload(); err != nil {
+			klog.Errorf("Failed to reload state after becoming the leader of lease %s/%s: %v", e.config.Namespace, e.config.Name, err)
+			e.onStopped()
+			return
+		}
+	}
+	if ctx.Err() == nil {
+		klog.Infof("Became the leader of lease %s/%s", e.config.Namespace, e.config.Name)
+		e.onStarted()
+	}
+
+	e.mu.Lock()
+	lost := ctx.Err() != nil
+	if !lost {
+		e.leading.Store(true)
+	}
+	stopping := e.ctx.Err() != nil
+	e.mu.Unlock()
+	// 还没开始处理请求就失去了 Lease, stoppedLeading 看不到 leading, 在这里处理
+	if lost && !stopping {
+		klog.Errorf("Lost the leadership of lease %s/%s", e.config.Namespace, e.config.Name)
+		e.onStopped()
+	}
+}
+
+// stoppedLeading 在选举结束时调用; 只有作为 leader 处理请求时失去 Lease 才调用 onStopped, 退出时释放 Lease 不算
+func (e *LeaderElector) stoppedLeading() {
+	e.mu.Lock()
+	leading := e.leading.Swap(false)
+	stopping := e.ctx.Err() != nil
+	e.mu.Unlock()
+	if leading && !stopping {
+		klog.Errorf("Lost the leadership of lease %s/%s", e.config.Namespace, e.config.Name)
+		e.onStopped()
+	}
+}
+
+// Release 在驱动退出时结束选举并放弃 leader 身份, 让其他副本不用等 Lease 过期就能接替; 等 Lease 释放完成或者 ctx 超时才返回。
+// 调用之前这个副本对共用状态的修改必须已经完成, 释放之后其他副本随时可能开始修改状态文件
+func (e *LeaderElector) Release(ctx context.Context) error {
+	e.mu.Lock()
+	cancel := e.cancel
+	e.leading.Store(false)
+	if cancel != nil {
+		cancel()
+	}
+	e.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return fmt.Errorf("failed to release lease %s/%s: %v", e.config.Namespace, e.config.Name, ctx.Err())
+	}
+	klog.Infof("Released lease %s/%s", e.config.Namespace, e.config.Name)
+	return nil
+}
+
+// UnaryServerInterceptor 返回 gRPC 拦截器: 不是 leader 时 Controller 和 GroupController 的请求返回 Unavailable,
+// sidecar 会重试; 查询能力的请求不拒绝, sidecar 启动时需要它
+func (e *LeaderElector) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		controller := strings.HasPrefix(info.FullMethod, "/csi.v1.Controller/") || strings.HasPrefix(info.FullMethod, "/csi.v1.GroupController/")
+		capabilities := strings.HasSuffix(info.FullMethod, "GetCapabilities")
+		if controller && !capabilities && !e.IsLeader() {
+			return nil, status.Errorf(codes.Unavailable, "%s is not the leader of the controller, the current leader is %q", e.config.Identity, e.elector.GetLeader())
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,135 @@
+package hostpathcsi
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestLeaderElector 创建一个用 client 访问 Lease 的 LeaderElector, 续约时间很短, 测试不用等太久
+func newTestLeaderElector(t *testing.T, client *fake.Clientset, identity string, state *State) *LeaderElector {
+	t.Helper()
+	e, err := newLeaderElector(LeaderElectionConfig{
+		Namespace:     "kube-system",
+		Name:          LeaseNameFor("hostpath.csi.k8s.io"),
+		Identity:      identity,
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+		State:         state,
+	}, client)
+	if err != nil {
+		t.Fatalf("newLeaderElector: %v", err)
+	}
+	return e
+}
+
+// waitLeading 等 e 成为 leader
+func waitLeading(t *testing.T, e *LeaderElector, started <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s did not become the leader", e.config.Identity)
+	}
+	if !e.IsLeader() {
+		t.Fatalf("%s started leading but IsLeader() = false", e.config.Identity)
+	}
+}
+
+func TestLeaderElectorPromotionReloadsState(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	// 两个副本在启动时加载状态, 这时状态文件还不存在
+	stateA, err := NewState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateB, err := NewState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestLeaderElector(t, client, "replica-a", stateA)
+	startedA := make(chan struct{})
+	go a.Run(context.Background(), func() { close(startedA) }, func() { t.Error("replica-a stopped leading unexpectedly") })
+	waitLeading(t, a, startedA)
+
+	b := newTestLeaderElector(t, client, "replica-b", stateB)
+	startedB := make(chan struct{})
+	go b.Run(context.Background(), func() { close(startedB) }, func() { t.Error("replica-b stopped leading unexpectedly") })
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Release(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// replica-a 作为 leader 写入记录, 之后退出
+	if err := stateA.UpdateVolume(Volume{ID: "vol-a", Path: "/data/vol-a", CapacityBytes: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stateA.UpdateSnapshot(Snapshot{ID: "snap-a", SourceVolumeID: "vol-a", Path: "/data/snap-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if b.IsLeader() {
+		t.Fatal("replica-b is the leader while replica-a holds the lease")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// replica-b 接替之后写入新的记录, 不能覆盖 replica-a 的记录
+	waitLeading(t, b, startedB)
+	if err := stateB.UpdateVolume(Volume{ID: "vol-b", Path: "/data/vol-b", CapacityBytes: 2 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, state := range map[string]*State{"replica-b": stateB, "state file": reloaded} {
+		for _, id := range []string{"vol-a", "vol-b"} {
+			if _, ok := state.GetVolume(id); !ok {
+				t.Errorf("%s: volume %s is missing", name, id)
+			}
+		}
+		if _, ok := state.GetSnapshot("snap-a"); !ok {
+			t.Errorf("%s: snapshot snap-a is missing", name)
+		}
+	}
+}
+
+func TestLeaderElectorInterceptor(t *testing.T) {
+	e := newTestLeaderElector(t, fake.NewSimpleClientset(), "replica-a", nil)
+	interceptor := e.UnaryServerInterceptor()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+
+	tests := []struct {
+		method  string
+		leading bool
+		want    codes.Code
+	}{
+		{method: "/csi.v1.Controller/CreateVolume", want: codes.Unavailable},
+		{method: "/csi.v1.GroupController/CreateVolumeGroupSnapshot", want: codes.Unavailable},
+		{method: "/csi.v1.Controller/ControllerGetCapabilities", want: codes.OK},
+		{method: "/csi.v1.Node/NodePublishVolume", want: codes.OK},
+		{method: "/csi.v1.Controller/CreateVolume", leading: true, want: codes.OK},
+	}
+	for _, tt := range tests {
+		e.leading.Store(tt.leading)
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s (leading %v) = %v, want %v", tt.method, tt.leading, got, tt.want)
+		}
+	}
+}
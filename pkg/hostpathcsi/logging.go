@@ -0,0 +1,97 @@
+// Package hostpathcsi Description: 这个文件实现记录每次 CSI 调用的 gRPC 拦截器, 代替各个方法开头零散的日志: 在 --rpc-log-level 级别记录
+// 方法名、请求、耗时和结果的错误码, 再高一级记录响应; 失败的调用总是记录。请求和响应中 CSI 规范标记为 csi_secret 的字段
+// (StorageClass 引用的 Secret 等)在记录前替换掉, 日志里不会出现凭证。
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"k8s.io/klog"
+	"time"
+)
+
+// strippedSecret 是日志中代替 secret 字段的值
+const strippedSecret = "***stripped***"
+
+// NewLoggingInterceptor 返回记录 CSI 调用的 gRPC 拦截器, level 是请求和结果的日志级别, 响应在 level+1 级别记录
+func NewLoggingInterceptor(level klog.Level) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		log := logFor(ctx)
+		log.V(level).Infof("%s called with request: %s", info.FullMethod, sanitize(req))
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		duration := time.Since(start)
+		if err != nil {
+			log.Errorf("%s failed after %s with %s: %s", info.FullMethod, duration, status.Code(err), status.Convert(err).Message())
+			return resp, err
+		}
+		log.V(level).Infof("%s finished in %s with %s", info.FullMethod, duration, codes.OK)
+		log.V(level+1).Infof("%s response: %s", info.FullMethod, sanitize(resp))
+		return resp, err
+	}
+}
+
+// sanitize 把 CSI 消息编码成单行的 JSON, secret 字段的值替换成 strippedSecret
+func sanitize(msg interface{}) string {
+	m, ok := msg.(proto.Message)
+	if !ok || m == nil {
+		return "{}"
+	}
+	m = proto.Clone(m)
+	stripSecrets(m.ProtoReflect())
+	raw, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(raw)
+}
+
+// stripSecrets 递归地替换消息中带 csi_secret 选项的字段
+func stripSecrets(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if isSecretField(fd) {
+			switch {
+			case fd.IsMap():
+				v.Map().Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+					v.Map().Set(k, protoreflect.ValueOfString(strippedSecret))
+					return true
+				})
+			case fd.Kind() == protoreflect.StringKind && !fd.IsList():
+				m.Set(fd, protoreflect.ValueOfString(strippedSecret))
+			default:
+				m.Clear(fd)
+			}
+			return true
+		}
+		switch {
+		case fd.IsMap() && fd.MapValue().Kind() == protoreflect.MessageKind:
+			v.Map().Range(func(_ protoreflect.MapKey, value protoreflect.Value) bool {
+				stripSecrets(value.Message())
+				return true
+			})
+		case fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			for i := 0; i < v.List().Len(); i++ {
+				stripSecrets(v.List().Get(i).Message())
+			}
+		case !fd.IsMap() && !fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			stripSecrets(v.Message())
+		}
+		return true
+	})
+}
+
+// isSecretField 判断字段在 CSI 规范中是否标记为 csi_secret
+func isSecretField(fd protoreflect.FieldDescriptor) bool {
+	opts := fd.Options()
+	if opts == nil || !proto.HasExtension(opts, csi.E_CsiSecret) {
+		return false
+	}
+	secret, _ := proto.GetExtension(opts, csi.E_CsiSecret).(bool)
+	return secret
+}
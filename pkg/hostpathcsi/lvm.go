@@ -0,0 +1,191 @@
+// Package hostpathcsi Description: 这个文件实现可选的 lvm 后端: 每个卷是卷组里 thin pool 上的一个 thin LV, 文件系统卷在 stage 时格式化并挂载,
+// block 卷直接使用 LV 的设备; 快照、克隆和从快照恢复都是 thin snapshot, 不需要复制数据。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// lvmBackendName 是 lvm 后端的名字
+	lvmBackendName = "lvm"
+	// lvmSnapshotPrefix 是快照 LV 名字的前缀, 和卷的 LV 区分开
+	lvmSnapshotPrefix = "snapshot-"
+)
+
+func init() {
+	filesystemBackends[lvmBackendName] = true
+}
+
+// lvmBackend 把卷保存为 thin pool 上的 thin LV
+type lvmBackend struct {
+	// volumeGroup 和 thinPool 是卷所在的卷组和 thin pool
+	volumeGroup string
+	thinPool    string
+}
+
+// NewLVMBackend 创建 lvm 后端, 卷创建在卷组 volumeGroup 的 thin pool thinPool 上; 需要用 RegisterBackend 登记后才能使用
+func NewLVMBackend(volumeGroup, thinPool string) Backend {
+	return lvmBackend{volumeGroup: volumeGroup, thinPool: thinPool}
+}
+
+func (lvmBackend) Name() string {
+	return lvmBackendName
+}
+
+// CreateVolume 创建一个卷容量大小的 thin LV, 卷的路径是 LV 的设备
+func (b lvmBackend) CreateVolume(ctx context.Context, volume *Volume) error {
+	if volume.CapacityBytes <= 0 {
+		return status.Error(codes.InvalidArgument, "required bytes must be set for lvm volumes")
+	}
+	volume.Path = b.devicePath(volume.ID)
+	if b.exists(volume.ID) {
+		return nil
+	}
+	if _, err := runLVM("lvcreate", "--thin", "-V", bytesArg(volume.CapacityBytes), "-n", volume.ID, b.volumeGroup+"/"+b.thinPool); err != nil {
+		return status.Errorf(codes.Internal, "failed to create logical volume for volume %s: %v", volume.ID, err)
+	}
+	return nil
+}
+
+// CloneVolume 对源卷做一个 thin snapshot 作为新卷
+func (b lvmBackend) CloneVolume(ctx context.Context, source Volume, volume *Volume) error {
+	if err := b.snapshotAsVolume(source.ID, volume); err != nil {
+		return status.Errorf(codes.Internal, "failed to clone volume %s: %v", source.ID, err)
+	}
+	logFor(ctx).Infof("Cloned volume %s into %s", source.ID, volume.Path)
+	return nil
+}
+
+// DeleteVolume 删除卷的 LV
+func (b lvmBackend) DeleteVolume(ctx context.Context, volume Volume) error {
+	if err := b.remove(volume.ID); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete logical volume of volume %s: %v", volume.ID, err)
+	}
+	return nil
+}
+
+// ExpandVolume 扩大 LV, 文件系统由 NodeExpandVolume 扩展
+func (b lvmBackend) ExpandVolume(ctx context.Context, volume Volume, capacity int64) error {
+	if err := b.extend(volume.ID, capacity); err != nil {
+		return status.Errorf(codes.Internal, "failed to expand volume %s: %v", volume.ID, err)
+	}
+	return nil
+}
+
+// NodeExpansionRequired 文件系统卷需要节点扩展文件系统, block 卷扩大 LV 后立即生效
+func (lvmBackend) NodeExpansionRequired(volume Volume) bool {
+	return volume.AccessType != accessTypeBlock
+}
+
+// CreateSnapshot 对卷做一个 thin snapshot, 快照的 Path 记录快照 LV 的名字(卷组/LV)
+func (b lvmBackend) CreateSnapshot(ctx context.Context, volume Volume, snapshot *Snapshot) error {
+	name := lvmSnapshotPrefix + snapshot.ID
+	if !b.exists(name) {
+		if _, err := runLVM("lvcreate", "-s", "-n", name, b.volumeGroup+"/"+volume.ID); err != nil {
+			return status.Errorf(codes.Internal, "failed to snapshot volume %s: %v", volume.ID, err)
+		}
+	}
+	size, err := b.size(name)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get size of snapshot %s: %v", snapshot.ID, err)
+	}
+	snapshot.Path = b.volumeGroup + "/" + name
+	snapshot.SizeBytes = size
+	return nil
+}
+
+// RestoreSnapshot 对快照 LV 再做一个 thin snapshot 作为新卷
+func (b lvmBackend) RestoreSnapshot(ctx context.Context, snapshot Snapshot, volume *Volume) error {
+	if err := b.snapshotAsVolume(lvmSnapshotPrefix+snapshot.ID, volume); err != nil {
+		return status.Errorf(codes.Internal, "failed to restore snapshot %s: %v", snapshot.ID, err)
+	}
+	logFor(ctx).Infof("Restored snapshot %s into %s", snapshot.ID, volume.Path)
+	return nil
+}
+
+// DeleteSnapshot 删除快照 LV
+func (b lvmBackend) DeleteSnapshot(ctx context.Context, snapshot Snapshot) error {
+	if err := b.remove(lvmSnapshotPrefix + snapshot.ID); err != nil {
+		return status.Errorf(codes.Internal, "failed to delete snapshot %s: %v", snapshot.ID, err)
+	}
+	return nil
+}
+
+// Stats 文件系统卷独占 LV 上的文件系统, 直接上报文件系统的使用情况
+func (lvmBackend) Stats(ctx context.Context, volumeID, path string) (VolumeStats, error) {
+	return filesystemStats(volumeID, path)
+}
+
+// snapshotAsVolume 对 LV origin 做一个激活的 thin snapshot 作为新卷, 再扩大到新卷的容量
+func (b lvmBackend) snapshotAsVolume(origin string, volume *Volume) error {
+	volume.Path = b.devicePath(volume.ID)
+	if !b.exists(volume.ID) {
+		// thin snapshot 默认带有跳过激活的标记, -kn 去掉这个标记, 新卷和普通卷一样被激活
+		if _, err := runLVM("lvcreate", "-s", "-kn", "-n", volume.ID, b.volumeGroup+"/"+origin); err != nil {
+			return err
+		}
+	}
+	return b.extend(volume.ID, volume.CapacityBytes)
+}
+
+// extend 把 LV 扩大到 capacity, 已经不小于 capacity 时什么都不做
+func (b lvmBackend) extend(name string, capacity int64) error {
+	size, err := b.size(name)
+	if err != nil {
+		return err
+	}
+	if size >= capacity {
+		return nil
+	}
+	_, err = runLVM("lvextend", "-L", bytesArg(capacity), b.volumeGroup+"/"+name)
+	return err
+}
+
+// remove 删除 LV, 不存在时什么都不做
+func (b lvmBackend) remove(name string) error {
+	if !b.exists(name) {
+		return nil
+	}
+	_, err := runLVM("lvremove", "-y", b.volumeGroup+"/"+name)
+	return err
+}
+
+// size 返回 LV 的大小(字节)
+func (b lvmBackend) size(name string) (int64, error) {
+	out, err := runLVM("lvs", "--noheadings", "--units", "b", "--nosuffix", "-o", "lv_size", b.volumeGroup+"/"+name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// exists 判断 LV 是否存在
+func (b lvmBackend) exists(name string) bool {
+	return exec.Command("lvs", b.volumeGroup+"/"+name).Run() == nil
+}
+
+// devicePath 返回 LV 的设备路径
+func (b lvmBackend) devicePath(name string) string {
+	return "/dev/" + b.volumeGroup + "/" + name
+}
+
+// bytesArg 把字节数转换成 LVM 的大小参数, LVM 会向上取整到 extent 的大小
+func bytesArg(size int64) string {
+	return strconv.FormatInt(size, 10) + "b"
+}
+
+// runLVM 执行一条 LVM 命令, 返回它的输出
+func runLVM(command string, args ...string) (string, error) {
+	out, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v, output: %s", command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
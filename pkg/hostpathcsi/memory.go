@@ -0,0 +1,38 @@
+// Package hostpathcsi Description: 这个文件实现内存卷: StorageClass 设置 medium=Memory 时, NodeStageVolume 在 staging 目录挂载一个
+// 请求容量大小的 tmpfs, 而不是使用磁盘上的卷目录; 大小由内核限制, 适合作为高速的临时空间, unstage 后数据随 tmpfs 一起丢失。
+package hostpathcsi
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	mount "k8s.io/mount-utils"
+	"os"
+	"strconv"
+)
+
+const (
+	// mediumParameter 是 StorageClass 中选择存储介质的参数
+	mediumParameter = "medium"
+	// mediumMemory 表示卷使用内存(tmpfs)
+	mediumMemory = "Memory"
+	// volumeContextSizeKey 是 VolumeContext 中记录卷容量的 key, Node 端用它设置 tmpfs 的大小
+	volumeContextSizeKey = "size"
+)
+
+// isMemoryVolume 判断卷是否使用内存
+func isMemoryVolume(parameters map[string]string) bool {
+	return parameters[mediumParameter] == mediumMemory
+}
+
+// mountMemoryVolume 在 target 上挂载一个 size 字节的 tmpfs, data 是额外的挂载选项(例如 SELinux 标签)
+func mountMemoryVolume(mounter mount.Interface, target string, size int64, flags uintptr, data string) error {
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return fmt.Errorf("failed to create staging path %s: %v", target, err)
+	}
+	return mounter.Mount("tmpfs", target, "tmpfs", mountOptions(flags, "size="+strconv.FormatInt(size, 10), data))
+}
+
+// resizeMemoryVolume 把挂载在 target 上的 tmpfs 调整为 size 字节, 已有的数据不受影响
+func resizeMemoryVolume(mounter mount.Interface, target string, size int64) error {
+	return mounter.Mount("tmpfs", target, "tmpfs", mountOptions(unix.MS_REMOUNT, "size="+strconv.FormatInt(size, 10)))
+}
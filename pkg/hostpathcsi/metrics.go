@@ -0,0 +1,163 @@
+// Package hostpathcsi Description: 这个文件实现 Prometheus 指标(--metrics-address 的 /metrics): gRPC 拦截器统计每个 CSI 方法的调用次数、
+// 按 gRPC 错误码统计的失败次数和耗时分布; 卷的数量和容量、节点上卷的用量、后台校验发现的损坏文件数在抓取时从状态和各组件读取。
+package hostpathcsi
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"path"
+	"time"
+)
+
+// metricsNamespace 是所有指标名的前缀
+const metricsNamespace = "hostpathcsi"
+
+// Metrics 保存驱动的 Prometheus 指标
+type Metrics struct {
+	registry *prometheus.Registry
+	// operations 是每个方法的调用次数, errors 是失败次数, duration 是耗时
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	// panics 是每个方法处理中出现 panic 的次数
+	panics *prometheus.CounterVec
+	// collector 在抓取时读取卷相关的指标
+	collector *volumeCollector
+}
+
+// NewMetrics 创建指标, 同时导出 Go 运行时和进程的指标
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operations_total",
+			Help:      "Number of CSI calls by method.",
+		}, []string{"method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_errors_total",
+			Help:      "Number of failed CSI calls by method and gRPC status code.",
+		}, []string{"method", "code"}),
+		// 卷的创建、擦除和迁移可能要几分钟, 桶覆盖到 10 分钟
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of CSI calls by method.",
+			Buckets:   []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+		}, []string{"method"}),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "panics_total",
+			Help:      "Number of panics recovered while handling CSI calls by method.",
+		}, []string{"method"}),
+		collector: &volumeCollector{},
+	}
+	m.registry.MustRegister(
+		m.operations, m.errors, m.duration, m.panics, m.collector,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// SetState 导出状态中记录的卷和快照的数量和容量
+func (m *Metrics) SetState(state *State) {
+	m.collector.state = state
+}
+
+// SetNodeServer 导出节点上已发布的卷的用量, 来自后台用量统计的缓存
+func (m *Metrics) SetNodeServer(node *NodeServer) {
+	m.collector.node = node
+}
+
+// SetControllerServer 导出后台校验发现的每个卷的损坏文件数
+func (m *Metrics) SetControllerServer(controller *ControllerServer) {
+	m.collector.controller = controller
+}
+
+// Handler 返回 /metrics 的 HTTP handler
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry}))
+	return mux
+}
+
+// UnaryServerInterceptor 返回统计每次 CSI 调用的 gRPC 拦截器
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		// FullMethod 是 /csi.v1.Node/NodePublishVolume 的形式, 方法名在各服务之间不重复
+		method := path.Base(info.FullMethod)
+		m.operations.WithLabelValues(method).Inc()
+		m.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			m.errors.WithLabelValues(method, status.Code(err).String()).Inc()
+		}
+		return resp, err
+	}
+}
+
+var (
+	volumesDesc = prometheus.NewDesc(metricsNamespace+"_volumes",
+		"Number of provisioned volumes.", nil, nil)
+	volumeBytesDesc = prometheus.NewDesc(metricsNamespace+"_volume_capacity_bytes",
+		"Total capacity of provisioned volumes in bytes.", nil, nil)
+	snapshotsDesc = prometheus.NewDesc(metricsNamespace+"_snapshots",
+		"Number of snapshots.", nil, nil)
+	snapshotBytesDesc = prometheus.NewDesc(metricsNamespace+"_snapshot_size_bytes",
+		"Total size of snapshots in bytes.", nil, nil)
+	volumeUsedDesc = prometheus.NewDesc(metricsNamespace+"_volume_used_bytes",
+		"Used bytes of each volume published on this node, from the background usage accounting.", []string{"volume_id"}, nil)
+	volumeCorruptedDesc = prometheus.NewDesc(metricsNamespace+"_volume_corrupted_files",
+		"Files of each volume that failed the last integrity check.", []string{"volume_id"}, nil)
+)
+
+// volumeCollector 在抓取时读取卷相关的指标, 没有设置的组件不导出对应的指标
+type volumeCollector struct {
+	state      *State
+	node       *NodeServer
+	controller *ControllerServer
+}
+
+func (c *volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumesDesc
+	ch <- volumeBytesDesc
+	ch <- snapshotsDesc
+	ch <- snapshotBytesDesc
+	ch <- volumeUsedDesc
+	ch <- volumeCorruptedDesc
+}
+
+func (c *volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.state != nil {
+		var volumeBytes, snapshotBytes int64
+		volumes, snapshots := c.state.ListVolumes(), c.state.ListSnapshots()
+		for _, v := range volumes {
+			volumeBytes += v.CapacityBytes
+		}
+		for _, s := range snapshots {
+			snapshotBytes += s.SizeBytes
+		}
+		ch <- prometheus.MustNewConstMetric(volumesDesc, prometheus.GaugeValue, float64(len(volumes)))
+		ch <- prometheus.MustNewConstMetric(volumeBytesDesc, prometheus.GaugeValue, float64(volumeBytes))
+		ch <- prometheus.MustNewConstMetric(snapshotsDesc, prometheus.GaugeValue, float64(len(snapshots)))
+		ch <- prometheus.MustNewConstMetric(snapshotBytesDesc, prometheus.GaugeValue, float64(snapshotBytes))
+	}
+	if c.node != nil {
+		for id, stats := range c.node.VolumeUsage() {
+			ch <- prometheus.MustNewConstMetric(volumeUsedDesc, prometheus.GaugeValue, float64(stats.UsedBytes), id)
+		}
+	}
+	if c.controller != nil {
+		for id, corrupted := range c.controller.ScrubResults() {
+			ch <- prometheus.MustNewConstMetric(volumeCorruptedDesc, prometheus.GaugeValue, float64(corrupted), id)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Package hostpathcsi Description: 这个文件实现卷在存储池之间的迁移, 运维可以腾空一块磁盘而不删除 PVC:
+// 先在卷还在使用时用 rsync 复制一遍, 再在持有 ControllerServer 锁(期间其他 Controller 请求等待)并确认卷没有发布时增量同步一遍,
+// 原路径换成指向新路径的软链接, PV 里记录的旧路径仍然可以使用, 最后更新状态记录。只支持 directory 和 image 后端。
+package hostpathcsi
+
+import (
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// migratingSuffix 是迁移过程中新存储池里的数据的后缀, 同步完成后才改名为卷的路径
+	migratingSuffix = ".migrating"
+	// migratedSuffix 是迁移时原数据在删除之前临时重命名的后缀
+	migratedSuffix = ".migrated"
+)
+
+// MigrateVolume 把卷的数据迁移到存储池 pool(为空表示 DataDir); 卷必须没有发布在任何节点上, 否则 pod 还在写原来的数据
+func (s *ControllerServer) MigrateVolume(volumeID, pool string) (Volume, error) {
+	volume, ok := s.state.GetVolume(volumeID)
+	if !ok {
+		return Volume{}, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+	}
+	newPath, err := s.checkMigration(volume, pool)
+	if err != nil {
+		return Volume{}, err
+	}
+	copyPath := newPath + migratingSuffix
+	// 重试时已经有上一次复制的数据, 它们占用的空间已经不算在可用空间里了
+	if _, err := os.Lstat(copyPath); os.IsNotExist(err) {
+		available, err := s.availableCapacity(pool)
+		if err != nil {
+			return Volume{}, status.Errorf(codes.Internal, "failed to get capacity: %v", err)
+		}
+		if volume.CapacityBytes > available {
+			return Volume{}, status.Errorf(codes.ResourceExhausted, "volume %s needs %d bytes but pool %q only has %d bytes available", volume.ID, volume.CapacityBytes, pool, available)
+		}
+	}
+
+	// 第一遍复制最慢, 不持有锁, 卷还在使用也可以进行
+	klog.Infof("Migrating volume %s from %s to %s", volumeID, volume.Path, newPath)
+	if err := syncVolumeData(volume.Path, copyPath); err != nil {
+		return Volume{}, status.Errorf(codes.Internal, "failed to copy volume %s: %v", volumeID, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	volume, ok = s.state.GetVolume(volumeID)
+	if !ok {
+		os.RemoveAll(copyPath)
+		return Volume{}, status.Errorf(codes.NotFound, "volume %s was deleted during the migration", volumeID)
+	}
+	if _, err := s.checkMigration(volume, pool); err != nil {
+		return Volume{}, err
+	}
+	// 复制好的数据保留下来, 卷不再使用之后重试只需要增量同步
+	if err := checkVolumeUnused(s.config.publishedDir(), volume); err != nil {
+		return Volume{}, err
+	}
+	if err := syncVolumeData(volume.Path, copyPath); err != nil {
+		return Volume{}, status.Errorf(codes.Internal, "failed to sync volume %s: %v", volumeID, err)
+	}
+	// 迁回之前的存储池时, 新路径是上次迁移留下的软链接
+	var previousPaths []string
+	for _, path := range volume.PreviousPaths {
+		if path == newPath {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return Volume{}, status.Errorf(codes.Internal, "failed to remove old link %s of volume %s: %v", path, volumeID, err)
+			}
+			continue
+		}
+		previousPaths = append(previousPaths, path)
+	}
+	if err := os.Rename(copyPath, newPath); err != nil {
+		return Volume{}, status.Errorf(codes.Internal, "failed to move migrated data of volume %s into place: %v", volumeID, err)
+	}
+	if volume.AccessType != accessTypeBlock && volume.Backend != imageBackendName {
+		if err := applyQuota(volume.ID, newPath, volume.CapacityBytes); err != nil {
+			klog.Warningf("Failed to apply project quota to migrated volume %s: %v", volumeID, err)
+		}
+		if err := clearQuota(volume.Path); err != nil {
+			klog.Warningf("Failed to clear project quota of %s: %v", volume.Path, err)
+		}
+	}
+
+	// 原路径先改名再换成软链接, 这样原路径不存在的时间最短
+	oldPath := volume.Path
+	if err := os.Rename(oldPath, oldPath+migratedSuffix); err != nil {
+		return Volume{}, status.Errorf(codes.Internal, "failed to move away old data of volume %s: %v", volumeID, err)
+	}
+	if err := os.Symlink(newPath, oldPath); err != nil {
+		os.Rename(oldPath+migratedSuffix, oldPath)
+		return Volume{}, status.Errorf(codes.Internal, "failed to link old path of volume %s: %v", volumeID, err)
+	}
+	volume.PreviousPaths = append(previousPaths, oldPath)
+	volume.Path = newPath
+	volume.Pool = pool
+	if err := s.state.UpdateVolume(volume); err != nil {
+		return Volume{}, status.Errorf(codes.Internal, "failed to record migration of volume %s: %v", volumeID, err)
+	}
+	if err := os.RemoveAll(oldPath + migratedSuffix); err != nil {
+		klog.Warningf("Failed to remove old data of volume %s: %v", volumeID, err)
+	}
+	klog.Infof("Volume %s migrated to %s", volumeID, newPath)
+	return volume, nil
+}
+
+// checkMigration 检查卷能否迁移到存储池 pool, 返回卷在新存储池中的路径
+func (s *ControllerServer) checkMigration(volume Volume, pool string) (string, error) {
+	switch {
+	case volume.Static:
+		return "", status.Errorf(codes.FailedPrecondition, "volume %s is a static volume, its data is not managed by the driver", volume.ID)
+	case isMemoryVolume(volume.Parameters):
+		return "", status.Errorf(codes.FailedPrecondition, "volume %s is a memory volume and has no data to migrate", volume.ID)
+	case volume.Backend != "" && volume.Backend != directoryBackendName && volume.Backend != imageBackendName:
+		return "", status.Errorf(codes.FailedPrecondition, "volumes on the %s backend can not be migrated", volume.Backend)
+	case volume.Pool == pool:
+		return "", status.Errorf(codes.InvalidArgument, "volume %s is already in pool %q", volume.ID, pool)
+	}
+	poolDir, err := s.config.PoolDir(pool)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return filepath.Join(poolDir, volume.ID), nil
+}
+
+// checkVolumeUnused 检查卷没有发布在任何节点上, 镜像卷和 block 卷也没有挂在 loop 设备上
+func checkVolumeUnused(publishedDir string, volume Volume) error {
+	published, err := listPublishedNodes(publishedDir)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to load publish records: %v", err)
+	}
+	if nodes := published[volume.ID]; len(nodes) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is still published on nodes %v, stop its pods before migrating it", volume.ID, nodes)
+	}
+	if fi, err := os.Stat(volume.Path); err == nil && fi.Mode().IsRegular() {
+		if device, err := findLoopDevice(volume.Path); err == nil && device != "" {
+			return status.Errorf(codes.FailedPrecondition, "volume %s is still attached to %s", volume.ID, device)
+		}
+	}
+	return nil
+}
+
+// syncVolumeData 用 rsync 把卷目录(或镜像文件)同步到 dst, 保留硬链接、ACL、xattr 和稀疏文件, 删除 dst 中多出来的文件
+func syncVolumeData(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	args := []string{"-aHAX", "--numeric-ids", "--sparse", "--delete"}
+	if fi.IsDir() {
+		// 末尾的 / 表示同步目录的内容, 而不是在 dst 下再建一层目录
+		args = append(args, src+"/", dst+"/")
+	} else {
+		args = append(args, src, dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if out, err := exec.Command("rsync", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("rsync failed: %v, output: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// removePreviousPaths 删除卷迁移之前留下的指向新路径的软链接
+func removePreviousPaths(volume Volume) {
+	for _, path := range volume.PreviousPaths {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(path); err != nil {
+				klog.Warningf("Failed to remove old path %s of volume %s: %v", path, volume.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package hostpathcsi Description: 这个文件实现卷的数据被手工删除或移走之后的处理(--on-missing-backing): 状态里还有卷的记录,
+// 卷目录(或 block 卷的文件)却不在了。ControllerGetVolume 和 NodePublishVolume 按策略返回 NotFound、重新创建一个空卷,
+// 或者(只在 Controller 上)删除卷的记录, 而不是在后面的操作里报出让人看不懂的错误。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+)
+
+// MissingBackingPolicy 是卷的数据不见之后的处理策略
+type MissingBackingPolicy string
+
+const (
+	// MissingBackingError 返回 NotFound, 由运维决定怎么处理
+	MissingBackingError MissingBackingPolicy = "error"
+	// MissingBackingRecreate 在原来的位置重新创建一个空卷
+	MissingBackingRecreate MissingBackingPolicy = "recreate"
+	// MissingBackingPrune 删除卷的记录, 之后的请求都按卷不存在处理; Node 上没有状态, 按 error 处理
+	MissingBackingPrune MissingBackingPolicy = "prune"
+)
+
+// ParseMissingBackingPolicy 解析 --on-missing-backing 的值, 为空时是 error
+func ParseMissingBackingPolicy(value string) (MissingBackingPolicy, error) {
+	switch policy := MissingBackingPolicy(value); policy {
+	case "":
+		return MissingBackingError, nil
+	case MissingBackingError, MissingBackingRecreate, MissingBackingPrune:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown policy %q, must be %s, %s or %s", value, MissingBackingError, MissingBackingRecreate, MissingBackingPrune)
+}
+
+// SetOnMissingBacking 设置 ControllerGetVolume 发现卷的数据不见时的处理策略
+func (s *ControllerServer) SetOnMissingBacking(policy MissingBackingPolicy) {
+	s.onMissing = policy
+}
+
+// SetOnMissingBacking 设置 NodePublishVolume 发现卷目录不见时的处理策略
+func (s *NodeServer) SetOnMissingBacking(policy MissingBackingPolicy) {
+	s.onMissing = policy
+}
+
+// checkBacking 检查状态里记录的卷的数据还在, 不在时按策略处理, 返回处理之后的卷;
+// 静态卷的目录不归驱动所有, 不会重新创建
+func (s *ControllerServer) checkBacking(ctx context.Context, volume Volume) (Volume, error) {
+	if _, err := os.Lstat(volume.Path); !os.IsNotExist(err) {
+		return volume, nil
+	}
+	// 删除记录和重新创建卷要和 CreateVolume、ControllerExpandVolume 互斥; 拿到锁之前卷可能已经被重新创建或者删除, 重新读取记录再检查
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.lookupVolume(volume.ID)
+	if !ok {
+		return Volume{}, status.Errorf(codes.NotFound, "volume %s not found", volume.ID)
+	}
+	volume = current
+	if _, err := os.Lstat(volume.Path); !os.IsNotExist(err) {
+		return volume, nil
+	}
+	switch {
+	case s.onMissing == MissingBackingPrune:
+		if err := s.state.DeleteVolume(volume.ID); err != nil {
+			return Volume{}, status.Errorf(codes.Internal, "failed to remove the record of volume %s: %v", volume.ID, err)
+		}
+		logFor(ctx).Warningf("Removed the record of volume %s whose data at %s is missing", volume.ID, volume.Path)
+		return Volume{}, status.Errorf(codes.NotFound, "volume %s was removed because its data at %s is missing", volume.ID, volume.Path)
+	case s.onMissing == MissingBackingRecreate && !volume.Static:
+		backend, err := backendOf(volume.Backend)
+		if err != nil {
+			return Volume{}, status.Errorf(codes.Internal, "failed to recreate volume %s: %v", volume.ID, err)
+		}
+		if err := backend.CreateVolume(ctx, &volume); err != nil {
+			return Volume{}, err
+		}
+		// 模板卷和 CreateVolume 一样要有 overlayfs 的 upper 和 work 目录, 否则节点上 stage 会失败
+		if isTemplateVolume(volume.Parameters) {
+			if err := createOverlayDirs(volume.Path); err != nil {
+				backend.DeleteVolume(ctx, volume)
+				return Volume{}, storageError(err, "failed to create overlay directories of volume %s", volume.ID)
+			}
+		}
+		if root := ownershipRoot(volume); root != "" {
+			if err := applyVolumeOwnership(root, volume.Parameters); err != nil {
+				return Volume{}, status.Errorf(codes.Internal, "failed to apply ownership to volume %s: %v", volume.ID, err)
+			}
+		}
+		if err := s.state.UpdateVolume(volume); err != nil {
+			return Volume{}, status.Errorf(codes.Internal, "failed to record volume %s: %v", volume.ID, err)
+		}
+		logFor(ctx).Warningf("Recreated volume %s as an empty volume at %s, its data was missing", volume.ID, volume.Path)
+		return volume, nil
+	}
+	return Volume{}, status.Errorf(codes.NotFound, "data of volume %s at %s is missing", volume.ID, volume.Path)
+}
+
+// recreateSource 在 NodePublishVolume 发现目录卷的目录不见时按策略处理: recreate 时重新创建空的卷目录并返回 true,
+// 其他策略返回 false, 由调用方返回 NotFound。只处理驱动分配的路径上的目录卷, 其他卷的数据由后端或者 stage 准备
+func (s *NodeServer) recreateSource(ctx context.Context, req *csi.NodePublishVolumeRequest, sourcePath string) (bool, error) {
+	backend := req.VolumeContext[backendParameter]
+	if s.onMissing != MissingBackingRecreate || req.VolumeCapability.GetBlock() != nil ||
+		(backend != "" && backend != directoryBackendName) || !s.config.isManagedPath(req.VolumeId, sourcePath) {
+		return false, nil
+	}
+	if err := os.MkdirAll(sourcePath, 0755); err != nil {
+		return false, status.Errorf(codes.Internal, "failed to recreate volume directory %s: %v", sourcePath, err)
+	}
+	if err := applyVolumeOwnership(sourcePath, req.VolumeContext); err != nil {
+		return false, status.Errorf(codes.Internal, "failed to apply ownership to volume %s: %v", req.VolumeId, err)
+	}
+	logFor(ctx).Warningf("Recreated the missing directory %s of volume %s as an empty directory", sourcePath, req.VolumeId)
+	return true, nil
+}
@@ -0,0 +1,125 @@
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControllerGetVolumeMissingBacking(t *testing.T) {
+	tests := []struct {
+		policy     MissingBackingPolicy
+		wantCode   codes.Code
+		wantRecord bool
+		wantDir    bool
+	}{
+		{policy: MissingBackingError, wantCode: codes.NotFound, wantRecord: true},
+		{policy: MissingBackingRecreate, wantRecord: true, wantDir: true},
+		{policy: MissingBackingPrune, wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			s := newTestControllerServer(t)
+			s.SetOnMissingBacking(tt.policy)
+			path := s.config.VolumePath("pvc-1")
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.state.UpdateVolume(Volume{ID: "pvc-1", Path: path, Backend: directoryBackendName}); err != nil {
+				t.Fatal(err)
+			}
+			// 卷目录在驱动之外被删除
+			if err := os.RemoveAll(path); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := s.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pvc-1"})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerGetVolume() error = %v, want code %v", err, tt.wantCode)
+			}
+			if _, ok := s.state.GetVolume("pvc-1"); ok != tt.wantRecord {
+				t.Errorf("volume recorded = %v, want %v", ok, tt.wantRecord)
+			}
+			if fi, err := os.Stat(path); (err == nil && fi.IsDir()) != tt.wantDir {
+				t.Errorf("volume directory exists = %v, want %v", err == nil, tt.wantDir)
+			}
+		})
+	}
+}
+
+func TestControllerGetVolumeMissingStaticVolume(t *testing.T) {
+	s := newTestControllerServer(t)
+	s.SetOnMissingBacking(MissingBackingRecreate)
+	path := filepath.Join(t.TempDir(), "static")
+	if err := s.state.UpdateVolume(Volume{ID: "pv-static", Path: path, Static: true}); err != nil {
+		t.Fatal(err)
+	}
+	// 静态卷的目录不归驱动所有, 不会重新创建
+	if _, err := s.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pv-static"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("ControllerGetVolume() error = %v, want code %v", err, codes.NotFound)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("directory of the static volume was recreated: %v", err)
+	}
+}
+
+func TestControllerGetVolumeMissingTemplateVolume(t *testing.T) {
+	s := newTestControllerServer(t)
+	s.SetOnMissingBacking(MissingBackingRecreate)
+	path := s.config.VolumePath("pvc-1")
+	parameters := map[string]string{templateParameter: "base"}
+	if err := s.state.UpdateVolume(Volume{ID: "pvc-1", Path: path, Backend: directoryBackendName, Parameters: parameters}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pvc-1"}); err != nil {
+		t.Fatalf("ControllerGetVolume: %v", err)
+	}
+	// 重新创建的模板卷要有 overlayfs 的 upper 和 work 目录, 节点才能 stage
+	for _, dir := range []string{overlayUpperDir, overlayWorkDir} {
+		if fi, err := os.Stat(filepath.Join(path, dir)); err != nil || !fi.IsDir() {
+			t.Errorf("%s directory of the recreated template volume is missing: %v", dir, err)
+		}
+	}
+}
+
+func TestNodePublishVolumeMissingBacking(t *testing.T) {
+	tests := []struct {
+		policy   MissingBackingPolicy
+		wantCode codes.Code
+		wantDir  bool
+	}{
+		{policy: MissingBackingError, wantCode: codes.NotFound},
+		{policy: MissingBackingRecreate, wantDir: true},
+		// Node 上没有状态可以修剪, 和 error 一样
+		{policy: MissingBackingPrune, wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			s := newTestNodeServer(t)
+			useFakeMounter(s)
+			s.SetOnMissingBacking(tt.policy)
+			path := s.config.VolumePath("pvc-1")
+
+			_, err := s.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:   "pvc-1",
+				TargetPath: filepath.Join(t.TempDir(), "mount"),
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+				VolumeContext: map[string]string{volumeContextPathKey: path},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("NodePublishVolume() error = %v, want code %v", err, tt.wantCode)
+			}
+			if _, err := os.Stat(path); (err == nil) != tt.wantDir {
+				t.Errorf("volume directory exists = %v, want %v", err == nil, tt.wantDir)
+			}
+		})
+	}
+}
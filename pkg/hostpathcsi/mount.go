@@ -0,0 +1,233 @@
+package hostpathcsi
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sys/unix"
+	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewMounter 返回 NodeServer 使用的 mount-utils 挂载器: 挂载和卸载调用 mount(8) 和 umount(8), 格式化调用 mkfs;
+// 不通过 systemd-run 挂载, 挂载留在驱动容器的 mount namespace 里, 由 Bidirectional 传播到宿主机
+func NewMounter() *mount.SafeFormatAndMount {
+	return mount.NewSafeFormatAndMount(mount.NewWithoutSystemd(""), utilexec.New())
+}
+
+// mountFlagOptions 是 mount(2) 标志对应的 mount(8) 选项, 按这个顺序转换
+var mountFlagOptions = []struct {
+	flag   uintptr
+	option string
+}{
+	{unix.MS_REMOUNT, "remount"},
+	{unix.MS_RDONLY, "ro"},
+	{unix.MS_NODEV, "nodev"},
+	{unix.MS_NOSUID, "nosuid"},
+	{unix.MS_NOEXEC, "noexec"},
+	{unix.MS_NOATIME, "noatime"},
+	{unix.MS_NODIRATIME, "nodiratime"},
+	{unix.MS_RELATIME, "relatime"},
+	{unix.MS_STRICTATIME, "strictatime"},
+}
+
+// mountOptions 把 mount(2) 标志和逗号分隔的文件系统选项(例如 tmpfs 的 size、SELinux 的 context)转换成 mount-utils 的选项
+func mountOptions(flags uintptr, data ...string) []string {
+	var options []string
+	for _, f := range mountFlagOptions {
+		if flags&f.flag != 0 {
+			options = append(options, f.option)
+		}
+	}
+	for _, o := range splitMountOptions(joinMountData(data...)) {
+		if o != "" {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// bindMount 把 source bind mount 到 target; flags 不为 0 时 mount-utils 再以这些标志 remount, bind mount 的 ro、nodev 等标志只能这样设置
+func bindMount(mounter mount.Interface, source, target string, flags uintptr) error {
+	return mounter.Mount(source, target, "", append([]string{"bind"}, mountOptions(flags)...))
+}
+
+// isMountPoint 判断 path 是否是挂载点, 对 bind mount 的目录和文件也有效; path 不存在时返回 false
+func isMountPoint(mounter mount.Interface, path string) (bool, error) {
+	mounted, err := mounter.IsMountPoint(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return mounted, err
+}
+
+// unmount 卸载 target, target 不存在或者不是挂载点时什么都不做
+func unmount(mounter mount.Interface, target string) error {
+	mounted, err := isMountPoint(mounter, target)
+	if err != nil || !mounted {
+		return err
+	}
+	return mounter.Unmount(target)
+}
+
+// mountFlagValues 是 bind mount 支持的挂载选项, 值为 0 的选项是默认行为, 接受但不需要处理
+var mountFlagValues = map[string]uintptr{
+	"defaults":    0,
+	"bind":        0,
+	"rw":          0,
+	"dev":         0,
+	"suid":        0,
+	"exec":        0,
+	"ro":          unix.MS_RDONLY,
+	"nodev":       unix.MS_NODEV,
+	"nosuid":      unix.MS_NOSUID,
+	"noexec":      unix.MS_NOEXEC,
+	"noatime":     unix.MS_NOATIME,
+	"nodiratime":  unix.MS_NODIRATIME,
+	"relatime":    unix.MS_RELATIME,
+	"strictatime": unix.MS_STRICTATIME,
+}
+
+// mountFlagOverrides 是可以取消默认加固标志的挂载选项
+var mountFlagOverrides = map[string]uintptr{
+	"suid": unix.MS_NOSUID,
+	"dev":  unix.MS_NODEV,
+	"exec": unix.MS_NOEXEC,
+}
+
+// hardenedMountFlags 返回 defaults 中没有被 mountOptions 里的 suid、dev、exec 取消的标志
+func hardenedMountFlags(defaults uintptr, options []string) uintptr {
+	for _, option := range options {
+		for _, o := range splitMountOptions(option) {
+			defaults &^= mountFlagOverrides[strings.TrimSpace(o)]
+		}
+	}
+	return defaults
+}
+
+// parseMountFlags 把 StorageClass/PV 的 mountOptions 转换成 mount(2) 的标志, 不支持的选项返回错误;
+// 一个选项里可以用逗号写多个值, 例如 "noatime,nodev"
+func parseMountFlags(options []string) (uintptr, error) {
+	var flags uintptr
+	for _, option := range options {
+		for _, o := range splitMountOptions(option) {
+			o = strings.TrimSpace(o)
+			if o == "" {
+				continue
+			}
+			value, ok := mountFlagValues[o]
+			if !ok {
+				return 0, fmt.Errorf("mount option %q is not supported for hostpath volumes", o)
+			}
+			flags |= value
+		}
+	}
+	return flags, nil
+}
+
+// mountEntry 是 /proc/self/mountinfo 中的一条挂载记录
+type mountEntry struct {
+	// Root 是挂载的源文件系统内的路径, 挂载整个文件系统时是 "/", bind mount 子目录时是子目录的路径
+	Root       string
+	MountPoint string
+	FsType     string
+	// Source 是挂载源, 对块设备上的文件系统是设备路径
+	Source string
+	// SuperOptions 是文件系统的挂载选项, 例如 xfs 的 prjquota
+	SuperOptions string
+}
+
+// findMount 返回挂载在 path 上的记录, 同一个路径挂载了多次时返回最后(最上层)的一条
+func findMount(path string) (mountEntry, bool, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return mountEntry{}, false, err
+	}
+	entries, err := readMountInfo()
+	if err != nil {
+		return mountEntry{}, false, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].MountPoint == abs {
+			return entries[i], true, nil
+		}
+	}
+	return mountEntry{}, false, nil
+}
+
+// mountContaining 返回 path 所在的挂载, 即挂载点是 path 本身或者它最近的上级目录的那条记录
+func mountContaining(path string) (mountEntry, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return mountEntry{}, err
+	}
+	entries, err := readMountInfo()
+	if err != nil {
+		return mountEntry{}, err
+	}
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].MountPoint == dir {
+				return entries[i], nil
+			}
+		}
+		if dir == "/" {
+			return mountEntry{}, fmt.Errorf("no mount found for %s", path)
+		}
+	}
+}
+
+// readMountInfo 解析 /proc/self/mountinfo, 按文件中的顺序返回所有挂载
+func readMountInfo() ([]mountEntry, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %v", err)
+	}
+	defer f.Close()
+
+	var entries []mountEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 格式: ID 父ID 设备号 root 挂载点 选项 [可选字段...] - 文件系统类型 挂载源 超级块选项,
+		// 路径中的空格等特殊字符以八进制转义
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		entry := mountEntry{Root: unescapeMountPath(fields[3]), MountPoint: unescapeMountPath(fields[4])}
+		for i := 5; i+2 < len(fields); i++ {
+			if fields[i] == "-" {
+				entry.FsType = fields[i+1]
+				entry.Source = unescapeMountPath(fields[i+2])
+				if i+3 < len(fields) {
+					entry.SuperOptions = fields[i+3]
+				}
+				break
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// unescapeMountPath 还原 mountinfo 中 \040 这样的八进制转义
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package hostpathcsi
+
+import (
+	"golang.org/x/sys/unix"
+	mount "k8s.io/mount-utils"
+	"testing"
+)
+
+func TestBindMount(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		// wantOptions 是传给 mount-utils 的选项, wantRemount 是 mount-utils 第二次 remount 时使用的选项
+		wantOptions []string
+		wantRemount []string
+	}{
+		{
+			name:        "no flags",
+			options:     []string{"rw", "defaults"},
+			wantOptions: []string{"bind"},
+			wantRemount: []string{"bind", "remount"},
+		},
+		{
+			name:        "read only",
+			options:     []string{"ro"},
+			wantOptions: []string{"bind", "ro"},
+			wantRemount: []string{"bind", "remount", "ro"},
+		},
+		{
+			name:        "several options in one entry",
+			options:     []string{"ro,noatime", "nodev"},
+			wantOptions: []string{"bind", "ro", "nodev", "noatime"},
+			wantRemount: []string{"bind", "remount", "ro", "nodev", "noatime"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, err := parseMountFlags(tt.options)
+			if err != nil {
+				t.Fatalf("parseMountFlags(%v) error = %v", tt.options, err)
+			}
+			fake := mount.NewFakeMounter(nil)
+			if err := bindMount(fake, "/src", "/dst", flags); err != nil {
+				t.Fatalf("bindMount: %v", err)
+			}
+			if len(fake.MountPoints) != 1 || fake.MountPoints[0].Device != "/src" || fake.MountPoints[0].Path != "/dst" {
+				t.Fatalf("mounts = %+v, want /src on /dst", fake.MountPoints)
+			}
+			if got := fake.MountPoints[0].Opts; !equalStrings(got, tt.wantOptions) {
+				t.Errorf("options = %v, want %v", got, tt.wantOptions)
+			}
+			bind, _, remount := mount.MakeBindOpts(fake.MountPoints[0].Opts)
+			if !bind || !equalStrings(remount, tt.wantRemount) {
+				t.Errorf("remount options = %v (bind %v), want %v", remount, bind, tt.wantRemount)
+			}
+		})
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags uintptr
+		data  []string
+		want  []string
+	}{
+		{name: "nothing"},
+		{name: "remount a tmpfs", flags: unix.MS_REMOUNT, data: []string{"size=1024"}, want: []string{"remount", "size=1024"}},
+		{
+			name:  "selinux context with a comma",
+			flags: unix.MS_RDONLY | unix.MS_NOSUID,
+			data:  []string{"", `context="system_u:object_r:container_file_t:s0:c1,c2"`, "discard"},
+			want:  []string{"ro", "nosuid", `context="system_u:object_r:container_file_t:s0:c1,c2"`, "discard"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mountOptions(tt.flags, tt.data...); !equalStrings(got, tt.want) {
+				t.Errorf("mountOptions(%#x, %q) = %q, want %q", tt.flags, tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHardenedMountFlags(t *testing.T) {
+	defaults := uintptr(unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+	tests := []struct {
+		name    string
+		options []string
+		want    uintptr
+	}{
+		{name: "no options", want: defaults},
+		{name: "exec", options: []string{"exec"}, want: unix.MS_NOSUID | unix.MS_NODEV},
+		{name: "suid and dev in one entry", options: []string{"suid, dev"}, want: unix.MS_NOEXEC},
+		{name: "unrelated options", options: []string{"ro", "noatime"}, want: defaults},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hardenedMountFlags(defaults, tt.options); got != tt.want {
+				t.Errorf("hardenedMountFlags(%v) = %#x, want %#x", tt.options, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMountFlagsUnsupported(t *testing.T) {
+	if _, err := parseMountFlags([]string{"noatime,sync"}); err == nil {
+		t.Error("parseMountFlags() accepted the unsupported option sync")
+	}
+}
@@ -6,115 +6,736 @@ import (
 	"context"
 	"fmt"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog"
+	mount "k8s.io/mount-utils"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeNameEnv 是通过 downward API 注入节点名的环境变量
+const nodeNameEnv = "KUBE_NODE_NAME"
+
+// topologyNodeKey 是拓扑信息中表示节点的 key
+const topologyNodeKey = "topology.hostpath.csi/node"
+
+// lookupHostname 返回主机名, 是 ResolveNodeID 最后的选择; 测试时替换
+var lookupHostname = os.Hostname
+
+const (
+	// ephemeralContextKey 是 kubelet 在 inline ephemeral 卷的 VolumeContext 里设置的 key
+	ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+	// ephemeralDirName 是 DataDir 下存放 inline ephemeral 卷的临时目录的隐藏目录, 每个 pod 的卷一个子目录
+	ephemeralDirName = ".ephemeral"
 )
 
 type NodeServer struct {
-	csi.NodeServer
+	// 没有实现的 RPC 由它返回 codes.Unimplemented
+	csi.UnimplementedNodeServer
+
+	// config 是和 ControllerServer 共用的配置, VolumeContext 里没有卷路径时按它拼接
+	config *Config
+	// nodeID 是 NodeGetInfo 返回的节点 ID
+	nodeID string
+	// segments 是 NodeGetInfo 在节点名之外上报的拓扑, 例如节点的可用区和地域
+	segments map[string]string
+	// mounter 负责 stage 和 publish 阶段的挂载, 以及镜像卷第一次 stage 时的格式化
+	mounter *mount.SafeFormatAndMount
+
+	// usage 缓存后台统计的卷用量, 没有启动后台统计时为空
+	usage *usageCache
+
+	// mu 保护 published、ephemeral、ephemeralCleanups、backends 以及重新加载配置时可以修改的 maxVolumes 和 hardenedFlags
+	mu sync.Mutex
+	// maxVolumes 是节点上最多同时发布的卷数量, 0 表示不限制
+	maxVolumes int64
+	// hardenedFlags 是发布卷时默认加上的 nosuid、nodev、noexec 标志, mountOptions 里写了 suid、dev、exec 时不加对应的标志
+	hardenedFlags uintptr
+	// published 记录每个卷当前发布到的目标路径, 用于 SINGLE_NODE_SINGLE_WRITER 这类访问模式的检查,
+	// 同时持久化到 publishedPath, 供 Controller 的 ListVolumes 上报卷发布在哪些节点上
+	published     map[string]map[string]bool
+	publishedPath string
+	// ephemeral 记录以 inline ephemeral 卷发布的卷, 同时持久化到 ephemeralRecordPath;
+	// 只有这些卷在最后一个目标路径卸载之后删除临时目录, 驱动重启之后也能找到
+	ephemeral           map[string]bool
+	ephemeralRecordPath string
+	// ephemeralGrace 是最后一个目标路径卸载之后删除临时目录之前的宽限期, ephemeralCleanups 是宽限期内等待删除的卷
+	ephemeralGrace    time.Duration
+	ephemeralCleanups map[string]*ephemeralCleanup
+	// onMissing 是卷目录不见时 NodePublishVolume 的处理策略, 为空等同于 error
+	onMissing MissingBackingPolicy
+	// capacityTruth 为 store(或为空)时 NodeGetVolumeStats 在容量和状态里的记录不一致时报告卷异常
+	capacityTruth CapacityTruth
+	// stateSnapshot 是 NodeGetVolumeStats 比较容量时读取的状态文件, 文件没有变化时不重新解析
+	stateSnapshot *stateSnapshot
+	// backends 记录已发布卷的后端(来自 VolumeContext), NodeGetVolumeStats 只拿得到卷 ID 和路径;
+	// 没有记录的卷(例如驱动重启之前发布的卷)按目录后端统计
+	backends map[string]string
+}
+
+// NewNodeServer 创建一个 NodeServer, 并加载该节点之前的发布记录
+func NewNodeServer(config *Config, nodeID string, segments map[string]string, maxVolumes int64) (*NodeServer, error) {
+	publishedPath := filepath.Join(config.publishedDir(), nodeID+".json")
+	published, err := loadPublished(publishedPath)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralRecordPath := filepath.Join(config.ephemeralRecordDir(), nodeID+".json")
+	ephemeral, ok, err := loadEphemeral(ephemeralRecordPath)
+	if err != nil {
+		return nil, err
+	}
+	// 之前的版本没有记录哪些卷是 ephemeral 卷, 升级后按仍然发布着的卷有没有临时目录补上
+	if !ok {
+		for volumeID := range published {
+			if _, err := os.Stat(config.ephemeralPath(volumeID)); err == nil {
+				ephemeral[volumeID] = true
+			}
+		}
+	}
+	return &NodeServer{
+		config:              config,
+		nodeID:              nodeID,
+		segments:            segments,
+		maxVolumes:          maxVolumes,
+		mounter:             NewMounter(),
+		published:           published,
+		publishedPath:       publishedPath,
+		ephemeral:           ephemeral,
+		ephemeralRecordPath: ephemeralRecordPath,
+		ephemeralCleanups:   make(map[string]*ephemeralCleanup),
+		backends:            make(map[string]string),
+		usage:               newUsageCache(),
+		stateSnapshot:       &stateSnapshot{path: config.StatePath()},
+	}, nil
+}
+
+// SetHardenedMounts 让发布的卷默认以 nosuid、nodev 挂载, noexec 为 true 时再加上 noexec, 减少宿主机目录暴露给 pod 的攻击面;
+// 需要的卷可以在 mountOptions 里写 suid、dev 或 exec 取消对应的标志。hardened 为 false 时恢复为不加任何标志
+func (s *NodeServer) SetHardenedMounts(hardened, noexec bool) {
+	var flags uintptr
+	if hardened {
+		flags = unix.MS_NOSUID | unix.MS_NODEV
+		if noexec {
+			flags |= unix.MS_NOEXEC
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hardenedFlags = flags
+}
+
+// SetMaxVolumes 修改节点上最多同时发布的卷数量; 已经发布的卷不受影响, 调度器要等 kubelet 重新注册驱动才能看到新的上限
+func (s *NodeServer) SetMaxVolumes(maxVolumes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxVolumes = maxVolumes
+}
+
+// ResolveNodeID 按 flag > 文件 > 环境变量 > 主机名 的优先级确定节点 ID, 全部失败时返回错误而不是使用一个错误的默认值
+func ResolveNodeID(flagValue, idFile string) (string, error) {
+	if id := strings.TrimSpace(flagValue); id != "" {
+		return id, nil
+	}
+	if idFile != "" {
+		data, err := os.ReadFile(idFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read node id file %s: %v", idFile, err)
+		}
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+		klog.Warningf("Node id file %s is empty, falling back to $%s", idFile, nodeNameEnv)
+	}
+	if id := strings.TrimSpace(os.Getenv(nodeNameEnv)); id != "" {
+		return id, nil
+	}
+	hostname, err := lookupHostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine node id: no flag, file or $%s given and hostname lookup failed: %v", nodeNameEnv, err)
+	}
+	// 极简容器里主机名可能是空或者 localhost, 这种值作为节点 ID 没有意义
+	if hostname = strings.TrimSpace(hostname); hostname == "" || hostname == "localhost" {
+		return "", fmt.Errorf("failed to determine node id: no flag, file or $%s given and hostname %q is not usable", nodeNameEnv, hostname)
+	}
+	return hostname, nil
+}
+
+// reservePublish 检查访问模式和节点的卷数量上限, 并在同一个临界区里把 targetPath 预先记到卷的发布记录里,
+// 这样并发的发布请求能看到它: SINGLE_NODE_SINGLE_WRITER 要求同一时间只能有一个目标路径发布该卷, 两个请求不会都通过检查。
+// 发布失败时调用返回的 rollback 撤销预留; 目标路径之前已经有发布记录(重试)时 rollback 什么都不做
+func (s *NodeServer) reservePublish(volumeID, targetPath string, capability *csi.VolumeCapability) (func(), error) {
+	mode := capability.GetAccessMode().GetMode()
+	if capability.GetAccessMode() != nil && !supportedAccessModes[mode] {
+		return nil, status.Errorf(codes.InvalidArgument, "access mode %s is not supported", mode)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.published[volumeID][targetPath] {
+		return func() {}, nil
+	}
+	if mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		for existing := range s.published[volumeID] {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already published at %s with access mode %s", volumeID, existing, mode)
+		}
+	}
+	// 已经发布过的卷再发布到其他目标路径不占用新的名额
+	if s.maxVolumes > 0 && len(s.published[volumeID]) == 0 && int64(len(s.published)) >= s.maxVolumes {
+		return nil, status.Errorf(codes.ResourceExhausted, "node %s already has %d volumes published, the limit is %d", s.nodeID, len(s.published), s.maxVolumes)
+	}
+	if s.published[volumeID] == nil {
+		s.published[volumeID] = make(map[string]bool)
+	}
+	s.published[volumeID][targetPath] = true
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.published[volumeID], targetPath)
+		if len(s.published[volumeID]) == 0 {
+			delete(s.published, volumeID)
+		}
+		// 预留期间其他请求可能已经把它写进了文件
+		if err := savePublished(s.publishedPath, s.published); err != nil {
+			klog.Warningf("Failed to remove the reserved publish of volume %s at %s: %v", volumeID, targetPath, err)
+		}
+	}, nil
+}
+
+// trackPublish 记录卷发布到了 targetPath, 以及卷所在的后端和卷是否是 inline ephemeral 卷
+func (s *NodeServer) trackPublish(volumeID, targetPath, backend string, ephemeral bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if backend != "" {
+		s.backends[volumeID] = backend
+	}
+	// 先记录 ephemeral 卷, 发布记录写下之前崩溃时临时目录也不会被遗忘
+	if ephemeral && !s.ephemeral[volumeID] {
+		s.ephemeral[volumeID] = true
+		if err := saveEphemeral(s.ephemeralRecordPath, s.ephemeral); err != nil {
+			return err
+		}
+	}
+	// reservePublish 已经在内存里记下了目标路径, 这里写到文件里
+	if s.published[volumeID] == nil {
+		s.published[volumeID] = make(map[string]bool)
+	}
+	s.published[volumeID][targetPath] = true
+	return savePublished(s.publishedPath, s.published)
+}
+
+// volumeBackend 返回发布时记录的卷的后端, 没有记录时返回空字符串
+func (s *NodeServer) volumeBackend(volumeID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backends[volumeID]
+}
+
+// untrackPublish 删除卷在 targetPath 上的发布记录, 返回卷是否是已经没有任何发布的 inline ephemeral 卷;
+// 这时调用方删除临时目录之后再调用 forgetEphemeral, 中途失败重试时仍然会返回 true
+func (s *NodeServer) untrackPublish(volumeID, targetPath string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.published[volumeID][targetPath] {
+		delete(s.published[volumeID], targetPath)
+		if len(s.published[volumeID]) == 0 {
+			delete(s.published, volumeID)
+			delete(s.backends, volumeID)
+		}
+		if err := savePublished(s.publishedPath, s.published); err != nil {
+			return false, err
+		}
+	}
+	return s.ephemeral[volumeID] && len(s.published[volumeID]) == 0, nil
+}
+
+// forgetEphemeral 在删除临时目录之后删除卷的 inline ephemeral 记录
+func (s *NodeServer) forgetEphemeral(volumeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ephemeral[volumeID] {
+		return nil
+	}
+	delete(s.ephemeral, volumeID)
+	return saveEphemeral(s.ephemeralRecordPath, s.ephemeral)
 }
 
 func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	klog.Infof("Received NodePublishVolume request for %s", req.VolumeId)
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
 
 	targetPath := req.TargetPath
-	sourcePath := "/tmp/csi/hostpath/" + req.VolumeId
+	sourcePath := s.sourcePathFor(req.VolumeId, req.VolumeContext, req.PublishContext)
+	// 手工创建的 PV 指向的已有目录, 检查后记录下来供 Controller 登记
+	if err := s.adoptStaticVolume(ctx, req.VolumeId, req.VolumeContext, req.VolumeCapability); err != nil {
+		return nil, err
+	}
 
-	// 检查源路径是否存在
-	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("source path %s does not exist", sourcePath)
+	rollback, err := s.reservePublish(req.VolumeId, targetPath, req.VolumeCapability)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.publishVolume(ctx, req, sourcePath)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// publishVolume 完成 NodePublishVolume 在预留目标路径之后的工作, 成功时把发布记录写到文件里
+func (s *NodeServer) publishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest, sourcePath string) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.TargetPath
+	if err := checkSecrets(nodePublishSecrets, req.VolumeContext, req.Secrets); err != nil {
+		return nil, err
+	}
+	readOnly := req.Readonly
+	if isImmutableVolume(req.VolumeContext) {
+		if err := checkImmutablePublish(req); err != nil {
+			return nil, err
+		}
+		readOnly = true
 	}
 
-	// 检查目标路径的父目录是否存在，若不存在则创建
-	parentDir := filepath.Dir(targetPath)
-	if err := os.MkdirAll(parentDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create parent directory %s: %v", parentDir, err)
+	// block 卷把 loop 设备 bind mount 到目标文件上
+	if req.VolumeCapability.GetBlock() != nil {
+		if err := publishBlockVolume(s.mounter, sourcePath, targetPath, readOnly); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to publish block volume %s: %v", req.VolumeId, err)
+		}
+		if err := s.trackPublish(req.VolumeId, targetPath, req.VolumeContext[backendParameter], false); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record publish of volume %s: %v", req.VolumeId, err)
+		}
+		logFor(ctx).Infof("Block volume %s successfully published to %s", req.VolumeId, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	// 检查目标路径是否存在
-	if fi, err := os.Lstat(targetPath); err == nil {
-		// 如果目标路径已经是符号链接，检查它是否指向正确的源路径
-		if fi.Mode()&os.ModeSymlink != 0 {
-			existingSource, err := os.Readlink(targetPath)
-			if err == nil && existingSource == sourcePath {
-				klog.Infof("Target path %s already linked to correct source %s, skipping creation.", targetPath, sourcePath)
-				return &csi.NodePublishVolumeResponse{}, nil
-			}
-			klog.Infof("Target path %s is a symlink but points to %s, removing it.", targetPath, existingSource)
+	// 从 staging 目录发布时 mountOptions 已经在 stage 阶段应用, 这里再应用一次, 保证直接发布时也生效;
+	// readOnly 的卷以只读方式 bind mount, kubelet 的 subPath、fsGroup、SELinux 重新打标签都依赖真实的挂载点
+	mountOptions, seLinuxContext := extractSELinuxContext(req.VolumeCapability.GetMount().GetMountFlags())
+	flags, err := parseMountFlags(mountOptions)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	s.mu.Lock()
+	hardenedFlags := s.hardenedFlags
+	s.mu.Unlock()
+	flags |= hardenedMountFlags(hardenedFlags, mountOptions)
+	if readOnly {
+		flags |= unix.MS_RDONLY
+	}
+
+	// 卷已经 stage 时从 staging 目录发布, 这样 stage 阶段做的处理对 pod 可见
+	if req.StagingTargetPath != "" {
+		if mounted, err := isMountPoint(s.mounter, req.StagingTargetPath); err == nil && mounted {
+			sourcePath = req.StagingTargetPath
+		}
+	}
+
+	// 镜像卷、LVM 卷、内存卷和模板卷只有 stage 之后才有可以发布的文件系统
+	if (filesystemBackends[req.VolumeContext[backendParameter]] || isMemoryVolume(req.VolumeContext) || isTemplateVolume(req.VolumeContext)) && sourcePath != req.StagingTargetPath {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s must be staged before it is published", req.VolumeId)
+	}
+
+	// inline ephemeral 卷没有经过 CreateVolume, 在这里为 pod 创建一个临时目录
+	ephemeral := req.VolumeContext[ephemeralContextKey] == "true"
+	if ephemeral {
+		sourcePath = s.config.ephemeralPath(req.VolumeId)
+		// 宽限期内重新发布时复用还没有删除的临时目录
+		reused := s.cancelEphemeralCleanup(req.VolumeId)
+		if err := os.MkdirAll(sourcePath, 0755); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create ephemeral volume directory %s: %v", sourcePath, err)
+		}
+		if reused {
+			logFor(ctx).Infof("Reusing ephemeral volume directory %s within the grace period", sourcePath)
 		} else {
-			klog.Infof("Target path %s exists but is not a symlink, removing it.", targetPath)
+			logFor(ctx).Infof("Created ephemeral volume directory %s", sourcePath)
+		}
+	}
+
+	// 检查源路径是否存在, 目录卷的目录被手工删除时按 --on-missing-backing 处理
+	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+		recreated, err := s.recreateSource(ctx, req, sourcePath)
+		if err != nil {
+			return nil, err
+		}
+		if !recreated {
+			return nil, status.Errorf(codes.NotFound, "source path %s does not exist", sourcePath)
+		}
+	}
+
+	// 按 pod 隔离时只发布卷里属于这个 pod 的子目录
+	staged := sourcePath == req.StagingTargetPath
+	if mode := req.VolumeContext[podSubdirParameter]; mode != "" {
+		name, err := podSubdirFor(mode, req.VolumeContext)
+		if err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if sourcePath, err = ensurePodSubdir(sourcePath, name); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to prepare pod subdirectory of volume %s: %v", req.VolumeId, err)
+		}
+	}
+
+	// fsGroupPolicy=File 时 kubelet 不再自己 chown, 由驱动把卷的属组改成 pod 的 fsGroup
+	if group := req.VolumeCapability.GetMount().GetVolumeMountGroup(); group != "" {
+		if err := applyVolumeMountGroup(sourcePath, group); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to apply volume mount group to %s: %v", sourcePath, err)
+		}
+	}
+
+	// 没有 stage 直接发布的目录卷在这里打标签; 从 staging 目录发布时 stage 阶段已经处理过
+	if seLinuxContext != "" && !staged {
+		if err := relabel(sourcePath, seLinuxContext); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to relabel volume %s: %v", req.VolumeId, err)
 		}
-		// 删除现有的文件或目录，避免冲突
-		if err := os.RemoveAll(targetPath); err != nil {
-			return nil, fmt.Errorf("failed to remove existing target path %s: %v", targetPath, err)
+	}
+
+	// 之前的版本用软链接发布, 升级后遇到旧的软链接先删除, 再创建挂载点目录
+	if fi, err := os.Lstat(targetPath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		logFor(ctx).Infof("Target path %s is a symlink left by an older version, replacing it with a bind mount.", targetPath)
+		if err := os.Remove(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove symlink at target path %s: %v", targetPath, err)
 		}
 	}
+	if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create target path %s: %v", targetPath, err)
+	}
 
-	// 创建软链接
-	if err := os.Symlink(sourcePath, targetPath); err != nil {
-		return nil, fmt.Errorf("failed to create symlink from %s to %s: %v", sourcePath, targetPath, err)
+	// 幂等: 目标路径已经是挂载点时直接返回
+	mounted, err := isMountPoint(s.mounter, targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check target path %s: %v", targetPath, err)
+	}
+	if mounted {
+		logFor(ctx).Infof("Target path %s is already mounted, skipping.", targetPath)
+	} else if err := traceOperation(ctx, "mount.publish", func(ctx context.Context) error {
+		return s.publishMount(ctx, req.VolumeContext, sourcePath, targetPath, flags)
+	}, attribute.String("csi.volume_id", req.VolumeId), attribute.String("mount.target", targetPath)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to bind mount %s to %s: %v", sourcePath, targetPath, err)
+	}
+	if hasIOLimitParameters(req.VolumeContext) {
+		limits, err := parseIOLimits(req.VolumeContext)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := applyIOLimits(ctx, s.config.ioLimitsPath(s.nodeID), targetPath, limits); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to apply io limits to volume %s: %v", req.VolumeId, err)
+		}
 	}
 
-	klog.Infof("Volume %s successfully mounted to %s", sourcePath, targetPath)
+	if err := s.trackPublish(req.VolumeId, targetPath, req.VolumeContext[backendParameter], ephemeral); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record publish of volume %s: %v", req.VolumeId, err)
+	}
+	logFor(ctx).Infof("Volume %s successfully mounted to %s", sourcePath, targetPath)
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// publishMount 把卷 bind mount 到目标路径; 设置了 idMap 参数且有可用的映射时使用 idmapped mount,
+// 使用 pod 的映射但 pod 没有开启 user namespace 时退回普通的 bind mount
+func (s *NodeServer) publishMount(ctx context.Context, volumeContext map[string]string, sourcePath, targetPath string, flags uintptr) error {
+	uidMap, gidMap, ok, err := volumeIDMappings(volumeContext, targetPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if volumeContext[idMapParameter] != "" {
+			logFor(ctx).Infof("Pod of %s has no user namespace, publishing without id mapping.", targetPath)
+		}
+		return bindMount(s.mounter, sourcePath, targetPath, flags)
+	}
+	return idmappedBindMount(sourcePath, targetPath, uidMap, gidMap, flags)
+}
+
+// sourcePathFor 返回卷在宿主机上的源路径: 优先使用 Controller 写入 VolumeContext/PublishContext 的路径,
+// 都没有时才按默认布局拼接
+func (s *NodeServer) sourcePathFor(volumeID string, volumeContext, publishContext map[string]string) string {
+	if path := volumeContext[volumeContextPathKey]; path != "" {
+		return path
+	}
+	if path := publishContext[volumeContextPathKey]; path != "" {
+		return path
+	}
+	return s.config.VolumePath(volumeID)
+}
+
 func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	klog.Infof("Received NodeUnpublishVolume request for %s", req.VolumeId)
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
 
 	targetPath := req.TargetPath
 
-	// 检查目标路径是否存在且是软链接
+	// 目标路径是 bind mount 的目录(block 卷是文件), 先卸载再删除
+	mounted, err := isMountPoint(s.mounter, targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error checking mount point %s: %v", targetPath, err)
+	}
+	if mounted {
+		logFor(ctx).Infof("Target path %s is a mount point, unmounting it.", targetPath)
+		if err := traceOperation(ctx, "mount.unmount", func(context.Context) error {
+			return s.mounter.Unmount(targetPath)
+		}, attribute.String("csi.volume_id", req.VolumeId), attribute.String("mount.target", targetPath)); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// 卸载后删除挂载点; 之前的版本留下的是软链接
 	if fi, err := os.Lstat(targetPath); err == nil {
-		if fi.Mode()&os.ModeSymlink != 0 {
-			klog.Infof("Target path %s is a symlink, removing it.", targetPath)
-			if err := os.RemoveAll(targetPath); err != nil {
-				return nil, fmt.Errorf("failed to remove symlink at target path %s: %v", targetPath, err)
+		if fi.Mode()&os.ModeSymlink == 0 {
+			// 只删除空目录或者 block 卷的目标文件, 非空目录说明还挂着别的东西, 不能删除里面的数据
+			if err := os.Remove(targetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to remove target path %s: %v", targetPath, err)
 			}
-			klog.Infof("Successfully removed symlink at %s", targetPath)
+			logFor(ctx).Infof("Successfully removed target path %s", targetPath)
 		} else {
-			klog.Infof("Target path %s is not a symlink, skipping removal.", targetPath)
+			// DeleteVolume 可能先于 NodeUnpublishVolume 执行(强制清理时), 这时软链接指向的源已经不存在,
+			// 仍然要删除目标路径并返回成功
+			if _, err := os.Stat(targetPath); os.IsNotExist(err) {
+				existingSource, _ := os.Readlink(targetPath)
+				logFor(ctx).Infof("Source %s of target path %s was already deleted, removing dangling symlink.", existingSource, targetPath)
+			}
+			logFor(ctx).Infof("Target path %s is a symlink, removing it.", targetPath)
+			if err := os.RemoveAll(targetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to remove symlink at target path %s: %v", targetPath, err)
+			}
+			logFor(ctx).Infof("Successfully removed symlink at %s", targetPath)
 		}
 	} else if os.IsNotExist(err) {
-		klog.Infof("Target path %s does not exist, skipping unpublish.", targetPath)
+		logFor(ctx).Infof("Target path %s does not exist, skipping unpublish.", targetPath)
 	} else {
-		return nil, fmt.Errorf("error checking target path %s: %v", targetPath, err)
+		return nil, status.Errorf(codes.Internal, "error checking target path %s: %v", targetPath, err)
+	}
+
+	if err := resetIOLimits(ctx, s.config.ioLimitsPath(s.nodeID), targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reset io limits of volume %s: %v", req.VolumeId, err)
+	}
+
+	lastEphemeral, err := s.untrackPublish(req.VolumeId, targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record unpublish of volume %s: %v", req.VolumeId, err)
 	}
 
+	// inline ephemeral 卷的生命周期和 pod 一致, 最后一个目标路径卸载之后(宽限期结束时)删除临时目录; 其他卷的数据不能碰
+	if lastEphemeral {
+		if err := s.removeEphemeral(ctx, req.VolumeId); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove ephemeral volume %s: %v", req.VolumeId, err)
+		}
+	}
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (s *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	klog.Infof("Received NodeGetInfo request")
-
-	// 获取node的主机名
-	nodeID := "node1"
+	nodeID := s.nodeID
 
 	// 可选：假如你支持Topologies，可以添加相关信息
-	topology := &csi.Topology{
-		Segments: map[string]string{
-			"topology.hostpath.csi/node": nodeID,
-		},
-	}
+	topology := nodeTopology(nodeID, s.segments)
+	s.mu.Lock()
+	maxVolumes := s.maxVolumes
+	s.mu.Unlock()
 
 	return &csi.NodeGetInfoResponse{
-		NodeId:             nodeID,   // 返回节点ID
-		AccessibleTopology: topology, // 返回可访问拓扑信息
+		NodeId:             nodeID,     // 返回节点ID
+		AccessibleTopology: topology,   // 返回可访问拓扑信息
+		MaxVolumesPerNode:  maxVolumes, // 调度器据此限制节点上的卷数量, 0 表示不限制
+	}, nil
+}
+
+// NodeExpandVolume 在节点上扩容卷; 目录卷没有文件系统或配额需要调整, 只需确认卷已发布并返回新容量;
+// block 卷需要刷新 loop 设备的大小, 镜像卷和 LVM 卷还需要扩展文件系统
+func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(req.VolumePath); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", req.VolumePath)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stat volume path %s: %v", req.VolumePath, err)
+	}
+
+	// 后端文件已经由 Controller 扩大, 这里让 loop 设备重新读取大小; 有文件系统的卷还要在线扩展文件系统,
+	// 它的 staging 目录已经被文件系统盖住, 要先于 block 卷的记录检查
+	device, fsType, ok, err := stagedFilesystemDevice(req.StagingTargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	}
+	if ok {
+		// 加密卷挂载的是解密设备, 要先刷新它下面的 loop 设备, 再让解密设备跟着扩大
+		if _, err := os.Stat(encryptedDevicePath(req.VolumeId)); err == nil {
+			if err := expandEncryptedDevice(req.VolumeId, req.Secrets[encryptionPassphraseKey]); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to expand encrypted volume %s: %v", req.VolumeId, err)
+			}
+		} else if strings.HasPrefix(device, "/dev/loop") {
+			if err := reloadLoopDevice(device); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to expand volume %s: %v", req.VolumeId, err)
+			}
+		}
+		if err := resizeFilesystem(device, req.StagingTargetPath, fsType); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to expand volume %s: %v", req.VolumeId, err)
+		}
+	} else if entry, found, err := findMount(req.StagingTargetPath); err == nil && found && entry.FsType == "tmpfs" {
+		// 内存卷调整 tmpfs 的大小; tmpfs 的 size=0 表示不限制, 没有给出容量时不调整
+		size := req.GetCapacityRange().GetRequiredBytes()
+		if size <= 0 {
+			size = req.GetCapacityRange().GetLimitBytes()
+		}
+		if size > 0 {
+			if err := resizeMemoryVolume(s.mounter, req.StagingTargetPath, size); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to expand memory volume %s: %v", req.VolumeId, err)
+			}
+		}
+	} else if backingFile := stagedBackingFile(req.StagingTargetPath); backingFile != "" {
+		if err := refreshLoopDevice(backingFile); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to expand block volume %s: %v", req.VolumeId, err)
+		}
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+	}, nil
+}
+
+// NodeGetVolumeStats 返回已发布卷的容量、已用、可用字节数以及 inode 使用情况, kubelet 用它上报 kubelet_volume_stats 指标
+func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Lstat(req.VolumePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", req.VolumePath)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stat volume path %s: %v", req.VolumePath, err)
+	}
+
+	// block 卷的目标路径是 bind mount 的设备文件, 上报设备大小
+	if fi.Mode()&os.ModeSymlink == 0 && !fi.IsDir() {
+		size, err := blockDeviceSize(req.VolumePath)
+		if err != nil {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("block device at %s is not readable: %v", req.VolumePath, err)},
+			}, nil
+		}
+		usage := &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: size}
+		// 后端是稀疏文件时, 已用空间是文件实际占用的磁盘, 其余是还没有分配的部分
+		if backingFile := stagedBackingFile(req.StagingTargetPath); backingFile != "" && !isBlockDevice(backingFile) {
+			if allocated, err := allocatedBytes(backingFile); err == nil {
+				usage.Used = allocated
+				usage.Available = size - allocated
+				if usage.Available < 0 {
+					usage.Available = 0
+				}
+			}
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage:           []*csi.VolumeUsage{usage},
+			VolumeCondition: s.statsCondition(req.VolumeId),
+		}, nil
+	}
+
+	// 目标路径是 bind mount 的卷目录(旧版本是指向卷目录的软链接), 统计时使用真实路径; 旧的软链接指向的源目录已经被删除时解析失败,
+	// 这时不返回错误, 而是通过 VolumeCondition 告诉 kubelet 卷异常
+	path, err := filepath.EvalSymlinks(req.VolumePath)
+	if err != nil {
+		source, _ := os.Readlink(req.VolumePath)
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("source %s of volume path %s is gone: %v", source, req.VolumePath, err),
+			},
+		}, nil
+	}
+	if condition := volumeCondition(path); condition.Abnormal {
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+	}
+
+	// 优先使用后台统计的结果, 没有或者已经过期时实时计算
+	stats, ok := s.usage.get(req.VolumeId)
+	if !ok {
+		backend, err := backendOf(s.volumeBackend(req.VolumeId))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get stats of volume %s: %v", req.VolumeId, err)
+		}
+		if stats, err = backend.Stats(ctx, req.VolumeId, path); err != nil {
+			return nil, err
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     stats.TotalBytes,
+				Used:      stats.UsedBytes,
+				Available: stats.AvailableBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     stats.TotalInodes,
+				Used:      stats.UsedInodes,
+				Available: stats.FreeInodes,
+			},
+		},
+		VolumeCondition: s.statsCondition(req.VolumeId),
 	}, nil
 }
 
 // NodeGetCapabilities 返回该节点的能力信息
 func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	klog.Infof("Received NodeGetCapabilities request")
-
-	// 返回节点的能力信息，不包含 STAGE_UNSTAGE_VOLUME，表示跳过这个阶段
+	// 返回节点的能力信息
 	capabilities := []*csi.NodeServiceCapability{
 		{
 			Type: &csi.NodeServiceCapability_Rpc{
 				Rpc: &csi.NodeServiceCapability_RPC{
-					// 不包含 STAGE_UNSTAGE_VOLUME，跳过该能力
-					Type: csi.NodeServiceCapability_RPC_UNKNOWN, // 表示无特定能力
+					// stage 阶段把卷 bind mount 到 staging 目录(block 卷挂到 loop 设备上)
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					// 支持在线扩容
+					Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					// 支持上报卷的使用情况
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					// 在 NodeGetVolumeStats 中上报卷的健康状况
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					// 由驱动根据 volume_mount_group 设置卷的属组(fsGroup)
+					Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					// 支持 SINGLE_NODE_SINGLE_WRITER 和 SINGLE_NODE_MULTI_WRITER 访问模式
+					Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 				},
 			},
 		},
@@ -125,14 +746,179 @@ func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 	}, nil
 }
 
-// NodeStageVolume 空实现，用于跳过该操作
+// NodeStageVolume 把卷挂到 staging 目录: block 卷挂到 loop 设备上, 镜像卷和 LVM 卷把文件系统挂载到 staging_target_path,
+// 目录卷 bind mount 到 staging_target_path, 后续 NodePublishVolume 从 staging 目录发布
 func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	klog.Infof("Received NodeStageVolume request but this operation is not needed, skipping.")
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	sourcePath := s.sourcePathFor(req.VolumeId, req.VolumeContext, req.PublishContext)
+	if err := checkSecrets(nodeStageSecrets, req.VolumeContext, req.Secrets); err != nil {
+		return nil, err
+	}
+	if err := s.adoptStaticVolume(ctx, req.VolumeId, req.VolumeContext, req.VolumeCapability); err != nil {
+		return nil, err
+	}
+
+	if req.VolumeCapability.GetBlock() != nil {
+		device, err := stageBlockVolume(sourcePath, req.StagingTargetPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to stage block volume %s: %v", req.VolumeId, err)
+		}
+		logFor(ctx).Infof("Block volume %s attached to %s", req.VolumeId, device)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// StorageClass/PV 的 mountOptions 应用到 staging 目录的挂载上; kubelet 传入的 SELinux 标签在挂载文件系统时设置
+	mountOptions, seLinuxContext := extractSELinuxContext(req.VolumeCapability.GetMount().GetMountFlags())
+	flags, err := parseMountFlags(mountOptions)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	seLinuxData := seLinuxMountData(seLinuxContext)
+	if isMemoryVolume(req.VolumeContext) {
+		return s.stageMemoryVolume(ctx, req, flags, seLinuxData)
+	}
+	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "source path %s does not exist", sourcePath)
+	}
+	if err := os.MkdirAll(req.StagingTargetPath, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create staging path %s: %v", req.StagingTargetPath, err)
+	}
+	mounted, err := isMountPoint(s.mounter, req.StagingTargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	}
+	if mounted {
+		logFor(ctx).Infof("Staging path %s is already mounted, skipping.", req.StagingTargetPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// 模板卷在 staging 目录挂载以模板目录为底层的 overlayfs
+	if isTemplateVolume(req.VolumeContext) {
+		template, err := s.config.checkTemplate(req.VolumeContext[templateParameter])
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := mountOverlay(s.mounter, template, sourcePath, req.StagingTargetPath, flags, seLinuxData); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to stage template volume %s: %v", req.VolumeId, err)
+		}
+		if group := req.VolumeCapability.GetMount().GetVolumeMountGroup(); group != "" {
+			if err := applyVolumeMountGroup(req.StagingTargetPath, group); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to apply volume mount group to %s: %v", req.StagingTargetPath, err)
+			}
+		}
+		logFor(ctx).Infof("Template volume %s staged at %s on top of %s", req.VolumeId, req.StagingTargetPath, template)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// 镜像卷和 LVM 卷格式化(只在第一次)后把文件系统挂载到 staging 目录
+	if filesystemBackends[req.VolumeContext[backendParameter]] {
+		fsType := req.VolumeCapability.GetMount().GetFsType()
+		if fsType == "" {
+			fsType = defaultFsType
+		}
+		if !supportedFsTypes[fsType] {
+			return nil, status.Errorf(codes.InvalidArgument, "fsType %s is not supported", fsType)
+		}
+		discard := shouldDiscard(req.VolumeContext)
+		data := joinMountData(discardMountData(discard), seLinuxData)
+		if isEncryptedVolume(req.VolumeContext) {
+			// checkSecrets 已经检查过口令不为空
+			passphrase := req.Secrets[encryptionPassphraseKey]
+			if err := traceOperation(ctx, "mount.stage_encrypted", func(context.Context) error {
+				return stageEncryptedVolume(s.mounter, sourcePath, req.StagingTargetPath, fsType, flags, data, discard, req.VolumeId, passphrase)
+			}, attribute.String("csi.volume_id", req.VolumeId), attribute.String("mount.fs_type", fsType)); err != nil {
+				return nil, stageError(err, "failed to stage encrypted volume %s", req.VolumeId)
+			}
+		} else if err := traceOperation(ctx, "mount.stage_filesystem", func(context.Context) error {
+			return stageFilesystemVolume(s.mounter, sourcePath, req.StagingTargetPath, fsType, flags, data)
+		}, attribute.String("csi.volume_id", req.VolumeId), attribute.String("mount.fs_type", fsType)); err != nil {
+			return nil, stageError(err, "failed to stage volume %s", req.VolumeId)
+		}
+		if err := applyVolumeOwnership(req.StagingTargetPath, req.VolumeContext); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to apply ownership to volume %s: %v", req.VolumeId, err)
+		}
+		if group := req.VolumeCapability.GetMount().GetVolumeMountGroup(); group != "" {
+			if err := applyVolumeMountGroup(req.StagingTargetPath, group); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to apply volume mount group to %s: %v", req.StagingTargetPath, err)
+			}
+		}
+		logFor(ctx).Infof("Volume %s mounted at %s as %s", sourcePath, req.StagingTargetPath, fsType)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if group := req.VolumeCapability.GetMount().GetVolumeMountGroup(); group != "" {
+		if err := applyVolumeMountGroup(sourcePath, group); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to apply volume mount group to %s: %v", sourcePath, err)
+		}
+	}
+	// bind mount 不能设置 context, 直接给卷目录打上 pod 的标签
+	if seLinuxContext != "" {
+		if err := relabel(sourcePath, seLinuxContext); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to relabel volume %s: %v", req.VolumeId, err)
+		}
+	}
+	if err := traceOperation(ctx, "mount.stage_bind", func(context.Context) error {
+		return bindMount(s.mounter, sourcePath, req.StagingTargetPath, flags)
+	}, attribute.String("csi.volume_id", req.VolumeId), attribute.String("mount.target", req.StagingTargetPath)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stage volume %s: %v", req.VolumeId, err)
+	}
+
+	logFor(ctx).Infof("Volume %s staged at %s", sourcePath, req.StagingTargetPath)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-// NodeUnstageVolume 空实现，用于跳过该操作
+// stageMemoryVolume 在 staging 目录挂载内存卷的 tmpfs, 已经挂载时直接返回
+func (s *NodeServer) stageMemoryVolume(ctx context.Context, req *csi.NodeStageVolumeRequest, flags uintptr, data string) (*csi.NodeStageVolumeResponse, error) {
+	size, err := strconv.ParseInt(req.VolumeContext[volumeContextSizeKey], 10, 64)
+	if err != nil || size <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid size %q of memory volume %s", req.VolumeContext[volumeContextSizeKey], req.VolumeId)
+	}
+	if mounted, err := isMountPoint(s.mounter, req.StagingTargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	} else if mounted {
+		logFor(ctx).Infof("Staging path %s is already mounted, skipping.", req.StagingTargetPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	if err := traceOperation(ctx, "mount.stage_memory", func(context.Context) error {
+		return mountMemoryVolume(s.mounter, req.StagingTargetPath, size, flags, data)
+	}, attribute.String("csi.volume_id", req.VolumeId), attribute.Int64("csi.capacity_bytes", size)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stage memory volume %s: %v", req.VolumeId, err)
+	}
+	if err := applyVolumeOwnership(req.StagingTargetPath, req.VolumeContext); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to apply ownership to volume %s: %v", req.VolumeId, err)
+	}
+	if group := req.VolumeCapability.GetMount().GetVolumeMountGroup(); group != "" {
+		if err := applyVolumeMountGroup(req.StagingTargetPath, group); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to apply volume mount group to %s: %v", req.StagingTargetPath, err)
+		}
+	}
+	logFor(ctx).Infof("Memory volume %s of %d bytes staged at %s", req.VolumeId, size, req.StagingTargetPath)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume 撤销 NodeStageVolume: 先卸载 staging 目录的挂载, 关闭加密卷的解密设备, 再释放 block 卷和镜像卷的 loop 设备
 func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	klog.Infof("Received NodeUnstageVolume request but this operation is not needed, skipping.")
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+
+	if err := traceOperation(ctx, "mount.unmount", func(context.Context) error {
+		return unmount(s.mounter, req.StagingTargetPath)
+	}, attribute.String("csi.volume_id", req.VolumeId), attribute.String("mount.target", req.StagingTargetPath)); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unstage volume %s: %v", req.VolumeId, err)
+	}
+	// 加密卷的解密设备要在释放 loop 设备之前关闭
+	if err := closeEncryptedDevice(req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to close encrypted volume %s: %v", req.VolumeId, err)
+	}
+	// 镜像卷的后端文件记录在卸载之后才能读到
+	if stagedBackingFile(req.StagingTargetPath) != "" {
+		if err := unstageBlockVolume(req.StagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unstage block volume %s: %v", req.VolumeId, err)
+		}
+	}
+	logFor(ctx).Infof("Volume %s unstaged from %s", req.VolumeId, req.StagingTargetPath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
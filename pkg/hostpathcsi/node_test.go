@@ -0,0 +1,473 @@
+package hostpathcsi
+
+import (
+	"context"
+	"errors"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestNodeServer 创建使用临时目录的 NodeServer
+func newTestNodeServer(t *testing.T) *NodeServer {
+	t.Helper()
+	s, err := NewNodeServer(newTestConfig(t), "node-1", nil, 0)
+	if err != nil {
+		t.Fatalf("NewNodeServer: %v", err)
+	}
+	return s
+}
+
+// useFakeMounter 让 NodeServer 使用只在内存里记录挂载点的 mount-utils 挂载器, 不调用 mount(8)
+func useFakeMounter(s *NodeServer) *mount.FakeMounter {
+	fake := mount.NewFakeMounter(nil)
+	s.mounter = &mount.SafeFormatAndMount{Interface: fake}
+	return fake
+}
+
+func TestUntrackPublishEphemeral(t *testing.T) {
+	type publish struct {
+		volumeID, targetPath string
+		ephemeral            bool
+	}
+	tests := []struct {
+		name      string
+		published []publish
+		// unpublish 依次卸载的目标路径, want 是每次卸载之后是否应该删除临时目录
+		unpublish []publish
+		want      []bool
+	}{
+		{
+			name:      "ephemeral volume",
+			published: []publish{{"csi-1", "/pods/a", true}},
+			unpublish: []publish{{"csi-1", "/pods/a", false}},
+			want:      []bool{true},
+		},
+		{
+			name:      "regular volume",
+			published: []publish{{"pvc-1", "/pods/a", false}},
+			unpublish: []publish{{"pvc-1", "/pods/a", false}},
+			want:      []bool{false},
+		},
+		{
+			name:      "ephemeral volume published twice",
+			published: []publish{{"csi-1", "/pods/a", true}, {"csi-1", "/pods/b", true}},
+			unpublish: []publish{{"csi-1", "/pods/a", false}, {"csi-1", "/pods/b", false}},
+			want:      []bool{false, true},
+		},
+		{
+			name:      "retried unpublish of an ephemeral volume",
+			published: []publish{{"csi-1", "/pods/a", true}},
+			unpublish: []publish{{"csi-1", "/pods/a", false}, {"csi-1", "/pods/a", false}},
+			want:      []bool{true, true},
+		},
+		{
+			name:      "unknown volume",
+			unpublish: []publish{{"pvc-1", "/pods/a", false}},
+			want:      []bool{false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestNodeServer(t)
+			for _, p := range tt.published {
+				if err := s.trackPublish(p.volumeID, p.targetPath, "", p.ephemeral); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, p := range tt.unpublish {
+				got, err := s.untrackPublish(p.volumeID, p.targetPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want[i] {
+					t.Errorf("untrackPublish(%s, %s) = %v, want %v", p.volumeID, p.targetPath, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEphemeralRecordsSurviveRestart(t *testing.T) {
+	s := newTestNodeServer(t)
+	if err := s.trackPublish("csi-1", "/pods/a", "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewNodeServer(s.config, "node-1", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last, err := restarted.untrackPublish("csi-1", "/pods/a"); err != nil || !last {
+		t.Fatalf("untrackPublish() = %v, %v, want true", last, err)
+	}
+	if err := restarted.forgetEphemeral("csi-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err = NewNodeServer(s.config, "node-1", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.ephemeral["csi-1"] {
+		t.Errorf("ephemeral record of csi-1 was not removed")
+	}
+}
+
+func TestSourcePathFor(t *testing.T) {
+	s := newTestNodeServer(t)
+	tests := []struct {
+		name           string
+		volumeContext  map[string]string
+		publishContext map[string]string
+		want           string
+	}{
+		{
+			name: "default layout",
+			want: s.config.VolumePath("pvc-1"),
+		},
+		{
+			name:           "path from the publish context",
+			publishContext: map[string]string{volumeContextPathKey: "/mnt/ssd/pvc-1"},
+			want:           "/mnt/ssd/pvc-1",
+		},
+		{
+			name:           "volume context wins over the publish context",
+			volumeContext:  map[string]string{volumeContextPathKey: "/mnt/ssd/pvc-1"},
+			publishContext: map[string]string{volumeContextPathKey: "/mnt/hdd/pvc-1"},
+			want:           "/mnt/ssd/pvc-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.sourcePathFor("pvc-1", tt.volumeContext, tt.publishContext); got != tt.want {
+				t.Errorf("sourcePathFor() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishPathOfPoolVolume(t *testing.T) {
+	root := t.TempDir()
+	config, err := NewConfig(filepath.Join(root, "data"), filepath.Join(root, "snapshots"), filepath.Join(root, "state"), "", "", "", "ssd="+filepath.Join(root, "ssd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := NewState(config.StatePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := NewControllerServer(config, state, "node-1", true)
+	node, err := NewNodeServer(config, "node-1", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	created, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		Parameters:         map[string]string{poolParameter: "ssd"},
+		VolumeCapabilities: []*csi.VolumeCapability{mount},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	want := filepath.Join(root, "ssd", "pvc-1")
+	if got := created.Volume.VolumeContext[volumeContextPathKey]; got != want {
+		t.Fatalf("volume context path = %s, want %s", got, want)
+	}
+	published, err := controller.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: mount,
+	})
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume: %v", err)
+	}
+	// 静态 PV 或者旧版本创建的 PV 的 VolumeContext 里没有路径, 只能靠 publish context
+	if got := node.sourcePathFor("pvc-1", nil, published.PublishContext); got != want {
+		t.Errorf("source path from the publish context = %s, want %s", got, want)
+	}
+	if got := node.sourcePathFor("pvc-1", created.Volume.VolumeContext, nil); got != want {
+		t.Errorf("source path from the volume context = %s, want %s", got, want)
+	}
+}
+
+func TestNodeUnpublishVolumeAfterDelete(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup 准备好源已经被 DeleteVolume 删除之后的目标路径
+		setup func(t *testing.T, m *mount.FakeMounter, source, target string)
+	}{
+		{
+			name: "bind mount of a deleted source",
+			setup: func(t *testing.T, m *mount.FakeMounter, source, target string) {
+				if err := os.MkdirAll(target, 0750); err != nil {
+					t.Fatal(err)
+				}
+				m.MountPoints = append(m.MountPoints, mount.MountPoint{Device: source, Path: target})
+			},
+		},
+		{
+			name: "dangling symlink left by an older version",
+			setup: func(t *testing.T, m *mount.FakeMounter, source, target string) {
+				if err := os.Symlink(source, target); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:  "target already removed",
+			setup: func(t *testing.T, m *mount.FakeMounter, source, target string) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestNodeServer(t)
+			m := useFakeMounter(s)
+			source := s.config.VolumePath("pvc-1")
+			target := filepath.Join(t.TempDir(), "mount")
+			tt.setup(t, m, source, target)
+			if err := s.trackPublish("pvc-1", target, "", false); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := s.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1", TargetPath: target})
+			if err != nil {
+				t.Fatalf("NodeUnpublishVolume: %v", err)
+			}
+			if len(m.MountPoints) != 0 {
+				t.Errorf("mounts left: %v", m.MountPoints)
+			}
+			if _, err := os.Lstat(target); !os.IsNotExist(err) {
+				t.Errorf("target path %s was not removed: %v", target, err)
+			}
+			if len(s.published["pvc-1"]) != 0 {
+				t.Errorf("publish record of pvc-1 was not removed: %v", s.published["pvc-1"])
+			}
+		})
+	}
+}
+
+func TestReservePublish(t *testing.T) {
+	tests := []struct {
+		name string
+		mode csi.VolumeCapability_AccessMode_Mode
+		// published 是卷已经发布到的目标路径
+		published []string
+		target    string
+		wantCode  codes.Code
+	}{
+		{name: "single node writer", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, published: []string{"/pods/a"}, target: "/pods/b"},
+		{name: "single node reader only", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, published: []string{"/pods/a"}, target: "/pods/b"},
+		{name: "single node multi writer", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER, published: []string{"/pods/a"}, target: "/pods/b"},
+		{name: "single node single writer first publish", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER, target: "/pods/a"},
+		{name: "single node single writer same target", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER, published: []string{"/pods/a"}, target: "/pods/a"},
+		{
+			name:      "single node single writer conflict",
+			mode:      csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			published: []string{"/pods/a"},
+			target:    "/pods/b",
+			wantCode:  codes.FailedPrecondition,
+		},
+		{name: "multi node multi writer", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, target: "/pods/a", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestNodeServer(t)
+			for _, target := range tt.published {
+				if err := s.trackPublish("pvc-1", target, "", false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			capability := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: tt.mode}}
+			rollback, err := s.reservePublish("pvc-1", tt.target, capability)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("reservePublish() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if !s.published["pvc-1"][tt.target] {
+				t.Errorf("target %s is not reserved", tt.target)
+			}
+			// 撤销之后只剩下之前的发布记录
+			rollback()
+			if got, want := len(s.published["pvc-1"]), len(tt.published); got != want {
+				t.Errorf("%d publish records after the rollback, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestReservePublishSingleWriter(t *testing.T) {
+	s := newTestNodeServer(t)
+	capability := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER}}
+	rollback, err := s.reservePublish("pvc-1", "/pods/a", capability)
+	if err != nil {
+		t.Fatalf("reservePublish(/pods/a): %v", err)
+	}
+	// 第一个请求还没有发布完成, 第二个目标路径也不能通过检查
+	if _, err := s.reservePublish("pvc-1", "/pods/b", capability); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("reservePublish(/pods/b) while /pods/a is reserved error = %v, want code %v", err, codes.FailedPrecondition)
+	}
+	rollback()
+	if _, err := s.reservePublish("pvc-1", "/pods/b", capability); err != nil {
+		t.Errorf("reservePublish(/pods/b) after the rollback: %v", err)
+	}
+}
+
+func TestNodePublishVolumeRollsBackReservation(t *testing.T) {
+	s := newTestNodeServer(t)
+	useFakeMounter(s)
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER},
+	}
+	publish := func(target string) error {
+		_, err := s.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         "pvc-1",
+			TargetPath:       filepath.Join(t.TempDir(), target),
+			VolumeCapability: capability,
+		})
+		return err
+	}
+
+	// 卷目录不存在, 发布失败之后不能留下预留
+	if err := publish("a"); status.Code(err) != codes.NotFound {
+		t.Fatalf("NodePublishVolume without the volume directory error = %v, want code %v", err, codes.NotFound)
+	}
+	if len(s.published) != 0 {
+		t.Fatalf("publish records after a failed publish = %v, want none", s.published)
+	}
+	if err := os.MkdirAll(s.config.VolumePath("pvc-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("b"); err != nil {
+		t.Fatalf("NodePublishVolume after a failed publish: %v", err)
+	}
+	if len(s.published["pvc-1"]) != 1 {
+		t.Errorf("publish records = %v, want one target", s.published["pvc-1"])
+	}
+}
+
+func TestResolveNodeID(t *testing.T) {
+	dir := t.TempDir()
+	idFile := filepath.Join(dir, "node-id")
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(idFile, []byte("node-from-file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(emptyFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		flag     string
+		idFile   string
+		env      string
+		hostname string
+		// hostnameErr 是查询主机名返回的错误
+		hostnameErr error
+		want        string
+		wantErr     bool
+	}{
+		{name: "flag wins", flag: "node-from-flag", idFile: idFile, env: "node-from-env", hostname: "host", want: "node-from-flag"},
+		{name: "file wins over env", idFile: idFile, env: "node-from-env", hostname: "host", want: "node-from-file"},
+		{name: "empty file falls back to env", idFile: emptyFile, env: "node-from-env", hostname: "host", want: "node-from-env"},
+		{name: "env wins over hostname", env: "node-from-env", hostname: "host", want: "node-from-env"},
+		{name: "hostname", hostname: "host", want: "host"},
+		{name: "blank flag is ignored", flag: "  ", hostname: "host", want: "host"},
+		{name: "unreadable file", idFile: filepath.Join(dir, "missing"), env: "node-from-env", wantErr: true},
+		{name: "hostname lookup fails", hostnameErr: errors.New("no hostname"), wantErr: true},
+		{name: "hostname is localhost", hostname: "localhost", wantErr: true},
+		{name: "hostname is empty", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(nodeNameEnv, tt.env)
+			lookupHostname = func() (string, error) { return tt.hostname, tt.hostnameErr }
+			t.Cleanup(func() { lookupHostname = os.Hostname })
+
+			got, err := ResolveNodeID(tt.flag, tt.idFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveNodeID() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveNodeID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEphemeralGracePeriod(t *testing.T) {
+	tests := []struct {
+		name  string
+		grace time.Duration
+		// wait 为 true 时等宽限期结束之后再重新发布
+		wait      bool
+		wantReuse bool
+	}{
+		{name: "without a grace period", wantReuse: false},
+		{name: "re-published within the grace period", grace: time.Hour, wantReuse: true},
+		{name: "re-published after the grace period", grace: 10 * time.Millisecond, wait: true, wantReuse: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestNodeServer(t)
+			useFakeMounter(s)
+			s.SetEphemeralGracePeriod(tt.grace)
+			req := &csi.NodePublishVolumeRequest{
+				VolumeId:   "csi-1",
+				TargetPath: filepath.Join(t.TempDir(), "mount"),
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+				VolumeContext: map[string]string{ephemeralContextKey: "true"},
+			}
+			source := s.config.ephemeralPath("csi-1")
+			if _, err := s.NodePublishVolume(context.Background(), req); err != nil {
+				t.Fatalf("NodePublishVolume: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(source, "data"), []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-1", TargetPath: req.TargetPath}); err != nil {
+				t.Fatalf("NodeUnpublishVolume: %v", err)
+			}
+			if tt.wait {
+				deadline := time.Now().Add(5 * time.Second)
+				for {
+					if _, err := os.Stat(source); os.IsNotExist(err) {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("ephemeral directory %s was not removed after the grace period", source)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			if _, err := s.NodePublishVolume(context.Background(), req); err != nil {
+				t.Fatalf("NodePublishVolume: %v", err)
+			}
+			_, err := os.Stat(filepath.Join(source, "data"))
+			if reused := err == nil; reused != tt.wantReuse {
+				t.Errorf("ephemeral directory reused = %v, want %v", reused, tt.wantReuse)
+			}
+			if !s.ephemeral["csi-1"] {
+				t.Error("re-published volume is not recorded as ephemeral")
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Package hostpathcsi Description: 这个文件实现基于 overlayfs 的模板卷: StorageClass 设置 template 参数时, 卷目录下只有 overlayfs 的
+// upper 和 work 目录, NodeStageVolume 以只读的模板目录为 lowerdir 挂载 overlayfs, 很多 PVC 可以共享同一份数据(测试数据、训练集等),
+// 每个卷只保存自己改动的部分。卷的容量、快照和克隆都只针对 upper 中的改动。
+package hostpathcsi
+
+import (
+	"fmt"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// templateParameter 是 StorageClass 中指定模板目录的参数, 值是 --template-dir 下的目录
+	templateParameter = "template"
+	// overlayUpperDir 和 overlayWorkDir 是卷目录下 overlayfs 的 upperdir 和 workdir
+	overlayUpperDir = "upper"
+	overlayWorkDir  = "work"
+)
+
+// isTemplateVolume 判断卷是否是基于模板目录的 overlayfs 卷
+func isTemplateVolume(parameters map[string]string) bool {
+	return parameters[templateParameter] != ""
+}
+
+// checkTemplate 检查模板目录: 必须是 --template-dir 下的目录, 避免通过 StorageClass 把节点上的任意目录暴露给 pod;
+// overlayfs 的挂载选项以逗号和冒号分隔, 路径里不能有这两个字符
+func (c *Config) checkTemplate(template string) (string, error) {
+	if c.TemplateDir == "" {
+		return "", fmt.Errorf("template volumes are disabled, start the driver with --template-dir")
+	}
+	if !filepath.IsAbs(template) {
+		return "", fmt.Errorf("template %q must be an absolute path", template)
+	}
+	resolved, err := filepath.EvalSymlinks(template)
+	if err != nil {
+		return "", fmt.Errorf("template %s is not accessible: %v", template, err)
+	}
+	if rel, err := filepath.Rel(c.TemplateDir, resolved); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("template %s is not a directory under the template directory %s", template, c.TemplateDir)
+	}
+	if fi, err := os.Stat(resolved); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("template %s is not a directory", template)
+	}
+	if strings.ContainsAny(resolved, ",:") {
+		return "", fmt.Errorf("template %s must not contain ',' or ':'", template)
+	}
+	return resolved, nil
+}
+
+// checkTemplateVolume 检查模板卷的请求: 模板卷是目录后端上没有其他数据源的文件系统卷
+func (s *ControllerServer) checkTemplateVolume(req *csi.CreateVolumeRequest, accessType string, backend Backend) error {
+	switch {
+	case backend.Name() != directoryBackendName:
+		return status.Errorf(codes.InvalidArgument, "template volumes can not use the %s backend", backend.Name())
+	case accessType == accessTypeBlock:
+		return status.Error(codes.InvalidArgument, "template volumes can not be block volumes")
+	case req.VolumeContentSource != nil:
+		return status.Error(codes.InvalidArgument, "template volumes can not be created from a volume or snapshot")
+	case isMemoryVolume(req.Parameters):
+		return status.Error(codes.InvalidArgument, "template volumes can not be memory volumes")
+	case req.Parameters[importParameter] != "":
+		return status.Error(codes.InvalidArgument, "template volumes can not be imported from an archive")
+	}
+	if _, err := s.config.checkTemplate(req.Parameters[templateParameter]); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// createOverlayDirs 在卷目录下创建 overlayfs 的 upper 和 work 目录
+func createOverlayDirs(volumePath string) error {
+	for _, dir := range []string{overlayUpperDir, overlayWorkDir} {
+		if err := os.MkdirAll(filepath.Join(volumePath, dir), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountOverlay 在 target 上挂载以 template 为 lowerdir、卷目录下的 upper 和 work 为 upperdir 和 workdir 的 overlayfs,
+// extra 是额外的挂载选项(例如 SELinux 标签)
+func mountOverlay(mounter mount.Interface, template, volumePath, target string, flags uintptr, extra string) error {
+	if strings.ContainsAny(volumePath, ",:") {
+		return fmt.Errorf("volume path %s must not contain ',' or ':'", volumePath)
+	}
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return fmt.Errorf("failed to create staging path %s: %v", target, err)
+	}
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", template,
+		filepath.Join(volumePath, overlayUpperDir), filepath.Join(volumePath, overlayWorkDir))
+	return mounter.Mount("overlay", target, "overlay", mountOptions(flags, data, extra))
+}
@@ -0,0 +1,99 @@
+// Package hostpathcsi Description: 这个文件实现卷根目录的属主和权限参数: StorageClass 设置 ownerUid、ownerGid、dirMode 时,
+// 卷的根目录在创建时(有自己文件系统的卷和内存卷在 stage 时)改成对应的属主和权限, pod 不需要特权容器来 chown。
+// 参数原样记录在 VolumeContext 里。
+package hostpathcsi
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// ownerUIDParameter 和 ownerGIDParameter 是卷根目录的属主和属组, 十进制数字
+	ownerUIDParameter = "ownerUid"
+	ownerGIDParameter = "ownerGid"
+	// dirModeParameter 是卷根目录的权限, 八进制数字, 例如 0770 或 2775
+	dirModeParameter = "dirMode"
+)
+
+// ownership 是解析后的属主和权限, uid、gid 为 -1 和 mode 为 nil 表示不修改
+type ownership struct {
+	uid, gid int
+	mode     *uint32
+}
+
+// isZero 判断是否没有设置任何属主或权限参数
+func (o ownership) isZero() bool {
+	return o.uid < 0 && o.gid < 0 && o.mode == nil
+}
+
+// parseOwnership 解析卷参数中的属主和权限
+func parseOwnership(parameters map[string]string) (ownership, error) {
+	o := ownership{uid: -1, gid: -1}
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{ownerUIDParameter, &o.uid}, {ownerGIDParameter, &o.gid}} {
+		raw, ok := parameters[p.name]
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil || id == 1<<32-1 {
+			return o, fmt.Errorf("invalid %s parameter %q, must be a numeric id", p.name, raw)
+		}
+		*p.value = int(id)
+	}
+	if raw, ok := parameters[dirModeParameter]; ok {
+		mode, err := strconv.ParseUint(raw, 8, 32)
+		if err != nil || mode > 07777 {
+			return o, fmt.Errorf("invalid %s parameter %q, must be an octal mode such as 0755", dirModeParameter, raw)
+		}
+		m := uint32(mode)
+		o.mode = &m
+	}
+	return o, nil
+}
+
+// applyOwnership 修改卷根目录的属主和权限; 先 chown 再 chmod, chown 会清除 setuid/setgid 位
+func applyOwnership(path string, o ownership) error {
+	if o.uid >= 0 || o.gid >= 0 {
+		if err := unix.Lchown(path, o.uid, o.gid); err != nil {
+			return fmt.Errorf("failed to change owner of %s: %v", path, err)
+		}
+	}
+	if o.mode != nil {
+		if err := unix.Chmod(path, *o.mode); err != nil {
+			return fmt.Errorf("failed to change mode of %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// applyVolumeOwnership 按卷参数修改根目录 path 的属主和权限, 没有设置参数时什么都不做
+func applyVolumeOwnership(path string, parameters map[string]string) error {
+	o, err := parseOwnership(parameters)
+	if err != nil || o.isZero() {
+		return err
+	}
+	return applyOwnership(path, o)
+}
+
+// ownershipRoot 返回 Controller 创建卷时要修改属主和权限的目录: 卷目录, 模板卷是 overlayfs 的 upper 目录(它决定挂载后根目录的属性);
+// 有自己文件系统的卷、内存卷和 block 卷返回空字符串, 前两者在 stage 时修改
+func ownershipRoot(volume Volume) string {
+	if filesystemBackends[volume.Backend] || isMemoryVolume(volume.Parameters) {
+		return ""
+	}
+	root := volume.Path
+	if isTemplateVolume(volume.Parameters) {
+		root = filepath.Join(volume.Path, overlayUpperDir)
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return ""
+	}
+	return root
+}
@@ -0,0 +1,95 @@
+// Package hostpathcsi Description: 这个文件实现 CreateVolume 参数组合的校验: 在创建卷之前一次性检查不能同时使用的 StorageClass 参数、
+// 不适用于 block 卷的参数和不存在的存储池, 返回的 InvalidArgument 写明冲突的参数名, 而不是创建到一半才失败或者悄悄忽略参数。
+package hostpathcsi
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// conflictingParameters 是不能同时启用的参数
+var conflictingParameters = [][2]string{
+	{templateParameter, importParameter},
+	{templateParameter, mediumParameter},
+	{importParameter, mediumParameter},
+	{immutableParameter, mediumParameter},
+	{integrityParameter, mediumParameter},
+	{integrityParameter, templateParameter},
+	{iopsLimitParameter, mediumParameter},
+	{iopsLimitParameter, templateParameter},
+	{bpsLimitParameter, mediumParameter},
+	{bpsLimitParameter, templateParameter},
+	{encryptedParameter, mediumParameter},
+	{encryptedParameter, templateParameter},
+	{discardParameter, mediumParameter},
+	{discardParameter, templateParameter},
+	{wipeOnDeleteParameter, mediumParameter},
+	{wipeOnDeleteParameter, onDeleteParameter},
+	{poolParameter, mediumParameter},
+}
+
+// filesystemOnlyParameters 是只适用于文件系统卷的参数, volumeMode 为 Block 的卷不能使用
+var filesystemOnlyParameters = []string{
+	templateParameter,
+	importParameter,
+	mediumParameter,
+	idMapParameter,
+	podSubdirParameter,
+	integrityParameter,
+	iopsLimitParameter,
+	bpsLimitParameter,
+	encryptedParameter,
+	discardParameter,
+	ownerUIDParameter,
+	ownerGIDParameter,
+	dirModeParameter,
+}
+
+// parameterEnabled 判断参数是否启用: 开关类的参数为 true, medium 为 Memory, onDelete 为 archive, 其他参数不为空
+func parameterEnabled(parameters map[string]string, key string) bool {
+	value := parameters[key]
+	switch key {
+	case immutableParameter, integrityParameter, encryptedParameter, discardParameter, wipeOnDeleteParameter:
+		return value == "true"
+	case mediumParameter:
+		return value == mediumMemory
+	case onDeleteParameter:
+		return value == onDeleteArchive
+	}
+	return value != ""
+}
+
+// checkParameterCombinations 检查 CreateVolume 的参数(包括 VolumeAttributesClass 的可变参数)能否一起使用,
+// accessType 和 backend 是卷的访问类型和后端; 单个参数的取值由各个功能自己校验
+func (s *ControllerServer) checkParameterCombinations(req *csi.CreateVolumeRequest, accessType, backend string) error {
+	parameters := make(map[string]string, len(req.Parameters)+len(req.MutableParameters))
+	for k, v := range req.Parameters {
+		parameters[k] = v
+	}
+	for k, v := range req.MutableParameters {
+		parameters[k] = v
+	}
+
+	for _, pair := range conflictingParameters {
+		if parameterEnabled(parameters, pair[0]) && parameterEnabled(parameters, pair[1]) {
+			return status.Errorf(codes.InvalidArgument, "the %s=%s and %s=%s parameters can not be used together", pair[0], parameters[pair[0]], pair[1], parameters[pair[1]])
+		}
+	}
+	if accessType == accessTypeBlock {
+		for _, key := range filesystemOnlyParameters {
+			if parameterEnabled(parameters, key) {
+				return status.Errorf(codes.InvalidArgument, "the %s=%s parameter does not apply to volumes with volumeMode Block", key, parameters[key])
+			}
+		}
+	}
+	if pool := parameters[poolParameter]; pool != "" {
+		if !pooledBackends[backend] {
+			return status.Errorf(codes.InvalidArgument, "the %s=%s parameter does not apply to volumes on the %s backend", poolParameter, pool, backend)
+		}
+		if _, err := s.config.PoolDir(pool); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", poolParameter, err)
+		}
+	}
+	return nil
+}
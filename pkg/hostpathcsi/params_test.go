@@ -0,0 +1,103 @@
+package hostpathcsi
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckParameterCombinations(t *testing.T) {
+	root := t.TempDir()
+	config, err := NewConfig(filepath.Join(root, "data"), filepath.Join(root, "snapshots"), filepath.Join(root, "state"), "", "", "", "ssd="+filepath.Join(root, "ssd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ControllerServer{config: config}
+
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		mutable    map[string]string
+		accessType string
+		backend    string
+		// wantKeys 是错误信息里应该写明的参数, 为空表示参数可以一起使用
+		wantKeys []string
+	}{
+		{
+			name:       "compatible parameters",
+			parameters: map[string]string{poolParameter: "ssd", wipeOnDeleteParameter: "true", onDeleteParameter: onDeleteDelete},
+		},
+		{
+			name:       "disabled switches do not conflict",
+			parameters: map[string]string{templateParameter: "base", encryptedParameter: "false", integrityParameter: "false"},
+		},
+		{
+			name:       "template with importFrom",
+			parameters: map[string]string{templateParameter: "base", importParameter: "data.tar"},
+			wantKeys:   []string{templateParameter, importParameter},
+		},
+		{
+			name:       "template on a block volume",
+			parameters: map[string]string{templateParameter: "base"},
+			accessType: accessTypeBlock,
+			wantKeys:   []string{templateParameter, "Block"},
+		},
+		{
+			name:       "memory volume in a pool",
+			parameters: map[string]string{mediumParameter: mediumMemory, poolParameter: "ssd"},
+			wantKeys:   []string{poolParameter, mediumParameter},
+		},
+		{
+			name:       "wipeOnDelete of an archived volume",
+			parameters: map[string]string{wipeOnDeleteParameter: "true", onDeleteParameter: onDeleteArchive},
+			wantKeys:   []string{wipeOnDeleteParameter, onDeleteParameter},
+		},
+		{
+			name:       "io limit from the VolumeAttributesClass on a template volume",
+			parameters: map[string]string{templateParameter: "base"},
+			mutable:    map[string]string{iopsLimitParameter: "100"},
+			wantKeys:   []string{iopsLimitParameter, templateParameter},
+		},
+		{
+			name:       "unknown pool",
+			parameters: map[string]string{poolParameter: "nvme"},
+			wantKeys:   []string{poolParameter, "nvme"},
+		},
+		{
+			name:       "pool on the zfs backend",
+			parameters: map[string]string{poolParameter: "ssd"},
+			backend:    zfsBackendName,
+			wantKeys:   []string{poolParameter, zfsBackendName},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accessType, backend := tt.accessType, tt.backend
+			if accessType == "" {
+				accessType = accessTypeMount
+			}
+			if backend == "" {
+				backend = directoryBackendName
+			}
+			req := &csi.CreateVolumeRequest{Name: "pvc-1", Parameters: tt.parameters, MutableParameters: tt.mutable}
+			err := s.checkParameterCombinations(req, accessType, backend)
+			if len(tt.wantKeys) == 0 {
+				if err != nil {
+					t.Fatalf("checkParameterCombinations() error = %v", err)
+				}
+				return
+			}
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("checkParameterCombinations() error = %v, want code %v", err, codes.InvalidArgument)
+			}
+			for _, key := range tt.wantKeys {
+				if !strings.Contains(err.Error(), key) {
+					t.Errorf("error %q does not name %s", err, key)
+				}
+			}
+		})
+	}
+}
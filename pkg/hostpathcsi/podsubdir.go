@@ -0,0 +1,82 @@
+// Package hostpathcsi Description: 这个文件实现按 pod 隔离的子目录: StorageClass 设置 podSubdir 参数时, NodePublishVolume 不发布整个卷,
+// 而是发布卷里属于这个 pod 的子目录, 多个 pod 共用一个 PVC 时互相看不到对方的文件。pod 的信息来自 CSIDriver 的 podInfoOnMount。
+package hostpathcsi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// podSubdirParameter 是 StorageClass 中开启按 pod 隔离的参数: uid 按 pod UID 分目录, 每个新的 pod 都从空目录开始;
+	// name 按 <namespace>_<pod 名> 分目录, StatefulSet 重建的同名 pod 仍然使用原来的数据
+	podSubdirParameter = "podSubdir"
+	podSubdirUID       = "uid"
+	podSubdirName      = "name"
+
+	// podInfoOnMount 时 kubelet 在 VolumeContext 中传入的 pod 信息
+	podUIDContextKey       = "csi.storage.k8s.io/pod.uid"
+	podNameContextKey      = "csi.storage.k8s.io/pod.name"
+	podNamespaceContextKey = "csi.storage.k8s.io/pod.namespace"
+)
+
+// checkPodSubdir 检查 podSubdir 参数
+func checkPodSubdir(mode, accessType string) error {
+	switch {
+	case mode != podSubdirUID && mode != podSubdirName:
+		return fmt.Errorf("invalid %s parameter %q, must be %s or %s", podSubdirParameter, mode, podSubdirUID, podSubdirName)
+	case accessType == accessTypeBlock:
+		return fmt.Errorf("the %s parameter does not apply to block volumes", podSubdirParameter)
+	}
+	return nil
+}
+
+// podSubdirFor 返回 pod 在卷里的子目录名, VolumeContext 里没有 pod 信息(CSIDriver 没有开启 podInfoOnMount)时返回错误
+func podSubdirFor(mode string, volumeContext map[string]string) (string, error) {
+	var name string
+	switch mode {
+	case podSubdirUID:
+		name = volumeContext[podUIDContextKey]
+	case podSubdirName:
+		if namespace, pod := volumeContext[podNamespaceContextKey], volumeContext[podNameContextKey]; namespace != "" && pod != "" {
+			name = namespace + "_" + pod
+		}
+	default:
+		return "", fmt.Errorf("invalid %s parameter %q", podSubdirParameter, mode)
+	}
+	if name == "" {
+		return "", fmt.Errorf("no pod information in the volume context, the CSIDriver must set podInfoOnMount: true")
+	}
+	// pod 的名字和 UID 不会包含 /, 这里防止手工构造的 VolumeContext 跳出卷目录
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid pod subdirectory name %q", name)
+	}
+	return name, nil
+}
+
+// ensurePodSubdir 在卷目录 root 下创建 pod 的子目录, 属主、属组和权限和卷目录相同, 返回子目录的路径
+func ensurePodSubdir(root, name string) (string, error) {
+	dir := filepath.Join(root, name)
+	fi, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(dir, fi.Mode().Perm()); err != nil {
+		if os.IsExist(err) {
+			return dir, nil
+		}
+		return "", fmt.Errorf("failed to create pod subdirectory %s: %v", dir, err)
+	}
+	// Mkdir 受 umask 影响, 并且不设置 setgid 这类特殊位
+	if err := os.Chmod(dir, fi.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return "", err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dir, int(st.Uid), int(st.Gid)); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
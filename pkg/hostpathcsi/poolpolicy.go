@@ -0,0 +1,196 @@
+// Package hostpathcsi Description: 这个文件实现存储池的自动选择: 配置了 --pools 并指定了 --pool-policy 时, StorageClass 没有设置 pool 参数的卷
+// 由策略在放得下这个卷的存储池中选择一个, 选中的池记录在卷的状态和 VolumeContext 里, 之后的请求都使用这个池。
+// 策略和后端一样通过注册表扩展, 内置 most-free(可用空间最多)、round-robin(轮流)和 weighted(按权重轮流)。
+package hostpathcsi
+
+import (
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PoolCandidate 是一个放得下新卷的存储池
+type PoolCandidate struct {
+	Name           string
+	AvailableBytes int64
+}
+
+// PoolPolicy 从候选的存储池中选择一个放新卷; 调用方持有 ControllerServer 的锁, 实现不需要自己加锁
+type PoolPolicy interface {
+	// Name 返回策略的名字, 即 --pool-policy 的值
+	Name() string
+	// Choose 从按名字排序、至少有一个的候选中选择一个, 返回池名
+	Choose(candidates []PoolCandidate) string
+}
+
+// pooledBackends 是把卷保存在存储池目录下的后端, zfs 和 lvm 后端的卷在 dataset 和卷组里, 不使用存储池
+var pooledBackends = map[string]bool{
+	directoryBackendName: true,
+	imageBackendName:     true,
+	btrfsBackendName:     true,
+}
+
+var (
+	poolPoliciesMu sync.RWMutex
+	// poolPolicies 是注册的策略: 名字 -> 根据每个池的权重创建策略的函数
+	poolPolicies = map[string]func(weights map[string]int64) PoolPolicy{
+		"most-free":   func(map[string]int64) PoolPolicy { return mostFreePolicy{} },
+		"round-robin": func(map[string]int64) PoolPolicy { return &roundRobinPolicy{} },
+		"weighted": func(weights map[string]int64) PoolPolicy {
+			return &weightedPolicy{weights: weights, current: make(map[string]int64)}
+		},
+	}
+)
+
+// RegisterPoolPolicy 注册一个存储池选择策略, 同名的策略会被替换
+func RegisterPoolPolicy(name string, newPolicy func(weights map[string]int64) PoolPolicy) {
+	poolPoliciesMu.Lock()
+	defer poolPoliciesMu.Unlock()
+	poolPolicies[name] = newPolicy
+}
+
+// NewPoolPolicy 按名字创建策略, weights 是 "name=weight,..." 格式的每个池的权重, 没有列出的池权重为 1
+func NewPoolPolicy(name, weights string) (PoolPolicy, error) {
+	poolPoliciesMu.RLock()
+	newPolicy, ok := poolPolicies[name]
+	var names []string
+	for n := range poolPolicies {
+		names = append(names, n)
+	}
+	poolPoliciesMu.RUnlock()
+	if !ok {
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown pool policy %q, available policies are %v", name, names)
+	}
+
+	parsed := make(map[string]int64)
+	for _, pair := range strings.Split(weights, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		pool, value, ok := strings.Cut(pair, "=")
+		weight, err := strconv.ParseInt(value, 10, 64)
+		if !ok || pool == "" || err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid pool weight %q, expected name=weight with a non-negative weight", pair)
+		}
+		parsed[pool] = weight
+	}
+	return newPolicy(parsed), nil
+}
+
+// SetPoolPolicy 设置没有指定 pool 参数的卷使用的策略, 为 nil 时这些卷放在 DataDir 下
+func (s *ControllerServer) SetPoolPolicy(policy PoolPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.poolPolicy = policy
+}
+
+// usesPoolPolicy 判断卷是否由策略选择存储池: 没有指定 pool 参数, 后端使用存储池, 并且配置了存储池和策略; 调用方需要持有 s.mu
+func (s *ControllerServer) usesPoolPolicy(parameters map[string]string, backend Backend) bool {
+	return s.poolPolicy != nil && len(s.config.PoolDirs()) > 0 && parameters[poolParameter] == "" &&
+		pooledBackends[backend.Name()] && !isMemoryVolume(parameters)
+}
+
+// poolCandidates 返回按名字排序的所有存储池以及它们的可用容量
+func (s *ControllerServer) poolCandidates() ([]PoolCandidate, error) {
+	var candidates []PoolCandidate
+	for name := range s.config.PoolDirs() {
+		available, err := s.availableCapacity(name)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, PoolCandidate{Name: name, AvailableBytes: available})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+	return candidates, nil
+}
+
+// choosePool 用策略在放得下 capacity 字节的存储池中选择一个, 调用方需要持有 s.mu
+func (s *ControllerServer) choosePool(capacity int64) (string, error) {
+	all, err := s.poolCandidates()
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "failed to get capacity: %v", err)
+	}
+	var candidates []PoolCandidate
+	for _, c := range all {
+		if c.AvailableBytes >= capacity {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", status.Errorf(codes.ResourceExhausted, "requested %d bytes but no pool has that much available", capacity)
+	}
+	return s.poolPolicy.Choose(candidates), nil
+}
+
+// mostFreePolicy 选择可用空间最多的池
+type mostFreePolicy struct{}
+
+func (mostFreePolicy) Name() string {
+	return "most-free"
+}
+
+func (mostFreePolicy) Choose(candidates []PoolCandidate) string {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.AvailableBytes > best.AvailableBytes {
+			best = c
+		}
+	}
+	return best.Name
+}
+
+// roundRobinPolicy 按名字顺序轮流选择, 放不下的池跳过
+type roundRobinPolicy struct {
+	last string
+}
+
+func (*roundRobinPolicy) Name() string {
+	return "round-robin"
+}
+
+func (p *roundRobinPolicy) Choose(candidates []PoolCandidate) string {
+	chosen := candidates[0].Name
+	for _, c := range candidates {
+		if c.Name > p.last {
+			chosen = c.Name
+			break
+		}
+	}
+	p.last = chosen
+	return chosen
+}
+
+// weightedPolicy 按权重平滑地轮流选择(和 nginx 的加权轮询相同), 权重为 3 和 1 的两个池依次选中 a a b a ...;
+// 权重为 0 的池只在其他池都放不下时才选
+type weightedPolicy struct {
+	weights map[string]int64
+	current map[string]int64
+}
+
+func (*weightedPolicy) Name() string {
+	return "weighted"
+}
+
+func (p *weightedPolicy) Choose(candidates []PoolCandidate) string {
+	var total int64
+	best := ""
+	for _, c := range candidates {
+		weight, ok := p.weights[c.Name]
+		if !ok {
+			weight = 1
+		}
+		total += weight
+		p.current[c.Name] += weight
+		if best == "" || p.current[c.Name] > p.current[best] {
+			best = c.Name
+		}
+	}
+	p.current[best] -= total
+	return best
+}
@@ -0,0 +1,284 @@
+// Package hostpathcsi Description: 这个文件实现卷的 IO 限速: StorageClass 或 VolumeAttributesClass 设置 iopsLimit/bpsLimit 时,
+// NodePublishVolume 在 pod 的 cgroup v2 io.max 里限制 pod 对卷所在块设备的读写, 避免一个 pod 占满节点的磁盘。
+// image 和 lvm 卷有自己的 loop 设备或逻辑卷, 限制只作用于这个卷; 目录卷限制的是 pod 对卷所在整块磁盘的访问。
+// io.max 里每个设备只有一行, 同一个 pod 在同一块设备上的多个卷写入的是它们上限的和; 每次写入都记录下来,
+// NodeUnpublishVolume 时按剩下的卷重新计算, 最后一个卷卸载之后恢复为 max。
+package hostpathcsi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// iopsLimitParameter 是卷每秒读和写的 IO 次数上限(各自独立计算)
+	iopsLimitParameter = "iopsLimit"
+	// bpsLimitParameter 是卷每秒读和写的字节数上限(各自独立计算)
+	bpsLimitParameter = "bpsLimit"
+	// cgroupRoot 是 cgroup v2 的挂载点
+	cgroupRoot = "/sys/fs/cgroup"
+	// kubeletPodsDir 是 kubelet 目标路径中 pod UID 前面的部分
+	kubeletPodsDir = "/pods/"
+)
+
+func init() {
+	mutableParameters[iopsLimitParameter] = true
+	mutableParameters[bpsLimitParameter] = true
+}
+
+// ioLimits 是卷的 IO 上限, 0 表示不限制
+type ioLimits struct {
+	iops uint64
+	bps  uint64
+}
+
+// ioLimitRecord 是写入某个目标路径所在 pod 的 io.max 的上限
+type ioLimitRecord struct {
+	Cgroup string `json:"cgroup"`
+	Device string `json:"device"`
+	IOPS   uint64 `json:"iops,omitempty"`
+	BPS    uint64 `json:"bps,omitempty"`
+}
+
+// ioLimitsMu 保护 IO 上限记录; Controller 修改上限和 Node 发布、卸载卷可能在同一个进程里同时修改
+var ioLimitsMu sync.Mutex
+
+// parseIOLimits 解析卷参数(或 VolumeContext)中的 iopsLimit 和 bpsLimit
+func parseIOLimits(parameters map[string]string) (ioLimits, error) {
+	var limits ioLimits
+	for key, field := range map[string]*uint64{iopsLimitParameter: &limits.iops, bpsLimitParameter: &limits.bps} {
+		value := parameters[key]
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return ioLimits{}, fmt.Errorf("invalid %s parameter %q, must be a non-negative integer", key, value)
+		}
+		*field = n
+	}
+	return limits, nil
+}
+
+// hasIOLimitParameters 判断参数里是否设置了 IO 上限
+func hasIOLimitParameters(parameters map[string]string) bool {
+	return parameters[iopsLimitParameter] != "" || parameters[bpsLimitParameter] != ""
+}
+
+// checkIOLimits 检查 IO 上限参数: 卷必须落在真实的块设备上, 内存卷、模板卷以及 btrfs、zfs 卷没有可以限制的设备
+func checkIOLimits(parameters map[string]string, accessType string, backend Backend) error {
+	if _, err := parseIOLimits(parameters); err != nil {
+		return err
+	}
+	switch {
+	case isMemoryVolume(parameters), isTemplateVolume(parameters):
+		return fmt.Errorf("%s and %s do not apply to memory or template volumes", iopsLimitParameter, bpsLimitParameter)
+	case backend.Name() == btrfsBackendName || backend.Name() == zfsBackendName:
+		return fmt.Errorf("%s and %s are not supported on the %s backend", iopsLimitParameter, bpsLimitParameter, backend.Name())
+	case accessType == accessTypeBlock:
+		return fmt.Errorf("%s and %s do not apply to block volumes", iopsLimitParameter, bpsLimitParameter)
+	}
+	return nil
+}
+
+// ioMaxLine 返回写入 io.max 的一行, 不限制的项写 max, 这样修改参数时可以取消之前的限制
+func (l ioLimits) ioMaxLine(device string) string {
+	value := func(n uint64) string {
+		if n == 0 {
+			return "max"
+		}
+		return strconv.FormatUint(n, 10)
+	}
+	return fmt.Sprintf("%s riops=%s wiops=%s rbps=%s wbps=%s", device, value(l.iops), value(l.iops), value(l.bps), value(l.bps))
+}
+
+// combineIOLimits 返回 records 中同一个 cgroup 和设备上所有卷的上限之和; 有一个卷不限制的项整体不限制,
+// 没有卷时全部不限制
+func combineIOLimits(records map[string]ioLimitRecord, cgroup, device string) ioLimits {
+	var combined ioLimits
+	var unlimitedIOPS, unlimitedBPS bool
+	for _, record := range records {
+		if record.Cgroup != cgroup || record.Device != device {
+			continue
+		}
+		unlimitedIOPS = unlimitedIOPS || record.IOPS == 0
+		unlimitedBPS = unlimitedBPS || record.BPS == 0
+		combined.iops += record.IOPS
+		combined.bps += record.BPS
+	}
+	if unlimitedIOPS {
+		combined.iops = 0
+	}
+	if unlimitedBPS {
+		combined.bps = 0
+	}
+	return combined
+}
+
+// applyIOLimits 把 IO 上限写入挂载在 targetPath 上的 pod 的 cgroup, 设备是 targetPath 所在的块设备;
+// 同一个 pod 在这个设备上还有其他限速的卷时写入它们的和, 并把上限记录到 recordPath
+func applyIOLimits(ctx context.Context, recordPath, targetPath string, limits ioLimits) error {
+	device, err := ioDevice(targetPath)
+	if err != nil {
+		return err
+	}
+	podCgroup, err := findPodCgroup(targetPath)
+	if err != nil {
+		return err
+	}
+
+	ioLimitsMu.Lock()
+	defer ioLimitsMu.Unlock()
+	records, err := loadIOLimitRecords(recordPath)
+	if err != nil {
+		return err
+	}
+	records[targetPath] = ioLimitRecord{Cgroup: podCgroup, Device: device, IOPS: limits.iops, BPS: limits.bps}
+	// 先记录再写 io.max, 中途失败时卸载仍然能找到这个设备并恢复
+	if err := saveIOLimitRecords(recordPath, records); err != nil {
+		return err
+	}
+	line := combineIOLimits(records, podCgroup, device).ioMaxLine(device)
+	if err := os.WriteFile(filepath.Join(podCgroup, "io.max"), []byte(line), 0644); err != nil {
+		return fmt.Errorf("failed to set io.max of %s: %v", podCgroup, err)
+	}
+	logFor(ctx).Infof("Set io.max %q in %s for %s", line, podCgroup, targetPath)
+	return nil
+}
+
+// resetIOLimits 在卷从 targetPath 卸载之后删除它的上限: 按同一个 pod 在这个设备上剩下的卷重新写入 io.max,
+// 没有剩下的卷时恢复为 max; pod 的 cgroup 已经删除时只删除记录
+func resetIOLimits(ctx context.Context, recordPath, targetPath string) error {
+	ioLimitsMu.Lock()
+	defer ioLimitsMu.Unlock()
+	records, err := loadIOLimitRecords(recordPath)
+	if err != nil {
+		return err
+	}
+	record, ok := records[targetPath]
+	if !ok {
+		return nil
+	}
+	delete(records, targetPath)
+	line := combineIOLimits(records, record.Cgroup, record.Device).ioMaxLine(record.Device)
+	err = os.WriteFile(filepath.Join(record.Cgroup, "io.max"), []byte(line), 0644)
+	switch {
+	case err == nil:
+		logFor(ctx).Infof("Set io.max %q in %s after unpublishing %s", line, record.Cgroup, targetPath)
+	case os.IsNotExist(err):
+		logFor(ctx).Infof("Cgroup %s of %s no longer exists, dropping its io limits.", record.Cgroup, targetPath)
+	default:
+		return fmt.Errorf("failed to reset io.max of %s: %v", record.Cgroup, err)
+	}
+	return saveIOLimitRecords(recordPath, records)
+}
+
+// loadIOLimitRecords 读取一个节点写入的 IO 上限(目标路径 -> 上限), 文件不存在时返回空记录
+func loadIOLimitRecords(path string) (map[string]ioLimitRecord, error) {
+	records := make(map[string]ioLimitRecord)
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read io limit records %s: %v", path, err)
+	}
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse io limit records %s: %v", path, err)
+	}
+	return records, nil
+}
+
+// saveIOLimitRecords 持久化一个节点写入的 IO 上限
+func saveIOLimitRecords(path string, records map[string]ioLimitRecord) error {
+	raw, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode io limit records: %v", err)
+	}
+	return writeFileAtomic(path, raw)
+}
+
+// ioDevice 返回 path 所在的块设备的 MAJ:MIN; 分区不能单独限速, 返回它所在的整块磁盘
+func ioDevice(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	major, minor := unix.Major(st.Dev), unix.Minor(st.Dev)
+	if major == 0 {
+		return "", fmt.Errorf("%s is not on a block device", path)
+	}
+	device := fmt.Sprintf("%d:%d", major, minor)
+	sysfs := filepath.Join("/sys/dev/block", device)
+	if _, err := os.Stat(filepath.Join(sysfs, "partition")); err == nil {
+		raw, err := os.ReadFile(filepath.Join(sysfs, "..", "dev"))
+		if err != nil {
+			return "", fmt.Errorf("failed to find the disk of partition %s: %v", device, err)
+		}
+		device = strings.TrimSpace(string(raw))
+	}
+	return device, nil
+}
+
+// findPodCgroup 从 kubelet 的目标路径取出 pod UID, 在 cgroup 层级里找到 pod 的 cgroup 目录;
+// systemd 驱动下目录名是 kubepods-<qos>-pod<uid>.slice(UID 中的 - 换成 _), cgroupfs 驱动下是 pod<uid>
+func findPodCgroup(targetPath string) (string, error) {
+	start := strings.Index(targetPath, kubeletPodsDir)
+	end := strings.Index(targetPath, kubeletCSIVolumesDir)
+	if start < 0 || end < start {
+		return "", fmt.Errorf("target path %s is not in a kubelet pod directory", targetPath)
+	}
+	uid := targetPath[start+len(kubeletPodsDir) : end]
+	names := map[string]bool{"pod" + uid: true}
+	suffix := "-pod" + strings.ReplaceAll(uid, "-", "_") + ".slice"
+
+	var found string
+	err := filepath.WalkDir(cgroupRoot, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if names[d.Name()] || strings.HasSuffix(d.Name(), suffix) {
+			found = path
+			return filepath.SkipAll
+		}
+		// pod 的 cgroup 都在 kubepods 下面, 不进入其他子树
+		if path != cgroupRoot && !strings.HasPrefix(d.Name(), "kubepods") {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", fmt.Errorf("cgroup of pod %s not found under %s", uid, cgroupRoot)
+	}
+	return found, nil
+}
+
+// reapplyIOLimits 在 VolumeAttributesClass 修改 IO 上限后, 更新本节点上卷已经发布到的 pod 的 cgroup;
+// 其他节点上的 pod 保持发布时的上限, 直到卷重新发布
+func reapplyIOLimits(ctx context.Context, config *Config, nodeID string, volume Volume) {
+	limits, err := parseIOLimits(volume.Parameters)
+	if err != nil {
+		logFor(ctx).Warningf("Invalid io limits of volume %s: %v", volume.ID, err)
+		return
+	}
+	published, err := loadPublished(filepath.Join(config.publishedDir(), nodeID+".json"))
+	if err != nil {
+		logFor(ctx).Warningf("Failed to update io limits of volume %s: %v", volume.ID, err)
+		return
+	}
+	for target := range published[volume.ID] {
+		if err := applyIOLimits(ctx, config.ioLimitsPath(nodeID), target, limits); err != nil {
+			logFor(ctx).Warningf("Failed to update io limits of volume %s at %s: %v", volume.ID, target, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package hostpathcsi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCombineIOLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		records map[string]ioLimitRecord
+		want    ioLimits
+	}{
+		{
+			name: "no volumes",
+		},
+		{
+			name:    "one volume",
+			records: map[string]ioLimitRecord{"/a": {Cgroup: "pod1", Device: "8:0", IOPS: 100, BPS: 1000}},
+			want:    ioLimits{iops: 100, bps: 1000},
+		},
+		{
+			name: "volumes on the same device add up",
+			records: map[string]ioLimitRecord{
+				"/a": {Cgroup: "pod1", Device: "8:0", IOPS: 100, BPS: 1000},
+				"/b": {Cgroup: "pod1", Device: "8:0", IOPS: 50, BPS: 500},
+			},
+			want: ioLimits{iops: 150, bps: 1500},
+		},
+		{
+			name: "a volume without a limit lifts it",
+			records: map[string]ioLimitRecord{
+				"/a": {Cgroup: "pod1", Device: "8:0", IOPS: 100, BPS: 1000},
+				"/b": {Cgroup: "pod1", Device: "8:0", IOPS: 50},
+			},
+			want: ioLimits{iops: 150},
+		},
+		{
+			name: "other pods and devices are ignored",
+			records: map[string]ioLimitRecord{
+				"/a": {Cgroup: "pod1", Device: "8:0", IOPS: 100, BPS: 1000},
+				"/b": {Cgroup: "pod2", Device: "8:0", IOPS: 50, BPS: 500},
+				"/c": {Cgroup: "pod1", Device: "8:16"},
+			},
+			want: ioLimits{iops: 100, bps: 1000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := combineIOLimits(tt.records, "pod1", "8:0"); got != tt.want {
+				t.Errorf("combineIOLimits() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResetIOLimits(t *testing.T) {
+	cgroup := t.TempDir()
+	tests := []struct {
+		name    string
+		records map[string]ioLimitRecord
+		target  string
+		// wantIOMax 是 io.max 写入的内容, 为空表示不写
+		wantIOMax string
+		wantLeft  int
+	}{
+		{
+			name:      "last volume restores max",
+			records:   map[string]ioLimitRecord{"/a": {Cgroup: cgroup, Device: "8:0", IOPS: 100, BPS: 1000}},
+			target:    "/a",
+			wantIOMax: "8:0 riops=max wiops=max rbps=max wbps=max",
+		},
+		{
+			name: "remaining volume keeps its limit",
+			records: map[string]ioLimitRecord{
+				"/a": {Cgroup: cgroup, Device: "8:0", IOPS: 100, BPS: 1000},
+				"/b": {Cgroup: cgroup, Device: "8:0", IOPS: 50, BPS: 500},
+			},
+			target:    "/a",
+			wantIOMax: "8:0 riops=50 wiops=50 rbps=500 wbps=500",
+			wantLeft:  1,
+		},
+		{
+			name:     "volume without a record",
+			records:  map[string]ioLimitRecord{"/b": {Cgroup: cgroup, Device: "8:0", IOPS: 50}},
+			target:   "/a",
+			wantLeft: 1,
+		},
+		{
+			name:    "pod cgroup already removed",
+			records: map[string]ioLimitRecord{"/a": {Cgroup: filepath.Join(cgroup, "gone"), Device: "8:0", IOPS: 100}},
+			target:  "/a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(cgroup, "io.max"))
+			recordPath := filepath.Join(t.TempDir(), "node-1.json")
+			if err := saveIOLimitRecords(recordPath, tt.records); err != nil {
+				t.Fatal(err)
+			}
+			if err := resetIOLimits(context.Background(), recordPath, tt.target); err != nil {
+				t.Fatalf("resetIOLimits: %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(cgroup, "io.max"))
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if string(got) != tt.wantIOMax {
+				t.Errorf("io.max = %q, want %q", got, tt.wantIOMax)
+			}
+			left, err := loadIOLimitRecords(recordPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != tt.wantLeft {
+				t.Errorf("%d records left, want %d", len(left), tt.wantLeft)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Package hostpathcsi Description: 这个文件用 project quota 限制目录卷的容量: 卷目录所在的 xfs 或 ext4 文件系统开启了 project quota 时,
+// 每个卷目录分配一个 project ID, 把 PVC 的容量设为这个 project 的块硬限制, 否则目录卷可以无限制地写入。
+package hostpathcsi
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"hash/fnv"
+	"k8s.io/klog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// xfsSuperMagic 和 ext4SuperMagic 是 statfs 返回的文件系统类型(ext2/3/4 共用同一个值)
+	xfsSuperMagic  = 0x58465342
+	ext4SuperMagic = 0xef53
+	// fsIocFsgetxattr 和 fsIocFssetxattr 是 FS_IOC_FSGETXATTR/FS_IOC_FSSETXATTR, 读写文件的 project ID, x/sys 没有提供
+	fsIocFsgetxattr = 0x801c581f
+	fsIocFssetxattr = 0x401c5820
+	// fsXflagProjinherit 让目录下新建的文件和子目录继承目录的 project ID
+	fsXflagProjinherit = 0x200
+	// projectIDMin 和 projectIDMax 是分配给卷的 project ID 范围, 避开管理员在 /etc/projid 里手工分配的小编号
+	projectIDMin = 1 << 20
+	projectIDMax = 1 << 31
+)
+
+// fsxattr 对应内核的 struct fsxattr
+type fsxattr struct {
+	Xflags     uint32
+	Extsize    uint32
+	Nextents   uint32
+	Projid     uint32
+	Cowextsize uint32
+	Pad        [8]byte
+}
+
+// projectQuota 是一个开启了 project quota 的文件系统
+type projectQuota struct {
+	// mountPoint 是文件系统的挂载点, xfs_quota 通过它找到文件系统
+	mountPoint string
+	// foreign 表示不是 xfs 文件系统(ext4), xfs_quota 需要 -f 才能操作
+	foreign bool
+}
+
+// projectQuotaFor 返回 path 所在文件系统的 project quota; 文件系统不支持或者没有开启 project quota 时返回 nil
+func projectQuotaFor(path string) (*projectQuota, error) {
+	quota, _, err := detectProjectQuota(path)
+	return quota, err
+}
+
+// CheckProjectQuota 检查 path 所在的文件系统能否用 project quota 限制目录卷的容量, 不能时返回原因;
+// path 不存在时检查它最近的已存在的上级目录
+func CheckProjectQuota(path string) error {
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	quota, reason, err := detectProjectQuota(path)
+	if err != nil {
+		return err
+	}
+	if quota == nil {
+		return errors.New(reason)
+	}
+	if _, err := exec.LookPath("xfs_quota"); err != nil {
+		return fmt.Errorf("xfs_quota is required to manage project quotas: %v", err)
+	}
+	return nil
+}
+
+// detectProjectQuota 判断 path 所在的文件系统是否是开启了 project quota 的 xfs 或 ext4, 不支持时 reason 说明原因
+func detectProjectQuota(path string) (quota *projectQuota, reason string, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return nil, "", fmt.Errorf("failed to statfs %s: %v", path, err)
+	}
+	entry, err := mountContaining(path)
+	if err != nil {
+		return nil, "", err
+	}
+	options := strings.Split(entry.SuperOptions, ",")
+
+	switch st.Type {
+	case xfsSuperMagic:
+		// xfs 在 mountinfo 里把 pquota/prjquota 都显示为 prjquota, 只记账不限制的 pqnoenforce 不算
+		if slices.Contains(options, "prjquota") || slices.Contains(options, "pquota") {
+			return &projectQuota{mountPoint: entry.MountPoint}, "", nil
+		}
+		return nil, fmt.Sprintf("xfs filesystem %s is not mounted with the prjquota option", entry.MountPoint), nil
+	case ext4SuperMagic:
+		// ext4 需要先用 tune2fs -O project,quota 打开 project 和 quota 特性(文件系统卸载时执行),
+		// 之后挂载时会自动开启 project quota, 这种情况 mountinfo 里没有 prjquota 选项, 只能读超级块的特性
+		if entry.FsType == "ext4" && (slices.Contains(options, "prjquota") || ext4HasProjectQuota(entry.Source)) {
+			return &projectQuota{mountPoint: entry.MountPoint, foreign: true}, "", nil
+		}
+		return nil, fmt.Sprintf("%s filesystem %s does not have project quotas enabled, run tune2fs -O project,quota %s while it is unmounted and mount it with prjquota", entry.FsType, entry.MountPoint, entry.Source), nil
+	default:
+		return nil, fmt.Sprintf("filesystem %s (%s) does not support project quotas, only xfs and ext4 do", entry.MountPoint, entry.FsType), nil
+	}
+}
+
+// applyQuota 把卷目录的容量限制为 capacity, 目录还没有 project ID 时先分配一个; 文件系统不支持 project quota 时什么都不做
+func applyQuota(volumeID, dir string, capacity int64) error {
+	quota, err := projectQuotaFor(dir)
+	if err != nil || quota == nil {
+		return err
+	}
+	id, err := getProjectID(dir)
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		if id, err = quota.allocate(volumeID); err != nil {
+			return err
+		}
+		if err := setProjectID(dir, id); err != nil {
+			return err
+		}
+	}
+	if err := quota.setLimit(id, capacity); err != nil {
+		return err
+	}
+	klog.Infof("Limited volume %s to %d bytes with project quota %d", volumeID, capacity, id)
+	return nil
+}
+
+// clearQuota 删除卷目录的容量限制, 释放它的 project ID
+func clearQuota(dir string) error {
+	quota, err := projectQuotaFor(dir)
+	if err != nil || quota == nil {
+		return err
+	}
+	id, err := getProjectID(dir)
+	if err != nil || id == 0 {
+		return err
+	}
+	return quota.setLimit(id, 0)
+}
+
+// ext4HasProjectQuota 通过 tune2fs -l 判断 ext4 设备是否打开了 project 和 quota 特性
+func ext4HasProjectQuota(device string) bool {
+	out, err := exec.Command("tune2fs", "-l", device).CombinedOutput()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// 例如 "Filesystem features:      has_journal ext_attr ... quota project"
+		if features, ok := strings.CutPrefix(line, "Filesystem features:"); ok {
+			fields := strings.Fields(features)
+			return slices.Contains(fields, "project") && slices.Contains(fields, "quota")
+		}
+	}
+	return false
+}
+
+// allocate 为卷选择一个还没有被使用的 project ID; 由卷 ID 的哈希开始探测, 重试时同一个卷通常得到同一个 ID
+func (q *projectQuota) allocate(volumeID string) (uint32, error) {
+	used, err := q.usedIDs()
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New32a()
+	h.Write([]byte(volumeID))
+	id := projectIDMin + h.Sum32()%(projectIDMax-projectIDMin)
+	for used[id] {
+		if id++; id >= projectIDMax {
+			id = projectIDMin
+		}
+	}
+	return id, nil
+}
+
+// usedIDs 返回文件系统上已经有用量或者限制的 project ID
+func (q *projectQuota) usedIDs() (map[uint32]bool, error) {
+	out, err := q.run("report -p -n -N")
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[uint32]bool)
+	for _, line := range strings.Split(out, "\n") {
+		// 每行以 #ID 开头, 例如 "#1048577  0  0  1073741824  00 [--------]"
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if id, err := strconv.ParseUint(fields[0][1:], 10, 32); err == nil {
+			used[uint32(id)] = true
+		}
+	}
+	return used, nil
+}
+
+// setLimit 设置 project 的块硬限制, bytes 为 0 表示不限制
+func (q *projectQuota) setLimit(id uint32, bytes int64) error {
+	_, err := q.run(fmt.Sprintf("limit -p bhard=%d %d", bytes, id))
+	return err
+}
+
+// run 在文件系统上执行一条 xfs_quota 专家模式命令
+func (q *projectQuota) run(command string) (string, error) {
+	args := []string{"-x", "-c", command, q.mountPoint}
+	if q.foreign {
+		args = append([]string{"-f"}, args...)
+	}
+	out, err := exec.Command("xfs_quota", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("xfs_quota %q on %s failed: %v, output: %s", command, q.mountPoint, err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// getProjectID 读取目录的 project ID
+func getProjectID(dir string) (uint32, error) {
+	attr, err := getFsxattr(dir)
+	if err != nil {
+		return 0, err
+	}
+	return attr.Projid, nil
+}
+
+// setProjectID 设置目录的 project ID 并让新建的文件继承它; 只影响之后写入的数据, 所以要在填充卷之前调用
+func setProjectID(dir string, id uint32) error {
+	attr, err := getFsxattr(dir)
+	if err != nil {
+		return err
+	}
+	attr.Projid = id
+	attr.Xflags |= fsXflagProjinherit
+	return fsxattrIoctl(dir, fsIocFssetxattr, &attr)
+}
+
+// hasProjectQuota 判断目录是否设置了继承的 project ID; xfs 和 ext4 对这样的目录执行 statfs 时,
+// 返回的是 project quota 的限制和已用量, 不需要遍历目录就能知道卷的用量
+func hasProjectQuota(dir string) bool {
+	attr, err := getFsxattr(dir)
+	return err == nil && attr.Projid != 0 && attr.Xflags&fsXflagProjinherit != 0
+}
+
+func getFsxattr(dir string) (fsxattr, error) {
+	var attr fsxattr
+	err := fsxattrIoctl(dir, fsIocFsgetxattr, &attr)
+	return attr, err
+}
+
+// fsxattrIoctl 对目录执行 FS_IOC_FSGETXATTR/FS_IOC_FSSETXATTR
+func fsxattrIoctl(dir string, request uintptr, attr *fsxattr) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), request, uintptr(unsafe.Pointer(attr))); errno != 0 {
+		return fmt.Errorf("failed to access project id of %s: %v", dir, errno)
+	}
+	return nil
+}
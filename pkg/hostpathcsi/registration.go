@@ -0,0 +1,154 @@
+// Package hostpathcsi Description: 这个文件实现向 kubelet 注册驱动, 代替 node-driver-registrar sidecar: 在 kubelet 的插件注册目录下
+// 创建 <驱动名>-reg.sock 并提供 pluginregistration/v1 的 Registration 服务, kubelet 发现 socket 后调用 GetInfo 获取驱动名和
+// CSI socket 的路径, 再通过 NotifyRegistrationStatus 通知注册结果。kubelet 重启时会重新扫描注册目录并再次注册;
+// 注册目录被清理、socket 被删除时, 驱动定期检查后重新创建 socket, 触发 kubelet 再次注册。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultRegistrationDir 是 kubelet 监听插件注册 socket 的目录
+	DefaultRegistrationDir = "/var/lib/kubelet/plugins_registry/"
+	// registrationCheckInterval 是检查注册 socket 是否被删除的间隔
+	registrationCheckInterval = 10 * time.Second
+)
+
+// supportedCSIVersions 是上报给 kubelet 的驱动支持的 CSI 版本
+var supportedCSIVersions = []string{"1.0.0"}
+
+// PluginRegistration 在注册目录下提供 kubelet 的插件注册服务
+type PluginRegistration struct {
+	driverName string
+	// kubeletEndpoint 是 kubelet 访问驱动的 CSI socket 的路径, 即宿主机上的路径, 可能和驱动容器里的路径不同
+	kubeletEndpoint string
+	// socketPath 是注册 socket 的路径
+	socketPath string
+	server     *grpc.Server
+
+	// mu 保护 listener 和 inode
+	mu       sync.Mutex
+	listener net.Listener
+	// inode 是当前 socket 文件的 inode, 用来发现 socket 被删除或者被替换
+	inode uint64
+	done  chan struct{}
+}
+
+// NewPluginRegistration 创建注册服务, kubeletEndpoint 是宿主机上 CSI socket 的绝对路径, registrationDir 是注册目录
+func NewPluginRegistration(driverName, kubeletEndpoint, registrationDir string) (*PluginRegistration, error) {
+	if !filepath.IsAbs(kubeletEndpoint) {
+		return nil, fmt.Errorf("kubelet registration path %q must be an absolute path", kubeletEndpoint)
+	}
+	r := &PluginRegistration{
+		driverName:      driverName,
+		kubeletEndpoint: kubeletEndpoint,
+		socketPath:      filepath.Join(registrationDir, driverName+"-reg.sock"),
+		server:          grpc.NewServer(),
+		done:            make(chan struct{}),
+	}
+	registerapi.RegisterRegistrationServer(r.server, r)
+	return r, nil
+}
+
+// GetInfo 返回驱动的信息, kubelet 用它连接 CSI socket
+func (r *PluginRegistration) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	klog.Infof("Received GetInfo call from kubelet")
+	return &registerapi.PluginInfo{
+		Type:              registerapi.CSIPlugin,
+		Name:              r.driverName,
+		Endpoint:          r.kubeletEndpoint,
+		SupportedVersions: supportedCSIVersions,
+	}, nil
+}
+
+// NotifyRegistrationStatus 接收 kubelet 的注册结果; 注册失败时只记录错误, kubelet 重启或 socket 重新创建后会再次注册
+func (r *PluginRegistration) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if !status.PluginRegistered {
+		klog.Errorf("Kubelet failed to register driver %s: %s", r.driverName, status.Error)
+	} else {
+		klog.Infof("Driver %s registered with kubelet, CSI endpoint %s", r.driverName, r.kubeletEndpoint)
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// Start 创建注册 socket 开始服务, 并定期检查 socket 是否还在, 不在时重新创建
+func (r *PluginRegistration) Start() error {
+	if err := r.listen(); err != nil {
+		return err
+	}
+	klog.Infof("Serving kubelet plugin registration on %s", r.socketPath)
+	go func() {
+		ticker := time.NewTicker(registrationCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+			}
+			if r.socketExists() {
+				continue
+			}
+			klog.Warningf("Registration socket %s was removed, re-creating it to register with kubelet again", r.socketPath)
+			if err := r.listen(); err != nil {
+				klog.Errorf("Failed to re-create registration socket: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop 停止注册服务并删除 socket, kubelet 看到 socket 被删除后注销驱动
+func (r *PluginRegistration) Stop() {
+	close(r.done)
+	r.server.Stop()
+	if err := os.Remove(r.socketPath); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Failed to remove registration socket %s: %v", r.socketPath, err)
+	}
+}
+
+// listen 创建(或重新创建)注册 socket, 关闭之前的 listener
+func (r *PluginRegistration) listen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.listener != nil {
+		r.listener.Close()
+		r.listener = nil
+	}
+	listener, err := Listen("unix://"+r.socketPath, SocketOptions{UID: -1, GID: -1})
+	if err != nil {
+		return fmt.Errorf("failed to listen on registration socket %s: %v", r.socketPath, err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(r.socketPath, &st); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to stat registration socket %s: %v", r.socketPath, err)
+	}
+	r.listener, r.inode = listener, st.Ino
+	go func() {
+		// listener 被关闭(重新创建或者停止)时 Serve 返回
+		if err := r.server.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+			klog.V(4).Infof("Stopped serving registration socket: %v", err)
+		}
+	}()
+	return nil
+}
+
+// socketExists 判断注册 socket 是否还是驱动创建的那个文件
+func (r *PluginRegistration) socketExists() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var st syscall.Stat_t
+	return syscall.Stat(r.socketPath, &st) == nil && st.Ino == r.inode
+}
@@ -0,0 +1,116 @@
+// Package hostpathcsi Description: 这个文件实现请求 ID: 每次 CSI 调用使用 gRPC metadata 中的 x-request-id(调用方传入时), 否则生成一个,
+// 放进 context 并通过响应 header 返回; 处理过程中的日志(包括后端的克隆、恢复等多步操作)都带上 [请求 ID] 前缀,
+// 返回的错误信息也带上它, 通过 sidecar 日志里的错误就能找到驱动里这次调用的所有日志。
+package hostpathcsi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+const (
+	// requestIDMetadata 是传入和返回请求 ID 的 gRPC metadata 键
+	requestIDMetadata = "x-request-id"
+	// maxRequestIDLength 是接受的调用方请求 ID 的最大长度, 更长或者包含不可打印字符的 ID 会被替换
+	maxRequestIDLength = 64
+)
+
+// requestIDKey 是 context 中请求 ID 的键
+type requestIDKey struct{}
+
+// RequestID 返回 context 中的请求 ID, 不在 CSI 调用中时返回空字符串
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestIDInterceptor 返回为每次调用设置请求 ID 的 gRPC 拦截器
+func NewRequestIDInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		id := incomingRequestID(ctx)
+		if id == "" {
+			id = newRequestID()
+		}
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+		grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, id))
+		// 请求 ID 记录在链路上, 可以从日志找到对应的链路
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("request.id", id))
+		resp, err := handler(ctx, req)
+		if err != nil {
+			// 保留错误码和 details, 只在信息后面加上请求 ID
+			s := status.Convert(err).Proto()
+			s.Message = fmt.Sprintf("%s (request id %s)", s.Message, id)
+			err = status.ErrorProto(s)
+		}
+		return resp, err
+	}
+}
+
+// incomingRequestID 返回调用方在 metadata 中传入的合法的请求 ID
+func incomingRequestID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(requestIDMetadata)
+	if len(values) == 0 || len(values[0]) > maxRequestIDLength {
+		return ""
+	}
+	for _, c := range values[0] {
+		if c <= ' ' || c > '~' {
+			return ""
+		}
+	}
+	return values[0]
+}
+
+// newRequestID 生成 16 个十六进制字符的随机请求 ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogger 是带请求 ID 前缀的日志, 日志的文件和行号是调用方的
+type requestLogger struct {
+	prefix string
+	// verbose 为 false 时 Infof 不记录, 由 V 根据日志级别设置
+	verbose bool
+}
+
+// logFor 返回 ctx 所在请求的日志, 不在 CSI 调用中时没有前缀
+func logFor(ctx context.Context) requestLogger {
+	l := requestLogger{verbose: true}
+	if id := RequestID(ctx); id != "" {
+		l.prefix = "[" + id + "] "
+	}
+	return l
+}
+
+// V 返回只在 klog 的日志级别不低于 level 时记录 Infof 的日志
+func (l requestLogger) V(level klog.Level) requestLogger {
+	l.verbose = l.verbose && bool(klog.V(level))
+	return l
+}
+
+func (l requestLogger) Infof(format string, args ...interface{}) {
+	if l.verbose {
+		klog.InfoDepth(1, l.prefix+fmt.Sprintf(format, args...))
+	}
+}
+
+func (l requestLogger) Warningf(format string, args ...interface{}) {
+	klog.WarningDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
+
+func (l requestLogger) Errorf(format string, args ...interface{}) {
+	klog.ErrorDepth(1, l.prefix+fmt.Sprintf(format, args...))
+}
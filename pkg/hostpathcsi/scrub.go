@@ -0,0 +1,241 @@
+// Package hostpathcsi Description: 这个文件实现卷数据的后台校验: StorageClass 设置 integrity=true 的卷, 由 Controller 定期遍历卷里的文件,
+// 在卷外的清单里记录每个文件的 sha256、大小和修改时间; 大小和修改时间都没变而内容的校验和变了, 说明数据在磁盘上损坏(而不是被 pod 修改),
+// 这时 ControllerGetVolume 返回异常的 VolumeCondition, 直到文件被重新写入。
+package hostpathcsi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"io"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// integrityParameter 是 StorageClass 中开启后台校验的参数
+	integrityParameter = "integrity"
+)
+
+// scrubEntry 是清单中一个文件的记录
+type scrubEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	SHA256  string `json:"sha256"`
+}
+
+// scrubResult 是一个卷最近一次校验的结果
+type scrubResult struct {
+	// Corrupted 是内容和记录的校验和不一致的文件(相对卷目录的路径)
+	Corrupted []string
+	// CheckedAt 是校验完成的时间
+	CheckedAt time.Time
+}
+
+// scrubResults 保存每个卷最近一次校验的结果
+type scrubResults struct {
+	mu      sync.RWMutex
+	results map[string]scrubResult
+}
+
+func newScrubResults() *scrubResults {
+	return &scrubResults{results: make(map[string]scrubResult)}
+}
+
+// isIntegrityVolume 判断卷参数是否开启了后台校验
+func isIntegrityVolume(parameters map[string]string) bool {
+	return parameters[integrityParameter] == "true"
+}
+
+// checkIntegrityVolume 检查开启校验的卷: Controller 只能直接读取目录形式的卷, 镜像卷、LVM 卷、block 卷、内存卷和模板卷的文件不在卷目录里
+func checkIntegrityVolume(parameters map[string]string, accessType string, backend Backend) error {
+	switch {
+	case accessType == accessTypeBlock:
+		return fmt.Errorf("the %s parameter does not apply to block volumes", integrityParameter)
+	case filesystemBackends[backend.Name()]:
+		return fmt.Errorf("the %s parameter is not supported on the %s backend", integrityParameter, backend.Name())
+	case isMemoryVolume(parameters), isTemplateVolume(parameters):
+		return fmt.Errorf("the %s parameter does not apply to memory or template volumes", integrityParameter)
+	}
+	return nil
+}
+
+// StartScrubbing 启动后台校验, 每隔 interval 校验一次所有开启了 integrity 的卷
+func (s *ControllerServer) StartScrubbing(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.scrubVolumes()
+			<-ticker.C
+		}
+	}()
+}
+
+// ScrubResults 返回每个卷最近一次校验发现的损坏文件数(卷 ID -> 文件数), 供 metrics 等导出使用
+func (s *ControllerServer) ScrubResults() map[string]int {
+	s.scrub.mu.RLock()
+	defer s.scrub.mu.RUnlock()
+	results := make(map[string]int, len(s.scrub.results))
+	for id, r := range s.scrub.results {
+		results[id] = len(r.Corrupted)
+	}
+	return results
+}
+
+// scrubCondition 返回卷最近一次校验的结果对应的 VolumeCondition, 没有发现损坏时返回 nil
+func (s *ControllerServer) scrubCondition(volumeID string) *csi.VolumeCondition {
+	s.scrub.mu.RLock()
+	defer s.scrub.mu.RUnlock()
+	r, ok := s.scrub.results[volumeID]
+	if !ok || len(r.Corrupted) == 0 {
+		return nil
+	}
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message:  fmt.Sprintf("%d files failed the integrity check at %s: %s", len(r.Corrupted), r.CheckedAt.Format(time.RFC3339), strings.Join(r.Corrupted, ", ")),
+	}
+}
+
+// scrubVolumes 校验一轮所有开启了 integrity 的卷, 并删除已经不存在的卷的清单和结果;
+// 校验可能很慢, 不持有 ControllerServer 的锁
+func (s *ControllerServer) scrubVolumes() {
+	volumes := make(map[string]bool)
+	for _, volume := range s.state.ListVolumes() {
+		if !isIntegrityVolume(volume.Parameters) {
+			continue
+		}
+		volumes[volume.ID] = true
+		corrupted, err := scrubVolume(s.config.scrubDir(), volume)
+		if err != nil {
+			klog.Warningf("Failed to scrub volume %s: %v", volume.ID, err)
+			continue
+		}
+		for _, name := range corrupted {
+			klog.Warningf("File %s of volume %s failed the integrity check", name, volume.ID)
+		}
+		s.scrub.mu.Lock()
+		s.scrub.results[volume.ID] = scrubResult{Corrupted: corrupted, CheckedAt: time.Now()}
+		s.scrub.mu.Unlock()
+	}
+
+	s.scrub.mu.Lock()
+	for id := range s.scrub.results {
+		if !volumes[id] {
+			delete(s.scrub.results, id)
+		}
+	}
+	s.scrub.mu.Unlock()
+	entries, _ := os.ReadDir(s.config.scrubDir())
+	for _, entry := range entries {
+		if id := strings.TrimSuffix(entry.Name(), ".json"); !volumes[id] {
+			os.Remove(filepath.Join(s.config.scrubDir(), entry.Name()))
+		}
+	}
+}
+
+// scrubVolume 校验一个卷, 返回损坏的文件; 新的和被修改过的文件重新计算校验和, 写回清单
+func scrubVolume(scrubDir string, volume Volume) ([]string, error) {
+	manifestPath := filepath.Join(scrubDir, volume.ID+".json")
+	manifest, err := loadScrubManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupted []string
+	updated := make(map[string]scrubEntry, len(manifest))
+	err = filepath.WalkDir(volume.Path, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			// 遍历过程中被 pod 删除的文件跳过, 其他错误中止这一轮
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(volume.Path, path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return nil
+		}
+		// 计算期间文件被修改过时这一轮不判断, 下一轮再记录
+		if after, err := os.Lstat(path); err != nil || after.Size() != fi.Size() || !after.ModTime().Equal(fi.ModTime()) {
+			if old, ok := manifest[rel]; ok {
+				updated[rel] = old
+			}
+			return nil
+		}
+		entry := scrubEntry{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), SHA256: sum}
+		old, ok := manifest[rel]
+		if ok && old.Size == entry.Size && old.ModTime == entry.ModTime && old.SHA256 != entry.SHA256 {
+			// 保留原来的校验和, 文件被重新写入之前一直报告损坏
+			corrupted = append(corrupted, rel)
+			entry = old
+		}
+		updated[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := saveScrubManifest(manifestPath, updated); err != nil {
+		return nil, err
+	}
+	sort.Strings(corrupted)
+	return corrupted, nil
+}
+
+// fileSHA256 计算文件内容的 sha256
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadScrubManifest 读取卷的校验和清单, 文件不存在时返回空清单
+func loadScrubManifest(path string) (map[string]scrubEntry, error) {
+	manifest := make(map[string]scrubEntry)
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checksum manifest %s: %v", path, err)
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse checksum manifest %s: %v", path, err)
+	}
+	return manifest, nil
+}
+
+// saveScrubManifest 持久化卷的校验和清单
+func saveScrubManifest(path string, manifest map[string]scrubEntry) error {
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode checksum manifest: %v", err)
+	}
+	return writeFileAtomic(path, raw)
+}
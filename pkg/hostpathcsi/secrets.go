@@ -0,0 +1,62 @@
+package hostpathcsi
+
+import (
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strings"
+)
+
+// Secrets 是 CSI 请求中携带的密钥(StorageClass 的 csi.storage.k8s.io/*-secret-name 指定的 Secret),
+// 只在请求处理过程中使用, 不写入状态文件; String 只输出 key, 避免密钥出现在日志里
+type Secrets map[string]string
+
+// String 返回排序后的 key 列表, 值一律隐藏
+func (s Secrets) String() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return "[" + strings.Join(keys, " ") + "]"
+}
+
+// secretKind 是请求携带的密钥的种类, 对应 StorageClass 里不同的 csi.storage.k8s.io/*-secret-name
+type secretKind string
+
+const (
+	// provisionerSecrets 随 CreateVolume 和 DeleteVolume 传入
+	provisionerSecrets secretKind = "provisioner"
+	// snapshotterSecrets 随 CreateSnapshot 传入
+	snapshotterSecrets secretKind = "snapshotter"
+	// nodeStageSecrets 随 NodeStageVolume 传入
+	nodeStageSecrets secretKind = "node-stage"
+	// nodePublishSecrets 随 NodePublishVolume 传入
+	nodePublishSecrets secretKind = "node-publish"
+)
+
+// secretRequirement 是一个功能需要的密钥: enabled 判断参数是否开启了这个功能, 开启时 kind 这类请求必须带上 keys
+type secretRequirement struct {
+	enabled func(parameters map[string]string) bool
+	kind    secretKind
+	keys    []string
+}
+
+// requiredSecrets 按参数名记录功能需要的密钥, 由使用密钥的功能(例如加密、备份)在 init 里登记
+var requiredSecrets = map[string]secretRequirement{}
+
+// checkSecrets 检查 parameters 开启的功能在 kind 这类请求里需要的密钥都已经提供, 缺少时返回 InvalidArgument
+func checkSecrets(kind secretKind, parameters map[string]string, secrets Secrets) error {
+	for parameter, required := range requiredSecrets {
+		if required.kind != kind || !required.enabled(parameters) {
+			continue
+		}
+		for _, key := range required.keys {
+			if secrets[key] == "" {
+				return status.Error(codes.InvalidArgument, fmt.Sprintf("parameter %s requires secret key %s", parameter, key))
+			}
+		}
+	}
+	return nil
+}
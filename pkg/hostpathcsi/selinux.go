@@ -0,0 +1,85 @@
+// Package hostpathcsi Description: 这个文件支持 Kubernetes 的 SELinuxMount 特性: CSIDriver 设置 seLinuxMount: true 后, kubelet 在
+// mountFlags 里传入 context="..." 选项, 有自己文件系统的卷(镜像卷、LVM 卷、内存卷、模板卷)挂载时直接带上这个选项,
+// 整个文件系统以 pod 的标签呈现; bind mount 不能设置 context, 目录卷改为给卷目录重新打标签。
+package hostpathcsi
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// seLinuxContextOption 是 kubelet 传入的 SELinux 挂载选项的前缀
+	seLinuxContextOption = "context="
+	// seLinuxXattr 是保存文件 SELinux 标签的扩展属性
+	seLinuxXattr = "security.selinux"
+)
+
+// splitMountOptions 按逗号拆分一个挂载选项, 引号里的逗号不拆分(SELinux 的 MCS 标签例如 s0:c1,c2 里有逗号)
+func splitMountOptions(option string) []string {
+	var options []string
+	var quoted bool
+	start := 0
+	for i, c := range option {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			options = append(options, option[start:i])
+			start = i + 1
+		}
+	}
+	return append(options, option[start:])
+}
+
+// extractSELinuxContext 从 mountFlags 中取出 context= 选项, 返回其余的选项和去掉引号的 SELinux 标签, 没有时标签为空
+func extractSELinuxContext(options []string) ([]string, string) {
+	var rest []string
+	var context string
+	for _, option := range options {
+		for _, o := range splitMountOptions(option) {
+			o = strings.TrimSpace(o)
+			if strings.HasPrefix(o, seLinuxContextOption) {
+				context = strings.Trim(strings.TrimPrefix(o, seLinuxContextOption), `"`)
+				continue
+			}
+			rest = append(rest, o)
+		}
+	}
+	return rest, context
+}
+
+// seLinuxMountData 返回挂载文件系统时设置 SELinux 标签的 data 选项, 标签为空时返回空字符串
+func seLinuxMountData(context string) string {
+	if context == "" {
+		return ""
+	}
+	return fmt.Sprintf(`%s"%s"`, seLinuxContextOption, context)
+}
+
+// joinMountData 用逗号连接非空的 data 选项
+func joinMountData(options ...string) string {
+	var nonEmpty []string
+	for _, o := range options {
+		if o != "" {
+			nonEmpty = append(nonEmpty, o)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
+
+// relabel 把 path 下所有文件的 SELinux 标签设置为 context, 用于不能通过挂载选项设置标签的 bind mount 卷
+func relabel(path, context string) error {
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(p, seLinuxXattr, []byte(context), 0); err != nil {
+			return fmt.Errorf("failed to relabel %s: %v", p, err)
+		}
+		return nil
+	})
+}
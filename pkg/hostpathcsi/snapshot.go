@@ -0,0 +1,284 @@
+// Package hostpathcsi Description: 这个文件实现 ControllerService 中的快照功能, 快照的数据由源卷所在的后端保存。
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"os"
+	"time"
+)
+
+// CreateSnapshot 由源卷的后端创建快照, 并记录快照的元数据
+func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	if err := checkSecrets(snapshotterSecrets, req.Parameters, req.Secrets); err != nil {
+		return nil, err
+	}
+	if err := checkSnapshotFormat(req.Parameters[snapshotFormatParameter]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// 幂等: 同名快照已经存在时, 源卷相同则直接返回, 否则冲突
+	if snap, ok := s.state.GetSnapshot(req.Name); ok {
+		if snap.SourceVolumeID != req.SourceVolumeId {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", req.Name, snap.SourceVolumeID)
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(snap)}, nil
+	}
+
+	unlock, err := s.lockSnapshotLimit(req.SourceVolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	snap, err := s.takeSnapshot(ctx, req.Name, req.SourceVolumeId, req.Parameters[snapshotFormatParameter])
+	if err != nil {
+		return nil, err
+	}
+	if err := s.state.UpdateSnapshot(snap); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record snapshot %s: %v", req.Name, err)
+	}
+
+	logFor(ctx).Infof("Snapshot %s of volume %s created at %s", req.Name, req.SourceVolumeId, snap.Path)
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(snap)}, nil
+}
+
+// takeSnapshot 由源卷的后端创建快照(format 是归档格式时写成归档), 返回快照的元数据, 由调用方记录到状态里
+func (s *ControllerServer) takeSnapshot(ctx context.Context, snapshotID, sourceVolumeID, format string) (Snapshot, error) {
+	volume, ok := s.lookupVolume(sourceVolumeID)
+	if !ok {
+		return Snapshot{}, status.Errorf(codes.NotFound, "source volume %s not found", sourceVolumeID)
+	}
+	// 内存卷的数据只在节点的 tmpfs 里, Controller 拿不到
+	if isMemoryVolume(volume.Parameters) {
+		return Snapshot{}, status.Errorf(codes.FailedPrecondition, "volume %s is a memory volume and can not be snapshotted", sourceVolumeID)
+	}
+	if isArchiveFormat(format) {
+		return s.exportSnapshot(snapshotID, volume, format)
+	}
+	backend, err := backendOf(volume.Backend)
+	if err != nil {
+		return Snapshot{}, status.Errorf(codes.Internal, "failed to snapshot volume %s: %v", sourceVolumeID, err)
+	}
+
+	snap := Snapshot{
+		ID:             snapshotID,
+		SourceVolumeID: sourceVolumeID,
+		Path:           s.config.SnapshotPath(snapshotID),
+		CreationTime:   time.Now(),
+		Backend:        backend.Name(),
+	}
+	// 支持增量快照的后端基于同一个卷最近的快照创建, 没有变化的数据不再占用空间;
+	// 快照链达到 maxChainDepth 时创建完整的快照, 开始新的链, 限制恢复时要经过的快照数
+	if incremental, ok := backend.(incrementalBackend); ok {
+		if parent, ok := s.latestSnapshot(sourceVolumeID, backend.Name()); ok {
+			if s.maxChainDepth > 0 && s.chainDepth(parent) >= s.maxChainDepth {
+				logFor(ctx).Infof("Snapshot chain of volume %s reached the maximum depth %d at %s, taking a full snapshot", sourceVolumeID, s.maxChainDepth, parent.ID)
+			} else {
+				if err := incremental.CreateIncrementalSnapshot(ctx, volume, parent, &snap); err != nil {
+					return Snapshot{}, err
+				}
+				return snap, nil
+			}
+		}
+	}
+	if err := backend.CreateSnapshot(ctx, volume, &snap); err != nil {
+		return Snapshot{}, err
+	}
+	return snap, nil
+}
+
+// exportSnapshot 把卷的目录写成归档格式的快照; 归档不依赖后端, 可以恢复到任何以目录保存卷的后端上
+func (s *ControllerServer) exportSnapshot(snapshotID string, volume Volume, format string) (Snapshot, error) {
+	if fi, err := os.Stat(volume.Path); err != nil || !fi.IsDir() {
+		return Snapshot{}, status.Errorf(codes.InvalidArgument, "snapshot format %s is only supported for filesystem volumes stored as directories", format)
+	}
+	snap := Snapshot{
+		ID:             snapshotID,
+		SourceVolumeID: volume.ID,
+		Path:           s.config.SnapshotPath(snapshotID) + "." + format,
+		CreationTime:   time.Now(),
+		Format:         format,
+	}
+	size, err := exportArchive(volume.Path, snap.Path, format)
+	if err != nil {
+		return Snapshot{}, storageError(err, "failed to export volume %s", volume.ID)
+	}
+	snap.SizeBytes = size
+	return snap, nil
+}
+
+// restoreArchive 在后端上创建一个空卷, 再把归档格式的快照解包进去
+func restoreArchive(ctx context.Context, backend Backend, snap Snapshot, volume *Volume) error {
+	if volume.AccessType == accessTypeBlock {
+		return status.Errorf(codes.InvalidArgument, "snapshot %s is an archive and can only be restored to a filesystem volume", snap.ID)
+	}
+	open := func() (io.ReadCloser, error) { return os.Open(snap.Path) }
+	if err := traceOperation(ctx, "volume.restore_archive", func(ctx context.Context) error {
+		return populateFromArchive(ctx, backend, volume, open, true)
+	}, attribute.String("csi.volume_id", volume.ID), attribute.String("csi.snapshot_id", snap.ID)); err != nil {
+		return err
+	}
+	logFor(ctx).Infof("Restored snapshot archive %s into %s", snap.Path, volume.Path)
+	return nil
+}
+
+// latestSnapshot 返回卷在后端上最近创建的快照
+func (s *ControllerServer) latestSnapshot(volumeID, backend string) (Snapshot, bool) {
+	var latest Snapshot
+	found := false
+	for _, snap := range s.state.ListSnapshots() {
+		// 引入后端之前创建的快照没有记录后端, 它们都在目录后端上
+		name := snap.Backend
+		if name == "" {
+			name = directoryBackendName
+		}
+		if snap.SourceVolumeID != volumeID || name != backend || snap.Format != "" {
+			continue
+		}
+		if !found || snap.CreationTime.After(latest.CreationTime) {
+			latest, found = snap, true
+		}
+	}
+	return latest, found
+}
+
+// chainDepth 返回快照在增量快照链中的深度: 完整的快照是 0, 基于它的增量快照是 1, 依此类推;
+// 链上已经删除的快照还算一层, 但不再往上找
+func (s *ControllerServer) chainDepth(snap Snapshot) int {
+	depth := 0
+	seen := map[string]bool{snap.ID: true}
+	for snap.ParentSnapshotID != "" && !seen[snap.ParentSnapshotID] {
+		depth++
+		parent, ok := s.state.GetSnapshot(snap.ParentSnapshotID)
+		if !ok {
+			break
+		}
+		seen[parent.ID] = true
+		snap = parent
+	}
+	return depth
+}
+
+// countSnapshots 返回卷的快照数量, 包括归档格式的快照和组快照中的快照
+func (s *ControllerServer) countSnapshots(volumeID string) int {
+	count := 0
+	for _, snap := range s.state.ListSnapshots() {
+		if snap.SourceVolumeID == volumeID {
+			count++
+		}
+	}
+	return count
+}
+
+// lockSnapshotLimit 在限制了快照数量时锁住 snapshotMu, 检查每个卷是否还能再创建一个快照; 调用方记录快照之后再调用返回的 unlock,
+// 检查和记录才是原子的。CreateSnapshot 和 CreateVolumeGroupSnapshot 都要经过这里, 组快照不能绕过上限
+func (s *ControllerServer) lockSnapshotLimit(volumeIDs ...string) (func(), error) {
+	if s.maxSnapshots <= 0 {
+		return func() {}, nil
+	}
+	s.snapshotMu.Lock()
+	for _, volumeID := range volumeIDs {
+		if count := s.countSnapshots(volumeID); count >= s.maxSnapshots {
+			s.snapshotMu.Unlock()
+			return nil, status.Errorf(codes.ResourceExhausted, "volume %s already has %d snapshots, the limit is %d", volumeID, count, s.maxSnapshots)
+		}
+	}
+	return s.snapshotMu.Unlock, nil
+}
+
+// SetMaxSnapshotsPerVolume 设置每个卷的快照数量上限, 0 表示不限制
+func (s *ControllerServer) SetMaxSnapshotsPerVolume(max int) {
+	s.maxSnapshots = max
+}
+
+// SetMaxSnapshotChainDepth 设置增量快照链的最大深度, 0 表示不限制
+func (s *ControllerServer) SetMaxSnapshotChainDepth(depth int) {
+	s.maxChainDepth = depth
+}
+
+// deleteSnapshotData 由快照的后端删除快照的数据, 归档格式的快照直接删除归档
+func deleteSnapshotData(ctx context.Context, snap Snapshot) error {
+	if isArchiveFormat(snap.Format) {
+		if err := removeArchive(snap.Path); err != nil {
+			return status.Errorf(codes.Internal, "failed to delete snapshot %s: %v", snap.ID, err)
+		}
+		return nil
+	}
+	backend, err := backendOf(snap.Backend)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to delete snapshot %s: %v", snap.ID, err)
+	}
+	return backend.DeleteSnapshot(ctx, snap)
+}
+
+// DeleteSnapshot 删除快照数据和元数据, 快照不存在时也返回成功
+func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+
+	// 没有记录的快照可能是记录之前就中断的残留, 按默认布局清理
+	snap, ok := s.state.GetSnapshot(req.SnapshotId)
+	if !ok {
+		snap = Snapshot{ID: req.SnapshotId, Path: s.config.SnapshotPath(req.SnapshotId)}
+	}
+	// 组快照的成员只能随组快照一起删除
+	if snap.GroupSnapshotID != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot %s belongs to group snapshot %s", req.SnapshotId, snap.GroupSnapshotID)
+	}
+	if err := deleteSnapshotData(ctx, snap); err != nil {
+		return nil, err
+	}
+	if err := s.state.DeleteSnapshot(req.SnapshotId); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to forget snapshot %s: %v", req.SnapshotId, err)
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots 列出快照, 支持按快照 ID、源卷过滤以及分页
+func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	var snapshots []Snapshot
+	for _, snap := range s.state.ListSnapshots() {
+		if req.SnapshotId != "" && snap.ID != req.SnapshotId {
+			continue
+		}
+		if req.SourceVolumeId != "" && snap.SourceVolumeID != req.SourceVolumeId {
+			continue
+		}
+		snapshots = append(snapshots, snap)
+	}
+
+	start, end, nextToken, err := paginate(len(snapshots), req.StartingToken, req.MaxEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, end-start)
+	for _, snap := range snapshots[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(snap)})
+	}
+
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+// csiSnapshot 把快照元数据转换成 CSI 的 Snapshot
+func csiSnapshot(snap Snapshot) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:      snap.ID,
+		SourceVolumeId:  snap.SourceVolumeID,
+		SizeBytes:       snap.SizeBytes,
+		CreationTime:    timestamppb.New(snap.CreationTime),
+		ReadyToUse:      true,
+		GroupSnapshotId: snap.GroupSnapshotID,
+	}
+}
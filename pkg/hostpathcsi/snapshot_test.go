@@ -0,0 +1,143 @@
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotChainDepth(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDepth int
+		// wantParents 是依次创建的快照的父快照, 为空表示完整的快照
+		wantParents []string
+	}{
+		{
+			name:        "unlimited",
+			wantParents: []string{"", "snap-0", "snap-1", "snap-2", "snap-3"},
+		},
+		{
+			name:        "depth 2",
+			maxDepth:    2,
+			wantParents: []string{"", "snap-0", "snap-1", "", "snap-3"},
+		},
+		{
+			name:        "depth 1",
+			maxDepth:    1,
+			wantParents: []string{"", "snap-0", "", "snap-2", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestControllerServer(t)
+			s.SetMaxSnapshotChainDepth(tt.maxDepth)
+			path := s.config.VolumePath("pvc-1")
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(path, "data"), []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.state.UpdateVolume(Volume{ID: "pvc-1", Path: path, Backend: directoryBackendName}); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, wantParent := range tt.wantParents {
+				id := fmt.Sprintf("snap-%d", i)
+				if _, err := s.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: id, SourceVolumeId: "pvc-1"}); err != nil {
+					t.Fatalf("CreateSnapshot(%s): %v", id, err)
+				}
+				snap, ok := s.state.GetSnapshot(id)
+				if !ok {
+					t.Fatalf("snapshot %s not recorded", id)
+				}
+				if snap.ParentSnapshotID != wantParent {
+					t.Errorf("snapshot %s parent = %q, want %q", id, snap.ParentSnapshotID, wantParent)
+				}
+			}
+		})
+	}
+}
+
+func TestChainDepthOfDeletedParent(t *testing.T) {
+	s := newTestControllerServer(t)
+	for _, snap := range []Snapshot{
+		{ID: "snap-1", ParentSnapshotID: "snap-0"},
+		{ID: "snap-2", ParentSnapshotID: "snap-1"},
+	} {
+		if err := s.state.UpdateSnapshot(snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, _ := s.state.GetSnapshot("snap-2")
+	if got := s.chainDepth(snap); got != 2 {
+		t.Errorf("chainDepth() = %d, want 2", got)
+	}
+}
+
+func TestMaxSnapshotsPerVolume(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxSnapshots int
+		existing     int
+		// group 表示通过组快照创建新的快照
+		group    bool
+		wantCode codes.Code
+	}{
+		{name: "unlimited", existing: 5},
+		{name: "under the limit", maxSnapshots: 3, existing: 2},
+		{name: "at the limit", maxSnapshots: 3, existing: 3, wantCode: codes.ResourceExhausted},
+		{name: "group snapshot under the limit", maxSnapshots: 3, existing: 2, group: true},
+		{name: "group snapshot at the limit", maxSnapshots: 3, existing: 3, group: true, wantCode: codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestControllerServer(t)
+			s.SetMaxSnapshotsPerVolume(tt.maxSnapshots)
+			path := s.config.VolumePath("pvc-1")
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.state.UpdateVolume(Volume{ID: "pvc-1", Path: path, Backend: directoryBackendName}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.existing; i++ {
+				if err := s.state.UpdateSnapshot(Snapshot{ID: fmt.Sprintf("old-%d", i), SourceVolumeID: "pvc-1"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 其他卷的快照不计入
+			if err := s.state.UpdateSnapshot(Snapshot{ID: "other", SourceVolumeID: "pvc-2"}); err != nil {
+				t.Fatal(err)
+			}
+
+			newID := "snap-new"
+			var err error
+			if tt.group {
+				// 组快照里的快照 ID 是组快照 ID 加上卷 ID
+				newID = "group-new-pvc-1"
+				_, err = NewGroupControllerServer(s).CreateVolumeGroupSnapshot(context.Background(), &csi.CreateVolumeGroupSnapshotRequest{Name: "group-new", SourceVolumeIds: []string{"pvc-1"}})
+			} else {
+				_, err = s.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: newID, SourceVolumeId: "pvc-1"})
+			}
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("creating a snapshot error = %v, want code %v", err, tt.wantCode)
+			}
+			if _, ok := s.state.GetSnapshot(newID); ok != (tt.wantCode == codes.OK) {
+				t.Errorf("snapshot recorded = %v, want %v", ok, tt.wantCode == codes.OK)
+			}
+			// 已经存在的快照不受上限影响
+			if tt.existing > 0 {
+				if _, err := s.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "old-0", SourceVolumeId: "pvc-1"}); err != nil {
+					t.Errorf("CreateSnapshot() of an existing snapshot error = %v", err)
+				}
+			}
+		})
+	}
+}
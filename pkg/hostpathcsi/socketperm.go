@@ -0,0 +1,105 @@
+// Package hostpathcsi Description: 这个文件实现 Unix socket 文件的权限和属主控制: 节点加固策略要求 socket 不能让所有用户访问时,
+// 用 --socket-mode 和 --socket-owner 把 csi.sock 设置成例如 0660、属组为 kubelet 所在的组。
+// socket 先以只有属主可以访问的权限创建, 再改成要求的权限, 中间不会有其他用户可以连接的时间窗口。
+package hostpathcsi
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SocketOptions 是 Unix socket 文件的权限和属主, 零值表示保持 net.Listen 创建时的权限(受 umask 影响)和驱动进程的属主
+type SocketOptions struct {
+	// Mode 是 socket 文件的权限, 为 0 时不修改
+	Mode os.FileMode
+	// UID 和 GID 是 socket 文件的属主和属组, 为 -1 时不修改
+	UID, GID int
+}
+
+// ParseSocketOptions 解析八进制的权限(例如 0660)和 user[:group] 格式的属主, user 和 group 可以是名字或数字, 都为空时返回零值
+func ParseSocketOptions(mode, owner string) (SocketOptions, error) {
+	opts := SocketOptions{UID: -1, GID: -1}
+	if mode = strings.TrimSpace(mode); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m == 0 || m > 0777 {
+			return SocketOptions{}, fmt.Errorf("invalid socket mode %q, expected octal permissions such as 0660", mode)
+		}
+		opts.Mode = os.FileMode(m)
+	}
+	if owner = strings.TrimSpace(owner); owner != "" {
+		userName, groupName, _ := strings.Cut(owner, ":")
+		if userName != "" {
+			uid, err := lookupID(userName, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+			if err != nil {
+				return SocketOptions{}, fmt.Errorf("invalid socket owner %q: %v", owner, err)
+			}
+			opts.UID = uid
+		}
+		if groupName != "" {
+			gid, err := lookupID(groupName, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+			if err != nil {
+				return SocketOptions{}, fmt.Errorf("invalid socket owner %q: %v", owner, err)
+			}
+			opts.GID = gid
+		}
+	}
+	return opts, nil
+}
+
+// lookupID 把数字或名字转换成 uid/gid, 容器里通常没有宿主机的 /etc/passwd 和 /etc/group, 所以优先按数字解析
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// isZero 判断是否没有要求修改 socket 文件
+func (o SocketOptions) isZero() bool {
+	return o.Mode == 0 && o.UID == -1 && o.GID == -1
+}
+
+// listenUmask 在创建 socket 期间把 umask 设置成只有属主可以访问, 返回恢复原来 umask 的函数;
+// umask 是进程级的, 只能在启动阶段(还没有其他 goroutine 创建文件时)调用
+func (o SocketOptions) listenUmask() func() {
+	if o.isZero() {
+		return func() {}
+	}
+	old := syscall.Umask(0177)
+	return func() { syscall.Umask(old) }
+}
+
+// apply 修改 socket 文件的属主和权限; 先 chown 再 chmod, 因为 chown 会清掉 setuid 这类特殊位
+func (o SocketOptions) apply(path string) error {
+	if o.UID != -1 || o.GID != -1 {
+		if err := os.Chown(path, o.UID, o.GID); err != nil {
+			return fmt.Errorf("failed to change the owner of socket %s: %v", path, err)
+		}
+	}
+	if o.Mode != 0 {
+		if err := os.Chmod(path, o.Mode); err != nil {
+			return fmt.Errorf("failed to change the mode of socket %s: %v", path, err)
+		}
+	}
+	return nil
+}
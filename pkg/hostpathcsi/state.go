@@ -0,0 +1,454 @@
+package hostpathcsi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Volume 记录一个卷的元数据
+type Volume struct {
+	ID            string            `json:"id"`
+	Path          string            `json:"path"`
+	CapacityBytes int64             `json:"capacityBytes"`
+	Parameters    map[string]string `json:"parameters,omitempty"`
+	// AccessType 是 mount 或 block, 为空表示 mount(兼容旧的记录)
+	AccessType string `json:"accessType,omitempty"`
+	// SourceVolumeID 和 SourceSnapshotID 记录卷是从哪个卷克隆或从哪个快照恢复的
+	SourceVolumeID   string `json:"sourceVolumeId,omitempty"`
+	SourceSnapshotID string `json:"sourceSnapshotId,omitempty"`
+	// NodeID 是卷所在的节点, 卷只能在这个节点上访问; 为空表示引入拓扑之前创建的卷
+	NodeID string `json:"nodeId,omitempty"`
+	// AttachedNodes 是 ControllerPublishVolume 记录的卷当前挂到的节点
+	AttachedNodes []string `json:"attachedNodes,omitempty"`
+	// Backend 是保存卷数据的后端, 为空表示引入后端之前创建的目录卷
+	Backend string `json:"backend,omitempty"`
+	// Pool 是卷所在的存储池, 为空表示卷在 DataDir 下
+	Pool string `json:"pool,omitempty"`
+	// Compression 是 btrfs 和 zfs 后端读回的实际生效的压缩设置, 为空表示不知道(其他后端或者子卷没有设置压缩属性)
+	Compression string `json:"compression,omitempty"`
+	// Static 表示卷是手工创建的 PV 领养的已有目录, 数据不归驱动所有, 删除卷时只删除记录
+	Static bool `json:"static,omitempty"`
+	// PreviousPaths 是卷迁移到其他存储池之前的路径, 现在是指向 Path 的软链接, PV 的 VolumeContext 里仍然是这些路径
+	PreviousPaths []string `json:"previousPaths,omitempty"`
+}
+
+// Snapshot 记录一个快照的元数据
+type Snapshot struct {
+	ID             string    `json:"id"`
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	Path           string    `json:"path"`
+	SizeBytes      int64     `json:"sizeBytes"`
+	CreationTime   time.Time `json:"creationTime"`
+	// GroupSnapshotID 是快照所属的组快照, 为空表示单独创建的快照
+	GroupSnapshotID string `json:"groupSnapshotId,omitempty"`
+	// Backend 是保存快照数据的后端, 和源卷的后端相同
+	Backend string `json:"backend,omitempty"`
+	// Format 是归档格式的快照的格式(tar.gz 或 tar.zst), 为空表示由后端保存的快照
+	Format string `json:"format,omitempty"`
+	// ParentSnapshotID 是增量快照基于的上一个快照, 为空表示完整的快照; 只记录快照链, 删除父快照不影响这个快照
+	ParentSnapshotID string `json:"parentSnapshotId,omitempty"`
+}
+
+// GroupSnapshot 记录一个组快照的元数据, 成员快照记录在 Snapshots 里
+type GroupSnapshot struct {
+	ID           string    `json:"id"`
+	SnapshotIDs  []string  `json:"snapshotIds"`
+	CreationTime time.Time `json:"creationTime"`
+}
+
+// stateFile 是状态文件的序列化格式
+type stateFile struct {
+	Volumes        map[string]*Volume        `json:"volumes"`
+	Snapshots      map[string]*Snapshot      `json:"snapshots"`
+	GroupSnapshots map[string]*GroupSnapshot `json:"groupSnapshots,omitempty"`
+}
+
+// State 是以 JSON 文件持久化的卷元数据存储, 驱动重启后可以从文件中恢复
+type State struct {
+	mu   sync.RWMutex
+	path string
+	data stateFile
+}
+
+// NewState 从 path 加载状态, 文件不存在时返回一个空的状态
+func NewState(path string) (*State, error) {
+	data, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+	return &State{path: path, data: data}, nil
+}
+
+// readState 读取并解析状态文件, 文件不存在时返回空的状态
+func readState(path string) (stateFile, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return stateFile{
+			Volumes:        make(map[string]*Volume),
+			Snapshots:      make(map[string]*Snapshot),
+			GroupSnapshots: make(map[string]*GroupSnapshot),
+		}, nil
+	}
+	if err != nil {
+		return stateFile{}, fmt.Errorf("failed to read state file %s: %v", path, err)
+	}
+	data, err := parseState(raw)
+	if err != nil {
+		return stateFile{}, fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+	return data, nil
+}
+
+// Reload 从文件重新加载状态, 替换内存里的状态; 多副本的 Controller 成为 leader 时调用, 读到之前的 leader 写入的记录
+func (s *State) Reload() error {
+	data, err := readState(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = data
+	return nil
+}
+
+// parseState 解析状态文件的内容, 没有出现的表初始化为空; 记录为 null 或者键和记录的 ID 不一致时返回错误
+func parseState(raw []byte) (stateFile, error) {
+	var data stateFile
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return stateFile{}, err
+	}
+	for id, v := range data.Volumes {
+		if v == nil || v.ID != id {
+			return stateFile{}, fmt.Errorf("volume %q: the record is null or its id does not match the key", id)
+		}
+	}
+	for id, snap := range data.Snapshots {
+		if snap == nil || snap.ID != id {
+			return stateFile{}, fmt.Errorf("snapshot %q: the record is null or its id does not match the key", id)
+		}
+	}
+	for id, group := range data.GroupSnapshots {
+		if group == nil || group.ID != id {
+			return stateFile{}, fmt.Errorf("group snapshot %q: the record is null or its id does not match the key", id)
+		}
+	}
+	if data.Volumes == nil {
+		data.Volumes = make(map[string]*Volume)
+	}
+	if data.Snapshots == nil {
+		data.Snapshots = make(map[string]*Snapshot)
+	}
+	if data.GroupSnapshots == nil {
+		data.GroupSnapshots = make(map[string]*GroupSnapshot)
+	}
+	return data, nil
+}
+
+// Export 把当前的状态按状态文件的格式写到 w, 持有读锁, 导出的是同一时刻一致的状态
+func (s *State) Export(w io.Writer) error {
+	s.mu.RLock()
+	raw, err := encodeState(&s.data)
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(raw)
+	return err
+}
+
+// errInvalidState 表示要导入的状态不能解析
+var errInvalidState = errors.New("invalid state")
+
+// Import 用 Export 导出的内容替换整个状态并写回文件; 内容不能解析或者写文件失败时保留原来的状态。
+// 没有任何记录的内容(比如 {} 或者 null)会清空所有记录, 多半是传错了文件, 只有 allowEmpty 为 true 时才接受
+func (s *State) Import(r io.Reader, allowEmpty bool) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read state: %v", err)
+	}
+	data, err := parseState(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidState, err)
+	}
+	if !allowEmpty && len(data.Volumes) == 0 && len(data.Snapshots) == 0 && len(data.GroupSnapshots) == 0 {
+		return fmt.Errorf("%w: the state has no records, importing it would remove all volumes and snapshots", errInvalidState)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.data
+	s.data = data
+	if err := s.save(); err != nil {
+		s.data = previous
+		return err
+	}
+	return nil
+}
+
+// GetVolume 返回卷的元数据副本
+func (s *State) GetVolume(id string) (Volume, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.data.Volumes[id]
+	if !ok {
+		return Volume{}, false
+	}
+	return *v, true
+}
+
+// ListVolumes 返回按 ID 排序的所有卷
+func (s *State) ListVolumes() []Volume {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	volumes := make([]Volume, 0, len(s.data.Volumes))
+	for _, v := range s.data.Volumes {
+		volumes = append(volumes, *v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return volumes
+}
+
+// UpdateVolume 新增或更新卷, 并持久化到文件
+func (s *State) UpdateVolume(v Volume) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Volumes[v.ID] = &v
+	return s.save()
+}
+
+// DeleteVolume 删除卷, 并持久化到文件
+func (s *State) DeleteVolume(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Volumes[id]; !ok {
+		return nil
+	}
+	delete(s.data.Volumes, id)
+	return s.save()
+}
+
+// GetSnapshot 返回快照的元数据副本
+func (s *State) GetSnapshot(id string) (Snapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap, ok := s.data.Snapshots[id]
+	if !ok {
+		return Snapshot{}, false
+	}
+	return *snap, true
+}
+
+// ListSnapshots 返回按 ID 排序的所有快照
+func (s *State) ListSnapshots() []Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshots := make([]Snapshot, 0, len(s.data.Snapshots))
+	for _, snap := range s.data.Snapshots {
+		snapshots = append(snapshots, *snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots
+}
+
+// UpdateSnapshot 新增或更新快照, 并持久化到文件
+func (s *State) UpdateSnapshot(snap Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Snapshots[snap.ID] = &snap
+	return s.save()
+}
+
+// DeleteSnapshot 删除快照, 并持久化到文件
+func (s *State) DeleteSnapshot(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Snapshots[id]; !ok {
+		return nil
+	}
+	delete(s.data.Snapshots, id)
+	return s.save()
+}
+
+// GetGroupSnapshot 返回组快照的元数据副本
+func (s *State) GetGroupSnapshot(id string) (GroupSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	group, ok := s.data.GroupSnapshots[id]
+	if !ok {
+		return GroupSnapshot{}, false
+	}
+	return *group, true
+}
+
+// AddGroupSnapshot 在一次持久化中记录组快照和它的所有成员快照, 避免只记录了一部分成员
+func (s *State) AddGroupSnapshot(group GroupSnapshot, snapshots []Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range snapshots {
+		s.data.Snapshots[snapshots[i].ID] = &snapshots[i]
+	}
+	s.data.GroupSnapshots[group.ID] = &group
+	return s.save()
+}
+
+// DeleteGroupSnapshot 删除组快照和它的所有成员快照, 并持久化到文件
+func (s *State) DeleteGroupSnapshot(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.data.GroupSnapshots[id]
+	if !ok {
+		return nil
+	}
+	for _, snapshotID := range group.SnapshotIDs {
+		delete(s.data.Snapshots, snapshotID)
+	}
+	delete(s.data.GroupSnapshots, id)
+	return s.save()
+}
+
+// Check 检查状态文件仍然可以读取和解析, 文件不存在时认为正常(还没有创建过卷)
+func (s *State) Check() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	raw, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file %s: %v", s.path, err)
+	}
+	var data stateFile
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// Flush 把状态重新写一遍并刷到磁盘, 在驱动退出之前调用; 平时的写入不 fsync, 宿主机掉电时可能丢失最近的修改
+func (s *State) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(); err != nil {
+		return err
+	}
+	// 重命名要把所在目录也刷到磁盘才算持久化
+	for _, path := range []string{s.path, filepath.Dir(s.path)} {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to flush %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// save 把状态写回文件; 调用方需要持有写锁
+func (s *State) save() error {
+	raw, err := encodeState(&s.data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+// encodeState 把状态编码成状态文件的内容
+func encodeState(data *stateFile) ([]byte, error) {
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state: %v", err)
+	}
+	return raw, nil
+}
+
+// loadPublished 读取一个节点的发布记录(卷 ID -> 目标路径集合), 文件不存在时返回空记录
+func loadPublished(path string) (map[string]map[string]bool, error) {
+	published := make(map[string]map[string]bool)
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return published, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read publish records %s: %v", path, err)
+	}
+	if err := json.Unmarshal(raw, &published); err != nil {
+		return nil, fmt.Errorf("failed to parse publish records %s: %v", path, err)
+	}
+	return published, nil
+}
+
+// savePublished 持久化一个节点的发布记录
+func savePublished(path string, published map[string]map[string]bool) error {
+	raw, err := json.MarshalIndent(published, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode publish records: %v", err)
+	}
+	return writeFileAtomic(path, raw)
+}
+
+// loadEphemeral 读取一个节点上 inline ephemeral 卷的记录(卷 ID 集合), 文件不存在时返回 ok 为 false
+func loadEphemeral(path string) (ephemeral map[string]bool, ok bool, err error) {
+	ephemeral = make(map[string]bool)
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ephemeral, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read ephemeral volume records %s: %v", path, err)
+	}
+	if err := json.Unmarshal(raw, &ephemeral); err != nil {
+		return nil, false, fmt.Errorf("failed to parse ephemeral volume records %s: %v", path, err)
+	}
+	return ephemeral, true, nil
+}
+
+// saveEphemeral 持久化一个节点上 inline ephemeral 卷的记录
+func saveEphemeral(path string, ephemeral map[string]bool) error {
+	raw, err := json.MarshalIndent(ephemeral, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode ephemeral volume records: %v", err)
+	}
+	return writeFileAtomic(path, raw)
+}
+
+// listPublishedNodes 汇总所有节点的发布记录, 返回卷 ID -> 已发布的节点 ID 列表
+func listPublishedNodes(dir string) (map[string][]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read publish records directory %s: %v", dir, err)
+	}
+
+	nodes := make(map[string][]string)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		nodeID := strings.TrimSuffix(entry.Name(), ".json")
+		published, err := loadPublished(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for volumeID, targets := range published {
+			if len(targets) > 0 {
+				nodes[volumeID] = append(nodes[volumeID], nodeID)
+			}
+		}
+	}
+	for _, ids := range nodes {
+		sort.Strings(ids)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,168 @@
+// Package hostpathcsi Description: 这个文件实现静态卷的领养: 手工创建的 PV 在 volumeAttributes 的 path 中指定节点上已有的目录
+// (在 --static-volume-roots 的某个目录下, 并且不在驱动管理的目录下), NodePublishVolume 检查这个目录并写一条领养记录, Controller 查找卷时把它登记到状态里,
+// 之后 ControllerGetVolume、ListVolumes 都能看到这个卷。领养的数据不归驱动所有, DeleteVolume 只删除记录, 和 Retain 一样保留数据。
+package hostpathcsi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// adoptedVolume 是一条领养记录
+type adoptedVolume struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	NodeID    string    `json:"nodeId"`
+	AdoptedAt time.Time `json:"adoptedAt"`
+}
+
+// isManagedPath 判断 path 是否是驱动为卷分配的路径(DataDir 或某个存储池下以卷 ID 命名的目录或文件)
+func (c *Config) isManagedPath(volumeID, path string) bool {
+	if path == c.VolumePath(volumeID) {
+		return true
+	}
+	for _, dir := range c.PoolDirs() {
+		if path == filepath.Join(dir, volumeID) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStaticPath 检查静态卷的目录: 必须是 StaticRoots 下已有的目录, 并且不能在驱动管理的目录下,
+// 避免通过手工的 PV 访问宿主机上的任意目录或者其他卷、快照的数据
+func (c *Config) checkStaticPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("path %q of a static volume must be an absolute path", path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("path %s of a static volume is not accessible: %v", path, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("path %s of a static volume is not a directory", path)
+	}
+	managed := []string{c.DataDir, c.SnapshotDir, c.StateDir}
+	for _, dir := range c.PoolDirs() {
+		managed = append(managed, dir)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("path %s of a static volume is not accessible: %v", path, err)
+	}
+	for _, dir := range managed {
+		if isWithin(dir, resolved) {
+			return fmt.Errorf("path %s of a static volume is inside the driver managed directory %s", path, dir)
+		}
+	}
+	for _, root := range c.StaticRoots {
+		if isWithin(root, resolved) && resolved != root {
+			return nil
+		}
+	}
+	return fmt.Errorf("path %s of a static volume is not inside any of the static volume roots %v", path, c.StaticRoots)
+}
+
+// isWithin 判断 path 是 dir 本身或者在 dir 下面
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// adoptStaticVolume 在 VolumeContext 的 path 不是驱动分配的路径时把卷当作静态卷: 检查目录并写下领养记录
+func (s *NodeServer) adoptStaticVolume(ctx context.Context, volumeID string, volumeContext map[string]string, capability *csi.VolumeCapability) error {
+	// inline ephemeral 卷的 VolumeContext 由 pod 的作者填写, 不能信任其中的 path, 它们的数据在临时目录里
+	if volumeContext[ephemeralContextKey] == "true" {
+		return nil
+	}
+	path := volumeContext[volumeContextPathKey]
+	if path == "" || s.config.isManagedPath(volumeID, path) {
+		return nil
+	}
+	if len(s.config.StaticRoots) == 0 {
+		return status.Errorf(codes.InvalidArgument, "path %s is not a path provisioned by the driver and static volumes are disabled, set --static-volume-roots to allow them", path)
+	}
+	if capability.GetBlock() != nil {
+		return status.Error(codes.InvalidArgument, "static volumes can only be mounted as filesystems")
+	}
+	if filepath.Base(volumeID) != volumeID {
+		return status.Errorf(codes.InvalidArgument, "volume id %q of a static volume must not contain '/'", volumeID)
+	}
+	if err := s.config.checkStaticPath(path); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	recordPath := filepath.Join(s.config.adoptedDir(), volumeID+".json")
+	if existing, ok, err := loadAdoption(recordPath); err == nil && ok && existing.Path == path {
+		return nil
+	}
+	raw, err := json.MarshalIndent(adoptedVolume{ID: volumeID, Path: path, NodeID: s.nodeID, AdoptedAt: time.Now()}, "", "  ")
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to encode adoption record of volume %s: %v", volumeID, err)
+	}
+	if err := writeFileAtomic(recordPath, raw); err != nil {
+		return status.Errorf(codes.Internal, "failed to record adoption of volume %s: %v", volumeID, err)
+	}
+	logFor(ctx).Infof("Adopted static volume %s at %s", volumeID, path)
+	return nil
+}
+
+// loadAdoption 读取一条领养记录, 文件不存在时 ok 为 false
+func loadAdoption(path string) (adoptedVolume, bool, error) {
+	var adopted adoptedVolume
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return adopted, false, nil
+	}
+	if err != nil {
+		return adopted, false, fmt.Errorf("failed to read adoption record %s: %v", path, err)
+	}
+	if err := json.Unmarshal(raw, &adopted); err != nil {
+		return adopted, false, fmt.Errorf("failed to parse adoption record %s: %v", path, err)
+	}
+	return adopted, true, nil
+}
+
+// registerAdoptedVolume 把 Node 领养的卷登记到状态里, 没有领养记录时 ok 为 false
+func (s *ControllerServer) registerAdoptedVolume(volumeID string) (Volume, bool) {
+	if filepath.Base(volumeID) != volumeID {
+		return Volume{}, false
+	}
+	adopted, ok, err := loadAdoption(filepath.Join(s.config.adoptedDir(), volumeID+".json"))
+	if err != nil {
+		klog.Warningf("Failed to look up adoption of volume %s: %v", volumeID, err)
+	}
+	if !ok {
+		return Volume{}, false
+	}
+	volume := Volume{
+		ID:      adopted.ID,
+		Path:    adopted.Path,
+		NodeID:  adopted.NodeID,
+		Backend: directoryBackendName,
+		Static:  true,
+	}
+	if err := s.state.UpdateVolume(volume); err != nil {
+		klog.Warningf("Failed to register static volume %s: %v", volumeID, err)
+	} else {
+		klog.Infof("Registered static volume %s at %s", volumeID, adopted.Path)
+	}
+	return volume, true
+}
+
+// removeAdoption 删除卷的领养记录, 不存在时返回成功
+func (s *ControllerServer) removeAdoption(volumeID string) error {
+	if err := os.Remove(filepath.Join(s.config.adoptedDir(), volumeID+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package hostpathcsi
+
+import (
+	"context"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckStaticPath(t *testing.T) {
+	config := newTestConfig(t)
+	root := filepath.Join(t.TempDir(), "static")
+	for _, dir := range []string{filepath.Join(root, "vol"), filepath.Join(filepath.Dir(root), "elsewhere")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(filepath.Dir(root), "elsewhere"), filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(config.VolumePath("pvc-1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		roots   []string
+		path    string
+		wantErr bool
+	}{
+		{name: "directory under a root", roots: []string{root}, path: filepath.Join(root, "vol")},
+		{name: "the root itself", roots: []string{root}, path: root, wantErr: true},
+		{name: "no roots configured", path: filepath.Join(root, "vol"), wantErr: true},
+		{name: "directory outside the roots", roots: []string{root}, path: filepath.Join(filepath.Dir(root), "elsewhere"), wantErr: true},
+		{name: "symlink out of a root", roots: []string{root}, path: filepath.Join(root, "escape"), wantErr: true},
+		{name: "volume managed by the driver", roots: []string{filepath.Dir(config.DataDir)}, path: config.VolumePath("pvc-1"), wantErr: true},
+		{name: "relative path", roots: []string{root}, path: "static/vol", wantErr: true},
+		{name: "missing directory", roots: []string{root}, path: filepath.Join(root, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.StaticRoots = tt.roots
+			err := config.checkStaticPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkStaticPath(%s) error = %v, want error %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdoptStaticVolume(t *testing.T) {
+	config := newTestConfig(t)
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "vol"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewNodeServer(config, "node-1", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mount := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+
+	tests := []struct {
+		name          string
+		roots         []string
+		volumeContext map[string]string
+		wantCode      codes.Code
+		wantRecord    bool
+	}{
+		{
+			name:          "static volume under a root",
+			roots:         []string{root},
+			volumeContext: map[string]string{volumeContextPathKey: filepath.Join(root, "vol")},
+			wantRecord:    true,
+		},
+		{
+			name:          "static volumes disabled",
+			volumeContext: map[string]string{volumeContextPathKey: filepath.Join(root, "vol")},
+			wantCode:      codes.InvalidArgument,
+		},
+		{
+			name:          "inline ephemeral volume is never adopted",
+			roots:         []string{root},
+			volumeContext: map[string]string{volumeContextPathKey: filepath.Join(root, "vol"), ephemeralContextKey: "true"},
+		},
+		{
+			name:          "provisioned volume",
+			volumeContext: map[string]string{volumeContextPathKey: config.VolumePath("pvc-1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.StaticRoots = tt.roots
+			os.RemoveAll(config.adoptedDir())
+			err := s.adoptStaticVolume(context.Background(), "pvc-1", tt.volumeContext, mount)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("adoptStaticVolume() error = %v, want code %v", err, tt.wantCode)
+			}
+			_, statErr := os.Stat(filepath.Join(config.adoptedDir(), "pvc-1.json"))
+			if gotRecord := statErr == nil; gotRecord != tt.wantRecord {
+				t.Errorf("adoption record written = %v, want %v", gotRecord, tt.wantRecord)
+			}
+		})
+	}
+}
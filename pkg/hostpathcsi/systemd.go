@@ -0,0 +1,50 @@
+// Package hostpathcsi Description: 这个文件实现 systemd 的 socket 激活: 在 Kubernetes 之外用 systemd 运行驱动时(例如单机的 CSI 测试环境),
+// socket 由 .socket 单元创建并通过 LISTEN_FDS 传给驱动, 驱动不需要自己管理 socket 路径和权限:
+//
+//	# hostpathcsi.socket
+//	[Socket]
+//	ListenStream=/run/csi/csi.sock
+//	SocketMode=0660
+package hostpathcsi
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFDsStart 是 systemd 传入的第一个文件描述符(SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// SystemdListener 返回 systemd 通过 socket 激活传入的 listener, 不是由 systemd 激活时返回 nil;
+// 和 sd_listen_fds 一样检查 LISTEN_PID 是当前进程, 并清除这些环境变量, 避免子进程(mount、rsync 等)误用
+func SystemdListener() (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	// CSI 服务只监听一个地址
+	if n > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets, the driver listens on exactly one", n)
+	}
+	syscall.CloseOnExec(listenFDsStart)
+	f := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d from systemd is not a listening socket: %v", listenFDsStart, err)
+	}
+	return listener, nil
+}
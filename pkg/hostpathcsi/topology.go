@@ -0,0 +1,87 @@
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	"strings"
+)
+
+// nodeTopology 返回只能在 nodeID 节点上访问的拓扑, segments 是额外的拓扑(可用区、地域等)
+func nodeTopology(nodeID string, segments map[string]string) *csi.Topology {
+	topology := &csi.Topology{Segments: map[string]string{topologyNodeKey: nodeID}}
+	for k, v := range segments {
+		if k != topologyNodeKey {
+			topology.Segments[k] = v
+		}
+	}
+	return topology
+}
+
+// topologyMatches 判断拓扑是否包含 nodeID 节点; 不认识的 key 不参与比较
+func topologyMatches(topology *csi.Topology, nodeID string) bool {
+	if node, ok := topology.GetSegments()[topologyNodeKey]; ok && node != nodeID {
+		return false
+	}
+	return true
+}
+
+// chooseNode 根据 AccessibilityRequirements 选择卷所在的节点; hostpath 卷只能建在 Controller 所在的节点上,
+// requisite 不包含这个节点时返回 ResourceExhausted, preferred 只影响选择顺序, 这里只有一个候选所以不需要处理
+func chooseNode(requirements *csi.TopologyRequirement, nodeID string) (string, error) {
+	requisite := requirements.GetRequisite()
+	if len(requisite) == 0 {
+		return nodeID, nil
+	}
+	for _, topology := range requisite {
+		if topologyMatches(topology, nodeID) {
+			return nodeID, nil
+		}
+	}
+	return "", status.Errorf(codes.ResourceExhausted, "node %s does not satisfy the requisite topology %v", nodeID, requisite)
+}
+
+// ParseTopologySegments 解析 "key=value,key=value" 格式的静态拓扑
+func ParseTopologySegments(s string) (map[string]string, error) {
+	segments := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid topology segment %q, expected key=value", pair)
+		}
+		segments[key] = value
+	}
+	return segments, nil
+}
+
+// ResolveTopologySegments 返回节点除节点名以外的拓扑: 静态配置的拓扑, 加上从节点 labels 中读取的 labelKeys(例如
+// topology.kubernetes.io/zone), 多可用区的集群靠它做拓扑感知的调度; 节点上没有的 label 会被跳过
+func ResolveTopologySegments(ctx context.Context, nodeID string, static map[string]string, labelKeys []string) (map[string]string, error) {
+	segments := make(map[string]string, len(static)+len(labelKeys))
+	for k, v := range static {
+		segments[k] = v
+	}
+	if len(labelKeys) == 0 {
+		return segments, nil
+	}
+
+	labels, err := getNodeLabels(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range labelKeys {
+		if value, ok := labels[key]; ok {
+			segments[key] = value
+		} else {
+			klog.Warningf("Node %s has no label %s, not publishing it as a topology segment", nodeID, key)
+		}
+	}
+	return segments, nil
+}
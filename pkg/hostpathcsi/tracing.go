@@ -0,0 +1,177 @@
+// Package hostpathcsi Description: 这个文件实现 OpenTelemetry 链路追踪: 配置了 --otlp-endpoint 时, 每次 CSI 调用由 otelgrpc 创建一个 span,
+// 后端的创建、克隆、恢复、删除等操作和节点上的挂载、卸载、擦除等文件系统操作是它的子 span, 通过 OTLP/gRPC 导出到 Jaeger、Tempo 等,
+// 可以看出一次很慢的 NodePublishVolume 或 CreateVolume 的时间花在了哪一步。没有配置时使用全局的空实现, span 不做任何事情。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// tracerName 是驱动创建的 span 的 instrumentation 名字
+const tracerName = "github.com/ZhangSIming-blyq/hostpathcsi"
+
+// TracingConfig 是链路追踪的配置
+type TracingConfig struct {
+	// Endpoint 是 OTLP/gRPC 接收端的 host:port, 例如 otel-collector:4317
+	Endpoint string
+	// Insecure 为 true 时不使用 TLS 连接接收端
+	Insecure bool
+	// SampleRatio 是采样的比例, 调用方已经采样的请求总是采样
+	SampleRatio float64
+	// ServiceName 是上报的服务名, 一般是驱动名
+	ServiceName string
+}
+
+// SetupTracing 创建 OTLP 导出器并设置为全局的 TracerProvider, 返回的函数在退出时导出剩余的 span
+func SetupTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return nil, fmt.Errorf("sample ratio %v must be between 0 and 1", config.SampleRatio)
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	// 导出器在后台连接接收端, 接收端暂时不可用不影响启动
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", config.ServiceName),
+			attribute.String("service.version", Version),
+		)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// TracingServerOption 返回为每次 gRPC 调用创建 span 的服务端选项, 调用方通过 traceparent metadata 传入的链路会延续下去
+func TracingServerOption() grpc.ServerOption {
+	return grpc.StatsHandler(otelgrpc.NewServerHandler())
+}
+
+// traceOperation 在名为 name 的子 span 中执行 op, op 返回的错误记录到 span 上
+func traceOperation(ctx context.Context, name string, op func(ctx context.Context) error, attrs ...attribute.KeyValue) error {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+	defer span.End()
+	err := op(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// traceBackend 返回为每个操作创建 span 的后端, 保留后端是否支持增量快照和组快照
+func traceBackend(backend Backend) Backend {
+	traced := tracedBackend{backend}
+	if group, ok := backend.(groupSnapshotBackend); ok {
+		return tracedGroupSnapshotBackend{traced, group}
+	}
+	if incremental, ok := backend.(incrementalBackend); ok {
+		return tracedIncrementalBackend{traced, incremental}
+	}
+	return traced
+}
+
+// tracedBackend 在 span 中执行后端的每个操作
+type tracedBackend struct {
+	Backend
+}
+
+// trace 在名为 backend.<operation> 的 span 中执行 op
+func (b tracedBackend) trace(ctx context.Context, operation string, op func(ctx context.Context) error, attrs ...attribute.KeyValue) error {
+	attrs = append(attrs, attribute.String("csi.backend", b.Name()))
+	return traceOperation(ctx, "backend."+operation, op, attrs...)
+}
+
+func (b tracedBackend) CreateVolume(ctx context.Context, volume *Volume) error {
+	return b.trace(ctx, "CreateVolume", func(ctx context.Context) error {
+		return b.Backend.CreateVolume(ctx, volume)
+	}, attribute.String("csi.volume_id", volume.ID), attribute.Int64("csi.capacity_bytes", volume.CapacityBytes))
+}
+
+func (b tracedBackend) CloneVolume(ctx context.Context, source Volume, volume *Volume) error {
+	return b.trace(ctx, "CloneVolume", func(ctx context.Context) error {
+		return b.Backend.CloneVolume(ctx, source, volume)
+	}, attribute.String("csi.volume_id", volume.ID), attribute.String("csi.source_volume_id", source.ID))
+}
+
+func (b tracedBackend) DeleteVolume(ctx context.Context, volume Volume) error {
+	return b.trace(ctx, "DeleteVolume", func(ctx context.Context) error {
+		return b.Backend.DeleteVolume(ctx, volume)
+	}, attribute.String("csi.volume_id", volume.ID))
+}
+
+func (b tracedBackend) ExpandVolume(ctx context.Context, volume Volume, capacity int64) error {
+	return b.trace(ctx, "ExpandVolume", func(ctx context.Context) error {
+		return b.Backend.ExpandVolume(ctx, volume, capacity)
+	}, attribute.String("csi.volume_id", volume.ID), attribute.Int64("csi.capacity_bytes", capacity))
+}
+
+func (b tracedBackend) CreateSnapshot(ctx context.Context, volume Volume, snapshot *Snapshot) error {
+	return b.trace(ctx, "CreateSnapshot", func(ctx context.Context) error {
+		return b.Backend.CreateSnapshot(ctx, volume, snapshot)
+	}, attribute.String("csi.volume_id", volume.ID), attribute.String("csi.snapshot_id", snapshot.ID))
+}
+
+func (b tracedBackend) RestoreSnapshot(ctx context.Context, snapshot Snapshot, volume *Volume) error {
+	return b.trace(ctx, "RestoreSnapshot", func(ctx context.Context) error {
+		return b.Backend.RestoreSnapshot(ctx, snapshot, volume)
+	}, attribute.String("csi.volume_id", volume.ID), attribute.String("csi.snapshot_id", snapshot.ID))
+}
+
+func (b tracedBackend) DeleteSnapshot(ctx context.Context, snapshot Snapshot) error {
+	return b.trace(ctx, "DeleteSnapshot", func(ctx context.Context) error {
+		return b.Backend.DeleteSnapshot(ctx, snapshot)
+	}, attribute.String("csi.snapshot_id", snapshot.ID))
+}
+
+func (b tracedBackend) Stats(ctx context.Context, volumeID, path string) (VolumeStats, error) {
+	var stats VolumeStats
+	err := b.trace(ctx, "Stats", func(ctx context.Context) error {
+		var err error
+		stats, err = b.Backend.Stats(ctx, volumeID, path)
+		return err
+	}, attribute.String("csi.volume_id", volumeID))
+	return stats, err
+}
+
+// tracedGroupSnapshotBackend 是支持组快照的 tracedBackend
+type tracedGroupSnapshotBackend struct {
+	tracedBackend
+	group groupSnapshotBackend
+}
+
+func (b tracedGroupSnapshotBackend) CreateGroupSnapshot(ctx context.Context, volumes []Volume, snapshots []*Snapshot) error {
+	return b.trace(ctx, "CreateGroupSnapshot", func(ctx context.Context) error {
+		return b.group.CreateGroupSnapshot(ctx, volumes, snapshots)
+	}, attribute.Int("csi.group_size", len(volumes)))
+}
+
+// tracedIncrementalBackend 是支持增量快照的 tracedBackend
+type tracedIncrementalBackend struct {
+	tracedBackend
+	incremental incrementalBackend
+}
+
+func (b tracedIncrementalBackend) CreateIncrementalSnapshot(ctx context.Context, volume Volume, parent Snapshot, snapshot *Snapshot) error {
+	return b.trace(ctx, "CreateIncrementalSnapshot", func(ctx context.Context) error {
+		return b.incremental.CreateIncrementalSnapshot(ctx, volume, parent, snapshot)
+	}, attribute.String("csi.volume_id", volume.ID), attribute.String("csi.snapshot_id", snapshot.ID), attribute.String("csi.parent_snapshot_id", parent.ID))
+}
@@ -0,0 +1,178 @@
+// Package hostpathcsi Description: 这个文件实现节点上卷用量的后台统计: 定期统计已发布的文件系统卷的用量并缓存,
+// NodeGetVolumeStats 直接读取缓存, 不用每次请求都遍历卷目录; 用量超过阈值时打印告警。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	"k8s.io/klog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// volumeUsage 是一次统计得到的卷用量
+type volumeUsage struct {
+	stats     VolumeStats
+	updatedAt time.Time
+}
+
+// usageCache 缓存后台统计的卷用量, 以及近满告警的状态
+type usageCache struct {
+	mu sync.RWMutex
+	// interval 是统计的周期, 0 表示没有启动后台统计, NodeGetVolumeStats 每次实时计算
+	interval time.Duration
+	// alertRatio 是已用量占总量的告警阈值, 0 表示不告警
+	alertRatio float64
+	usage      map[string]volumeUsage
+	// alerted 记录已经告警过的卷, 用量回落到阈值以下之后才会再次告警
+	alerted map[string]bool
+	// lastRun 是最近一次完成统计的时间, 健康检查据此判断后台统计还在运行
+	lastRun time.Time
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{usage: make(map[string]volumeUsage), alerted: make(map[string]bool)}
+}
+
+// get 返回卷缓存的用量; 超过两个统计周期没有更新的结果认为已经过期, 由调用方实时计算
+func (c *usageCache) get(volumeID string) (VolumeStats, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	u, ok := c.usage[volumeID]
+	if !ok || c.interval == 0 || time.Since(u.updatedAt) > 2*c.interval {
+		return VolumeStats{}, false
+	}
+	return u.stats, true
+}
+
+// update 记录卷的用量, 用量第一次超过告警阈值时打印告警
+func (c *usageCache) update(volumeID string, stats VolumeStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usage[volumeID] = volumeUsage{stats: stats, updatedAt: time.Now()}
+
+	if c.alertRatio <= 0 || stats.TotalBytes <= 0 {
+		return
+	}
+	ratio := float64(stats.UsedBytes) / float64(stats.TotalBytes)
+	switch {
+	case ratio >= c.alertRatio && !c.alerted[volumeID]:
+		klog.Warningf("Volume %s is %.0f%% full: %d of %d bytes used", volumeID, ratio*100, stats.UsedBytes, stats.TotalBytes)
+		c.alerted[volumeID] = true
+	case ratio < c.alertRatio && c.alerted[volumeID]:
+		klog.Infof("Volume %s is back to %.0f%% full", volumeID, ratio*100)
+		delete(c.alerted, volumeID)
+	}
+}
+
+// finish 结束一轮统计, 清理已经不在节点上发布的卷
+func (c *usageCache) finish(volumeIDs map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.usage {
+		if !volumeIDs[id] {
+			delete(c.usage, id)
+			delete(c.alerted, id)
+		}
+	}
+	c.lastRun = time.Now()
+}
+
+// StartUsageAccounting 启动后台用量统计, 每隔 interval 统计一次节点上所有已发布的文件系统卷;
+// alertRatio 大于 0 时, 卷的已用量超过总量的这个比例就打印告警
+func (s *NodeServer) StartUsageAccounting(interval time.Duration, alertRatio float64) {
+	s.usage.mu.Lock()
+	s.usage.interval = interval
+	s.usage.alertRatio = alertRatio
+	s.usage.lastRun = time.Now()
+	s.usage.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.accountUsage()
+			<-ticker.C
+		}
+	}()
+}
+
+// CheckUsageAccounting 检查后台统计还在运行: 超过三个统计周期没有完成一轮统计时返回错误
+func (s *NodeServer) CheckUsageAccounting() error {
+	s.usage.mu.RLock()
+	defer s.usage.mu.RUnlock()
+	if s.usage.interval == 0 {
+		return nil
+	}
+	if since := time.Since(s.usage.lastRun); since > 3*s.usage.interval {
+		return fmt.Errorf("volume usage was last accounted %s ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+// VolumeUsage 返回后台统计缓存的所有卷的用量(卷 ID -> 用量), 供 metrics 等导出使用
+func (s *NodeServer) VolumeUsage() map[string]VolumeStats {
+	s.usage.mu.RLock()
+	defer s.usage.mu.RUnlock()
+	usage := make(map[string]VolumeStats, len(s.usage.usage))
+	for id, u := range s.usage.usage {
+		usage[id] = u.stats
+	}
+	return usage
+}
+
+// accountUsage 统计一轮节点上已发布的文件系统卷的用量; block 卷的用量直接来自设备大小和文件的分配, 不需要缓存
+func (s *NodeServer) accountUsage() {
+	targets := s.publishedTargets()
+	for volumeID, targetPath := range targets {
+		path, err := filepath.EvalSymlinks(targetPath)
+		if err != nil {
+			continue
+		}
+		if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+			continue
+		}
+		if condition := volumeCondition(path); condition.Abnormal {
+			continue
+		}
+		backend, err := backendOf(s.volumeBackend(volumeID))
+		if err != nil {
+			klog.Warningf("Failed to account usage of volume %s: %v", volumeID, err)
+			continue
+		}
+		stats, err := backend.Stats(context.Background(), volumeID, path)
+		if err != nil {
+			klog.Warningf("Failed to account usage of volume %s: %v", volumeID, err)
+			continue
+		}
+		s.usage.update(volumeID, stats)
+	}
+
+	volumeIDs := make(map[string]bool, len(targets))
+	for id := range targets {
+		volumeIDs[id] = true
+	}
+	s.usage.finish(volumeIDs)
+}
+
+// publishedTargets 返回每个已发布的卷的一个目标路径, 同一个卷的所有目标路径挂载的是同一份数据
+func (s *NodeServer) publishedTargets() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	targets := make(map[string]string, len(s.published))
+	for volumeID, paths := range s.published {
+		sorted := make([]string, 0, len(paths))
+		for path := range paths {
+			sorted = append(sorted, path)
+		}
+		if len(sorted) == 0 {
+			continue
+		}
+		sort.Strings(sorted)
+		targets[volumeID] = sorted[0]
+	}
+	return targets
+}
@@ -0,0 +1,175 @@
+// Package hostpathcsi Description: 这个文件集中校验各个 RPC 的请求, 在做任何文件系统操作之前拒绝不完整或者不合法的请求,
+// 避免空的 ID 或者带 "../" 的 ID 在错误的位置创建、删除目录。
+package hostpathcsi
+
+import (
+	"fmt"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path/filepath"
+	"strings"
+)
+
+// validateRequest 按请求类型检查必填字段, 不合法时返回 InvalidArgument(容量范围矛盾时返回 OutOfRange)
+func validateRequest(req interface{}) error {
+	var err error
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		err = firstError(
+			checkID("volume name", r.Name),
+			checkCapabilities(r.VolumeCapabilities),
+			checkCapacityRange(r.CapacityRange, false),
+		)
+	case *csi.DeleteVolumeRequest:
+		err = checkID("volume id", r.VolumeId)
+	case *csi.ControllerPublishVolumeRequest:
+		err = firstError(
+			checkID("volume id", r.VolumeId),
+			checkRequired("node id", r.NodeId),
+			checkCapabilities([]*csi.VolumeCapability{r.VolumeCapability}),
+		)
+	case *csi.ControllerUnpublishVolumeRequest:
+		err = checkID("volume id", r.VolumeId)
+	case *csi.ValidateVolumeCapabilitiesRequest:
+		err = checkID("volume id", r.VolumeId)
+		if err == nil && len(r.VolumeCapabilities) == 0 {
+			err = fmt.Errorf("volume capabilities are required")
+		}
+	case *csi.ControllerExpandVolumeRequest:
+		err = firstError(
+			checkID("volume id", r.VolumeId),
+			checkCapacityRange(r.CapacityRange, true),
+		)
+	case *csi.ControllerGetVolumeRequest:
+		err = checkID("volume id", r.VolumeId)
+	case *csi.ControllerModifyVolumeRequest:
+		err = checkID("volume id", r.VolumeId)
+	case *csi.CreateSnapshotRequest:
+		err = firstError(
+			checkID("snapshot name", r.Name),
+			checkID("source volume id", r.SourceVolumeId),
+		)
+	case *csi.DeleteSnapshotRequest:
+		err = checkID("snapshot id", r.SnapshotId)
+	case *csi.CreateVolumeGroupSnapshotRequest:
+		err = checkID("group snapshot name", r.Name)
+		if err == nil && len(r.SourceVolumeIds) == 0 {
+			err = fmt.Errorf("source volume ids are required")
+		}
+		for _, id := range r.SourceVolumeIds {
+			err = firstError(err, checkID("source volume id", id))
+		}
+	case *csi.DeleteVolumeGroupSnapshotRequest:
+		err = checkID("group snapshot id", r.GroupSnapshotId)
+	case *csi.GetVolumeGroupSnapshotRequest:
+		err = checkID("group snapshot id", r.GroupSnapshotId)
+	case *csi.NodeStageVolumeRequest:
+		err = firstError(
+			checkID("volume id", r.VolumeId),
+			checkPath("staging target path", r.StagingTargetPath),
+			checkCapabilities([]*csi.VolumeCapability{r.VolumeCapability}),
+		)
+	case *csi.NodeUnstageVolumeRequest:
+		err = firstError(
+			checkID("volume id", r.VolumeId),
+			checkPath("staging target path", r.StagingTargetPath),
+		)
+	case *csi.NodePublishVolumeRequest:
+		err = firstError(
+			checkID("volume id", r.VolumeId),
+			checkPath("target path", r.TargetPath),
+			checkCapabilities([]*csi.VolumeCapability{r.VolumeCapability}),
+		)
+		if err == nil && r.StagingTargetPath != "" {
+			err = checkPath("staging target path", r.StagingTargetPath)
+		}
+	case *csi.NodeUnpublishVolumeRequest:
+		err = firstError(
+			checkID("volume id", r.VolumeId),
+			checkPath("target path", r.TargetPath),
+		)
+	case *csi.NodeExpandVolumeRequest:
+		err = firstError(
+			checkID("volume id", r.VolumeId),
+			checkPath("volume path", r.VolumePath),
+		)
+	case *csi.NodeGetVolumeStatsRequest:
+		err = firstError(
+			checkID("volume id", r.VolumeId),
+			checkPath("volume path", r.VolumePath),
+		)
+	}
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// firstError 返回第一个不为 nil 的错误
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRequired 检查字段不为空
+func checkRequired(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", name)
+	}
+	return nil
+}
+
+// checkID 检查卷、快照的 ID: ID 会作为目录名使用, 不能为空, 也不能包含路径分隔符或者是 "." 和 ".."
+func checkID(name, id string) error {
+	if id == "" {
+		return fmt.Errorf("%s is required", name)
+	}
+	if id == "." || id == ".." || strings.ContainsAny(id, "/\x00") {
+		return fmt.Errorf("%s %q is not a valid name", name, id)
+	}
+	return nil
+}
+
+// checkPath 检查 kubelet 传入的路径不为空并且是绝对路径
+func checkPath(name, path string) error {
+	if path == "" {
+		return fmt.Errorf("%s is required", name)
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s %q must be an absolute path", name, path)
+	}
+	return nil
+}
+
+// checkCapabilities 检查请求带了 VolumeCapability, 并且访问类型和访问模式都被支持
+func checkCapabilities(capabilities []*csi.VolumeCapability) error {
+	if len(capabilities) == 0 || capabilities[0] == nil {
+		return fmt.Errorf("volume capability is required")
+	}
+	return validateVolumeCapabilities(capabilities)
+}
+
+// checkCapacityRange 检查容量范围: 不能为负数, required 不能大于 limit; required 为 true 时容量范围必须存在
+func checkCapacityRange(capacityRange *csi.CapacityRange, required bool) error {
+	if capacityRange == nil {
+		if required {
+			return fmt.Errorf("capacity range is required")
+		}
+		return nil
+	}
+	if capacityRange.RequiredBytes < 0 || capacityRange.LimitBytes < 0 {
+		return fmt.Errorf("capacity range must not be negative")
+	}
+	if capacityRange.LimitBytes > 0 && capacityRange.RequiredBytes > capacityRange.LimitBytes {
+		return status.Errorf(codes.OutOfRange, "required bytes %d exceed limit bytes %d", capacityRange.RequiredBytes, capacityRange.LimitBytes)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package hostpathcsi
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestCheckID(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{id: "pvc-1"},
+		{id: "csi-0123abcd"},
+		{id: "..hidden"},
+		{id: "a..b"},
+		{id: "", wantErr: true},
+		{id: ".", wantErr: true},
+		{id: "..", wantErr: true},
+		{id: "../etc", wantErr: true},
+		{id: "a/b", wantErr: true},
+		{id: "/abs", wantErr: true},
+		{id: "pvc\x00-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			err := checkID("volume id", tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkID(%q) error = %v, want error %v", tt.id, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	tests := []struct {
+		name     string
+		req      interface{}
+		wantCode codes.Code
+	}{
+		{
+			name: "valid create",
+			req:  &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: []*csi.VolumeCapability{mount}},
+		},
+		{
+			name:     "create with a traversing name",
+			req:      &csi.CreateVolumeRequest{Name: "../pvc-1", VolumeCapabilities: []*csi.VolumeCapability{mount}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "create without capabilities",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-1"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "create with required bytes above the limit",
+			req:      &csi.CreateVolumeRequest{Name: "pvc-1", VolumeCapabilities: []*csi.VolumeCapability{mount}, CapacityRange: &csi.CapacityRange{RequiredBytes: 2, LimitBytes: 1}},
+			wantCode: codes.OutOfRange,
+		},
+		{
+			name:     "delete without an id",
+			req:      &csi.DeleteVolumeRequest{},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "delete with a NUL in the id",
+			req:      &csi.DeleteVolumeRequest{VolumeId: "pvc\x00"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "expand without a capacity range",
+			req:      &csi.ControllerExpandVolumeRequest{VolumeId: "pvc-1"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "snapshot of a traversing source",
+			req:      &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: ".."},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "group snapshot with a bad member",
+			req:      &csi.CreateVolumeGroupSnapshotRequest{Name: "group-1", SourceVolumeIds: []string{"pvc-1", "a/b"}},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "valid publish",
+			req:  &csi.NodePublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/pods/a/mount", VolumeCapability: mount},
+		},
+		{
+			name:     "publish to a relative target",
+			req:      &csi.NodePublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "mount", VolumeCapability: mount},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "publish without a capability",
+			req:      &csi.NodePublishVolumeRequest{VolumeId: "pvc-1", TargetPath: "/pods/a/mount"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unpublish without a target",
+			req:      &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1"},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateRequest(tt.req); status.Code(err) != tt.wantCode {
+				t.Errorf("validateRequest() error = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
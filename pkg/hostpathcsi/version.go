@@ -0,0 +1,26 @@
+package hostpathcsi
+
+import (
+	"runtime"
+)
+
+// 构建时通过 ldflags 注入, 例如:
+// -X github.com/ZhangSIming-blyq/hostpathcsi/pkg/hostpathcsi.Version=v1.2.0
+var (
+	// Version 是驱动的版本, 作为 GetPluginInfo 的 VendorVersion 返回
+	Version = "v1.0.0"
+	// Commit 是构建时的 git commit
+	Commit = "unknown"
+	// BuildDate 是构建时间
+	BuildDate = "unknown"
+)
+
+// BuildInfo 返回构建信息, 用于 GetPluginInfo 的 Manifest 和启动日志
+func BuildInfo() map[string]string {
+	return map[string]string{
+		"version":   Version,
+		"commit":    Commit,
+		"buildDate": BuildDate,
+		"goVersion": runtime.Version(),
+	}
+}
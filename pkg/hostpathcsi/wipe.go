@@ -0,0 +1,218 @@
+// Package hostpathcsi Description: 这个文件实现删除卷之前的数据擦除: StorageClass 设置 wipeOnDelete=true(或者驱动以 --wipe-on-delete 启动)时,
+// DeleteVolume 先用零覆盖卷里的文件内容、镜像文件或者逻辑卷, 再交给后端删除, 满足数据销毁的要求。
+// btrfs 和 zfs 是写时复制的文件系统, 覆盖写不会落到原来的块上, 不支持擦除。
+package hostpathcsi
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// wipeOnDeleteParameter 是 StorageClass 中要求删除前擦除数据的参数
+	wipeOnDeleteParameter = "wipeOnDelete"
+	// wipeChunkSize 是每次写入的零的大小
+	wipeChunkSize = 1 << 20
+)
+
+// shouldWipe 判断卷参数是否要求删除前擦除数据
+func shouldWipe(parameters map[string]string) bool {
+	return parameters[wipeOnDeleteParameter] == "true"
+}
+
+// canWipe 判断卷的数据能否通过覆盖写擦除: 写时复制的后端不能, 内存卷的数据 unstage 后就不存在了, 不需要
+func canWipe(volume Volume) error {
+	switch {
+	case volume.Backend == btrfsBackendName || volume.Backend == zfsBackendName:
+		return fmt.Errorf("volumes on the copy-on-write %s backend can not be wiped by overwriting", volume.Backend)
+	case isMemoryVolume(volume.Parameters):
+		return fmt.Errorf("memory volumes keep no data on disk")
+	case volume.Parameters[onDeleteParameter] == onDeleteArchive:
+		return fmt.Errorf("archived volumes are kept instead of deleted")
+	}
+	return nil
+}
+
+// SetWipeOnDelete 让 DeleteVolume 擦除所有可以擦除的卷, 不论 StorageClass 是否设置了 wipeOnDelete
+func (s *ControllerServer) SetWipeOnDelete(wipe bool) {
+	s.wipeOnDelete.Store(wipe)
+}
+
+// errSharedData 表示卷里的文件还有在卷外面的硬链接, 覆盖会改写卷外的数据, 不覆盖又擦除不干净
+var errSharedData = errors.New("volume data is shared with files outside the volume")
+
+// wipeVolume 用零覆盖卷的数据: 目录卷覆盖其中的每个文件, 镜像文件、block 卷的文件和逻辑卷整体覆盖;
+// 有多个硬链接的文件只覆盖一次, 所有硬链接都在卷内时才覆盖, 否则返回 errSharedData, 一个文件都不覆盖
+func wipeVolume(volume Volume) error {
+	fi, err := os.Stat(volume.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		// 逻辑卷的路径是指向设备的软链接
+		path, err := filepath.EvalSymlinks(volume.Path)
+		if err != nil {
+			return err
+		}
+		files, err := collectWipeFiles(path, false)
+		if err != nil {
+			return err
+		}
+		return wipeFiles(files)
+	}
+	files, err := collectWipeFiles(volume.Path, true)
+	if err != nil {
+		return err
+	}
+	return wipeFiles(files)
+}
+
+// wipeTarget 是一个要覆盖的 inode
+type wipeTarget struct {
+	// path 是卷内第一个指向它的路径
+	path string
+	// regular 为 false 时是块设备, 块设备的链接数和数据无关
+	regular bool
+	nlink   uint64
+	// links 是卷内指向它的路径数
+	links uint64
+}
+
+// collectWipeFiles 遍历 root 找出要覆盖的普通文件和块设备, 按 inode 去重;
+// 卷内的硬链接数少于文件的硬链接数时说明有链接在卷外, 返回 errSharedData
+func collectWipeFiles(root string, walk bool) ([]*wipeTarget, error) {
+	type inode struct{ dev, ino uint64 }
+	targets := make(map[inode]*wipeTarget)
+	var order []*wipeTarget
+	visit := func(path string) error {
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err != nil {
+			return err
+		}
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFREG, unix.S_IFBLK:
+		default:
+			return nil
+		}
+		key := inode{uint64(st.Dev), st.Ino}
+		target, ok := targets[key]
+		if !ok {
+			target = &wipeTarget{path: path, regular: st.Mode&unix.S_IFMT == unix.S_IFREG, nlink: uint64(st.Nlink)}
+			targets[key] = target
+			order = append(order, target)
+		}
+		target.links++
+		return nil
+	}
+	if walk {
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			return visit(path)
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if err := visit(root); err != nil {
+		return nil, err
+	}
+	for _, target := range order {
+		if target.regular && target.links < target.nlink {
+			return nil, fmt.Errorf("%w: %s has %d links outside the volume", errSharedData, target.path, target.nlink-target.links)
+		}
+	}
+	return order, nil
+}
+
+// wipeFiles 依次覆盖 collectWipeFiles 找出的文件
+func wipeFiles(targets []*wipeTarget) error {
+	for _, target := range targets {
+		if err := wipeFile(target.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wipeFile 用零覆盖一个普通文件或块设备并刷到磁盘; 普通文件只覆盖已经分配的部分, 不会把稀疏文件填满;
+// 不跟随软链接, 遍历之后被换成软链接的文件不会把卷外的文件覆盖掉
+func wipeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return err
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG, unix.S_IFBLK:
+	default:
+		return nil
+	}
+	ranges, err := dataRanges(f, st)
+	if err != nil {
+		return fmt.Errorf("failed to find the data of %s: %v", path, err)
+	}
+	zeros := make([]byte, wipeChunkSize)
+	for _, r := range ranges {
+		for off := r[0]; off < r[1]; {
+			n := r[1] - off
+			if n > wipeChunkSize {
+				n = wipeChunkSize
+			}
+			if _, err := f.WriteAt(zeros[:n], off); err != nil {
+				return fmt.Errorf("failed to wipe %s: %v", path, err)
+			}
+			off += n
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to flush %s: %v", path, err)
+	}
+	return nil
+}
+
+// dataRanges 返回文件中有数据的区间 [start, end); 块设备和不支持 SEEK_DATA 的文件系统返回整个文件
+func dataRanges(f *os.File, st unix.Stat_t) ([][2]int64, error) {
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		return [][2]int64{{0, size}}, nil
+	}
+	fd := int(f.Fd())
+	var ranges [][2]int64
+	for off := int64(0); off < st.Size; {
+		start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break
+		}
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return [][2]int64{{0, st.Size}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, [2]int64{start, end})
+		off = end
+	}
+	return ranges, nil
+}
@@ -0,0 +1,138 @@
+package hostpathcsi
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWipeVolume(t *testing.T) {
+	data := []byte("secret data")
+	tests := []struct {
+		name string
+		// setup 在 root 下创建卷 root/vol 和卷外的文件, 返回卷的路径
+		setup func(t *testing.T, root string) string
+		// wiped 和 kept 是覆盖之后应该全为零、应该保持原样的文件(相对 root)
+		wiped   []string
+		kept    []string
+		wantErr error
+	}{
+		{
+			name: "files in a directory volume",
+			setup: func(t *testing.T, root string) string {
+				writeTestFile(t, filepath.Join(root, "vol/a"), data)
+				writeTestFile(t, filepath.Join(root, "vol/sub/b"), data)
+				return filepath.Join(root, "vol")
+			},
+			wiped: []string{"vol/a", "vol/sub/b"},
+		},
+		{
+			name: "hard links inside the volume",
+			setup: func(t *testing.T, root string) string {
+				writeTestFile(t, filepath.Join(root, "vol/a"), data)
+				linkTestFile(t, filepath.Join(root, "vol/a"), filepath.Join(root, "vol/sub/a-link"))
+				return filepath.Join(root, "vol")
+			},
+			wiped: []string{"vol/a", "vol/sub/a-link"},
+		},
+		{
+			name: "hard link outside the volume",
+			setup: func(t *testing.T, root string) string {
+				writeTestFile(t, filepath.Join(root, "vol/a"), data)
+				writeTestFile(t, filepath.Join(root, "vol/b"), data)
+				linkTestFile(t, filepath.Join(root, "vol/b"), filepath.Join(root, "outside"))
+				return filepath.Join(root, "vol")
+			},
+			kept:    []string{"vol/a", "vol/b", "outside"},
+			wantErr: errSharedData,
+		},
+		{
+			name: "symlink to a file outside the volume",
+			setup: func(t *testing.T, root string) string {
+				writeTestFile(t, filepath.Join(root, "outside"), data)
+				writeTestFile(t, filepath.Join(root, "vol/a"), data)
+				if err := os.Symlink(filepath.Join(root, "outside"), filepath.Join(root, "vol/link")); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(root, "vol")
+			},
+			wiped: []string{"vol/a"},
+			kept:  []string{"outside"},
+		},
+		{
+			name: "image file",
+			setup: func(t *testing.T, root string) string {
+				writeTestFile(t, filepath.Join(root, "vol.img"), data)
+				return filepath.Join(root, "vol.img")
+			},
+			wiped: []string{"vol.img"},
+		},
+		{
+			name: "image file with a hard link outside the volume",
+			setup: func(t *testing.T, root string) string {
+				writeTestFile(t, filepath.Join(root, "vol.img"), data)
+				linkTestFile(t, filepath.Join(root, "vol.img"), filepath.Join(root, "copy.img"))
+				return filepath.Join(root, "vol.img")
+			},
+			kept:    []string{"vol.img"},
+			wantErr: errSharedData,
+		},
+		{
+			name: "missing volume",
+			setup: func(t *testing.T, root string) string {
+				return filepath.Join(root, "vol")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			path := tt.setup(t, root)
+			err := wipeVolume(Volume{ID: "vol", Path: path})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("wipeVolume() error = %v, want %v", err, tt.wantErr)
+			}
+			for _, name := range tt.wiped {
+				if got := readTestFile(t, filepath.Join(root, name)); !bytes.Equal(got, make([]byte, len(data))) {
+					t.Errorf("%s = %q, want zeros", name, got)
+				}
+			}
+			for _, name := range tt.kept {
+				if got := readTestFile(t, filepath.Join(root, name)); !bytes.Equal(got, data) {
+					t.Errorf("%s = %q, want it unchanged", name, got)
+				}
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func linkTestFile(t *testing.T, oldname, newname string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(newname), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(oldname, newname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) []byte {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
@@ -0,0 +1,278 @@
+// Package hostpathcsi Description: 这个文件实现可选的 zfs 后端: 每个卷是父 dataset 下的一个文件系统 dataset, 挂载到卷的路径上,
+// 容量通过 refquota/refreservation 设置; CSI 快照对应 zfs snapshot, 克隆和从快照恢复对应 zfs clone, 都不需要复制数据。
+package hostpathcsi
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// zfsBackendName 是 zfs 后端的名字
+const zfsBackendName = "zfs"
+
+// zfsBackend 把卷保存为 parent 下的 zfs dataset
+type zfsBackend struct {
+	// parent 是存放卷的父 dataset, 例如 tank/csi
+	parent string
+}
+
+// NewZFSBackend 创建 zfs 后端, 卷创建在 parent dataset 下; 需要用 RegisterBackend 登记后才能使用
+func NewZFSBackend(parent string) Backend {
+	return zfsBackend{parent: strings.Trim(parent, "/")}
+}
+
+func (zfsBackend) Name() string {
+	return zfsBackendName
+}
+
+// CreateVolume 创建挂载在卷路径上的 dataset
+func (b zfsBackend) CreateVolume(ctx context.Context, volume *Volume) error {
+	if err := b.prepare(*volume); err != nil {
+		return err
+	}
+	args := append([]string{"create"}, datasetOptions(*volume)...)
+	if _, err := runZFS(append(args, b.dataset(volume.ID))...); err != nil {
+		return status.Errorf(codes.Internal, "failed to create dataset for volume %s: %v", volume.ID, err)
+	}
+	b.readCompression(ctx, volume)
+	return nil
+}
+
+// CloneVolume 对源卷做一个快照, 再从这个快照 clone 出新卷; 这个快照随新卷一起删除
+func (b zfsBackend) CloneVolume(ctx context.Context, source Volume, volume *Volume) error {
+	if err := b.prepare(*volume); err != nil {
+		return err
+	}
+	origin := b.dataset(source.ID) + "@clone-" + volume.ID
+	if !datasetExists(origin) {
+		if _, err := runZFS("snapshot", origin); err != nil {
+			return status.Errorf(codes.Internal, "failed to snapshot volume %s: %v", source.ID, err)
+		}
+	}
+	if err := b.clone(origin, *volume); err != nil {
+		return status.Errorf(codes.Internal, "failed to clone volume %s: %v", source.ID, err)
+	}
+	logFor(ctx).Infof("Cloned volume %s into %s", source.ID, volume.Path)
+	b.readCompression(ctx, volume)
+	return nil
+}
+
+// DeleteVolume 删除卷的 dataset 以及它的快照; 还有从它 clone 出来的卷时无法删除
+func (b zfsBackend) DeleteVolume(ctx context.Context, volume Volume) error {
+	dataset := b.dataset(volume.ID)
+	// 克隆出来的卷, 删除后再删掉作为 origin 的快照
+	origin, _ := zfsProperty(dataset, "origin")
+	if err := destroyDataset(dataset, "-r"); err != nil {
+		return err
+	}
+	if strings.Contains(origin, "@clone-") {
+		if err := destroyDataset(origin); err != nil {
+			logFor(ctx).Warningf("Failed to destroy clone origin %s of volume %s: %v", origin, volume.ID, err)
+		}
+	}
+	return nil
+}
+
+// ExpandVolume 调大 dataset 的 refquota 和 refreservation
+func (b zfsBackend) ExpandVolume(ctx context.Context, volume Volume, capacity int64) error {
+	if capacity <= 0 {
+		return nil
+	}
+	args := append([]string{"set"}, capacityProperties(capacity)...)
+	if _, err := runZFS(append(args, b.dataset(volume.ID))...); err != nil {
+		return status.Errorf(codes.Internal, "failed to expand volume %s: %v", volume.ID, err)
+	}
+	return nil
+}
+
+// NodeExpansionRequired dataset 的配额调整后立即生效, 不需要节点参与
+func (zfsBackend) NodeExpansionRequired(volume Volume) bool {
+	return false
+}
+
+// CreateSnapshot 创建 zfs 快照, 快照的 Path 记录快照的名字(dataset@快照 ID)
+func (b zfsBackend) CreateSnapshot(ctx context.Context, volume Volume, snapshot *Snapshot) error {
+	name := b.dataset(volume.ID) + "@" + snapshot.ID
+	if !datasetExists(name) {
+		if _, err := runZFS("snapshot", name); err != nil {
+			return status.Errorf(codes.Internal, "failed to snapshot volume %s: %v", volume.ID, err)
+		}
+	}
+	// 先记录快照的名字, 后面失败时调用方可以按它删除快照
+	snapshot.Path = name
+	referenced, err := zfsProperty(name, "referenced")
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get size of snapshot %s: %v", snapshot.ID, err)
+	}
+	snapshot.SizeBytes, _ = strconv.ParseInt(referenced, 10, 64)
+	return nil
+}
+
+// CreateGroupSnapshot 用一条 zfs snapshot 命令为所有卷创建快照; 卷都在父 dataset 所在的 pool 里, zfs 保证这些快照是同一时刻的
+func (b zfsBackend) CreateGroupSnapshot(ctx context.Context, volumes []Volume, snapshots []*Snapshot) error {
+	args := []string{"snapshot"}
+	for i, volume := range volumes {
+		// 重试时快照已经全部创建, 一条命令创建的快照要么全部存在, 要么全部不存在
+		if name := b.dataset(volume.ID) + "@" + snapshots[i].ID; !datasetExists(name) {
+			args = append(args, name)
+		}
+	}
+	if len(args) > 1 {
+		if _, err := runZFS(args...); err != nil {
+			return status.Errorf(codes.Internal, "failed to snapshot volumes: %v", err)
+		}
+	}
+	for i, volume := range volumes {
+		if err := b.CreateSnapshot(ctx, volume, snapshots[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreSnapshot 从快照 clone 出新卷
+func (b zfsBackend) RestoreSnapshot(ctx context.Context, snapshot Snapshot, volume *Volume) error {
+	if err := b.prepare(*volume); err != nil {
+		return err
+	}
+	if err := b.clone(snapshot.Path, *volume); err != nil {
+		return status.Errorf(codes.Internal, "failed to restore snapshot %s: %v", snapshot.ID, err)
+	}
+	logFor(ctx).Infof("Restored snapshot %s into %s", snapshot.ID, volume.Path)
+	b.readCompression(ctx, volume)
+	return nil
+}
+
+// DeleteSnapshot 删除 zfs 快照; 还有从它恢复出来的卷时无法删除
+func (zfsBackend) DeleteSnapshot(ctx context.Context, snapshot Snapshot) error {
+	if !strings.Contains(snapshot.Path, "@") {
+		// 不是 zfs 快照的名字(例如没有记录的快照按默认布局拼出来的路径), 没有可删除的数据
+		return nil
+	}
+	return destroyDataset(snapshot.Path)
+}
+
+// Stats 用 dataset 的 referenced 和 available 统计, available 已经考虑了 refquota
+func (b zfsBackend) Stats(ctx context.Context, volumeID, path string) (VolumeStats, error) {
+	out, err := runZFS("get", "-Hp", "-o", "value", "referenced,available", b.dataset(volumeID))
+	if err != nil {
+		return VolumeStats{}, status.Errorf(codes.Internal, "failed to get stats of volume %s: %v", volumeID, err)
+	}
+	values := strings.Fields(out)
+	if len(values) != 2 {
+		return VolumeStats{}, status.Errorf(codes.Internal, "unexpected zfs output for volume %s: %q", volumeID, out)
+	}
+	used, _ := strconv.ParseInt(values[0], 10, 64)
+	available, _ := strconv.ParseInt(values[1], 10, 64)
+
+	stats, err := statFS(path)
+	if err != nil {
+		return VolumeStats{}, status.Errorf(codes.Internal, "failed to get stats of volume %s: %v", volumeID, err)
+	}
+	return VolumeStats{
+		TotalBytes:     used + available,
+		UsedBytes:      used,
+		AvailableBytes: available,
+		TotalInodes:    stats.TotalInodes,
+		UsedInodes:     stats.UsedInodes,
+		FreeInodes:     stats.FreeInodes,
+	}, nil
+}
+
+// dataset 返回卷的 dataset 名字
+func (b zfsBackend) dataset(volumeID string) string {
+	return b.parent + "/" + volumeID
+}
+
+// prepare 检查访问类型并创建挂载点的父目录
+func (zfsBackend) prepare(volume Volume) error {
+	if volume.AccessType == accessTypeBlock {
+		return status.Error(codes.InvalidArgument, "the zfs backend does not support block volumes")
+	}
+	if err := os.MkdirAll(filepath.Dir(volume.Path), 0755); err != nil {
+		return storageError(err, "failed to create volume directory")
+	}
+	return nil
+}
+
+// clone 从快照 origin clone 出卷的 dataset, 已经存在时认为是重试
+func (b zfsBackend) clone(origin string, volume Volume) error {
+	dataset := b.dataset(volume.ID)
+	if datasetExists(dataset) {
+		return nil
+	}
+	args := append([]string{"clone"}, datasetOptions(volume)...)
+	_, err := runZFS(append(args, origin, dataset)...)
+	return err
+}
+
+// readCompression 把 dataset 实际生效的压缩设置(可能继承自父 dataset)记录到卷上
+func (b zfsBackend) readCompression(ctx context.Context, volume *Volume) {
+	compression, err := zfsProperty(b.dataset(volume.ID), "compression")
+	if err != nil {
+		logFor(ctx).Warningf("Failed to get compression of volume %s: %v", volume.ID, err)
+		return
+	}
+	volume.Compression = compression
+}
+
+// datasetOptions 返回创建卷的 dataset 时的 -o 参数: 挂载点、容量和压缩
+func datasetOptions(volume Volume) []string {
+	options := []string{"-o", "mountpoint=" + volume.Path}
+	if compression := volume.Parameters[compressionParameter]; compression != "" {
+		options = append(options, "-o", "compression="+compression)
+	}
+	if volume.CapacityBytes > 0 {
+		for _, property := range capacityProperties(volume.CapacityBytes) {
+			options = append(options, "-o", property)
+		}
+	}
+	return options
+}
+
+// capacityProperties 把容量转换成 zfs 属性: refquota 限制卷能写入的数据, refreservation 保证这些空间不被其他卷占用
+func capacityProperties(capacity int64) []string {
+	size := strconv.FormatInt(capacity, 10)
+	return []string{"refquota=" + size, "refreservation=" + size}
+}
+
+// destroyDataset 删除 dataset 或快照, 不存在时什么都不做; 还有依赖它的 clone 时返回 FailedPrecondition
+func destroyDataset(name string, flags ...string) error {
+	if !datasetExists(name) {
+		return nil
+	}
+	if _, err := runZFS(append(append([]string{"destroy"}, flags...), name)...); err != nil {
+		if strings.Contains(err.Error(), "dependent clones") {
+			return status.Errorf(codes.FailedPrecondition, "%s still has volumes cloned from it: %v", name, err)
+		}
+		return status.Errorf(codes.Internal, "failed to destroy %s: %v", name, err)
+	}
+	return nil
+}
+
+// datasetExists 判断 dataset 或快照是否存在
+func datasetExists(name string) bool {
+	return exec.Command("zfs", "list", "-H", "-t", "all", "-o", "name", name).Run() == nil
+}
+
+// zfsProperty 读取 dataset 的一个属性, 数值属性以字节为单位
+func zfsProperty(name, property string) (string, error) {
+	out, err := runZFS("get", "-Hp", "-o", "value", property, name)
+	return strings.TrimSpace(out), err
+}
+
+// runZFS 执行一条 zfs 命令, 返回它的输出
+func runZFS(args ...string) (string, error) {
+	out, err := exec.Command("zfs", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("zfs %s failed: %v, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}